@@ -0,0 +1,272 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Backend is an object storage Storage reads objects and bucket listings
+// from, below its caches. GCS at Storage.Base is used when Storage.Backend
+// is nil. MemBackend is an in-memory implementation, suitable for tests,
+// and DirBackend reads local files, e.g. for development.
+type Backend interface {
+	// Open returns object name of the bucket for reading, sending optional
+	// request headers h, e.g. Range, which a backend may ignore.
+	// Failures reported by the storage, such as a missing object,
+	// are returned as *FetchError with an HTTP status code, as are
+	// unsatisfied conditional requests, e.g. If-None-Match, with code 304.
+	Open(ctx context.Context, bucket, name string, h http.Header) (*ObjectReader, error)
+	// Stat is similar to Open except only the object metadata is returned.
+	// An empty name refers to the bucket itself, reporting whether it exists
+	// and is accessible.
+	Stat(ctx context.Context, bucket, name string) (map[string]string, error)
+	// List returns objects of the bucket whose names start with prefix,
+	// except the object named prefix itself, sorted by name.
+	// If delim is not empty, names are collapsed on the first delim
+	// following the prefix into "subdirectory" entries.
+	List(ctx context.Context, bucket, prefix, delim string) ([]*ListEntry, error)
+}
+
+// ObjectReader is an object opened with Backend.Open.
+type ObjectReader struct {
+	// Meta contains the object headers listed in objectHeaders, if any,
+	// and custom metadata, such as redirects.
+	Meta map[string]string
+	// Size is the length of Body in bytes, or -1 if unknown.
+	Size int64
+	// Body is the object contents. It must be closed by the caller.
+	Body io.ReadCloser
+}
+
+// backend returns s.Backend or the GCS backend of s if it is nil.
+func (s *Storage) backend() Backend {
+	if s.Backend != nil {
+		return s.Backend
+	}
+	return gcsBackend{s}
+}
+
+// gcsBackend is the Backend of GCS XML API at s.Base.
+// Requests are retried and observed as configured in s.
+type gcsBackend struct {
+	s *Storage
+}
+
+// Open sends a GET request of the object to GCS.
+// It is traced in a "gcs.fetch" span if s.Tracer is set.
+func (g gcsBackend) Open(ctx context.Context, bucket, name string, h http.Header) (r *ObjectReader, err error) {
+	s := g.s
+	if s.Tracer != nil {
+		var span Span
+		ctx, span = s.Tracer.StartSpan(ctx, "gcs.fetch")
+		span.SetAttribute("bucket", bucket)
+		span.SetAttribute("object", name)
+		start := time.Now()
+		defer func() {
+			span.SetAttribute("status", fetchStatus(r, err))
+			span.SetAttribute("duration", time.Since(start))
+			span.End()
+		}()
+	}
+	req, err := http.NewRequest("GET", s.objectURL(bucket, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	res, err := s.send(ctx, bucket, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode > 399 || res.StatusCode == http.StatusNotModified {
+		defer res.Body.Close()
+		return nil, responseError(res)
+	}
+	return &ObjectReader{Meta: responseMeta(res), Size: res.ContentLength, Body: res.Body}, nil
+}
+
+// Stat sends a HEAD request of the object to GCS.
+func (g gcsBackend) Stat(ctx context.Context, bucket, name string) (map[string]string, error) {
+	req, err := http.NewRequest("HEAD", g.s.objectURL(bucket, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	res, err := g.s.send(ctx, bucket, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	return responseMeta(res), nil
+}
+
+// fetchStatus returns the HTTP status code of a GCS object fetch
+// which resulted in r and err, or zero if it is unknown.
+func fetchStatus(r *ObjectReader, err error) int {
+	switch {
+	case err == nil && r.Meta["content-range"] != "":
+		return http.StatusPartialContent
+	case err == nil:
+		return http.StatusOK
+	}
+	if errf, ok := err.(*FetchError); ok {
+		return errf.Code
+	}
+	return 0
+}
+
+// responseMeta returns res headers listed in objectHeaders.
+func responseMeta(res *http.Response) map[string]string {
+	meta := make(map[string]string)
+	for _, k := range objectHeaders {
+		if v := res.Header.Get(k); v != "" {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+// responseError returns a FetchError of an error status response res,
+// with its body included in the message.
+func responseError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(res.Body)
+	return &FetchError{
+		Msg:  fmt.Sprintf("%s: %s", res.Status, b),
+		Code: res.StatusCode,
+	}
+}
+
+// MemBackend is a Backend keeping objects in memory, safe for concurrent use.
+// It ignores request headers passed to Open, so that ranges are read in full.
+// The zero value is an empty storage ready to use.
+type MemBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*Object // keyed by bucket/name
+}
+
+// Put stores an object of the bucket with contents body and metadata meta,
+// such as content-type, replacing a previously stored one.
+// The content-length is set to the length of body.
+func (m *MemBackend) Put(bucket, name string, body []byte, meta map[string]string) {
+	o := &Object{Meta: make(map[string]string, len(meta)+1), Body: body}
+	for k, v := range meta {
+		o.Meta[strings.ToLower(k)] = v
+	}
+	o.Meta["content-length"] = strconv.Itoa(len(body))
+	m.mu.Lock()
+	if m.objects == nil {
+		m.objects = make(map[string]*Object)
+	}
+	m.objects[path.Join(bucket, name)] = o
+	m.mu.Unlock()
+}
+
+// Delete removes an object of the bucket, if it exists.
+func (m *MemBackend) Delete(bucket, name string) {
+	m.mu.Lock()
+	delete(m.objects, path.Join(bucket, name))
+	m.mu.Unlock()
+}
+
+// Open returns the object contents or a 404 FetchError if it does not exist.
+func (m *MemBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*ObjectReader, error) {
+	meta, o, err := m.get(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReader{
+		Meta: meta,
+		Size: int64(len(o.Body)),
+		Body: ioutil.NopCloser(bytes.NewReader(o.Body)),
+	}, nil
+}
+
+// Stat returns the object metadata or a 404 FetchError if it does not exist.
+// A bucket exists if it contains any objects.
+func (m *MemBackend) Stat(ctx context.Context, bucket, name string) (map[string]string, error) {
+	if name == "" {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		for k := range m.objects {
+			if strings.HasPrefix(k, bucket+"/") {
+				return map[string]string{}, nil
+			}
+		}
+		return nil, &FetchError{Msg: "404 Not Found", Code: http.StatusNotFound}
+	}
+	meta, _, err := m.get(bucket, name)
+	return meta, err
+}
+
+// get returns a copy of the object metadata along with the object.
+func (m *MemBackend) get(bucket, name string) (map[string]string, *Object, error) {
+	m.mu.RLock()
+	o, ok := m.objects[path.Join(bucket, name)]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, nil, &FetchError{Msg: "404 Not Found", Code: http.StatusNotFound}
+	}
+	meta := make(map[string]string, len(o.Meta))
+	for k, v := range o.Meta {
+		meta[k] = v
+	}
+	return meta, o, nil
+}
+
+// List returns objects of the bucket as described in Backend.
+// Updated time of the entries is zero.
+func (m *MemBackend) List(ctx context.Context, bucket, prefix, delim string) ([]*ListEntry, error) {
+	var list []*ListEntry
+	dirs := make(map[string]bool)
+	m.mu.RLock()
+	for k, o := range m.objects {
+		if !strings.HasPrefix(k, bucket+"/") {
+			continue
+		}
+		name := k[len(bucket)+1:]
+		if name == prefix || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], delim); delim != "" && i >= 0 {
+			dirs[name[:len(prefix)+i+len(delim)]] = true
+			continue
+		}
+		list = append(list, &ListEntry{Name: name, Size: int64(len(o.Body))})
+	}
+	m.mu.RUnlock()
+	for d := range dirs {
+		list = append(list, &ListEntry{Name: d})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestMemBackend(t *testing.T) {
+	m := &MemBackend{}
+	m.Put("bucket", "index.html", []byte("root"), map[string]string{"Content-Type": "text/html"})
+	m.Put("bucket", "docs/index.html", []byte("docs"), nil)
+	m.Put("bucket", "docs/a.txt", []byte("a"), nil)
+	m.Put("bucket", "docs/sub/b.txt", []byte("bb"), nil)
+	m.Put("bucket", "big.bin", []byte(strings.Repeat("x", 100)), nil)
+	m.Put("other", "docs/c.txt", []byte("c"), nil)
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{Base: "mem://test", Index: "index.html", Backend: m, StreamThreshold: 10}
+
+	o, err := stor.ReadFile(ctx, "bucket", "")
+	if err != nil || string(o.Body) != "root" || o.Meta["content-type"] != "text/html" || o.Meta["content-length"] != "4" {
+		t.Errorf("ReadFile(\"\") = %+v, %v; want root text/html", o, err)
+	}
+	o, err = stor.ReadFile(ctx, "bucket", "docs")
+	if err != nil || o.Redirect() != "/docs/" {
+		t.Errorf("ReadFile(docs) = %+v, %v; want redirect to /docs/", o, err)
+	}
+	o, err = stor.StatFile(ctx, "bucket", "docs/")
+	if err != nil || o.Meta["content-length"] != "4" {
+		t.Errorf("StatFile(docs/) = %+v, %v; want content-length 4", o, err)
+	}
+	_, err = stor.ReadFile(ctx, "bucket", "missing.txt")
+	if errf, ok := err.(*FetchError); !ok || errf.Code != http.StatusNotFound {
+		t.Errorf("ReadFile(missing.txt) err = %v; want 404 FetchError", err)
+	}
+
+	o, err = stor.ReadObject(ctx, "bucket", "big.bin")
+	if err != nil || o.Stream == nil {
+		t.Fatalf("ReadObject(big.bin) = %+v, %v; want a stream", o, err)
+	}
+	b, _ := ioutil.ReadAll(o.Stream)
+	o.Close()
+	if len(b) != 100 {
+		t.Errorf("len(big.bin) = %d; want 100", len(b))
+	}
+
+	list, err := stor.List(ctx, "bucket", "docs/")
+	want := []*ListEntry{{Name: "docs/a.txt", Size: 1}, {Name: "docs/index.html", Size: 4}, {Name: "docs/sub/"}}
+	if err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("List(docs/) = %+v, %v; want %+v", list, err, want)
+	}
+	list, err = stor.ListAll(ctx, "bucket", "docs/")
+	want = []*ListEntry{{Name: "docs/a.txt", Size: 1}, {Name: "docs/index.html", Size: 4}, {Name: "docs/sub/b.txt", Size: 2}}
+	if err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("ListAll(docs/) = %+v, %v; want %+v", list, err, want)
+	}
+
+	if err := stor.StatBucket(ctx, "bucket"); err != nil {
+		t.Errorf("StatBucket(bucket): %v", err)
+	}
+	if err := stor.StatBucket(ctx, "missing"); err == nil {
+		t.Error("StatBucket(missing): err = nil")
+	}
+
+	m.Delete("bucket", "docs/a.txt")
+	if _, err := stor.Head(ctx, "bucket", "docs/a.txt"); err == nil {
+		t.Error("Head(docs/a.txt) of a deleted object: err = nil")
+	}
+}
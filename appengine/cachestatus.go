@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// cacheStatusKey is the context key of CacheStatus.
+type cacheStatusKey struct{}
+
+// CacheStatus counts cache hits and misses of Storage reads
+// done with a context returned by WithCacheStatus, along with the time
+// spent in cache lookups and storage fetches.
+// It is safe for concurrent use.
+type CacheStatus struct {
+	hits, misses int32
+	cacheTime    int64 // nanoseconds
+	fetchTime    int64 // nanoseconds
+}
+
+// WithCacheStatus returns a copy of ctx which makes Storage record
+// cache lookups in the returned CacheStatus.
+func WithCacheStatus(ctx context.Context) (context.Context, *CacheStatus) {
+	cs := &CacheStatus{}
+	return context.WithValue(ctx, cacheStatusKey{}, cs), cs
+}
+
+// Hits returns the number of objects found in cache.
+func (cs *CacheStatus) Hits() int {
+	return int(atomic.LoadInt32(&cs.hits))
+}
+
+// Misses returns the number of objects requested from GCS.
+func (cs *CacheStatus) Misses() int {
+	return int(atomic.LoadInt32(&cs.misses))
+}
+
+// CacheTime returns the total time spent looking up objects in
+// the in-memory cache and memcache. Concurrent lookups add up.
+func (cs *CacheStatus) CacheTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cs.cacheTime))
+}
+
+// FetchTime returns the total time spent fetching objects and their
+// metadata from the storage, up to the response headers of streamed ones.
+// Concurrent fetches add up. Background revalidations are not included.
+func (cs *CacheStatus) FetchTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cs.fetchTime))
+}
+
+// recordCache increments hits or misses of ctx CacheStatus, if any,
+// and adds the time elapsed since start of the lookup to its CacheTime.
+func recordCache(ctx context.Context, hit bool, start time.Time) {
+	cs, ok := ctx.Value(cacheStatusKey{}).(*CacheStatus)
+	if !ok {
+		return
+	}
+	if hit {
+		atomic.AddInt32(&cs.hits, 1)
+	} else {
+		atomic.AddInt32(&cs.misses, 1)
+	}
+	atomic.AddInt64(&cs.cacheTime, int64(time.Since(start)))
+}
+
+// recordFetch adds the time elapsed since start of a storage fetch
+// to the FetchTime of ctx CacheStatus, if any.
+func recordFetch(ctx context.Context, start time.Time) {
+	if cs, ok := ctx.Value(cacheStatusKey{}).(*CacheStatus); ok {
+		atomic.AddInt64(&cs.fetchTime, int64(time.Since(start)))
+	}
+}
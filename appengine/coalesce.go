@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// fetches coalesces concurrent fetches of all storages, keyed by cache key,
+// which includes the storage base, purge generation and request headers.
+var fetches flightGroup
+
+// flightGroup runs a single call of a function per key at a time,
+// sharing its result with duplicate calls made meanwhile.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// flight is an in-progress or completed call of flightGroup.do.
+type flight struct {
+	wg  sync.WaitGroup
+	o   *Object
+	err error
+}
+
+// do calls fn and returns its results, unless a call with the same key
+// is in progress, in which case it waits for the latter and returns its
+// results instead. It reports whether the results are shared.
+func (g *flightGroup) do(key string, fn func() (*Object, error)) (o *Object, shared bool, err error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flight)
+	}
+	if f, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.o, true, f.err
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.m[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		f.wg.Done()
+	}()
+	f.o, f.err = fn()
+	return f.o, false, f.err
+}
+
+// flightKey returns the fetches key of cache key, its purgeTracker
+// generation and request headers h. Reads starting after a purge of the key
+// have a new generation, so they do not share fetches started before it.
+func flightKey(key string, gen uint64, h http.Header) string {
+	b := []byte(key)
+	b = append(b, '\n')
+	b = strconv.AppendUint(b, gen, 10)
+	if len(h) == 0 {
+		return string(b)
+	}
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		b = append(b, '\n')
+		b = append(b, http.CanonicalHeaderKey(k)...)
+		b = append(b, ':')
+		b = append(b, strings.Join(h[k], ",")...)
+	}
+	return string(b)
+}
+
+// coalesce returns the result of load, a fetch f of the object sending
+// request headers h, which concurrent calls with the same cache key, purge
+// generation and headers share if s.CoalesceFetches is enabled;
+// see CoalesceFetches.
+//
+// The shared object is the one load returns, so load is expected to cache it
+// once for all callers. Streamed objects cannot be shared: callers waiting
+// for a fetch which turns out to be streamed, panics, or fails with the context
+// error of its caller, call load themselves.
+func (s *Storage) coalesce(ctx context.Context, f *fetchEpoch, h http.Header, load func() (*Object, error)) (*Object, error) {
+	if !s.CoalesceFetches {
+		return load()
+	}
+	o, shared, err := fetches.do(flightKey(f.key, f.gen, h), load)
+	if !shared {
+		return o, err
+	}
+	if err == nil && (o == nil || o.Stream != nil) || (err == context.Canceled || err == context.DeadlineExceeded) && ctx.Err() == nil {
+		return load()
+	}
+	return o, err
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// slowBackend is a MemBackend counting Open calls, each of which takes delay.
+type slowBackend struct {
+	*MemBackend
+	delay time.Duration
+	opens int32
+}
+
+func (b *slowBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*ObjectReader, error) {
+	atomic.AddInt32(&b.opens, 1)
+	time.Sleep(b.delay)
+	return b.MemBackend.Open(ctx, bucket, name, h)
+}
+
+func TestCoalesceFetches(t *testing.T) {
+	const n = 10 // concurrent reads
+	body := bytes.Repeat([]byte("x"), 1<<10)
+	tests := []struct {
+		coalesce bool
+		stream   int64
+		opens    int32
+	}{
+		{true, 0, 1},
+		{false, 0, n},
+		// streamed objects are fetched by each waiter
+		{true, 1 << 9, n},
+	}
+	for i, test := range tests {
+		m := &MemBackend{}
+		m.Put("bucket", "large.bin", body, map[string]string{"content-type": "application/octet-stream"})
+		b := &slowBackend{MemBackend: m, delay: 100 * time.Millisecond}
+		stor := &Storage{
+			Base:            "https://coalesce.example.com",
+			Backend:         b,
+			CoalesceFetches: test.coalesce,
+			StreamThreshold: test.stream,
+		}
+		r, _ := testInstance.NewRequest("GET", "/", nil)
+		ctx := appengine.NewContext(r)
+		if err := memcache.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errc := make(chan error, n)
+		for j := 0; j < n; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				o, err := stor.ReadObject(ctx, "bucket", "large.bin")
+				if err != nil {
+					errc <- err
+					return
+				}
+				defer o.Close()
+				if o.Stream == nil && !bytes.Equal(o.Body, body) {
+					t.Errorf("%d: o.Body of %d bytes; want %d", i, len(o.Body), len(body))
+				}
+			}()
+		}
+		wg.Wait()
+		close(errc)
+		for err := range errc {
+			t.Errorf("%d: ReadObject: %v", i, err)
+		}
+		if v := atomic.LoadInt32(&b.opens); v != test.opens {
+			t.Errorf("%d: %d backend fetches; want %d", i, v, test.opens)
+		}
+	}
+}
+
+func TestFlightKey(t *testing.T) {
+	a := flightKey("key", 0, http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}})
+	b := flightKey("key", 0, http.Header{"Range": {"bytes=0-9"}, "Accept-Encoding": {"gzip"}})
+	if a != b {
+		t.Errorf("flightKey depends on header order: %q != %q", a, b)
+	}
+	for _, h := range []http.Header{nil, {"Accept-Encoding": {"gzip"}}, {"Range": {"bytes=0-8"}}} {
+		if v := flightKey("key", 0, h); v == a {
+			t.Errorf("flightKey(%v) = %q; same as with other headers", h, v)
+		}
+	}
+	if v := flightKey("key", 1, http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}}); v == a {
+		t.Errorf("flightKey(gen 1) = %q; same as with gen 0", v)
+	}
+}
+
+// gatedBackend is a MemBackend whose first Open blocks on release,
+// after reading the object and signaling started.
+type gatedBackend struct {
+	*MemBackend
+	opens            int32
+	started, release chan bool
+}
+
+func (b *gatedBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*ObjectReader, error) {
+	r, err := b.MemBackend.Open(ctx, bucket, name, h)
+	if atomic.AddInt32(&b.opens, 1) == 1 {
+		b.started <- true
+		<-b.release
+	}
+	return r, err
+}
+
+func TestCoalescePurge(t *testing.T) {
+	m := &MemBackend{}
+	m.Put("bucket", "page.html", []byte("old"), nil)
+	b := &gatedBackend{MemBackend: m, started: make(chan bool), release: make(chan bool)}
+	stor := &Storage{Base: "https://coalesce-purge.example.com", Backend: b, CoalesceFetches: true}
+	r, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(r)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	first := make(chan *Object, 1)
+	go func() {
+		o, err := stor.ReadObject(ctx, "bucket", "page.html")
+		if err != nil {
+			t.Errorf("first ReadObject: %v", err)
+		}
+		first <- o
+	}()
+	<-b.started
+	m.Put("bucket", "page.html", []byte("new"), nil)
+	if err := stor.PurgeCache(ctx, "bucket", "page.html"); err != nil {
+		t.Fatalf("PurgeCache: %v", err)
+	}
+
+	// a read after the purge must not wait for the fetch started before it
+	second := make(chan *Object, 1)
+	go func() {
+		o, err := stor.ReadObject(ctx, "bucket", "page.html")
+		if err != nil {
+			t.Errorf("second ReadObject: %v", err)
+		}
+		second <- o
+	}()
+	select {
+	case o := <-second:
+		if o != nil && string(o.Body) != "new" {
+			t.Errorf("second o.Body = %q; want new", o.Body)
+		}
+	case <-time.After(time.Second):
+		t.Error("second ReadObject shares the fetch started before the purge")
+	}
+	close(b.release)
+	<-first
+}
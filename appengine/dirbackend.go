@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// DirBackend is a Backend reading objects from files under the local
+// directory Root, e.g. a generated site previewed without GCS access.
+// Objects of all buckets are read from Root, with object names being
+// slash-separated paths relative to it. Request headers passed to Open
+// are ignored. Directories are not objects.
+type DirBackend struct {
+	Root string
+}
+
+// file returns the local file name of object name,
+// or false if name would refer to a file outside of d.Root.
+func (d *DirBackend) file(name string) (string, bool) {
+	for _, s := range strings.Split(name, "/") {
+		if s == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join(d.Root, filepath.FromSlash(name)), true
+}
+
+// Open returns the file contents, or a 404 FetchError if it does not exist
+// or is a directory, and 403 if it cannot be read.
+func (d *DirBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*ObjectReader, error) {
+	fname, ok := d.file(name)
+	if !ok {
+		return nil, &FetchError{Msg: "404 Not Found", Code: http.StatusNotFound}
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		f.Close()
+		return nil, fileError(err)
+	}
+	return &ObjectReader{Meta: fileMeta(name, fi), Size: fi.Size(), Body: f}, nil
+}
+
+// Stat returns the file metadata similar to Open.
+// The bucket exists, for an empty name, if d.Root is a directory.
+func (d *DirBackend) Stat(ctx context.Context, bucket, name string) (map[string]string, error) {
+	fname, ok := d.file(name)
+	if !ok {
+		return nil, &FetchError{Msg: "404 Not Found", Code: http.StatusNotFound}
+	}
+	fi, err := os.Stat(fname)
+	switch {
+	case err != nil:
+		return nil, fileError(err)
+	case fi.IsDir() != (name == ""):
+		return nil, fileError(os.ErrNotExist)
+	case name == "":
+		return map[string]string{}, nil
+	}
+	return fileMeta(name, fi), nil
+}
+
+// List returns files under d.Root as described in Backend.
+func (d *DirBackend) List(ctx context.Context, bucket, prefix, delim string) ([]*ListEntry, error) {
+	var list []*ListEntry
+	dirs := make(map[string]bool)
+	err := filepath.Walk(d.Root, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(d.Root, fname)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == prefix || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if i := strings.Index(name[len(prefix):], delim); delim != "" && i >= 0 {
+			dirs[name[:len(prefix)+i+len(delim)]] = true
+			return nil
+		}
+		list = append(list, &ListEntry{Name: name, Size: fi.Size(), Updated: fi.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, fileError(err)
+	}
+	for p := range dirs {
+		list = append(list, &ListEntry{Name: p})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// fileMeta returns metadata of object name stored in file fi:
+// content-type by the name extension, content-length and last-modified.
+func fileMeta(name string, fi os.FileInfo) map[string]string {
+	meta := map[string]string{
+		"content-length": strconv.FormatInt(fi.Size(), 10),
+		"last-modified":  fi.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		meta["content-type"] = ct
+	}
+	return meta
+}
+
+// fileError returns a FetchError of a file system error err,
+// with 404 code for missing files and 403 for inaccessible ones.
+func fileError(err error) error {
+	code := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		code = http.StatusNotFound
+	case os.IsPermission(err):
+		code = http.StatusForbidden
+	}
+	return &FetchError{Msg: err.Error(), Code: code}
+}
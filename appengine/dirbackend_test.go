@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDirBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"index.html":       "root",
+		"docs/index.html":  "docs",
+		"docs/a.txt":       "a",
+		"docs/sub/b.txt":   "bb",
+		"hello world.html": "hello",
+	}
+	for name, data := range files {
+		fname := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "index.html"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	d := &DirBackend{Root: dir}
+	r, err := d.Open(ctx, "bucket", "index.html", nil)
+	if err != nil {
+		t.Fatalf("Open(index.html): %v", err)
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	want := map[string]string{
+		"content-type":   "text/html; charset=utf-8",
+		"content-length": "4",
+		"last-modified":  "Sat, 02 Jan 2016 03:04:05 GMT",
+	}
+	if string(b) != "root" || r.Size != 4 || !reflect.DeepEqual(r.Meta, want) {
+		t.Errorf("Open(index.html) = %q, %d, %v; want root, 4, %v", b, r.Size, r.Meta, want)
+	}
+	if meta, err := d.Stat(ctx, "bucket", "hello world.html"); err != nil || meta["content-length"] != "5" {
+		t.Errorf("Stat(hello world.html) = %v, %v; want content-length 5", meta, err)
+	}
+	if _, err := d.Stat(ctx, "bucket", ""); err != nil {
+		t.Errorf("Stat(\"\") err = %v; want nil", err)
+	}
+
+	for _, name := range []string{"missing.txt", "docs", "docs/", "../" + filepath.Base(dir) + "/index.html"} {
+		_, err := d.Open(ctx, "bucket", name, nil)
+		if errf, ok := err.(*FetchError); !ok || errf.Code != http.StatusNotFound {
+			t.Errorf("Open(%q) err = %v; want 404 FetchError", name, err)
+		}
+		_, err = d.Stat(ctx, "bucket", name)
+		if errf, ok := err.(*FetchError); !ok || errf.Code != http.StatusNotFound {
+			t.Errorf("Stat(%q) err = %v; want 404 FetchError", name, err)
+		}
+	}
+	if _, err := (&DirBackend{Root: filepath.Join(dir, "missing")}).Stat(ctx, "bucket", ""); err == nil {
+		t.Errorf("Stat(\"\") of a missing root err = nil; want 404 FetchError")
+	}
+
+	list, err := d.List(ctx, "bucket", "docs/", "/")
+	names := make([]string, len(list))
+	for i, e := range list {
+		names[i] = e.Name
+	}
+	if want := []string{"docs/a.txt", "docs/index.html", "docs/sub/"}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("List(docs/) = %q, %v; want %q", names, err, want)
+	}
+	if list[0].Size != 1 || list[0].Updated.IsZero() {
+		t.Errorf("List(docs/)[0] = %+v; want size 1 and updated time", list[0])
+	}
+}
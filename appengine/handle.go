@@ -16,6 +16,7 @@ package weasel
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
@@ -38,7 +39,15 @@ var (
 )
 
 // ServeObject writes object o to w, with optional body.
+// The body is copied from o.Stream if it is not nil; o is closed on return.
 func ServeObject(w http.ResponseWriter, o *Object, withBody bool) error {
+	return ServeObjectCode(w, o, http.StatusOK, withBody)
+}
+
+// ServeObjectCode is similar to ServeObject except it responds
+// with the HTTP status code, unless o is a redirect.
+func ServeObjectCode(w http.ResponseWriter, o *Object, code int, withBody bool) error {
+	defer o.Close()
 	if v := o.Redirect(); v != "" {
 		w.Header().Set("location", v)
 		w.WriteHeader(o.RedirectCode())
@@ -51,20 +60,55 @@ func ServeObject(w http.ResponseWriter, o *Object, withBody bool) error {
 		h.Set(k, v)
 	}
 	h.Set("allow", allowMethodsStr)
+	w.WriteHeader(code)
 	// body
 	var err error
-	if withBody {
+	switch {
+	case !withBody:
+		// no body
+	case o.Stream != nil:
+		_, err = io.Copy(w, o.Stream)
+	default:
 		_, err = w.Write(o.Body)
 	}
 	return err
 }
 
+// ServeOptions responds to an OPTIONS request for an existing object
+// with 204 status code and Allow header listing the methods objects
+// may be requested with.
+func ServeOptions(w http.ResponseWriter) {
+	w.Header().Set("allow", allowMethodsStr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeNotModified responds with 304 status code and o's
+// cache and validator headers. Like ServeObject, it closes o.
+func ServeNotModified(w http.ResponseWriter, o *Object) {
+	defer o.Close()
+	h := w.Header()
+	for _, k := range notModifiedHeaders {
+		if v := o.Meta[k]; v != "" {
+			h.Set(k, v)
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
 // HandleChangeHook handles Object Change Notifications as described at
 // https://cloud.google.com/storage/docs/object-change-notification.
-// It removes objects from cache.
+// It removes objects from cache. Object keys are mapped to their names
+// as configured by s.KeyTransforms; keys no name maps to are ignored.
+// Requests which do not look like a notification are rejected with 400 status code.
 func (s *Storage) HandleChangeHook(w http.ResponseWriter, r *http.Request) {
-	// skip sync requests
-	if v := r.Header.Get("x-goog-resource-state"); v == "sync" {
+	switch r.Header.Get("x-goog-resource-state") {
+	case "sync":
+		// skip sync requests
+		return
+	case "exists", "not_exists":
+		// object created, updated or deleted
+	default:
+		http.Error(w, "not a GCS notification", http.StatusBadRequest)
 		return
 	}
 
@@ -72,14 +116,31 @@ func (s *Storage) HandleChangeHook(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	// we only care about name and the bucket
 	body := struct{ Name, Bucket string }{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Errorf(ctx, "json.Decode: %v", err.Error())
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Bucket == "" || body.Name == "" {
+		log.Errorf(ctx, "json.Decode: %v; bucket = %q, name = %q", err, body.Bucket, body.Name)
+		http.Error(w, "invalid notification payload", http.StatusBadRequest)
+		return
+	}
+	name, ok := s.objectName(body.Bucket, body.Name)
+	if !ok {
+		log.Debugf(ctx, "%s/%s: not served under any object name", body.Bucket, body.Name)
 		return
 	}
-	if err := s.PurgeCache(ctx, body.Bucket, body.Name); err != nil {
-		log.Errorf(ctx, "s.PurgeCache(%q, %q): %v", body.Bucket, body.Name, err)
+	if err := s.PurgeCache(ctx, body.Bucket, name); err != nil {
+		log.Errorf(ctx, "s.PurgeCache(%q, %q): %v", body.Bucket, name, err)
 		w.WriteHeader(http.StatusInternalServerError) // let GCS retry
+		return
 	}
+	log.Infof(ctx, "invalidated %s/%s", body.Bucket, body.Name)
+	if s.ObjectChanged != nil {
+		s.ObjectChanged(ctx, body.Bucket, name)
+	}
+}
+
+// AllowHeader returns Allow header value listing the methods objects
+// may be requested with, as accepted by ValidMethod.
+func AllowHeader() string {
+	return allowMethodsStr
 }
 
 // ValidMethod reports whether m is a supported HTTP method.
@@ -0,0 +1,67 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import "strings"
+
+// KeyTransform maps object names, as requested from Storage,
+// to the keys objects are stored under in a bucket, e.g. "docs/index.html"
+// to "public/docs/index.html". See Storage.KeyTransforms.
+type KeyTransform struct {
+	// Prefix is prepended to object names.
+	Prefix string
+	// Lowercase makes object names case-insensitive:
+	// they are lowercased before Prefix is prepended.
+	Lowercase bool
+}
+
+// Key returns the storage key of object name.
+func (t KeyTransform) Key(name string) string {
+	if t.Lowercase {
+		name = strings.ToLower(name)
+	}
+	return t.Prefix + name
+}
+
+// Name is the inverse of Key. It reports false if key is not
+// the result of Key for any name, e.g. it lacks the prefix.
+func (t KeyTransform) Name(key string) (string, bool) {
+	if !strings.HasPrefix(key, t.Prefix) {
+		return "", false
+	}
+	name := key[len(t.Prefix):]
+	if t.Lowercase && strings.ToLower(name) != name {
+		return "", false
+	}
+	return name, true
+}
+
+// objectKey returns the storage key of object name of the bucket,
+// transformed as configured by s.KeyTransforms.
+func (s *Storage) objectKey(bucket, name string) string {
+	if t, ok := s.KeyTransforms[bucket]; ok {
+		return t.Key(name)
+	}
+	return name
+}
+
+// objectName is the inverse of objectKey.
+// It reports false if no object name maps to key.
+func (s *Storage) objectName(bucket, key string) (string, bool) {
+	if t, ok := s.KeyTransforms[bucket]; ok {
+		return t.Name(key)
+	}
+	return key, true
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestKeyTransform(t *testing.T) {
+	tests := []struct {
+		t         KeyTransform
+		name, key string
+		inverse   bool
+	}{
+		{KeyTransform{}, "Docs/A.html", "Docs/A.html", true},
+		{KeyTransform{Prefix: "public/"}, "Docs/A.html", "public/Docs/A.html", true},
+		{KeyTransform{Lowercase: true}, "Docs/A.html", "docs/a.html", true},
+		{KeyTransform{Prefix: "Public/", Lowercase: true}, "Docs/A.html", "Public/docs/a.html", true},
+		{KeyTransform{Prefix: "public/"}, "", "public/", true},
+	}
+	for _, test := range tests {
+		key := test.t.Key(test.name)
+		if key != test.key {
+			t.Errorf("%+v.Key(%q) = %q; want %q", test.t, test.name, key, test.key)
+		}
+		if _, ok := test.t.Name(key); ok != test.inverse {
+			t.Errorf("%+v.Name(%q) ok = %v; want %v", test.t, key, ok, test.inverse)
+		}
+	}
+
+	names := []struct {
+		t    KeyTransform
+		key  string
+		name string
+		ok   bool
+	}{
+		{KeyTransform{Prefix: "public/"}, "public/Docs/A.html", "Docs/A.html", true},
+		{KeyTransform{Prefix: "public/"}, "private/a.html", "", false},
+		{KeyTransform{Prefix: "public/", Lowercase: true}, "public/docs/a.html", "docs/a.html", true},
+		{KeyTransform{Prefix: "public/", Lowercase: true}, "public/Docs/a.html", "", false},
+	}
+	for _, test := range names {
+		name, ok := test.t.Name(test.key)
+		if name != test.name || ok != test.ok {
+			t.Errorf("%+v.Name(%q) = %q, %v; want %q, %v", test.t, test.key, name, ok, test.name, test.ok)
+		}
+	}
+}
+
+func TestStorageKeyTransforms(t *testing.T) {
+	m := &MemBackend{}
+	m.Put("bucket", "public/docs/index.html", []byte("v1"), nil)
+	m.Put("bucket", "public/docs/a.txt", []byte("a"), nil)
+	m.Put("bucket", "public/Docs/B.txt", []byte("b"), nil)
+	m.Put("bucket", "private/secret.txt", []byte("s"), nil)
+	m.Put("other", "docs/index.html", []byte("other"), nil)
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{
+		Base:          "mem://test",
+		Index:         "index.html",
+		Backend:       m,
+		Cache:         NewLRU(1<<20, 0),
+		KeyTransforms: map[string]KeyTransform{"bucket": {Prefix: "public/", Lowercase: true}},
+	}
+
+	for _, name := range []string{"docs/", "Docs/", "DOCS/INDEX.HTML"} {
+		o, err := stor.ReadFile(ctx, "bucket", name)
+		if err != nil || string(o.Body) != "v1" {
+			t.Errorf("ReadFile(%q) = %+v, %v; want v1", name, o, err)
+		}
+	}
+	if k1, k2 := stor.CacheKey("bucket", "Docs/Index.html"), stor.CacheKey("bucket", "docs/index.html"); k1 != k2 {
+		t.Errorf("CacheKey = %q and %q; want the same", k1, k2)
+	}
+	if n := stor.Cache.Len(); n != 1 {
+		t.Errorf("stor.Cache.Len() = %d; want 1", n)
+	}
+	if o, err := stor.ReadFile(ctx, "other", "docs/"); err != nil || string(o.Body) != "other" {
+		t.Errorf("ReadFile(other, docs/) = %+v, %v; want other", o, err)
+	}
+
+	list, err := stor.List(ctx, "bucket", "docs/")
+	want := []*ListEntry{{Name: "docs/a.txt", Size: 1}, {Name: "docs/index.html", Size: 2}}
+	if err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("List(docs/) = %+v, %v; want %+v", list, err, want)
+	}
+
+	// notifications carry storage keys
+	var changed []string
+	stor.ObjectChanged = func(_ context.Context, bucket, name string) {
+		changed = append(changed, bucket+"/"+name)
+	}
+	m.Put("bucket", "public/docs/index.html", []byte("v2"), nil)
+	for _, key := range []string{"public/docs/index.html", "public/Docs/B.txt", "private/secret.txt"} {
+		body := `{"bucket": "bucket", "name": "` + key + `"}`
+		req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+		req.Header.Set("x-goog-resource-state", "exists")
+		res := httptest.NewRecorder()
+		stor.HandleChangeHook(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: hook res.Code = %d; want 200", key, res.Code)
+		}
+	}
+	if want := []string{"bucket/docs/index.html"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %q; want %q", changed, want)
+	}
+	if o, err := stor.ReadFile(ctx, "bucket", "docs/"); err != nil || string(o.Body) != "v2" {
+		t.Errorf("ReadFile(docs/) after hook = %+v, %v; want v2", o, err)
+	}
+}
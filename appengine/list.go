@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxListPages limits the number of GCS requests made by a single List call.
+const maxListPages = 10
+
+// ListEntry is an object or a "subdirectory" of a bucket listing.
+type ListEntry struct {
+	Name    string    // object name or a prefix ending with "/"
+	Size    int64     // object size in bytes
+	Updated time.Time // zero for prefixes
+}
+
+// Dir reports whether e is a "subdirectory".
+func (e *ListEntry) Dir() bool {
+	return strings.HasSuffix(e.Name, "/")
+}
+
+// listBucketResult is a GCS XML API bucket listing response.
+type listBucketResult struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// List returns objects and "subdirectories" of the bucket whose names
+// start with prefix, collapsing names on the first "/" following the prefix.
+// The object named prefix itself is omitted. Entries are sorted by name.
+// Listings are never cached.
+func (s *Storage) List(ctx context.Context, bucket, prefix string) ([]*ListEntry, error) {
+	return s.list(ctx, bucket, prefix, "/")
+}
+
+// ListAll is similar to List except names are not collapsed,
+// so that all objects starting with prefix are returned.
+func (s *Storage) ListAll(ctx context.Context, bucket, prefix string) ([]*ListEntry, error) {
+	return s.list(ctx, bucket, prefix, "")
+}
+
+// list implements List and ListAll, listing the storage keys of prefix
+// and returning entries named by their object names. Keys which
+// no object name maps to, see KeyTransform.Name, are omitted.
+func (s *Storage) list(ctx context.Context, bucket, prefix, delim string) ([]*ListEntry, error) {
+	from, done := s.readBucket(ctx, bucket)
+	if _, ok := s.KeyTransforms[bucket]; !ok {
+		list, err := s.backend().List(ctx, from, prefix, delim)
+		done(err)
+		return list, err
+	}
+	list, err := s.backend().List(ctx, from, s.objectKey(bucket, prefix), delim)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	names := list[:0]
+	for _, e := range list {
+		if name, ok := s.objectName(bucket, e.Name); ok {
+			e.Name = name
+			names = append(names, e)
+		}
+	}
+	return names, nil
+}
+
+// List implements Backend.List, following up to maxListPages pages.
+func (g gcsBackend) List(ctx context.Context, bucket, prefix, delim string) ([]*ListEntry, error) {
+	q := url.Values{"prefix": {prefix}}
+	if delim != "" {
+		q.Set("delimiter", delim)
+	}
+	var list []*ListEntry
+	for i := 0; i < maxListPages; i++ {
+		res, err := g.list(ctx, bucket, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			if c.Key != prefix {
+				list = append(list, &ListEntry{Name: c.Key, Size: c.Size, Updated: c.LastModified})
+			}
+		}
+		for _, p := range res.CommonPrefixes {
+			list = append(list, &ListEntry{Name: p.Prefix})
+		}
+		if !res.IsTruncated || res.NextMarker == "" {
+			break
+		}
+		q.Set("marker", res.NextMarker)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// list sends a single bucket listing request with query q.
+func (g gcsBackend) list(ctx context.Context, bucket string, q url.Values) (*listBucketResult, error) {
+	u := fmt.Sprintf("%s/%s?%s", g.s.base(bucket), bucket, q.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	res, err := g.s.send(ctx, bucket, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	var lr listBucketResult
+	if err := xml.NewDecoder(res.Body).Decode(&lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
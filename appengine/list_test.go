@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+func TestList(t *testing.T) {
+	t.Parallel()
+	pages := map[string]string{
+		"": `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://doc.s3.amazonaws.com/2006-03-01">
+  <Name>bucket</Name>
+  <Prefix>docs/</Prefix>
+  <IsTruncated>true</IsTruncated>
+  <NextMarker>docs/b.html</NextMarker>
+  <Contents><Key>docs/</Key><Size>0</Size><LastModified>2016-01-02T03:04:05.000Z</LastModified></Contents>
+  <Contents><Key>docs/b.html</Key><Size>12</Size><LastModified>2016-01-02T03:04:05.000Z</LastModified></Contents>
+  <CommonPrefixes><Prefix>docs/sub/</Prefix></CommonPrefixes>
+</ListBucketResult>`,
+		"docs/b.html": `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://doc.s3.amazonaws.com/2006-03-01">
+  <IsTruncated>false</IsTruncated>
+  <Contents><Key>docs/a.txt</Key><Size>3</Size><LastModified>2017-01-02T03:04:05.000Z</LastModified></Contents>
+</ListBucketResult>`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/bucket" || q.Get("prefix") != "docs/" || q.Get("delimiter") != "/" {
+			t.Errorf("r.URL = %s", r.URL)
+		}
+		w.Write([]byte(pages[q.Get("marker")]))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	stor := &Storage{Base: ts.URL}
+	list, err := stor.List(ctx, "bucket", "docs/")
+	if err != nil {
+		t.Fatalf("stor.List: %v", err)
+	}
+	want := []*ListEntry{
+		{Name: "docs/a.txt", Size: 3, Updated: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Name: "docs/b.html", Size: 12, Updated: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Name: "docs/sub/"},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("list = %+v; want %+v", list, want)
+	}
+	if !list[2].Dir() || list[1].Dir() {
+		t.Errorf("list[2].Dir(), list[1].Dir() = %v, %v; want true, false", list[2].Dir(), list[1].Dir())
+	}
+}
+
+func TestListAll(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["delimiter"]; ok {
+			t.Errorf("r.URL = %s; want no delimiter", r.URL)
+		}
+		w.Write([]byte(`<ListBucketResult>
+  <Contents><Key>a/b/c.html</Key><Size>1</Size><LastModified>2016-01-02T03:04:05.000Z</LastModified></Contents>
+  <Contents><Key>a.html</Key><Size>2</Size><LastModified>2016-01-02T03:04:05.000Z</LastModified></Contents>
+</ListBucketResult>`))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	stor := &Storage{Base: ts.URL}
+	list, err := stor.ListAll(appengine.NewContext(req), "bucket", "")
+	if err != nil {
+		t.Fatalf("stor.ListAll: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "a.html" || list[1].Name != "a/b/c.html" {
+		t.Errorf("list = %+v; want a.html, a/b/c.html", list)
+	}
+}
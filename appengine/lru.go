@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LRU is an in-memory least recently used object cache,
+// bounded by the total size of cached object bodies.
+// It is safe for concurrent use. A nil *LRU is a valid cache
+// which stores nothing.
+//
+// Cached objects are shared between callers and must not be modified.
+type LRU struct {
+	maxBytes      int64 // total size limit
+	maxEntryBytes int64 // objects larger than this are not cached
+
+	now func() time.Time // time source of entry ages
+
+	mu           sync.Mutex
+	size         int64 // current total size
+	ll           *list.List
+	items        map[string]*list.Element
+	revalidating map[string]bool // keys being revalidated
+}
+
+// lruEntry is a value of LRU list elements.
+type lruEntry struct {
+	key   string
+	obj   *Object
+	added time.Time
+}
+
+// NewLRU creates a new cache holding up to maxBytes of object bodies,
+// each of which is at most maxEntryBytes long.
+// Non-positive maxEntryBytes limits entries by maxBytes only.
+func NewLRU(maxBytes, maxEntryBytes int64) *LRU {
+	return &LRU{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		now:           time.Now,
+		ll:            list.New(),
+		items:         make(map[string]*list.Element),
+		revalidating:  make(map[string]bool),
+	}
+}
+
+// Get returns an object cached under key, marking it as recently used.
+func (c *LRU) Get(key string) (*Object, bool) {
+	o, _, ok := c.Lookup(key)
+	return o, ok
+}
+
+// Lookup is similar to Get and also returns the time elapsed
+// since the object was added to the cache.
+func (c *LRU) Lookup(key string) (*Object, time.Duration, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, 0, false
+	}
+	c.ll.MoveToFront(e)
+	ent := e.Value.(*lruEntry)
+	return ent.obj, c.now().Sub(ent.added), true
+}
+
+// Add caches o under key, evicting least recently used objects
+// to make room for it. Objects larger than the entry size limit are ignored.
+func (c *LRU) Add(key string, o *Object) {
+	c.add(key, o, true)
+}
+
+// add implements Add. The entry size limit is only applied if limit is true;
+// objects larger than the total size limit are always ignored.
+func (c *LRU) add(key string, o *Object, limit bool) {
+	if c == nil {
+		return
+	}
+	n := int64(len(o.Body))
+	if n > c.maxBytes || limit && c.maxEntryBytes > 0 && n > c.maxEntryBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key, o, c.now()})
+	c.size += n
+	for c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove evicts an object cached under key, if any.
+// It reports whether the object was cached.
+func (c *LRU) Remove(key string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if ok {
+		c.removeElement(e)
+	}
+	return ok
+}
+
+// RemovePrefix evicts objects cached under keys starting with prefix,
+// all of them if prefix is empty, and returns the number of evicted objects.
+func (c *LRU) RemovePrefix(prefix string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range c.items {
+		if strings.HasPrefix(k, prefix) {
+			c.removeElement(e)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of cached objects.
+func (c *LRU) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// startRevalidate marks key as being revalidated. It returns false
+// if it already is, in which case the caller should not revalidate it again.
+func (c *LRU) startRevalidate(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revalidating[key] {
+		return false
+	}
+	c.revalidating[key] = true
+	return true
+}
+
+// doneRevalidate unmarks key marked with startRevalidate.
+func (c *LRU) doneRevalidate(key string) {
+	c.mu.Lock()
+	delete(c.revalidating, key)
+	c.mu.Unlock()
+}
+
+// removeElement must be called with c.mu held.
+func (c *LRU) removeElement(e *list.Element) {
+	ent := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, ent.key)
+	c.size -= int64(len(ent.obj.Body))
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewLRU(10, 4)
+	obj := func(n int) *Object { return &Object{Body: make([]byte, n)} }
+
+	c.Add("a", obj(4))
+	c.Add("b", obj(4))
+	c.Add("big", obj(5)) // over entry limit
+	if _, ok := c.Get("big"); ok {
+		t.Errorf("found object larger than entry limit")
+	}
+	c.Get("a") // mark a as recently used
+	c.Add("c", obj(3))
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b should have been evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s: not found", k)
+		}
+	}
+	c.Add("a", obj(1)) // replace
+	if o, _ := c.Get("a"); len(o.Body) != 1 {
+		t.Errorf("len(a.Body) = %d; want 1", len(o.Body))
+	}
+	if !c.Remove("c") || c.Remove("c") {
+		t.Errorf("Remove(c) should report a cached object once")
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("c.Len() = %d; want 1", n)
+	}
+	c.Add("p/1", obj(1))
+	c.Add("p/2", obj(1))
+	if n := c.RemovePrefix("p/"); n != 2 || c.Len() != 1 {
+		t.Errorf("RemovePrefix(p/) = %d, c.Len() = %d; want 2, 1", n, c.Len())
+	}
+	if n := c.RemovePrefix(""); n != 1 || c.Len() != 0 {
+		t.Errorf("RemovePrefix(\"\") = %d, c.Len() = %d; want 1, 0", n, c.Len())
+	}
+
+	var nilc *LRU
+	nilc.Add("a", obj(1))
+	if _, ok := nilc.Get("a"); ok {
+		t.Errorf("nil cache: found object")
+	}
+}
+
+func TestLRUConcurrent(t *testing.T) {
+	c := NewLRU(100, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k := fmt.Sprintf("%d-%d", i, j%5)
+				c.Add(k, &Object{Body: make([]byte, j%10)})
+				c.Get(k)
+				if j%7 == 0 {
+					c.Remove(k)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if c.size > c.maxBytes {
+		t.Errorf("c.size = %d; want <= %d", c.size, c.maxBytes)
+	}
+}
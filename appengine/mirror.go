@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// defaultMirrorFailures is the default value of Mirror.Failures.
+	defaultMirrorFailures = 5
+	// defaultMirrorWindow is the default value of Mirror.Window.
+	defaultMirrorWindow = time.Minute
+	// defaultMirrorCooldown is the default value of Mirror.Cooldown.
+	defaultMirrorCooldown = 30 * time.Second
+)
+
+// Circuit breaker states of a Mirror.
+const (
+	mirrorClosed   = "closed"    // reading from the primary bucket
+	mirrorOpen     = "open"      // reading from the mirror bucket
+	mirrorHalfOpen = "half-open" // probing the primary bucket
+)
+
+// Mirror is a bucket holding a copy of a primary bucket, see Storage.Mirrors.
+// Reads of the primary bucket are routed to the mirror by a circuit breaker:
+// after Failures consecutive transient errors, see IsTransient, within Window,
+// the breaker opens and objects are read from the mirror for Cooldown.
+// Then it is half-open: a single read probes the primary bucket again,
+// closing the breaker if it succeeds or opening it for another Cooldown.
+// State transitions are logged.
+//
+// A Mirror must not be copied after first use.
+type Mirror struct {
+	// Bucket is the name of the mirror bucket.
+	Bucket string
+	// Base, if not empty, is the base URL of Bucket in place of
+	// Storage.Base, e.g. in another region.
+	Base string
+	// Failures is the number of consecutive failed reads of the primary
+	// bucket which open the breaker, defaultMirrorFailures if zero.
+	Failures int
+	// Window is how long consecutive failures are counted from the first
+	// of them, defaultMirrorWindow if zero.
+	Window time.Duration
+	// Cooldown is how long the breaker stays open before probing
+	// the primary bucket, defaultMirrorCooldown if zero.
+	Cooldown time.Duration
+
+	now func() time.Time // time source; time.Now if nil
+
+	mu       sync.Mutex
+	state    string    // one of mirror* states, mirrorClosed if empty
+	failures int       // consecutive failures while closed
+	first    time.Time // time of the first of failures
+	opened   time.Time // time the breaker last opened
+}
+
+// route returns the bucket to read in place of primary bucket, along with
+// a function which must be called with the error of the read, if any.
+// Reads are routed to m.Bucket while the breaker is open, or another read
+// is probing the primary bucket.
+func (m *Mirror) route(ctx context.Context, primary string) (string, func(error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock()
+	switch m.state {
+	case mirrorOpen:
+		if now.Sub(m.opened) < m.cooldown() {
+			return m.Bucket, func(error) {}
+		}
+		m.transition(ctx, primary, mirrorHalfOpen)
+		return primary, func(err error) { m.probed(ctx, primary, err) }
+	case mirrorHalfOpen:
+		return m.Bucket, func(error) {}
+	}
+	return primary, func(err error) { m.observe(ctx, primary, err) }
+}
+
+// observe records the result of a read of the primary bucket
+// while the breaker is closed, opening it if too many reads failed.
+func (m *Mirror) observe(ctx context.Context, primary string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !IsTransient(err) {
+		m.failures = 0
+		return
+	}
+	now := m.clock()
+	if m.failures == 0 || now.Sub(m.first) > m.window() {
+		m.failures, m.first = 0, now
+	}
+	m.failures++
+	if m.state != mirrorOpen && m.state != mirrorHalfOpen && m.failures >= m.threshold() {
+		m.opened = now
+		m.transition(ctx, primary, mirrorOpen)
+	}
+}
+
+// probed records the result of a half-open breaker probe.
+func (m *Mirror) probed(ctx context.Context, primary string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if IsTransient(err) {
+		m.opened = m.clock()
+		m.transition(ctx, primary, mirrorOpen)
+		return
+	}
+	m.failures = 0
+	m.transition(ctx, primary, mirrorClosed)
+}
+
+// transition sets the breaker state and logs it. m.mu must be held.
+func (m *Mirror) transition(ctx context.Context, primary, state string) {
+	m.state = state
+	switch state {
+	case mirrorOpen:
+		log.Warningf(ctx, "mirror %s: circuit open; reading from %s for %v", primary, m.Bucket, m.cooldown())
+	case mirrorHalfOpen:
+		log.Infof(ctx, "mirror %s: circuit half-open; probing primary bucket", primary)
+	default:
+		log.Infof(ctx, "mirror %s: circuit closed; reading from primary bucket", primary)
+	}
+}
+
+// clock returns the current time of m.now, or time.Now if it is nil.
+func (m *Mirror) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// threshold returns m.Failures or its default.
+func (m *Mirror) threshold() int {
+	if m.Failures > 0 {
+		return m.Failures
+	}
+	return defaultMirrorFailures
+}
+
+// window returns m.Window or its default.
+func (m *Mirror) window() time.Duration {
+	if m.Window > 0 {
+		return m.Window
+	}
+	return defaultMirrorWindow
+}
+
+// cooldown returns m.Cooldown or its default.
+func (m *Mirror) cooldown() time.Duration {
+	if m.Cooldown > 0 {
+		return m.Cooldown
+	}
+	return defaultMirrorCooldown
+}
+
+// readBucket returns the bucket to read in place of bucket,
+// and a function to call with the error of the read, if any.
+// Buckets with no s.Mirrors entry are read as is.
+func (s *Storage) readBucket(ctx context.Context, bucket string) (string, func(error)) {
+	m, ok := s.Mirrors[bucket]
+	if !ok {
+		return bucket, func(error) {}
+	}
+	return m.route(ctx, bucket)
+}
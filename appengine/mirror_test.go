@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// failingBackend is a MemBackend whose reads of bucket fail with 503
+// while down is set.
+type failingBackend struct {
+	MemBackend
+	bucket string
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *failingBackend) setDown(down bool) {
+	b.mu.Lock()
+	b.down = down
+	b.mu.Unlock()
+}
+
+func (b *failingBackend) fail(bucket string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down && bucket == b.bucket {
+		return &FetchError{Msg: "503 Service Unavailable", Code: http.StatusServiceUnavailable}
+	}
+	return nil
+}
+
+func (b *failingBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*ObjectReader, error) {
+	if err := b.fail(bucket); err != nil {
+		return nil, err
+	}
+	return b.MemBackend.Open(ctx, bucket, name, h)
+}
+
+func (b *failingBackend) Stat(ctx context.Context, bucket, name string) (map[string]string, error) {
+	if err := b.fail(bucket); err != nil {
+		return nil, err
+	}
+	return b.MemBackend.Stat(ctx, bucket, name)
+}
+
+func (b *failingBackend) List(ctx context.Context, bucket, prefix, delim string) ([]*ListEntry, error) {
+	if err := b.fail(bucket); err != nil {
+		return nil, err
+	}
+	return b.MemBackend.List(ctx, bucket, prefix, delim)
+}
+
+func TestMirror(t *testing.T) {
+	backend := &failingBackend{bucket: "primary"}
+	backend.Put("primary", "page.html", []byte("primary copy"), map[string]string{"x-goog-meta-copy": "primary"})
+	backend.Put("mirror", "page.html", []byte("mirror copy"), map[string]string{"x-goog-meta-copy": "mirror"})
+	now := time.Now()
+	m := &Mirror{Bucket: "mirror", Failures: 3, Window: time.Minute, Cooldown: 30 * time.Second}
+	m.now = func() time.Time { return now }
+	stor := &Storage{Backend: backend, Mirrors: map[string]*Mirror{"primary": m}}
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	// read reports the copy a read of the primary bucket was served from,
+	// or "error".
+	read := func() string {
+		o, err := stor.Head(ctx, "primary", "page.html")
+		if err != nil {
+			return "error"
+		}
+		return o.Meta["x-goog-meta-copy"]
+	}
+	step := func(name string, want ...string) {
+		for i, w := range want {
+			if v := read(); v != w {
+				t.Errorf("%s: read %d = %q; want %q", name, i, v, w)
+			}
+		}
+	}
+
+	step("closed", "primary")
+	backend.setDown(true)
+	step("failing", "error", "error")
+	// failures older than the window are forgotten
+	now = now.Add(2 * time.Minute)
+	step("failing again", "error", "error", "error")
+	step("open", "mirror", "mirror")
+	if o, err := stor.ReadObject(ctx, "primary", "page.html"); err != nil || string(o.Body) != "mirror copy" {
+		t.Errorf("open: ReadObject = %v, %v; want mirror copy", o, err)
+	}
+	if l, err := stor.List(ctx, "primary", ""); err != nil || len(l) != 1 {
+		t.Errorf("open: List = %v, %v; want the mirror entry", l, err)
+	}
+
+	now = now.Add(31 * time.Second)
+	step("failed probe", "error", "mirror")
+	now = now.Add(31 * time.Second)
+	backend.setDown(false)
+	step("probe", "primary", "primary")
+
+	// non-transient errors do not open the breaker
+	for i := 0; i < 5; i++ {
+		if _, err := stor.Head(ctx, "primary", "missing"); err == nil {
+			t.Fatal("missing: err = nil")
+		}
+	}
+	step("not found", "primary")
+}
+
+func TestMirrorHalfOpen(t *testing.T) {
+	now := time.Now()
+	m := &Mirror{Bucket: "mirror", Failures: 1}
+	m.now = func() time.Time { return now }
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	unavailable := &FetchError{Code: http.StatusServiceUnavailable}
+
+	b, done := m.route(ctx, "primary")
+	if b != "primary" {
+		t.Fatalf("closed: bucket = %q; want primary", b)
+	}
+	done(unavailable)
+	now = now.Add(defaultMirrorCooldown)
+	probe, done := m.route(ctx, "primary")
+	// reads concurrent with the probe go to the mirror
+	other, _ := m.route(ctx, "primary")
+	if probe != "primary" || other != "mirror" {
+		t.Errorf("half-open: buckets = %q, %q; want primary, mirror", probe, other)
+	}
+	done(nil)
+	if b, _ := m.route(ctx, "primary"); b != "primary" {
+		t.Errorf("closed: bucket = %q; want primary", b)
+	}
+}
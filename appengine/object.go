@@ -15,8 +15,11 @@
 package weasel
 
 import (
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -25,10 +28,20 @@ const (
 	metaRedirectCode = "x-goog-meta-redirect-code"
 )
 
+// notModifiedHeaders is a subset of objectHeaders sent with 304 responses.
+var notModifiedHeaders = []string{
+	"cache-control",
+	"etag",
+	"last-modified",
+}
+
 // objectHeaders is a slice of headers propagated from a GCS object.
 var objectHeaders = []string{
 	"cache-control",
 	"content-disposition",
+	"content-encoding",
+	"content-length",
+	"content-range",
 	"content-type",
 	"etag",
 	"last-modified",
@@ -38,6 +51,18 @@ var objectHeaders = []string{
 type Object struct {
 	Meta map[string]string
 	Body []byte
+	// Stream, if not nil, is the object contents to be read in place of Body,
+	// for objects larger than Storage.StreamThreshold. Such objects are never
+	// cached and must be closed with Close once no longer needed.
+	Stream io.ReadCloser
+}
+
+// Close closes o.Stream, if any.
+func (o *Object) Close() error {
+	if o.Stream == nil {
+		return nil
+	}
+	return o.Stream.Close()
 }
 
 // Redirect returns o's redirect URL, zero string otherwise.
@@ -54,3 +79,45 @@ func (o *Object) RedirectCode() int {
 	}
 	return c
 }
+
+// ETagMatch reports whether o's entity tag matches any of the comma-separated
+// tags of an If-None-Match header value inm, using the weak comparison.
+// It returns false if o has no entity tag.
+func (o *Object) ETagMatch(inm string) bool {
+	etag := strings.TrimPrefix(o.Meta["etag"], "W/")
+	if etag == "" || inm == "" {
+		return false
+	}
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifiedSince reports whether o has been modified after the time
+// of an If-Modified-Since header value ims, with one second precision.
+// It returns true if either ims or o's last-modified is missing or malformed.
+func (o *Object) ModifiedSince(ims string) bool {
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return true
+	}
+	mod, err := http.ParseTime(o.Meta["last-modified"])
+	if err != nil {
+		return true
+	}
+	return mod.Truncate(time.Second).After(t)
+}
+
+// NotModified reports whether a conditional request with If-None-Match
+// and If-Modified-Since header values inm and ims may be responded with
+// 304 status code. As per RFC 7232, ims is ignored when inm is present.
+func (o *Object) NotModified(inm, ims string) bool {
+	if inm != "" {
+		return o.ETagMatch(inm)
+	}
+	return ims != "" && !o.ModifiedSince(ims)
+}
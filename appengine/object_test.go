@@ -38,3 +38,50 @@ func TestObjectRedirect(t *testing.T) {
 		t.Errorf("o.RedirectCode() = %d; want %d", v, http.StatusMovedPermanently)
 	}
 }
+
+func TestObjectETagMatch(t *testing.T) {
+	tests := []struct {
+		etag, inm string
+		match     bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`"abc"`, `"xyz", "abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `*`, true},
+		{`"abc"`, `"xyz"`, false},
+		{`"abc"`, ``, false},
+		{``, `*`, false},
+	}
+	for _, test := range tests {
+		o := &Object{Meta: map[string]string{"etag": test.etag}}
+		if v := o.ETagMatch(test.inm); v != test.match {
+			t.Errorf("ETagMatch(%q) with etag %q = %v; want %v", test.inm, test.etag, v, test.match)
+		}
+	}
+}
+
+func TestObjectNotModified(t *testing.T) {
+	const mod = "Sat, 02 Jan 2016 03:04:05 GMT"
+	tests := []struct {
+		lastMod, etag, inm, ims string
+		notModified             bool
+	}{
+		{mod, "", "", mod, true},
+		{mod, "", "", "Sat, 02 Jan 2016 03:04:06 GMT", true},
+		{mod, "", "", "Sat, 02 Jan 2016 03:04:04 GMT", false},
+		{mod, "", "", "Saturday, 02-Jan-16 03:04:05 GMT", true}, // RFC 850
+		{mod, "", "", "not a date", false},
+		{"", "", "", mod, false},
+		{mod, "", "", "", false},
+		// If-None-Match takes precedence
+		{mod, `"abc"`, `"xyz"`, mod, false},
+		{mod, `"abc"`, `"abc"`, "Sat, 02 Jan 2016 03:04:04 GMT", true},
+	}
+	for i, test := range tests {
+		o := &Object{Meta: map[string]string{"last-modified": test.lastMod, "etag": test.etag}}
+		if v := o.NotModified(test.inm, test.ims); v != test.notModified {
+			t.Errorf("%d: NotModified(%q, %q) = %v; want %v", i, test.inm, test.ims, v, test.notModified)
+		}
+	}
+}
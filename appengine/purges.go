@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"strings"
+	"sync"
+)
+
+// purges tracks purges of the cache keys of all storages
+// while objects under those keys are being fetched.
+var purges purgeTracker
+
+// purgeTracker records purges of cache keys being fetched, so that a fetch
+// which started before its key was purged does not cache the object it got,
+// possibly the one the purge meant to evict.
+type purgeTracker struct {
+	mu sync.Mutex
+	m  map[string]*keyEpoch // keys of fetches in progress
+}
+
+// keyEpoch is a purgeTracker entry.
+type keyEpoch struct {
+	n int // fetches in progress, guarded by purgeTracker.mu
+
+	mu  sync.Mutex
+	gen uint64 // purges of the key since the first fetch started
+}
+
+// fetchEpoch is a fetch registered with purgeTracker.start.
+type fetchEpoch struct {
+	t   *purgeTracker
+	key string
+	e   *keyEpoch
+	gen uint64 // e.gen at the start of the fetch
+}
+
+// start registers a fetch of an object cached under key.
+// The returned fetch must be ended with done.
+func (t *purgeTracker) start(key string) *fetchEpoch {
+	t.mu.Lock()
+	if t.m == nil {
+		t.m = make(map[string]*keyEpoch)
+	}
+	e := t.m[key]
+	if e == nil {
+		e = &keyEpoch{}
+		t.m[key] = e
+	}
+	e.n++
+	t.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return &fetchEpoch{t: t, key: key, e: e, gen: e.gen}
+}
+
+// purge records a purge of key, or of all keys starting with key
+// if prefix is true. It must be called before the cached objects
+// are removed, so that fetches in progress do not cache them again.
+func (t *purgeTracker) purge(key string, prefix bool) {
+	t.mu.Lock()
+	var purged []*keyEpoch
+	for k, e := range t.m {
+		if k == key || prefix && strings.HasPrefix(k, key) {
+			purged = append(purged, e)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, e := range purged {
+		e.mu.Lock()
+		e.gen++
+		e.mu.Unlock()
+	}
+}
+
+// populate calls fn, which caches the fetched object, unless the key
+// has been purged since f started. Purges wait for fn to return.
+func (f *fetchEpoch) populate(fn func()) {
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	if f.e.gen == f.gen {
+		fn()
+	}
+}
+
+// done unregisters f.
+func (f *fetchEpoch) done() {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+	if f.e.n--; f.e.n == 0 {
+		delete(f.t.m, f.key)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+// revalidateTimeout limits revalidation of a stale object,
+// past which the revalidating request is served the stale object.
+const revalidateTimeout = 5 * time.Second
+
+// withAge returns a copy of o with an "age" Meta entry of age in seconds,
+// or o itself if ttl is not positive, i.e. cache entries do not expire.
+func withAge(o *Object, age, ttl time.Duration) *Object {
+	if ttl <= 0 {
+		return o
+	}
+	o2 := *o
+	o2.Meta = make(map[string]string, len(o.Meta)+1)
+	for k, v := range o.Meta {
+		o2.Meta[k] = v
+	}
+	o2.Meta["age"] = strconv.FormatInt(int64(age/time.Second), 10)
+	return &o2
+}
+
+// revalidate refreshes stale object o of s.Cache, unless it is being
+// revalidated already. The request to the storage includes headers h
+// and is conditional on o's etag, if any. It returns the object to serve
+// and true if o was revalidated: o, re-added to the cache as fresh, if not
+// modified, or the fresh object. A missing object is purged, and o is kept
+// on other errors until it expires; in either case, as when another request
+// is revalidating o, it reports false and the caller serves stale o.
+//
+// Revalidation runs within the request of ctx, bounded by revalidateTimeout,
+// since App Engine API calls of a request fail once its response is written.
+// Only the revalidating request waits for the storage: concurrent ones
+// are served o meanwhile.
+func (s *Storage) revalidate(ctx context.Context, bucket, name string, h http.Header, o *Object) (*Object, bool) {
+	key := s.CacheKey(bucket, name)
+	if !s.Cache.startRevalidate(key) {
+		return nil, false
+	}
+	defer s.Cache.doneRevalidate(key)
+	ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+	f := purges.start(key)
+	defer f.done()
+	if etag := o.Meta["etag"]; etag != "" {
+		h2 := http.Header{"If-None-Match": {etag}}
+		for k, v := range h {
+			h2[k] = v
+		}
+		h = h2
+	}
+	fresh, err := s.fetch(ctx, bucket, name, h)
+	if err != nil {
+		errf, _ := err.(*FetchError)
+		switch {
+		case errf != nil && errf.Code == http.StatusNotModified:
+			f.populate(func() { s.Cache.Add(key, o) })
+			return o, true
+		case errf != nil && errf.Code == http.StatusNotFound:
+			s.PurgeCache(ctx, bucket, name)
+		default:
+			log.Warningf(ctx, "revalidate %s: %v", key, err)
+		}
+		return nil, false
+	}
+	if fresh.Stream != nil {
+		// grown past the stream threshold
+		s.PurgeCache(ctx, bucket, name)
+		return fresh, true
+	}
+	f.populate(func() {
+		putCache(ctx, key, fresh)
+		s.Cache.Add(key, fresh)
+	})
+	return fresh, true
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultABCookie is the default value of appConfig.ABCookie.
+	defaultABCookie = "goa_ab"
+	// abCookieMaxAge is how long visitors stay on their ABRedirects variant.
+	abCookieMaxAge = 30 * 24 * time.Hour
+)
+
+// abVariant is an ABRedirects entry, a redirect target of a source path.
+type abVariant struct {
+	// Target is the redirect URL, e.g. "/landing-b/".
+	Target string `json:"target" yaml:"target"`
+	// Weight is the relative share of visitors redirected to Target.
+	// Zero weight variants are never picked, but visitors already on them
+	// stay there.
+	Weight int `json:"weight" yaml:"weight"`
+}
+
+// pickVariant returns the target of a variant of l picked at random,
+// each with a probability proportional to its weight.
+// Weights of l must add up to a positive total.
+func pickVariant(l []abVariant) string {
+	total := 0
+	for _, v := range l {
+		total += v.Weight
+	}
+	n := rand.Intn(total)
+	for _, v := range l {
+		if n < v.Weight {
+			return v.Target
+		}
+		n -= v.Weight
+	}
+	// unreachable with a positive total
+	return l[len(l)-1].Target
+}
+
+// serveABRedirect responds with a temporary redirect if the path of r
+// is a key of the current config ABRedirects, to the variant the visitor
+// was assigned to by a previous response, or one picked by pickVariant.
+// The assignment is remembered in a cookie of ABCookie name, scoped to
+// the source path, for abCookieMaxAge. The request query is kept.
+// It returns false if no response was written.
+func serveABRedirect(w http.ResponseWriter, r *http.Request) bool {
+	c := currentConfig()
+	variants, ok := c.ABRedirects[r.URL.Path]
+	if !ok {
+		return false
+	}
+	name := c.ABCookie
+	if name == "" {
+		name = defaultABCookie
+	}
+	to := ""
+	if ck, err := r.Cookie(name); err == nil {
+		v, _ := url.QueryUnescape(ck.Value)
+		for _, av := range variants {
+			if av.Target == v {
+				to = v
+				break
+			}
+		}
+	}
+	if to == "" {
+		to = pickVariant(variants)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(to),
+		Path:     r.URL.Path,
+		MaxAge:   int(abCookieMaxAge / time.Second),
+		HttpOnly: true,
+	})
+	// the response differs per visitor
+	w.Header().Set("cache-control", "no-store")
+	redirect{To: to, Code: http.StatusFound}.serveTo(w, r, to)
+	return true
+}
+
+// validateABRedirects reports an error if a c.ABRedirects key is not
+// a path or is redirected otherwise, or its variants have empty targets,
+// negative weights or no positive weight at all.
+func (c *appConfig) validateABRedirects() error {
+	for p, l := range c.ABRedirects {
+		switch {
+		case !strings.HasPrefix(p, "/"):
+			return fmt.Errorf(`ab_redirects[%q]: must start with "/"`, p)
+		case p == "/" && c.RootRedirect != nil:
+			return fmt.Errorf("ab_redirects[%q]: conflicts with root_redirect", p)
+		}
+		if _, ok := c.Redirects[p]; ok {
+			return fmt.Errorf("ab_redirects[%q]: conflicts with redirects[%q]", p, p)
+		}
+		if _, ok := c.LangRedirect[p]; ok {
+			return fmt.Errorf("ab_redirects[%q]: conflicts with lang_redirect[%q]", p, p)
+		}
+		total := 0
+		for i, v := range l {
+			if v.Target == "" {
+				return fmt.Errorf("ab_redirects[%q][%d].target: must not be empty", p, i)
+			}
+			if v.Weight < 0 {
+				return fmt.Errorf("ab_redirects[%q][%d].weight: %d must not be negative", p, i, v.Weight)
+			}
+			total += v.Weight
+		}
+		if total == 0 {
+			return fmt.Errorf("ab_redirects[%q]: must have a variant of positive weight", p)
+		}
+	}
+	if c.ABCookie != "" && !validCookieName(c.ABCookie) {
+		return fmt.Errorf("ab_cookie: %q is not a cookie name", c.ABCookie)
+	}
+	return nil
+}
+
+// validCookieName reports whether name is a non-empty RFC 6265 token.
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServe_ABRedirects(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.ABRedirects = map[string][]abVariant{"/landing": {
+			{Target: "/landing-a/", Weight: 3},
+			{Target: "/landing-b/", Weight: 1},
+			{Target: "/landing-old/", Weight: 0},
+		}}
+	})()
+
+	const n = 4000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		req, _ := testInstance.NewRequest("GET", "/landing", nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusFound {
+			t.Fatalf("res.Code = %d; want %d", res.Code, http.StatusFound)
+		}
+		loc := res.Header().Get("location")
+		counts[loc]++
+		cookies := (&http.Response{Header: res.Header()}).Cookies()
+		if len(cookies) != 1 || cookies[0].Name != defaultABCookie || cookies[0].Path != "/landing" {
+			t.Fatalf("cookies = %v; want %s scoped to /landing", cookies, defaultABCookie)
+		}
+	}
+	// 3:1 split, with a generous margin
+	if a := counts["/landing-a/"]; a < n*70/100 || a > n*80/100 {
+		t.Errorf("landing-a: %d of %d redirects; want about 75%%", a, n)
+	}
+	if b := counts["/landing-b/"]; b < n*20/100 || b > n*30/100 {
+		t.Errorf("landing-b: %d of %d redirects; want about 25%%", b, n)
+	}
+	if v := counts["/landing-old/"]; v != 0 {
+		t.Errorf("landing-old: %d redirects; want 0", v)
+	}
+}
+
+func TestServe_ABRedirectsSticky(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.ABRedirects = map[string][]abVariant{"/landing": {
+			{Target: "/landing-a/", Weight: 1},
+			{Target: "/landing-b/?v=b", Weight: 1},
+			{Target: "/landing-old/", Weight: 0},
+		}}
+		c.ABCookie = "variant"
+	})()
+
+	tests := []struct {
+		url, cookie, location string
+	}{
+		{"/landing", "%2Flanding-b%2F%3Fv%3Db", "/landing-b/?v=b"},
+		{"/landing?ref=ad", "%2Flanding-a%2F", "/landing-a/?ref=ad"},
+		// removed from the split, but still served to its visitors
+		{"/landing", "%2Flanding-old%2F", "/landing-old/"},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			req, _ := testInstance.NewRequest("GET", test.url, nil)
+			req.AddCookie(&http.Cookie{Name: "variant", Value: test.cookie})
+			res := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(res, req)
+			if v := res.Header().Get("location"); v != test.location {
+				t.Fatalf("%s %s: location = %q; want %q", test.url, test.cookie, v, test.location)
+			}
+			if v := res.Header().Get("cache-control"); v != "no-store" {
+				t.Errorf("%s: cache-control = %q; want no-store", test.url, v)
+			}
+		}
+	}
+
+	// unknown variants are replaced
+	req, _ := testInstance.NewRequest("GET", "/landing", nil)
+	req.AddCookie(&http.Cookie{Name: "variant", Value: "%2Fgone%2F"})
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if v := res.Header().Get("location"); v != "/landing-a/" && v != "/landing-b/?v=b" {
+		t.Errorf("unknown variant: location = %q; want a weighted variant", v)
+	}
+}
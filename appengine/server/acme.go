@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goadesign/goa.design/appengine"
+
+	"google.golang.org/appengine/log"
+)
+
+// acmePath is the path prefix of ACME HTTP-01 challenge responses.
+// Requests under it bypass CanonicalHost, ForceHTTPS, Redirects, Rewrites,
+// BasicAuth, maintenance mode and the SPA and NotFound fallbacks.
+const acmePath = "/.well-known/acme-challenge/"
+
+var (
+	acmeMu         sync.RWMutex
+	acmeChallenges = make(map[string]string)
+)
+
+// SetACMEChallenge makes the server respond to HTTP-01 challenge requests
+// for token with key authorization keyAuth, e.g. from a cert automation
+// client running within the app. An empty keyAuth removes the token.
+// The in-memory tokens take precedence over objects of ACMEBucket.
+func SetACMEChallenge(token, keyAuth string) {
+	acmeMu.Lock()
+	if keyAuth == "" {
+		delete(acmeChallenges, token)
+	} else {
+		acmeChallenges[token] = keyAuth
+	}
+	acmeMu.Unlock()
+}
+
+// serveACME responds to ACME HTTP-01 challenge requests under acmePath
+// with the key authorization of the token set with SetACMEChallenge or,
+// failing that, with the object of the same path in the current config
+// ACMEBucket, or the bucket the request maps to if it is not set.
+// Tokens containing "/" and missing objects get a plain 404.
+func serveACME(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("allow", "GET, HEAD")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, acmePath)
+	if token == "" || strings.Contains(token, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	acmeMu.RLock()
+	keyAuth, ok := acmeChallenges[token]
+	acmeMu.RUnlock()
+	if ok {
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("cache-control", "no-store")
+		w.Header().Set("content-length", strconv.Itoa(len(keyAuth)))
+		if r.Method == "GET" {
+			w.Write([]byte(keyAuth))
+		}
+		return
+	}
+
+	bucket := currentConfig().ACMEBucket
+	if bucket == "" {
+		bucket = resolveBucket(r.Host, r.URL.Path)
+	}
+	ctx := newContext(r)
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	o, err := storageFrom(ctx).ReadObject(ctx, bucket, name)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errf, ok := err.(*weasel.FetchError); ok {
+			code = errf.Code
+		}
+		if weasel.IsTransient(err) {
+			code = http.StatusServiceUnavailable
+		}
+		if code != http.StatusNotFound {
+			log.Errorf(ctx, "%s/%s: %v", bucket, name, err)
+		}
+		serveError(w, code, "")
+		return
+	}
+	o = cloneObject(o)
+	o.Meta["cache-control"] = "no-store"
+	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s/%s: %v", bucket, name, err)
+	}
+}
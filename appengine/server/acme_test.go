@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_ACME(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/acme/.well-known/acme-challenge/bucket-token", "/bucket/.well-known/acme-challenge/default-token":
+			w.Write([]byte(r.URL.Path))
+		case "/bucket/index.html":
+			w.Header().Set("content-type", "text/html")
+			w.Write([]byte("spa"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	SetACMEChallenge("mem-token", "mem-token.thumbprint")
+	defer SetACMEChallenge("mem-token", "")
+
+	tests := []struct {
+		acmeBucket string
+		path       string
+		code       int
+		body       string
+	}{
+		{"", "/.well-known/acme-challenge/mem-token", http.StatusOK, "mem-token.thumbprint"},
+		{"acme", "/.well-known/acme-challenge/mem-token", http.StatusOK, "mem-token.thumbprint"},
+		{"acme", "/.well-known/acme-challenge/bucket-token", http.StatusOK, "/acme/.well-known/acme-challenge/bucket-token"},
+		{"", "/.well-known/acme-challenge/default-token", http.StatusOK, "/bucket/.well-known/acme-challenge/default-token"},
+		// no SPA fallback
+		{"acme", "/.well-known/acme-challenge/missing", http.StatusNotFound, "Not Found"},
+		{"", "/.well-known/acme-challenge/a/b", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.ACMEBucket = test.acmeBucket
+			c.CanonicalHost = canonicalHost{"*": "goa.design"}
+			c.ForceHTTPS = true
+			c.SPAFallback = true
+			c.Redirects = map[string]redirect{"/.well-known/": {To: "https://example.com"}}
+			c.redirectPrefixes = c.buildRedirects()
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = "www.goa.design"
+		req.Header.Set("x-forwarded-proto", "http")
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != test.code {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.path, test.acmeBucket, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != "" {
+			t.Errorf("%s %q: location = %q; want none", test.path, test.acmeBucket, v)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s %q: res.Body = %q; want %q", test.path, test.acmeBucket, v, test.body)
+		}
+	}
+}
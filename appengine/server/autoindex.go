@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// autoIndexTemplate renders a directory listing.
+var autoIndexTemplate = template.Must(template.New("autoindex").Funcs(template.FuncMap{
+	"base": entryBase,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Dir}}</title></head>
+<body>
+<h1>Index of {{.Dir}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last modified</th></tr>
+{{if ne .Dir "/"}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="/{{.Name}}">{{base .Name}}</a></td>{{if .Dir}}<td>-</td><td></td>{{else}}<td>{{.Size}}</td><td>{{.Updated.UTC.Format "2006-01-02 15:04:05 MST"}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// entryBase returns the last element of an object name or prefix,
+// keeping the trailing slash of prefixes.
+func entryBase(name string) string {
+	if strings.HasSuffix(name, "/") {
+		return path.Base(name) + "/"
+	}
+	return path.Base(name)
+}
+
+// serveAutoIndex responds with an HTML listing of the bucket objects
+// under oname "directory", if AutoIndex is enabled and oname is a directory-like
+// name, with a trailing slash or no file extension.
+// It reports whether the response has been written; directories with no
+// objects are not listed.
+func serveAutoIndex(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, oname string) bool {
+	if !currentConfig().AutoIndex {
+		return false
+	}
+	if !strings.HasSuffix(oname, "/") && path.Ext(oname) != "" {
+		return false
+	}
+	prefix := strings.TrimSuffix(oname, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	list, err := storageFrom(ctx).List(ctx, bucket, prefix)
+	if err != nil {
+		log.Errorf(ctx, "storage.List(%q, %q): %v", bucket, prefix, err)
+		return false
+	}
+	if len(list) == 0 {
+		return false
+	}
+
+	dir := "/" + prefix
+	data := struct {
+		Dir, Parent string
+		Entries     []*weasel.ListEntry
+	}{dir, path.Dir(strings.TrimSuffix(dir, "/")), list}
+	if data.Parent != "/" {
+		data.Parent += "/"
+	}
+	var buf bytes.Buffer
+	if err := autoIndexTemplate.Execute(&buf, data); err != nil {
+		log.Errorf(ctx, "autoIndexTemplate.Execute: %v", err)
+		return false
+	}
+	o := &weasel.Object{
+		Meta: map[string]string{"content-type": "text/html; charset=utf-8"},
+		Body: buf.Bytes(),
+	}
+	o = applyHeaders(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+	}
+	return true
+}
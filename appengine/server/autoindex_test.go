@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_AutoIndex(t *testing.T) {
+	const listing = `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://doc.s3.amazonaws.com/2006-03-01">
+  <IsTruncated>false</IsTruncated>
+  <Contents><Key>docs/guide.html</Key><Size>1234</Size><LastModified>2016-01-02T03:04:05.000Z</LastModified></Contents>
+  <CommonPrefixes><Prefix>docs/api/</Prefix></CommonPrefixes>
+</ListBucketResult>`
+	var lists int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/idx-bucket" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lists++
+		if r.URL.Query().Get("prefix") != "docs/" {
+			w.Write([]byte(`<ListBucketResult></ListBucketResult>`))
+			return
+		}
+		w.Write([]byte(listing))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		autoIndex bool
+		host      string
+		path      string
+		code      int
+		lists     int
+	}{
+		{true, "docs.example.com", "/docs/", http.StatusOK, 1},
+		{true, "docs.example.com", "/docs", http.StatusOK, 1},
+		{true, "docs.example.com", "/empty/", http.StatusNotFound, 1},
+		{true, "docs.example.com", "/docs/missing.txt", http.StatusNotFound, 0},
+		{true, "www.example.com", "/docs/", http.StatusNotFound, 0},
+		{false, "docs.example.com", "/docs/", http.StatusNotFound, 0},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.AutoIndex = test.autoIndex
+			c.Buckets = map[string]bucketList{"default": {"other-bucket"}, "docs.example.com": {"idx-bucket"}}
+		})
+		lists = 0
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != test.code {
+			t.Errorf("%v %s%s: res.Code = %d; want %d", test.autoIndex, test.host, test.path, res.Code, test.code)
+		}
+		if lists != test.lists {
+			t.Errorf("%v %s%s: lists = %d; want %d", test.autoIndex, test.host, test.path, lists, test.lists)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if v := res.Header().Get("content-type"); v != "text/html; charset=utf-8" {
+			t.Errorf("%s: content-type = %q", test.path, v)
+		}
+		body := res.Body.String()
+		for _, s := range []string{
+			`<a href="/">../</a>`,
+			`<a href="/docs/guide.html">guide.html</a></td><td>1234</td><td>2016-01-02 03:04:05 UTC</td>`,
+			`<a href="/docs/api/">api/</a></td><td>-</td>`,
+		} {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: body does not contain %q:\n%s", test.path, s, body)
+			}
+		}
+	}
+}
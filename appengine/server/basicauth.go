@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultBasicAuthRealm is the default value of basicAuthRule.Realm.
+const defaultBasicAuthRealm = "Restricted"
+
+// basicAuthRule is an entry of appConfig.BasicAuth.
+type basicAuthRule struct {
+	// Prefix is the protected request path prefix, e.g. "/preview/".
+	// A trailing "*" is ignored, so "/preview/*" is the same.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Realm defaults to defaultBasicAuthRealm.
+	Realm string `json:"realm" yaml:"realm"`
+	// Users maps user names to bcrypt password hashes.
+	Users map[string]string `json:"users" yaml:"users"`
+}
+
+// validate reports an error if r has no users or their hashes are not bcrypt hashes.
+func (r *basicAuthRule) validate() error {
+	if !strings.HasPrefix(r.Prefix, "/") {
+		return fmt.Errorf("prefix %q must start with \"/\"", r.Prefix)
+	}
+	if len(r.Users) == 0 {
+		return fmt.Errorf("users: must not be empty")
+	}
+	for name, hash := range r.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("users[%q]: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// authorized reports whether the user credentials match one of r.Users.
+// User names are compared in constant time.
+func (r *basicAuthRule) authorized(name, password string) bool {
+	var hash string
+	for n, h := range r.Users {
+		if subtle.ConstantTimeCompare([]byte(n), []byte(name)) == 1 {
+			hash = h
+		}
+	}
+	if hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// findBasicAuth returns the current config BasicAuth rule
+// with the longest prefix matching path p, or nil if none matches.
+// Prefixes match case-insensitively if fold is true.
+func findBasicAuth(p string, fold bool) *basicAuthRule {
+	var best *basicAuthRule
+	rules := currentConfig().BasicAuth
+	if fold {
+		p = strings.ToLower(p)
+	}
+	for i := range rules {
+		prefix := strings.TrimSuffix(rules[i].Prefix, "*")
+		if fold {
+			prefix = strings.ToLower(prefix)
+		}
+		if strings.HasPrefix(p, prefix) && (best == nil || len(prefix) > len(strings.TrimSuffix(best.Prefix, "*"))) {
+			best = &rules[i]
+		}
+	}
+	return best
+}
+
+// foldsCase reports whether any bucket serving r has a Lowercase KeyTransform,
+// in which case paths differing in case only map to the same objects.
+func foldsCase(r *http.Request) bool {
+	c := currentConfig()
+	if len(c.KeyTransform) == 0 {
+		return false
+	}
+	for _, b := range overrideBuckets(r) {
+		if c.KeyTransform[b].Lowercase {
+			return true
+		}
+	}
+	return false
+}
+
+// basicAuth wraps h with HTTP basic authentication of requests
+// to paths protected by the current config BasicAuth rules.
+// Requests with missing or invalid credentials are challenged with 401 status code.
+// Rules match regardless of path case for buckets lowercasing object names,
+// so that changing the case of a path cannot bypass them.
+func basicAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := findBasicAuth(r.URL.Path, foldsCase(r))
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if name, password, ok := r.BasicAuth(); ok && rule.authorized(name, password) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		realm := rule.Realm
+		if realm == "" {
+			realm = defaultBasicAuthRealm
+		}
+		w.Header().Set("www-authenticate", "Basic realm="+strconv.Quote(realm)+`, charset="UTF-8"`)
+		serveError(w, http.StatusUnauthorized, "")
+	})
+}
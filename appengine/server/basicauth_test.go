@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestServe_BasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminHash, err := bcrypt.GenerateFromPassword([]byte("admin-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.BasicAuth = []basicAuthRule{
+			{Prefix: "/preview/*", Realm: "Staging", Users: map[string]string{
+				"alice": string(hash),
+				"admin": string(adminHash),
+			}},
+			{Prefix: "/preview/admin/", Users: map[string]string{"admin": string(adminHash)}},
+		}
+	})()
+
+	tests := []struct {
+		path, user, password string
+		code                 int
+		realm                string
+	}{
+		{"/index.html", "", "", http.StatusOK, ""},
+		{"/previews.html", "", "", http.StatusOK, ""},
+		{"/preview/page.html", "", "", http.StatusUnauthorized, "Staging"},
+		{"/preview/page.html", "alice", "wrong", http.StatusUnauthorized, "Staging"},
+		{"/preview/page.html", "bob", "secret", http.StatusUnauthorized, "Staging"},
+		{"/preview/page.html", "alice", "secret", http.StatusOK, ""},
+		{"/preview/admin/page.html", "alice", "secret", http.StatusUnauthorized, defaultBasicAuthRealm},
+		{"/preview/admin/page.html", "admin", "admin-secret", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s %s: res.Code = %d; want %d", test.path, test.user, res.Code, test.code)
+		}
+		want := ""
+		if test.realm != "" {
+			want = `Basic realm="` + test.realm + `", charset="UTF-8"`
+		}
+		if v := res.Header().Get("www-authenticate"); v != want {
+			t.Errorf("%s %s: www-authenticate = %q; want %q", test.path, test.user, v, want)
+		}
+	}
+}
+
+func TestServe_BasicAuthLowercase(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.KeyTransform = map[string]keyTransform{"bucket": {Lowercase: true}}
+		c.BasicAuth = []basicAuthRule{
+			{Prefix: "/preview/", Users: map[string]string{"alice": string(hash)}},
+		}
+	})()
+
+	for _, p := range []string{"/preview/secret.html", "/PREVIEW/secret.html", "/Preview/secret.html"} {
+		req, _ := testInstance.NewRequest("GET", p, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("%s: res.Code = %d; want %d", p, res.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// limitBody reports whether the body of r is within the current config
+// MaxRequestBody, responding with 413 status code otherwise. Bodies of
+// unknown length are wrapped in http.MaxBytesReader, so that reads past
+// the limit fail. If buffer is true, such a body is read into memory
+// right away, up to the limit, so that it is rejected with 413 as well.
+func limitBody(w http.ResponseWriter, r *http.Request, buffer bool) bool {
+	max := currentConfig().MaxRequestBody
+	if max <= 0 {
+		return true
+	}
+	if r.ContentLength > max {
+		serveError(w, http.StatusRequestEntityTooLarge, "")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	if !buffer || r.ContentLength >= 0 {
+		return true
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		serveError(w, http.StatusRequestEntityTooLarge, "")
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return true
+}
+
+// validateMaxRequestBody reports an error if c.MaxRequestBody is negative.
+func (c *appConfig) validateMaxRequestBody() error {
+	if c.MaxRequestBody < 0 {
+		return fmt.Errorf("max_request_body: %d must not be negative", c.MaxRequestBody)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServe_HookMaxRequestBody(t *testing.T) {
+	defer withConfig(func(c *appConfig) { c.MaxRequestBody = 64 })()
+
+	small := `{"bucket": "dummy", "name": "path/obj"}`
+	large := `{"bucket": "dummy", "name": "` + strings.Repeat("x", 64) + `"}`
+	tests := []struct {
+		body    string
+		chunked bool
+		code    int
+	}{
+		{small, false, http.StatusOK},
+		{small, true, http.StatusOK},
+		{large, false, http.StatusRequestEntityTooLarge},
+		{large, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(test.body))
+		req.Header.Set("x-goog-resource-state", "exists")
+		if test.chunked {
+			// the length of a chunked body is unknown until read
+			req.ContentLength = -1
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%d bytes, chunked = %v: res.Code = %d; want %d", len(test.body), test.chunked, res.Code, test.code)
+		}
+	}
+}
+
+func TestServe_ProxyMaxRequestBody(t *testing.T) {
+	var calls int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		ioutil.ReadAll(r.Body)
+	}))
+	defer up.Close()
+	defer withConfig(func(c *appConfig) {
+		c.Proxies = map[string]string{"/api/": up.URL}
+		c.MaxRequestBody = 8
+	})()
+
+	req, _ := testInstance.NewRequest("POST", "/api/upload", strings.NewReader("more than 8 bytes"))
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusRequestEntityTooLarge)
+	}
+	if calls != 0 {
+		t.Errorf("upstream calls = %d; want 0", calls)
+	}
+
+	req, _ = testInstance.NewRequest("POST", "/api/upload", strings.NewReader("8 bytes!"))
+	res = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusOK)
+	}
+	if calls != 1 {
+		t.Errorf("upstream calls = %d; want 1", calls)
+	}
+}
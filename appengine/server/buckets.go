@@ -0,0 +1,288 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	stdlog "log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// bucketList is an ordered list of buckets objects are looked up in.
+// The first bucket is the primary one.
+type bucketList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts either a single bucket or a list, see bucketRefs.
+// Base URLs of the buckets are decoded by decodeBucketBases.
+func (l *bucketList) UnmarshalJSON(b []byte) error {
+	var refs bucketRefs
+	if err := json.Unmarshal(b, &refs); err != nil {
+		return err
+	}
+	*l = refs.names()
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// It accepts either a single bucket or a sequence, see bucketRefs.
+func (l *bucketList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var refs bucketRefs
+	if err := unmarshal(&refs); err != nil {
+		return err
+	}
+	*l = refs.names()
+	return nil
+}
+
+// bucketRef is a bucket list entry: either a bucket name or an object
+// with the bucket name and the GCS base URL it is served from,
+// e.g. {"bucket": "assets", "base": "https://cdn.example.com"}.
+type bucketRef struct {
+	Bucket string `json:"bucket" yaml:"bucket"`
+	Base   string `json:"base" yaml:"base"`
+}
+
+// plainBucketRef is bucketRef with default decoding.
+type plainBucketRef bucketRef
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *bucketRef) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*r = bucketRef{}
+		return json.Unmarshal(b, &r.Bucket)
+	}
+	return json.Unmarshal(b, (*plainBucketRef)(r))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *bucketRef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*r = bucketRef{Bucket: name}
+		return nil
+	}
+	return unmarshal((*plainBucketRef)(r))
+}
+
+// bucketRefs is a bucketList along with base URLs of its buckets.
+type bucketRefs []bucketRef
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts either a single bucketRef or a list.
+func (l *bucketRefs) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '[' {
+		var r bucketRef
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		*l = bucketRefs{r}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]bucketRef)(l))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// It accepts either a single bucketRef or a sequence.
+func (l *bucketRefs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var r bucketRef
+	if err := unmarshal(&r); err == nil {
+		*l = bucketRefs{r}
+		return nil
+	}
+	return unmarshal((*[]bucketRef)(l))
+}
+
+// names returns bucket names of l.
+func (l bucketRefs) names() bucketList {
+	list := make(bucketList, len(l))
+	for i, r := range l {
+		list[i] = r.Bucket
+	}
+	return list
+}
+
+// decodeBucketBases decodes config file name contents b, see decodeConfig,
+// and returns base URLs of Buckets and BucketPaths entries keyed by bucket
+// name, with no trailing "/". A base applies to the bucket wherever it is
+// listed. It reports an error if a base is not an absolute http(s) URL
+// or a bucket is listed with different bases.
+func decodeBucketBases(name string, b []byte) (map[string]string, error) {
+	var c struct {
+		Buckets     map[string]bucketRefs `json:"buckets" yaml:"buckets"`
+		BucketPaths map[string]bucketRefs `json:"bucket_paths" yaml:"bucket_paths"`
+	}
+	if err := decodeConfig(name, b, &c); err != nil {
+		return nil, err
+	}
+	bases := make(map[string]string)
+	for _, m := range []struct {
+		field string
+		refs  map[string]bucketRefs
+	}{{"buckets", c.Buckets}, {"bucket_paths", c.BucketPaths}} {
+		keys := make([]string, 0, len(m.refs))
+		for k := range m.refs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, r := range m.refs[k] {
+				if r.Base == "" {
+					continue
+				}
+				u, err := url.Parse(r.Base)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return nil, fmt.Errorf(`%s[%q]: base %q is not an absolute http(s) URL`, m.field, k, r.Base)
+				}
+				base := strings.TrimSuffix(r.Base, "/")
+				if v, ok := bases[r.Bucket]; ok && v != base {
+					return nil, fmt.Errorf(`%s[%q]: base %q of bucket %q conflicts with %q`, m.field, k, base, r.Bucket, v)
+				}
+				bases[r.Bucket] = base
+			}
+		}
+	}
+	return bases, nil
+}
+
+// primary returns the first bucket of l or an empty string if l is empty.
+func (l bucketList) primary() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0]
+}
+
+// contains reports whether bucket is one of l.
+func (l bucketList) contains(bucket string) bool {
+	for _, b := range l {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// readChain reads oname from the first of buckets containing the object,
+// and returns the bucket name along with the object.
+// Only 404 errors fall through to the next bucket; other errors are returned
+// right away with the failed bucket name. If all buckets miss, the primary bucket
+// name is returned along with the 404 error.
+func readChain(ctx context.Context, buckets bucketList, oname string) (string, *weasel.Object, error) {
+	var notFound error
+	for _, b := range buckets {
+		o, err := readDir(ctx, b, oname)
+		if err == nil {
+			return b, o, nil
+		}
+		if errf, ok := err.(*weasel.FetchError); !ok || errf.Code != http.StatusNotFound {
+			return b, nil, err
+		}
+		notFound = err
+	}
+	return buckets.primary(), nil, notFound
+}
+
+// keyTransform is a KeyTransform config map value.
+type keyTransform struct {
+	Prefix    string `json:"prefix" yaml:"prefix"`       // prepended to object names
+	Lowercase bool   `json:"lowercase" yaml:"lowercase"` // lowercase names first
+}
+
+// keyTransforms returns c.KeyTransform as weasel.Storage.KeyTransforms,
+// or nil if it is empty.
+func (c *appConfig) keyTransforms() map[string]weasel.KeyTransform {
+	if len(c.KeyTransform) == 0 {
+		return nil
+	}
+	m := make(map[string]weasel.KeyTransform, len(c.KeyTransform))
+	for b, t := range c.KeyTransform {
+		m[b] = weasel.KeyTransform{Prefix: t.Prefix, Lowercase: t.Lowercase}
+	}
+	return m
+}
+
+// validateKeyTransform reports an error if a c.KeyTransform key
+// is not one of c distinct buckets or its prefix starts with "/".
+func (c *appConfig) validateKeyTransform() error {
+	buckets := c.distinctBuckets()
+	for b, t := range c.KeyTransform {
+		if i := sort.SearchStrings(buckets, b); i == len(buckets) || buckets[i] != b {
+			return fmt.Errorf("key_transform[%q]: not a bucket of buckets or bucket_paths", b)
+		}
+		if strings.HasPrefix(t.Prefix, "/") {
+			return fmt.Errorf(`key_transform[%q].prefix: %q must not start with "/"`, b, t.Prefix)
+		}
+	}
+	return nil
+}
+
+// distinctBuckets returns all buckets of c Buckets and BucketPaths,
+// those of Sites included, sorted.
+func (c *appConfig) distinctBuckets() []string {
+	seen := make(map[string]bool)
+	var list []string
+	maps := []map[string]bucketList{c.Buckets, c.BucketPaths}
+	for _, sc := range c.Sites {
+		if sc != nil {
+			maps = append(maps, sc.Buckets, sc.BucketPaths)
+		}
+	}
+	for _, m := range maps {
+		for _, l := range m {
+			for _, b := range l {
+				if !seen[b] {
+					seen[b] = true
+					list = append(list, b)
+				}
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// checkBuckets checks whether each of c distinct buckets is reachable
+// with storage.StatBucket, logging a warning for those which are not.
+// It returns an error naming the buckets which do not exist or are not
+// accessible to the app, as opposed to other, e.g. transient, failures.
+func checkBuckets(ctx context.Context, c *appConfig) error {
+	var bad []string
+	for _, b := range c.distinctBuckets() {
+		err := storage.StatBucket(ctx, b)
+		if err == nil {
+			continue
+		}
+		errf, ok := err.(*weasel.FetchError)
+		if ok && (errf.Code == http.StatusNotFound || errf.Code == http.StatusForbidden) {
+			bad = append(bad, b)
+			stdlog.Printf("warning: bucket %q is not reachable: %v", b, err)
+		} else {
+			stdlog.Printf("warning: bucket %q could not be checked: %v", b, err)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("check_buckets: unreachable buckets: %s", strings.Join(bad, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+)
+
+// bucketStatBackend is a weasel.Backend stat-ing buckets with errors
+// keyed by bucket name. It has no objects.
+type bucketStatBackend struct {
+	weasel.MemBackend
+	errs map[string]error
+}
+
+func (b *bucketStatBackend) Stat(ctx context.Context, bucket, name string) (map[string]string, error) {
+	if err := b.errs[bucket]; err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+func TestDecodeBucketBases(t *testing.T) {
+	const (
+		jsonConf = `{
+			"buckets": {
+				"default": "site",
+				"cdn.example.com": {"bucket": "assets", "base": "https://cdn.example.com/"},
+				"example.com": ["site", {"bucket": "legacy", "base": "http://legacy.example.com"}]
+			},
+			"bucket_paths": {"example.com/static/": [{"bucket": "assets"}]}
+		}`
+		yamlConf = `
+buckets:
+  default: site
+  cdn.example.com: {bucket: assets, base: "https://cdn.example.com/"}
+  example.com:
+    - site
+    - bucket: legacy
+      base: http://legacy.example.com
+bucket_paths:
+  example.com/static/: [{bucket: assets}]
+`
+	)
+	wantBuckets := map[string]bucketList{
+		"default":         {"site"},
+		"cdn.example.com": {"assets"},
+		"example.com":     {"site", "legacy"},
+	}
+	wantBases := map[string]string{
+		"assets": "https://cdn.example.com",
+		"legacy": "http://legacy.example.com",
+	}
+	for _, name := range []string{"config.json", "config.yaml"} {
+		data := jsonConf
+		if name == "config.yaml" {
+			data = yamlConf
+		}
+		var c appConfig
+		if err := decodeConfig(name, []byte(data), &c); err != nil {
+			t.Errorf("%s: decodeConfig: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Buckets, wantBuckets) {
+			t.Errorf("%s: c.Buckets = %v; want %v", name, c.Buckets, wantBuckets)
+		}
+		if v := c.BucketPaths["example.com/static/"]; !reflect.DeepEqual(v, bucketList{"assets"}) {
+			t.Errorf("%s: c.BucketPaths = %v; want [assets]", name, c.BucketPaths)
+		}
+		bases, err := decodeBucketBases(name, []byte(data))
+		if err != nil {
+			t.Errorf("%s: decodeBucketBases: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(bases, wantBases) {
+			t.Errorf("%s: bases = %v; want %v", name, bases, wantBases)
+		}
+	}
+
+	tests := []struct{ data, err string }{
+		{`{"buckets": {"default": {"bucket": "b", "base": "cdn.example.com"}}}`,
+			`buckets["default"]: base "cdn.example.com" is not an absolute http(s) URL`},
+		{`{"buckets": {"default": {"bucket": "b", "base": "ftp://cdn.example.com"}}}`,
+			`buckets["default"]: base "ftp://cdn.example.com" is not an absolute http(s) URL`},
+		{`{"buckets": {"a": {"bucket": "b", "base": "https://a.example.com"}},
+		  "bucket_paths": {"a/x/": {"bucket": "b", "base": "https://x.example.com"}}}`,
+			`bucket_paths["a/x/"]: base "https://x.example.com" of bucket "b" conflicts with "https://a.example.com"`},
+	}
+	for _, test := range tests {
+		_, err := decodeBucketBases("config.json", []byte(test.data))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("decodeBucketBases(%s) = %v; want %q", test.data, err, test.err)
+		}
+	}
+}
+
+func TestDistinctBuckets(t *testing.T) {
+	c := &appConfig{
+		Buckets:     map[string]bucketList{"default": {"b", "a"}, "host": {"c"}},
+		BucketPaths: map[string]bucketList{"host/assets/": {"a", "d"}},
+	}
+	want := []string{"a", "b", "c", "d"}
+	if v := c.distinctBuckets(); !reflect.DeepEqual(v, want) {
+		t.Errorf("distinctBuckets() = %v; want %v", v, want)
+	}
+}
+
+func TestCheckBuckets(t *testing.T) {
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = &bucketStatBackend{errs: map[string]error{
+		"typo":      &weasel.FetchError{Msg: "404 Not Found", Code: http.StatusNotFound},
+		"no-access": &weasel.FetchError{Msg: "403 Forbidden", Code: http.StatusForbidden},
+		"flaky":     &weasel.FetchError{Msg: "503 Service Unavailable", Code: http.StatusServiceUnavailable},
+		"offline":   errors.New("dial tcp: i/o timeout"),
+	}}
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+
+	tests := []struct {
+		buckets map[string]bucketList
+		err     string
+	}{
+		{map[string]bucketList{"default": {"ok"}, "host": {"ok", "other"}}, ""},
+		{map[string]bucketList{"default": {"ok"}, "host": {"flaky"}, "down": {"offline"}}, ""},
+		{map[string]bucketList{"default": {"ok"}, "host": {"typo", "flaky"}, "private": {"no-access"}},
+			"check_buckets: unreachable buckets: no-access, typo"},
+	}
+	for i, test := range tests {
+		err := checkBuckets(ctx, &appConfig{Buckets: test.buckets})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%d: checkBuckets: %v; want %q", i, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// canonicalHost maps request hosts to their canonical hosts.
+// The "*" key applies to hosts with no explicit mapping.
+type canonicalHost map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts either a single canonical host for all requests or a mapping.
+func (ch *canonicalHost) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var host string
+		if err := json.Unmarshal(b, &host); err != nil {
+			return err
+		}
+		*ch = canonicalHost{"*": host}
+		return nil
+	}
+	return json.Unmarshal(b, (*map[string]string)(ch))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// It accepts either a single canonical host for all requests or a mapping.
+func (ch *canonicalHost) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var host string
+	if err := unmarshal(&host); err == nil {
+		*ch = canonicalHost{"*": host}
+		return nil
+	}
+	return unmarshal((*map[string]string)(ch))
+}
+
+// lookup returns the canonical host of host, or host itself if none is configured.
+// Ports are ignored when looking up the mapping.
+func (ch canonicalHost) lookup(host string) string {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	if c, ok := ch[name]; ok && c != "" {
+		return c
+	}
+	if c := ch["*"]; c != "" {
+		return c
+	}
+	return host
+}
+
+// canonical wraps h with permanent redirects of requests to non-canonical hosts,
+// according to the current config CanonicalHost, and of plain HTTP requests
+// to HTTPS if ForceHTTPS is enabled. The request scheme is identified by
+// X-Forwarded-Proto header. App Engine internal paths and HookPath are never
+// redirected.
+func canonical(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if strings.HasPrefix(r.URL.Path, "/_ah/") || r.URL.Path == c.HookPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		scheme := requestScheme(r)
+		toScheme := scheme
+		if c.ForceHTTPS && r.Header.Get("x-forwarded-proto") == "http" {
+			toScheme = "https"
+		}
+		toHost := c.CanonicalHost.lookup(r.Host)
+		if toScheme == scheme && toHost == r.Host {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := toScheme + "://" + toHost + r.URL.EscapedPath()
+		if r.URL.RawQuery != "" && (c.CanonicalPreserveQuery == nil || *c.CanonicalPreserveQuery) {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusMovedPermanently)
+	})
+}
+
+// requestScheme returns the scheme of r as seen by the client,
+// identified by X-Forwarded-Proto header if present.
+func requestScheme(r *http.Request) string {
+	if s := r.Header.Get("x-forwarded-proto"); s != "" {
+		return s
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
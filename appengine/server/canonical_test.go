@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDecodeCanonicalHost(t *testing.T) {
+	tests := []struct {
+		json, yaml string
+		want       canonicalHost
+	}{
+		{`"goa.design"`, `goa.design`, canonicalHost{"*": "goa.design"}},
+		{`{"www.goa.design": "goa.design"}`, `{www.goa.design: goa.design}`, canonicalHost{"www.goa.design": "goa.design"}},
+	}
+	for _, test := range tests {
+		var ch canonicalHost
+		if err := json.Unmarshal([]byte(test.json), &ch); err != nil || !reflect.DeepEqual(ch, test.want) {
+			t.Errorf("json %s: ch = %v, err = %v; want %v", test.json, ch, err, test.want)
+		}
+		ch = nil
+		if err := yaml.Unmarshal([]byte(test.yaml), &ch); err != nil || !reflect.DeepEqual(ch, test.want) {
+			t.Errorf("yaml %s: ch = %v, err = %v; want %v", test.yaml, ch, err, test.want)
+		}
+	}
+}
+
+func TestServe_Canonical(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	noQuery := false
+
+	tests := []struct {
+		ch         canonicalHost
+		https      bool
+		noQuery    bool
+		host, path string
+		proto      string
+		location   string
+	}{
+		{canonicalHost{"*": "goa.design"}, false, false, "www.goa.design", "/docs/?q=1", "https", "https://goa.design/docs/?q=1"},
+		{canonicalHost{"*": "goa.design"}, false, true, "www.goa.design", "/docs/?q=1", "https", "https://goa.design/docs/"},
+		{canonicalHost{"*": "goa.design"}, false, false, "goa.design", "/docs/", "https", ""},
+		{canonicalHost{"www.goa.design": "goa.design"}, false, false, "other.com", "/", "http", ""},
+		{canonicalHost{"www.goa.design": "goa.design"}, false, false, "www.goa.design", "/a%20b.html", "http", "http://goa.design/a%20b.html"},
+		{nil, true, false, "goa.design", "/docs/?q=1", "http", "https://goa.design/docs/?q=1"},
+		{nil, true, false, "goa.design", "/docs/", "https", ""},
+		{nil, true, false, "localhost:8080", "/docs/", "", ""},
+		{canonicalHost{"*": "goa.design"}, true, false, "www.goa.design", "/", "http", "https://goa.design/"},
+		// internal paths
+		{canonicalHost{"*": "goa.design"}, true, false, "www.goa.design", "/_ah/warmup", "http", ""},
+		{canonicalHost{"*": "goa.design"}, true, false, "www.goa.design", "/_ah/health", "http", ""},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.CanonicalHost = test.ch
+			c.ForceHTTPS = test.https
+			if test.noQuery {
+				c.CanonicalPreserveQuery = &noQuery
+			}
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if test.proto != "" {
+			req.Header.Set("x-forwarded-proto", test.proto)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		code := http.StatusMovedPermanently
+		if test.location == "" {
+			code = http.StatusOK
+		}
+		if res.Code != code {
+			t.Errorf("%d: res.Code = %d; want %d", i, res.Code, code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%d: location = %q; want %q", i, v, test.location)
+		}
+	}
+}
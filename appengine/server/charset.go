@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// defaultCharset is the default value of appConfig.DefaultCharset.
+const defaultCharset = "utf-8"
+
+// defaultCharset returns c.DefaultCharset or its default value.
+func (c *appConfig) defaultCharset() string {
+	if c.DefaultCharset == "" {
+		return defaultCharset
+	}
+	return c.DefaultCharset
+}
+
+// textType reports whether media type t, lowercase and with no parameters,
+// is text-like and thus may carry a charset parameter.
+func textType(t string) bool {
+	switch {
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	return t == "application/javascript" || t == "application/ecmascript" || t == "application/xml"
+}
+
+// withCharset returns content type ct with a charset parameter of the current
+// config DefaultCharset appended if ct is text-like and has no charset.
+// Other content types, including malformed ones, are returned as is.
+func withCharset(ct string) string {
+	t, params, err := mime.ParseMediaType(ct)
+	if err != nil || !textType(t) {
+		return ct
+	}
+	if _, ok := params["charset"]; ok {
+		return ct
+	}
+	return ct + "; charset=" + currentConfig().defaultCharset()
+}
+
+// applyCharset returns o with its content-type passed through withCharset.
+// The object is returned as is if its content-type is unchanged or o is a redirect.
+func applyCharset(o *weasel.Object) *weasel.Object {
+	if o.Redirect() != "" {
+		return o
+	}
+	ct := withCharset(o.Meta["content-type"])
+	if ct == o.Meta["content-type"] {
+		return o
+	}
+	o = cloneObject(o)
+	o.Meta["content-type"] = ct
+	return o
+}
+
+// validateDefaultCharset reports an error if c.DefaultCharset is set
+// but is not a charset name.
+func (c *appConfig) validateDefaultCharset() error {
+	if c.DefaultCharset != "" && !validHeaderName(c.DefaultCharset) {
+		return fmt.Errorf("default_charset: %q is not a charset name", c.DefaultCharset)
+	}
+	return nil
+}
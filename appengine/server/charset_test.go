@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_DefaultCharset(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "page.html", []byte("<p>café</p>"), map[string]string{"content-type": "text/html"})
+	m.Put("bucket", "latin.html", []byte("<p>caf\xe9</p>"), map[string]string{"content-type": "text/html; charset=iso-8859-1"})
+	m.Put("bucket", "icon.svg", []byte("<svg/>"), map[string]string{"content-type": "image/svg+xml"})
+	m.Put("bucket", "app.js", []byte("1"), map[string]string{"content-type": "application/javascript"})
+	m.Put("bucket", "photo.png", []byte("png"), map[string]string{"content-type": "image/png"})
+	m.Put("bucket", "data.json", []byte("{}"), map[string]string{"content-type": "application/json"})
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+
+	tests := []struct {
+		charset, path, ctype string
+	}{
+		{"", "/page.html", "text/html; charset=utf-8"},
+		{"", "/latin.html", "text/html; charset=iso-8859-1"},
+		{"", "/icon.svg", "image/svg+xml; charset=utf-8"},
+		{"", "/app.js", "application/javascript; charset=utf-8"},
+		{"", "/photo.png", "image/png"},
+		{"", "/data.json", "application/json"},
+		{"windows-1252", "/page.html", "text/html; charset=windows-1252"},
+		{"windows-1252", "/latin.html", "text/html; charset=iso-8859-1"},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.DefaultCharset = test.charset
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != http.StatusOK {
+			t.Errorf("%q %s: res.Code = %d; want 200", test.charset, test.path, res.Code)
+		}
+		if v := res.Header().Get("content-type"); v != test.ctype {
+			t.Errorf("%q %s: content-type = %q; want %q", test.charset, test.path, v, test.ctype)
+		}
+	}
+}
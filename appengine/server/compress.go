@@ -0,0 +1,377 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// defaultGzipMinSize is the default value of appConfig.GzipMinSize.
+const defaultGzipMinSize = 1024
+
+// compressibleTypes are media types worth compressing on the fly,
+// unless the config Compressible overrides them.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+	"text/css":               true,
+	"text/html":              true,
+	"text/javascript":        true,
+	"text/plain":             true,
+	"text/xml":               true,
+}
+
+// encodingSiblings are content codings of pre-compressed objects
+// and their name suffixes, in the order of preference.
+var encodingSiblings = []struct{ coding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// compressible reports whether content type ct is one of the current config
+// Compressible types, or compressibleTypes if it is not set.
+// Media type parameters, such as charset, are ignored.
+func compressible(ct string) bool {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	list := currentConfig().Compressible
+	if list == nil {
+		return compressibleTypes[t]
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCompressible reports an error if any of c.Compressible
+// is not a media type with no parameters.
+func (c *appConfig) validateCompressible() error {
+	for i, v := range c.Compressible {
+		t, params, err := mime.ParseMediaType(v)
+		if err != nil || !strings.Contains(t, "/") || len(params) > 0 {
+			return fmt.Errorf("compressible[%d]: %q is not a media type", i, v)
+		}
+	}
+	return nil
+}
+
+// identityQ is the q-value of identity coding not listed in Accept-Encoding,
+// lower than any explicitly preferred coding.
+const identityQ = 0.001
+
+// acceptEncoding maps lowercase content codings of an Accept-Encoding
+// header, including "*", to their q-values.
+type acceptEncoding map[string]float64
+
+// parseAcceptEncoding parses Accept-Encoding header value h.
+// Codings with malformed q-values are not acceptable.
+func parseAcceptEncoding(h string) acceptEncoding {
+	ae := make(acceptEncoding)
+	for _, part := range strings.Split(h, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") && !strings.HasPrefix(p, "Q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(p[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		ae[coding] = q
+	}
+	return ae
+}
+
+// q returns the q-value of coding, or that of "*" if it is not listed.
+// Identity is acceptable unless excluded explicitly. See identityQ.
+func (ae acceptEncoding) q(coding string) float64 {
+	if q, ok := ae[coding]; ok {
+		return q
+	}
+	if q, ok := ae["*"]; ok {
+		return q
+	}
+	if coding == "identity" {
+		return identityQ
+	}
+	return 0
+}
+
+// preferred returns acceptable codings of offers, i.e. with positive
+// q-values, from the highest q-value. Equal ones keep the order of offers.
+func (ae acceptEncoding) preferred(offers ...string) []string {
+	var list []string
+	for _, c := range offers {
+		if ae.q(c) > 0 {
+			list = append(list, c)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return ae.q(list[i]) > ae.q(list[j]) })
+	return list
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding header lists coding enc
+// with a positive q-value, either explicitly or with "*".
+func acceptsEncoding(r *http.Request, enc string) bool {
+	return parseAcceptEncoding(r.Header.Get("accept-encoding")).q(enc) > 0
+}
+
+// preferredEncoding returns the coding of offers most preferred by r's
+// Accept-Encoding header, or an empty string if none is acceptable.
+// Offers should include "identity" to be compared with the compressed codings.
+func preferredEncoding(r *http.Request, offers ...string) string {
+	if list := parseAcceptEncoding(r.Header.Get("accept-encoding")).preferred(offers...); len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+// compressObject returns a copy of o with its body compressed on the fly
+// if o is compressible and its body is at least the current config GzipMinSize
+// long, using Brotli, if the config BrotliQuality is set, or gzip, whichever
+// r prefers over identity. Otherwise, including streamed objects, o is returned
+// as is. Objects stored with a content encoding are handled by decodeObject.
+// It also adds Accept-Encoding to w's Vary header for compressible objects,
+// and sets Accept-Ranges to none for compressed ones, whose etag is weakened.
+func compressObject(w http.ResponseWriter, r *http.Request, o *weasel.Object) *weasel.Object {
+	if o.Redirect() != "" {
+		return o
+	}
+	if o.Meta["content-encoding"] != "" {
+		return decodeObject(w, r, o)
+	}
+	if !compressible(o.Meta["content-type"]) {
+		return o
+	}
+	addVary(w.Header(), "Accept-Encoding")
+	if o.Stream != nil {
+		return o
+	}
+	var (
+		b      bytes.Buffer
+		zw     io.WriteCloser
+		coding = compressCoding(r, len(o.Body))
+	)
+	switch coding {
+	case "br":
+		zw = brotli.NewWriterLevel(&b, currentConfig().BrotliQuality)
+	case "gzip":
+		zw = gzip.NewWriter(&b)
+	default:
+		return o
+	}
+	if _, err := zw.Write(o.Body); err != nil {
+		return o
+	}
+	if err := zw.Close(); err != nil {
+		return o
+	}
+	o = cloneObject(o)
+	o.Body = b.Bytes()
+	delete(o.Meta, "content-length")
+	o.Meta["content-encoding"] = coding
+	weakenETag(o.Meta)
+	// ranges of the compressed body are not served, see serveRange
+	w.Header().Set("accept-ranges", "none")
+	return o
+}
+
+// compressCoding returns the content coding compressObject uses for
+// a compressible body of size bytes requested with r, or an empty string
+// if the body is to be served uncompressed.
+func compressCoding(r *http.Request, size int) string {
+	c := currentConfig()
+	min := c.GzipMinSize
+	if min == 0 {
+		min = defaultGzipMinSize
+	}
+	if min < 0 || size < min {
+		return ""
+	}
+	offers := []string{"gzip", "identity"}
+	if c.BrotliQuality > 0 {
+		offers = []string{"br", "gzip", "identity"}
+	}
+	if coding := preferredEncoding(r, offers...); coding != "identity" {
+		return coding
+	}
+	return ""
+}
+
+// decodeObject returns a copy of o stored with gzip content encoding,
+// see GzipPassthrough config, with its body or stream decompressed on the fly
+// unless r accepts gzip. Otherwise, o is returned as is, including objects
+// which fail to decompress. It adds Accept-Encoding to w's Vary header.
+func decodeObject(w http.ResponseWriter, r *http.Request, o *weasel.Object) *weasel.Object {
+	addVary(w.Header(), "Accept-Encoding")
+	if o.Meta["content-encoding"] != "gzip" || acceptsEncoding(r, "gzip") {
+		return o
+	}
+	o2 := cloneObject(o)
+	if o.Stream != nil {
+		zr, err := gzip.NewReader(o.Stream)
+		if err != nil {
+			return o
+		}
+		o2.Stream = gunzipStream{zr, o.Stream}
+	} else {
+		zr, err := gzip.NewReader(bytes.NewReader(o.Body))
+		if err != nil {
+			return o
+		}
+		if o2.Body, err = ioutil.ReadAll(zr); err != nil {
+			return o
+		}
+	}
+	delete(o2.Meta, "content-encoding")
+	delete(o2.Meta, "content-length")
+	weakenETag(o2.Meta)
+	return o2
+}
+
+// weakenETag marks the etag of meta, if any, as a weak validator.
+// The storage etag identifies the stored bytes, so a body encoded
+// on the fly may share it only as semantically equivalent content.
+func weakenETag(meta map[string]string) {
+	if etag := meta["etag"]; etag != "" && !strings.HasPrefix(etag, "W/") {
+		meta["etag"] = "W/" + etag
+	}
+}
+
+// recoded reports whether compressObject encodes or decodes the body of o
+// on the fly when served to r. The body size of objects without one loaded,
+// e.g. StatFile results, is their content-length.
+func recoded(r *http.Request, o *weasel.Object) bool {
+	switch o.Meta["content-encoding"] {
+	case "gzip":
+		return !acceptsEncoding(r, "gzip")
+	case "":
+		if o.Stream != nil || !compressible(o.Meta["content-type"]) {
+			return false
+		}
+		size := len(o.Body)
+		if o.Body == nil {
+			size, _ = strconv.Atoi(o.Meta["content-length"])
+		}
+		return compressCoding(r, size) != ""
+	}
+	return false
+}
+
+// notModifiedObject returns o, or a copy of it with a weak etag if its
+// body would be recoded for r, so that a 304 response to r carries
+// the etag of the representation r would get. See recoded.
+func notModifiedObject(r *http.Request, o *weasel.Object) *weasel.Object {
+	if o.Meta["etag"] == "" || !recoded(r, o) {
+		return o
+	}
+	o = cloneObject(o)
+	weakenETag(o.Meta)
+	return o
+}
+
+// gunzipStream is a decompressed object stream.
+// Closing it closes the compressed stream.
+type gunzipStream struct {
+	*gzip.Reader
+	stream io.Closer
+}
+
+// Close closes the compressed stream.
+func (s gunzipStream) Close() error {
+	s.Reader.Close()
+	return s.stream.Close()
+}
+
+// serveEncoded responds with a pre-compressed sibling of object oname,
+// such as oname.br or oname.gz, if r accepts its content coding,
+// trying them in the order of r's preference.
+// Content type of the response is inferred from oname extension.
+// Conditional requests are evaluated against the sibling validators.
+// It returns false if no response was written, e.g. no sibling exists.
+func serveEncoded(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, oname string) bool {
+	name := storageFrom(ctx).FileName(oname)
+	offers := make([]string, 0, len(encodingSiblings)+1)
+	exts := make(map[string]string, len(encodingSiblings))
+	for _, sib := range encodingSiblings {
+		offers = append(offers, sib.coding)
+		exts[sib.coding] = sib.ext
+	}
+	offers = append(offers, "identity")
+	for _, coding := range parseAcceptEncoding(r.Header.Get("accept-encoding")).preferred(offers...) {
+		if coding == "identity" {
+			// the original object is preferred to the rest
+			break
+		}
+		ext := exts[coding]
+		o, err := storageFrom(ctx).ReadRaw(ctx, bucket, name+ext)
+		if err != nil {
+			if errf, ok := err.(*weasel.FetchError); !ok || errf.Code != http.StatusNotFound {
+				log.Errorf(ctx, "%s/%s%s: %v", bucket, name, ext, err)
+			}
+			continue
+		}
+		o = cloneObject(o)
+		o.Meta["content-encoding"] = coding
+		o.Meta["content-type"] = withCharset(typeByExtension(path.Ext(name)))
+		if o.Meta["content-type"] == "" {
+			o.Meta["content-type"] = "application/octet-stream"
+		}
+		o = applyHeaders(r.URL.Path, applyDownload(r.URL.Path, applyManifest(r.URL.Path, applyCacheControl(r.URL.Path, o))))
+		addVary(w.Header(), "Accept-Encoding")
+		// the client copy may be of the sibling, whose validators differ
+		if o.NotModified(r.Header.Get("if-none-match"), r.Header.Get("if-modified-since")) {
+			weasel.ServeNotModified(w, o)
+			return true
+		}
+		if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+			log.Errorf(ctx, "%s/%s%s: %v", bucket, name, ext, err)
+			abortTimedOut(ctx)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,531 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Gzip(t *testing.T) {
+	large := bytes.Repeat([]byte("compress me "), 200)
+	objects := map[string]struct {
+		ctype string
+		body  []byte
+	}{
+		"/bucket/page.html": {"text/html; charset=utf-8", large},
+		"/bucket/tiny.css":  {"text/css", []byte("a{}")},
+		"/bucket/img.png":   {"image/png", large},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", o.ctype)
+		w.Write(o.body)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	tests := []struct {
+		path, accept string
+		gzip         bool
+		vary         string
+	}{
+		{"/page.html", "gzip, deflate", true, "Accept-Encoding"},
+		{"/page.html", "", false, "Accept-Encoding"},
+		{"/tiny.css", "gzip", false, "Accept-Encoding"},
+		{"/img.png", "gzip", false, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Header.Set("accept-encoding", test.accept)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, http.StatusOK)
+		}
+		if v := res.Header().Get("vary"); v != test.vary {
+			t.Errorf("%s: vary = %q; want %q", test.path, v, test.vary)
+		}
+		body := res.Body.Bytes()
+		if !test.gzip {
+			if v := res.Header().Get("content-encoding"); v != "" {
+				t.Errorf("%s: content-encoding = %q; want none", test.path, v)
+			}
+			if want := objects["/bucket"+test.path].body; !bytes.Equal(body, want) {
+				t.Errorf("%s: res.Body = %q; want %q", test.path, body, want)
+			}
+			continue
+		}
+		if v := res.Header().Get("content-encoding"); v != "gzip" {
+			t.Errorf("%s: content-encoding = %q; want gzip", test.path, v)
+		}
+		if v := res.Header().Get("content-length"); v != "" {
+			t.Errorf("%s: content-length = %q; want none", test.path, v)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("%s: gzip.NewReader: %v", test.path, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Errorf("%s: gzip read: %v", test.path, err)
+		}
+		if !bytes.Equal(b, large) {
+			t.Errorf("%s: decompressed body mismatch", test.path)
+		}
+	}
+}
+
+func TestServe_GzipETag(t *testing.T) {
+	large := bytes.Repeat([]byte("compress me "), 200)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.Header().Set("content-length", strconv.Itoa(len(large)))
+		w.Header().Set("etag", `"v1"`)
+		w.Write(large)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	tests := []struct {
+		accept, inm string
+		code        int
+		etag        string
+	}{
+		{"gzip", "", http.StatusOK, `W/"v1"`},
+		{"", "", http.StatusOK, `"v1"`},
+		{"gzip", `W/"v1"`, http.StatusNotModified, `W/"v1"`},
+		{"", `W/"v1"`, http.StatusNotModified, `"v1"`},
+		{"gzip", `"v0"`, http.StatusOK, `W/"v1"`},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/page.html", nil)
+		req.Header.Set("accept-encoding", test.accept)
+		if test.inm != "" {
+			req.Header.Set("if-none-match", test.inm)
+		}
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q %q: res.Code = %d; want %d", test.accept, test.inm, res.Code, test.code)
+		}
+		if v := res.Header().Get("etag"); v != test.etag {
+			t.Errorf("%q %q: etag = %q; want %q", test.accept, test.inm, v, test.etag)
+		}
+	}
+}
+
+func TestServe_Compressible(t *testing.T) {
+	large := []byte(strings.Repeat("compressible ", 200))
+	types := map[string]string{
+		"/bucket/app.wasm":     "application/wasm",
+		"/bucket/events.jsonl": "application/x-ndjson; charset=utf-8",
+		"/bucket/page.html":    "text/html",
+		"/bucket/site.css":     "text/css",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", types[r.URL.Path])
+		w.Write(large)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		list []string
+		path string
+		gzip bool
+	}{
+		{nil, "/app.wasm", false},
+		{nil, "/site.css", true},
+		{[]string{"application/wasm", "Application/X-NDJSON", "text/html"}, "/app.wasm", true},
+		{[]string{"application/wasm", "Application/X-NDJSON", "text/html"}, "/events.jsonl", true},
+		{[]string{"application/wasm", "Application/X-NDJSON", "text/html"}, "/page.html", true},
+		{[]string{"application/wasm", "Application/X-NDJSON", "text/html"}, "/site.css", false},
+		{[]string{}, "/page.html", false},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.Compressible = test.list
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Header.Set("accept-encoding", "gzip")
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != http.StatusOK {
+			t.Errorf("%v %s: res.Code = %d; want 200", test.list, test.path, res.Code)
+		}
+		want := ""
+		if test.gzip {
+			want = "gzip"
+		}
+		if v := res.Header().Get("content-encoding"); v != want {
+			t.Errorf("%v %s: content-encoding = %q; want %q", test.list, test.path, v, want)
+		}
+	}
+}
+
+func TestServe_Brotli(t *testing.T) {
+	large := bytes.Repeat([]byte("compress me "), 200)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.Write(large)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		quality  int
+		accept   string
+		encoding string
+	}{
+		{5, "gzip, deflate, br", "br"},
+		{5, "gzip", "gzip"},
+		{5, "identity", ""},
+		{0, "br, gzip", "gzip"},
+		{0, "br", ""},
+		{5, "gzip;q=1, br;q=0.8", "gzip"},
+		{5, "gzip;q=0, br;q=0", ""},
+		{5, "*", "br"},
+		{0, "*;q=0.1, identity", ""},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.BrotliQuality = test.quality
+		})
+		req, _ := testInstance.NewRequest("GET", "/page.html", nil)
+		req.Header.Set("accept-encoding", test.accept)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != http.StatusOK {
+			t.Errorf("%d: res.Code = %d; want %d", i, res.Code, http.StatusOK)
+		}
+		if v := res.Header().Get("vary"); v != "Accept-Encoding" {
+			t.Errorf("%d: vary = %q; want Accept-Encoding", i, v)
+		}
+		if v := res.Header().Get("content-encoding"); v != test.encoding {
+			t.Errorf("%d: content-encoding = %q; want %q", i, v, test.encoding)
+		}
+		var (
+			b   []byte
+			err error
+		)
+		switch test.encoding {
+		case "br":
+			b, err = ioutil.ReadAll(brotli.NewReader(res.Body))
+		case "gzip":
+			var zr *gzip.Reader
+			if zr, err = gzip.NewReader(res.Body); err == nil {
+				b, err = ioutil.ReadAll(zr)
+			}
+		default:
+			b = res.Body.Bytes()
+		}
+		if err != nil {
+			t.Errorf("%d: read %s body: %v", i, test.encoding, err)
+			continue
+		}
+		if !bytes.Equal(b, large) {
+			t.Errorf("%d: decompressed body mismatch", i)
+		}
+	}
+}
+
+func TestPreferredEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string // of br, gzip and identity
+		gzip   bool   // acceptsEncoding gzip
+	}{
+		{"", "identity", false},
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "br", true},
+		{"GZIP", "gzip", true},
+		{"gzip;q=0, br;q=1", "br", false},
+		{"gzip;q=0.8, br;q=0.5", "gzip", true},
+		{"gzip; q=0.8, br; Q=0.9", "br", true},
+		{"*", "br", true},
+		{"*;q=0.5, gzip", "gzip", true},
+		{"*;q=0", "", false},
+		{"*;q=0, identity", "identity", false},
+		{"gzip, identity;q=0", "gzip", true},
+		{"br, gzip, identity;q=0", "br", true},
+		{"identity;q=1, gzip;q=0.5", "identity", true},
+		{"deflate", "identity", false},
+		{"gzip;q=2, br;q=x", "identity", false},
+		{" , gzip ,", "gzip", true},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("accept-encoding", test.accept)
+		if v := preferredEncoding(req, "br", "gzip", "identity"); v != test.want {
+			t.Errorf("preferredEncoding(%q) = %q; want %q", test.accept, v, test.want)
+		}
+		if v := acceptsEncoding(req, "gzip"); v != test.gzip {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v; want %v", test.accept, v, test.gzip)
+		}
+	}
+}
+
+func TestServe_NegotiateEncodings(t *testing.T) {
+	objects := map[string]string{
+		"/bucket/both.js":           "identity",
+		"/bucket/both.js.br":        "brotli",
+		"/bucket/both.js.gz":        "gzip",
+		"/bucket/gz.css":            "identity",
+		"/bucket/gz.css.gz":         "gzip",
+		"/bucket/plain.css":         "identity",
+		"/bucket/dir/index.html":    "identity",
+		"/bucket/dir/index.html.br": "brotli",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Write([]byte(b))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.NegotiateEncodings = true
+		c.GzipMinSize = -1
+	})()
+
+	tests := []struct {
+		path, accept string
+		body, enc    string
+		ctype        string
+	}{
+		{"/both.js", "gzip, br", "brotli", "br", "text/javascript; charset=utf-8"},
+		{"/both.js", "gzip", "gzip", "gzip", "text/javascript; charset=utf-8"},
+		{"/both.js", "", "identity", "", "text/javascript; charset=utf-8"},
+		{"/gz.css", "br, gzip", "gzip", "gzip", "text/css; charset=utf-8"},
+		{"/plain.css", "br, gzip", "identity", "", "text/css; charset=utf-8"},
+		{"/dir/", "br", "brotli", "br", "text/html; charset=utf-8"},
+		{"/both.js", "gzip;q=1, br;q=0.5", "gzip", "gzip", "text/javascript; charset=utf-8"},
+		{"/both.js", "gzip;q=0, br;q=1", "brotli", "br", "text/javascript; charset=utf-8"},
+		{"/both.js", "br;q=0, gzip;q=0", "identity", "", "text/javascript; charset=utf-8"},
+		{"/both.js", "*", "brotli", "br", "text/javascript; charset=utf-8"},
+		{"/both.js", "identity, gzip;q=0.5", "identity", "", "text/javascript; charset=utf-8"},
+		{"/gz.css", "br;q=1, gzip;q=0.1", "gzip", "gzip", "text/css; charset=utf-8"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Header.Set("accept-encoding", test.accept)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.path, test.accept, res.Code, http.StatusOK)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s %q: res.Body = %q; want %q", test.path, test.accept, v, test.body)
+		}
+		if v := res.Header().Get("content-encoding"); v != test.enc {
+			t.Errorf("%s %q: content-encoding = %q; want %q", test.path, test.accept, v, test.enc)
+		}
+		if v := res.Header().Get("content-type"); v != test.ctype {
+			t.Errorf("%s %q: content-type = %q; want %q", test.path, test.accept, v, test.ctype)
+		}
+	}
+}
+
+func TestServe_NegotiateEncodingsRevalidate(t *testing.T) {
+	objects := map[string]string{
+		"/bucket/app.js":    "identity",
+		"/bucket/app.js.br": "brotli",
+		"/bucket/app.js.gz": "gzip",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("etag", strconv.Quote(b))
+		w.Write([]byte(b))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.NegotiateEncodings = true
+		c.GzipMinSize = -1
+	})()
+
+	tests := []struct {
+		accept, inm string
+		code        int
+		etag        string
+	}{
+		{"br", `"brotli"`, http.StatusNotModified, `"brotli"`},
+		{"gzip", `"gzip"`, http.StatusNotModified, `"gzip"`},
+		// another sibling is served in full
+		{"gzip", `"brotli"`, http.StatusOK, `"gzip"`},
+		{"br", `"stale"`, http.StatusOK, `"brotli"`},
+		{"", `"brotli"`, http.StatusOK, `"identity"`},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/app.js", nil)
+		req.Header.Set("accept-encoding", test.accept)
+		req.Header.Set("if-none-match", test.inm)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q %s: res.Code = %d; want %d", test.accept, test.inm, res.Code, test.code)
+		}
+		if v := res.Header().Get("etag"); v != test.etag {
+			t.Errorf("%q %s: etag = %q; want %q", test.accept, test.inm, v, test.etag)
+		}
+	}
+}
+
+func TestServe_GzipPassthrough(t *testing.T) {
+	page := bytes.Repeat([]byte("stored compressed "), 100)
+	data := make([]byte, 8<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	objects := map[string]struct {
+		ctype string
+		body  []byte
+	}{
+		"/bucket/page.html": {"text/html", page},
+		"/bucket/data.bin":  {"application/octet-stream", data},
+	}
+	gz := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	// GCS decompresses gzip encoded objects unless the client accepts gzip
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obj, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", obj.ctype)
+		if !strings.Contains(r.Header.Get("accept-encoding"), "gzip") {
+			w.Write(obj.body)
+			return
+		}
+		b := gz(obj.body)
+		w.Header().Set("content-encoding", "gzip")
+		w.Header().Set("content-length", strconv.Itoa(len(b)))
+		w.Write(b)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer func(accept bool, n int64) {
+		storage.AcceptGzip, storage.StreamThreshold = accept, n
+	}(storage.AcceptGzip, storage.StreamThreshold)
+	storage.AcceptGzip = true
+	storage.StreamThreshold = 4 << 10
+
+	tests := []struct {
+		path, accept string
+		gzipped      bool
+		want         []byte
+	}{
+		{"/page.html", "gzip", true, page},
+		{"/page.html", "br, gzip", true, page},
+		{"/page.html", "", false, page},
+		{"/page.html", "br", false, page},
+		{"/data.bin", "gzip", true, data},
+		{"/data.bin", "", false, data},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("accept-encoding", test.accept)
+		}
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s %q: res.Code = %d; want 200", test.path, test.accept, res.Code)
+			continue
+		}
+		if v := res.Header().Get("vary"); v != "Accept-Encoding" {
+			t.Errorf("%s %q: vary = %q; want Accept-Encoding", test.path, test.accept, v)
+		}
+		body := res.Body.Bytes()
+		if v := res.Header().Get("content-encoding"); test.gzipped != (v == "gzip") {
+			t.Errorf("%s %q: content-encoding = %q; gzipped = %v", test.path, test.accept, v, test.gzipped)
+		}
+		if test.gzipped {
+			zr, err := gzip.NewReader(res.Body)
+			if err != nil {
+				t.Errorf("%s %q: gzip.NewReader: %v", test.path, test.accept, err)
+				continue
+			}
+			body, _ = ioutil.ReadAll(zr)
+		} else if v := res.Header().Get("content-length"); v != "" && v != strconv.Itoa(len(test.want)) {
+			t.Errorf("%s %q: content-length = %s; want %d", test.path, test.accept, v, len(test.want))
+		}
+		if !bytes.Equal(body, test.want) {
+			t.Errorf("%s %q: body differs from the original (%d bytes; want %d)", test.path, test.accept, len(body), len(test.want))
+		}
+	}
+}
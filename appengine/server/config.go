@@ -16,55 +16,1096 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/goadesign/goa.design/appengine"
+	"gopkg.in/yaml.v2"
 )
 
-// configFile is the frontend server config file.
-// See appConfig for fields description.
-const configFile = "config.json"
+const (
+	// configFile is the default frontend server config file.
+	// See appConfig for fields description.
+	configFile = "config.json"
+	// configFileEnv is the environment variable which, when set,
+	// names the config file explicitly.
+	configFileEnv = "GOA_CONFIG_FILE"
+	// configFlag is the command line flag naming the config file explicitly,
+	// as "-config name" or "-config=name", or their "--" forms.
+	configFlag = "-config"
+	// defaultGCSMaxAttempts is the default value of appConfig.GCSMaxAttempts.
+	defaultGCSMaxAttempts = 3
+	// defaultStreamThreshold is the default value of appConfig.StreamThreshold,
+	// same as the memcache item size limit.
+	defaultStreamThreshold = 1 << 20
+)
+
+// envOverrides maps environment variables to the config fields they override.
+// See appConfig.applyEnv.
+var envOverrides = map[string]func(c *appConfig, v string){
+	"GOA_GCS_BASE":            func(c *appConfig, v string) { c.GCSBase = v },
+	"GOA_DEFAULT_BUCKET":      func(c *appConfig, v string) { c.setBucket("default", v) },
+	"GOA_WEBROOT":             func(c *appConfig, v string) { c.WebRoot = v },
+	"GOA_INDEX":               func(c *appConfig, v string) { c.setIndex("/", v) },
+	"GOA_HOOK_PATH":           func(c *appConfig, v string) { c.HookPath = v },
+	"GOA_HOOK_TOKEN":          func(c *appConfig, v string) { c.HookToken = v },
+	"GOA_BUCKET_OVERRIDE_KEY": func(c *appConfig, v string) { c.BucketOverrideKey = v },
+	"GOA_LOCAL_ROOT":          func(c *appConfig, v string) { c.LocalRoot = v },
+}
+
+// configFilesYAML are YAML config file names looked up when
+// neither configFileEnv is set nor configFile exists.
+var configFilesYAML = []string{"config.yaml", "config.yml"}
 
-// config is the global app config instance.
-var config appConfig
+var (
+	// configMu guards config.
+	configMu sync.RWMutex
+	// config is the global app config instance.
+	// It must be accessed via currentConfig and setConfig,
+	// and never modified in place once set.
+	config *appConfig
+)
 
 // appConfig is the frontend server config.
 type appConfig struct {
-	// Redirects is a map of URLs the app will permanently redirect to
+	// Redirects is a map of URLs the app will redirect to
 	// when the request host and path match a key.
-	// Map values must not end with "/" and cannot contain query string.
-	Redirects map[string]string `json:"redirects"`
+	// A key ending in "/" matches any path under it, similar to http.ServeMux.
+	// A key ending in "/*" matches any path under it as well, but only
+	// the remainder following the prefix is carried over to the target,
+	// e.g. "/docs/v1/*": "/docs/v2" redirects /docs/v1/intro to /docs/v2/intro.
+	// A value is either a URL string, which results in a permanent redirect,
+	// or an object with "to" URL, "code" HTTP status and "preserve_query" fields.
+	// The code is one of 301, 302, 307 or 308; the latter two preserve
+	// the request method, e.g. for moved API endpoints receiving POSTs.
+	// The request path is appended to the URL, so it must not end with "/"
+	// unless the key ends in "/*".
+	Redirects map[string]redirect `json:"redirects" yaml:"redirects"`
+
+	// Rewrites maps request paths to object paths served in their place,
+	// without redirecting the client. A key is either an exact path or
+	// a prefix ending in "/*", e.g. "/img/old/*": "/img/new" serves
+	// /img/new/logo.png for /img/old/logo.png. Rewrites apply after Redirects
+	// and must not match the same paths.
+	Rewrites map[string]string `json:"rewrites" yaml:"rewrites"`
+
+	// RootRedirect, if set, redirects requests to exactly "/" of any host
+	// to its target, e.g. "/home/", before Redirects and bucket resolution.
+	// Unlike Redirects, the target is used as is, trailing "/" included,
+	// and the request path is not appended. It takes the same forms
+	// as a Redirects value.
+	RootRedirect *redirect `json:"root_redirect" yaml:"root_redirect"`
+
+	// LangRedirect maps exact request paths, e.g. "/", to redirects chosen by
+	// the visitor's Accept-Language: {"langs": {"fr": "/fr/", "pt-BR": "/br/"},
+	// "default": "/en/"}. Bots and requests with no matching language get
+	// the default. Redirects are temporary, and apply after RootRedirect
+	// and before Redirects. See serveLangRedirect.
+	LangRedirect map[string]langRedirect `json:"lang_redirect" yaml:"lang_redirect"`
+
+	// ABRedirects maps exact request paths, e.g. "/landing", to variants
+	// visitors are split between by weight: [{"target": "/landing-a/",
+	// "weight": 80}, {"target": "/landing-b/", "weight": 20}]. Visitors stay
+	// on their variant with a cookie of ABCookie name, "goa_ab" if empty.
+	// Redirects are temporary, and apply after RootRedirect and LangRedirect
+	// and before Redirects. See serveABRedirect.
+	ABRedirects map[string][]abVariant `json:"ab_redirects" yaml:"ab_redirects"`
+	ABCookie    string                 `json:"ab_cookie" yaml:"ab_cookie"`
+
+	// MaxRedirects limits the length of redirect chains formed by Redirects
+	// entries within the same host. It defaults to defaultMaxRedirects.
+	MaxRedirects int `json:"max_redirects" yaml:"max_redirects"`
+
+	// RedirectExcludeAgents lists User-Agent substrings, matched case-insensitively,
+	// of clients such as synthetic monitors which are served objects in place
+	// of Redirects. CanonicalHost and ForceHTTPS redirects still apply.
+	RedirectExcludeAgents []string `json:"redirect_exclude_agents" yaml:"redirect_exclude_agents"`
+
+	// CanonicalHost is either a host all requests are redirected to,
+	// e.g. "goa.design", or a mapping of request hosts to their canonical hosts,
+	// where "*" key applies to unlisted hosts. Redirects preserve the path and,
+	// unless CanonicalPreserveQuery is false, the query.
+	// ForceHTTPS redirects plain HTTP requests to HTTPS.
+	// Both apply before any other request handling. See canonical.
+	CanonicalHost          canonicalHost `json:"canonical_host" yaml:"canonical_host"`
+	CanonicalPreserveQuery *bool         `json:"canonical_preserve_query" yaml:"canonical_preserve_query"`
+	ForceHTTPS             bool          `json:"force_https" yaml:"force_https"`
+
+	// CSP enables a Content-Security-Policy-Report-Only header on responses,
+	// with violations reported to cspReportPath and logged there, so that
+	// a policy can be tuned before it is enforced. See serveCSPReport.
+	CSP *cspConfig `json:"csp" yaml:"csp"`
+
+	// HSTS enables Strict-Transport-Security header on responses
+	// to HTTPS requests, identified by X-Forwarded-Proto header. See hsts.
+	HSTS *hstsConfig `json:"hsts" yaml:"hsts"`
+
+	// ACMEBucket is the bucket of ACME HTTP-01 challenge objects, named
+	// ".well-known/acme-challenge/<token>", which are served directly,
+	// exempt from CanonicalHost, ForceHTTPS and other redirects.
+	// It defaults to the bucket the request maps to. Tokens set with
+	// SetACMEChallenge take precedence. See serveACME.
+	ACMEBucket string `json:"acme_bucket" yaml:"acme_bucket"`
 
 	// Buckets defines a mapping between hosts
 	// and GCS buckets the responses should be served from.
 	// The map must contain at least "default" key.
-	Buckets map[string]string `json:"buckets"`
+	// A host may be mapped to a single bucket name or a list, e.g. ["new", "old"],
+	// in which case objects are served from the first bucket containing them.
+	// A key may start with a "*." wildcard label, e.g. "*.preview.goa.design",
+	// matching any single label subdomain with no exact key.
+	// A bucket may also be an object with its own GCS base URL overriding
+	// GCSBase, e.g. {"bucket": "assets", "base": "https://cdn.example.com"}.
+	// Like GCSBase, bases are applied at startup only. See bucketRef.
+	Buckets map[string]bucketList `json:"buckets" yaml:"buckets"`
+
+	// BucketPaths maps a host followed by a path prefix,
+	// e.g. "example.com/assets/" or "example.com/assets/*", to buckets,
+	// same as Buckets values.
+	// It is consulted before Buckets; the longest matching prefix wins.
+	BucketPaths map[string]bucketList `json:"bucket_paths" yaml:"bucket_paths"`
+
+	// bucketBases are base URLs of Buckets and BucketPaths entries,
+	// keyed by bucket name. See decodeBucketBases.
+	bucketBases map[string]string
+
+	// KeyTransform maps bucket names to transforms of object names,
+	// derived from request paths, into the keys objects are stored under,
+	// e.g. {"prefix": "public/", "lowercase": true} serves /Docs/ from
+	// public/docs/index.html. Unlike Rewrites, it leaves the paths other
+	// entries match intact. Like bucket bases, it is applied at startup only.
+	KeyTransform map[string]keyTransform `json:"key_transform" yaml:"key_transform"`
+
+	// Mirror maps primary bucket names to mirror buckets, e.g. in another
+	// region, which reads fail over to after repeated GCS failures of
+	// the primary bucket, as {"bucket": "site-eu", "base": "https://...",
+	// "failures": 5, "window": "1m", "cooldown": "30s"}. See weasel.Mirror.
+	// Like GCSBase, it is applied at startup only.
+	Mirror map[string]mirrorConfig `json:"mirror" yaml:"mirror"`
+
+	// LocalRoot, if set, is a local directory objects of all buckets are read
+	// from in place of GCS, e.g. to preview a generated site in development.
+	// Path, index and redirect handling stays the same. Signed URLs are not
+	// available. It is applied at startup only. See weasel.DirBackend.
+	LocalRoot string `json:"local_root" yaml:"local_root"`
+
+	// WebRoot, Index, HookPath and GCSBase are applied at startup only;
+	// changing them requires a restart even when hot-reload is enabled.
+	WebRoot  string `json:"webroot" yaml:"webroot"` // default handler pattern
+	HookPath string `json:"hook" yaml:"hook"`       // GCS object change notification hook pattern
+	GCSBase  string `json:"gcs" yaml:"gcs"`         // GCS base URL
+
+	// Index is the directory index file name, e.g. "index.html",
+	// appended to request paths ending with "/", or a list of candidates,
+	// e.g. ["index.html", "index.htm", "README.html"], of which the first
+	// found in the bucket is served. It may also map request path prefixes
+	// to index file names or lists, e.g. {"/": "index.html",
+	// "/docs/": "README.html"}; the longest matching prefix wins and
+	// the "/" key, weasel.DefaultStorage.Index if missing, applies to the rest.
+	Index indexConfig `json:"index" yaml:"index"`
+
+	// Hosts overrides Index, WebRoot and NotFound for requests to the hosts,
+	// e.g. those mapped to distinct sites in Buckets. Hosts with no entry,
+	// and zero entry fields, use the global values.
+	Hosts map[string]hostConfig `json:"hosts" yaml:"hosts"`
+
+	// Sites maps hosts to configs of distinct sites served by the app,
+	// which may set Buckets, BucketPaths, Redirects, RootRedirect, Index
+	// and NotFound only; the rest applies to all sites. Set fields replace
+	// the global ones for requests to the host, with or without a port;
+	// other hosts use the global ones. Bucket objects with their own "base"
+	// are not supported in sites. See appConfig.site.
+	Sites map[string]*appConfig `json:"sites" yaml:"sites"`
+
+	// PassthroughPaths are request path patterns, e.g. "/admin/" for a subtree,
+	// which are never served from GCS. They are routed to handlers registered
+	// with HandlePassthrough, or get 404 if none is registered; applied at startup only.
+	// Passthrough paths take precedence over WebRoot and bypass Redirects,
+	// CanonicalHost and BasicAuth. They must not shadow HookPath, HealthPath,
+	// Metrics.Path, SignPath, /_config, /_cache/purge or App Engine internal /_ah/ paths.
+	PassthroughPaths []string `json:"passthrough" yaml:"passthrough"`
+
+	// Proxies maps request path prefixes, e.g. "/search/", to upstream base URLs.
+	// Matching requests are reverse-proxied to the upstream, with the request
+	// path appended to the base URL path, instead of being served from GCS.
+	// The longest matching prefix wins. Redirects and BasicAuth still apply.
+	// See proxyOr.
+	Proxies map[string]string `json:"proxies" yaml:"proxies"`
+
+	// Methods maps request path prefixes, e.g. "/forms/", to the HTTP methods
+	// objects under the prefix may be requested with, replacing the default
+	// GET, HEAD and OPTIONS. The longest matching prefix wins. Other methods
+	// get 405 status code with Allow header listing the allowed ones; allowed
+	// methods other than the default are served like GET. Proxies and HookPath
+	// are not affected. See serveMethod.
+	Methods map[string][]string `json:"methods" yaml:"methods"`
+
+	// GCSMaxAttempts is the maximum number of GCS requests made for a single
+	// object when GCS fails with transient errors, such as 5xx or timeouts.
+	// It defaults to defaultGCSMaxAttempts; applied at startup only.
+	GCSMaxAttempts int `json:"gcs_max_attempts" yaml:"gcs_max_attempts"`
+
+	// Transport tunes connections of GCS requests, which are then sent with
+	// net/http, instead of urlfetch, using a transport built from it.
+	// Without it, urlfetch defaults apply. Applied at startup only.
+	// It requires outbound sockets, which the first-generation standard
+	// runtime (runtime: go, api_version: go1) does not allow, so leave it
+	// unset there: GCS requests would fail to dial.
+	Transport *transportConfig `json:"transport" yaml:"transport"`
+
+	// CoalesceFetches makes concurrent requests for the same object missing
+	// the caches share a single GCS fetch, except for streamed objects, whose
+	// body cannot be shared. Applied at startup only.
+	// See weasel.Storage.CoalesceFetches.
+	CoalesceFetches bool `json:"coalesce_fetches" yaml:"coalesce_fetches"`
+
+	// HealthPath is the health check handler pattern; applied at startup only.
+	// It defaults to "/healthz". See serveHealth.
+	HealthPath string `json:"health" yaml:"health"`
+
+	// HookToken is the client token of the GCS notification channel.
+	// When set, requests to HookPath must carry a matching
+	// X-Goog-Channel-Token header. See serveHook.
+	HookToken string `json:"hook_token" yaml:"hook_token"`
+
+	// BucketOverrideKey, if not empty, enables serving a request from
+	// the bucket of its X-Goa-Bucket header, e.g. a CI preview one, in place
+	// of Buckets resolution. The header is only honored along with
+	// an X-Goa-Bucket-Expires Unix time, at most 7 days ahead, and an
+	// X-Goa-Bucket-Sig header of the hex-encoded HMAC-SHA256 of both, keyed
+	// with the key; it is ignored otherwise. See overrideBuckets and bucketSig.
+	BucketOverrideKey string `json:"bucket_override_key" yaml:"bucket_override_key"`
+
+	// ConfigToken, if not empty, enables the /_config handler responding
+	// with this config, secrets redacted, to requests carrying the token
+	// as a bearer token in Authorization header. See serveConfig.
+	// It also enables the /_cache/purge handler. See servePurge.
+	ConfigToken string `json:"config_token" yaml:"config_token"`
+
+	// Sitemap enables serving sitemap.xml generated from the request
+	// bucket HTML objects, in place of the bucket's own. See serveSitemap.
+	Sitemap bool `json:"sitemap" yaml:"sitemap"`
+
+	// Feed enables serving an Atom feed of the request bucket HTML objects
+	// under a prefix, e.g. blog posts, at its path. Item titles, dates and
+	// summaries are read from JSON sidecars, e.g. "blog/post.json" of
+	// "blog/post.html". See serveFeed and feedSidecar.
+	Feed *feedConfig `json:"feed" yaml:"feed"`
+
+	// Robots enables robots.txt generation for buckets which have none.
+	// See serveRobots.
+	Robots *robotsConfig `json:"robots" yaml:"robots"`
+
+	// AutoIndex enables HTML listings of directory-like paths
+	// with no Index object, e.g. for internal doc buckets.
+	// Listings take precedence over SPAFallback and NotFound.
+	// It is disabled by default so that public buckets don't leak their contents.
+	AutoIndex bool `json:"autoindex" yaml:"autoindex"`
+
+	// TrailingSlash is the policy for directory-like paths, ones with no
+	// file extension: "add" redirects /dir to /dir/, "remove" redirects
+	// /dir/ to /dir and serves its index, "ignore" or empty serves both.
+	// See serveTrailingSlash.
+	TrailingSlash string `json:"trailing_slash" yaml:"trailing_slash"`
+
+	// CanonicalizeIndex enables permanent redirects of directory index paths,
+	// e.g. /blog/index.html, to the directory, /blog/, so that search engines
+	// index a single URL. With "remove" TrailingSlash policy, the redirect is
+	// to /blog, which serves the index, rather than to /blog/ redirecting
+	// to /blog in turn. Neither redirects back. See serveCanonicalIndex.
+	CanonicalizeIndex bool `json:"canonicalize_index" yaml:"canonicalize_index"`
+
+	// NotFound is an object path served from the request bucket
+	// with 404 status code when the requested object does not exist.
+	// If the object itself is missing, a plain text response is used.
+	NotFound string `json:"not_found" yaml:"not_found"`
+
+	// ServerError is an object path served from the request bucket
+	// with 5xx status code when reading the requested object fails,
+	// e.g. "/500.html". The error itself is logged regardless.
+	// If the object cannot be read either, a plain text response is used.
+	ServerError string `json:"server_error" yaml:"server_error"`
+
+	// SPAFallback enables serving Index object from the bucket root
+	// with 200 status code in place of missing objects, for requests
+	// accepting text/html. It takes precedence over NotFound.
+	SPAFallback bool `json:"spa_fallback" yaml:"spa_fallback"`
+
+	// NotFoundRedirect maps request path prefixes, e.g. "/docs/", to targets
+	// missing objects under them are temporarily redirected to in place of
+	// a 404 response, e.g. "/docs/search?q={path}", where {path} in the query
+	// is replaced with the request path. The longest matching prefix wins.
+	// It takes precedence over SPAFallback and NotFound.
+	// See serveNotFoundRedirect.
+	NotFoundRedirect map[string]string `json:"not_found_redirect" yaml:"not_found_redirect"`
+
+	// PrettyURLs enables serving extensionless paths such as /about
+	// from about.html or, if missing, the about/ directory index,
+	// with 200 status code and no redirect.
+	// TrailingSlash redirects take place first, so with "add" policy
+	// only the index is served, at /about/. Both lookups take precedence
+	// over AutoIndex, SPAFallback and NotFound.
+	PrettyURLs bool `json:"pretty_urls" yaml:"pretty_urls"`
+
+	// GzipMinSize is the minimum size in bytes of a compressible object body
+	// to be compressed on the fly, with gzip or Brotli.
+	// It defaults to defaultGzipMinSize.
+	// Negative value disables compression.
+	GzipMinSize int `json:"gzip_min_size" yaml:"gzip_min_size"`
+
+	// Compressible, if set, lists the media types compressed on the fly,
+	// e.g. "application/wasm", in place of the built-in compressibleTypes.
+	// An empty list disables compression on the fly.
+	Compressible []string `json:"compressible" yaml:"compressible"`
+
+	// BrotliQuality, if positive, enables Brotli compression on the fly
+	// at the quality level from 1 to 11, for clients accepting br.
+	// Others get gzip. See compressObject.
+	BrotliQuality int `json:"brotli_quality" yaml:"brotli_quality"`
+
+	// NegotiateEncodings enables serving pre-compressed object siblings,
+	// such as page.html.br or page.html.gz in place of page.html,
+	// to clients accepting their content coding.
+	NegotiateEncodings bool `json:"negotiate_encodings" yaml:"negotiate_encodings"`
+
+	// GzipPassthrough serves objects stored in GCS with gzip content encoding
+	// compressed to clients accepting gzip, and decompresses them on the fly
+	// for others. Otherwise, GCS decompresses them for all clients.
+	// Like GCSBase, it is applied at startup only. See decodeObject.
+	GzipPassthrough bool `json:"gzip_passthrough" yaml:"gzip_passthrough"`
+
+	// HeadMetadata makes HEAD requests stat objects instead of reading
+	// their contents, responding with the same headers as GET requests.
+	// Objects whose GET headers depend on the contents, e.g. compressed
+	// on the fly, are still read. See serveHead.
+	HeadMetadata bool `json:"head_metadata" yaml:"head_metadata"`
+
+	// ContentTypes maps file name extensions, e.g. ".wasm", to content types
+	// of served objects, overriding those reported by GCS.
+	// Objects with no override and an empty or application/octet-stream type
+	// get the type from mime.TypeByExtension. See applyContentType.
+	ContentTypes map[string]string `json:"content_types" yaml:"content_types"`
+
+	// DefaultCharset is the charset parameter added to text-like content types
+	// of served objects which have none, defaultCharset if empty. Types which
+	// specify a charset and binary ones are left alone. See withCharset.
+	DefaultCharset string `json:"default_charset" yaml:"default_charset"`
+
+	// CacheControl maps request path glob patterns to cache-control
+	// header values of served objects, overriding those set in GCS.
+	// A "*" in a pattern matches any sequence of characters, including "/",
+	// e.g. "/static/*" or "/*.html". When several patterns match,
+	// the longest one wins. Objects matching none keep their own value,
+	// or get defaultCacheControl if they have none.
+	CacheControl map[string]string `json:"cache_control" yaml:"cache_control"`
+
+	// Negotiate maps extensionless request path glob patterns, e.g. "/api/spec",
+	// to candidate sibling objects: [{"ext": ".json"}, {"ext": ".yaml",
+	// "type": "application/yaml"}]. Requests are served the existing candidate
+	// most preferred by their Accept header, the first one for "*/*", with
+	// "Vary: Accept"; the type defaults to that of the extension. Negotiation
+	// applies to the primary bucket of the request. See serveNegotiated.
+	Negotiate map[string][]negotiateCandidate `json:"negotiate" yaml:"negotiate"`
+
+	// CacheVaryQuery lists query parameters, e.g. "env", which select
+	// a variant object of the request path: /config.json?env=staging is
+	// served from "config.json?env=staging" object, cached apart from
+	// "config.json". Other parameters are ignored, as they always are without
+	// CacheVaryQuery, so that arbitrary queries don't fill the cache.
+	// Missing variants are not found; there is no fallback. See queryVariant.
+	CacheVaryQuery []string `json:"cache_vary_query" yaml:"cache_vary_query"`
+
+	// Headers maps request path glob patterns, same as in CacheControl,
+	// to response headers of served objects, e.g. "/*" for global
+	// security headers and "/embed/*" for a relaxed CSP.
+	// All matching patterns apply; the longest one wins for each header.
+	// An empty value removes the header. Headers are not added to redirects.
+	Headers map[string]map[string]string `json:"headers" yaml:"headers"`
+
+	// Preload maps request path glob patterns, same as in CacheControl,
+	// to assets HTML objects should preload with a Link header, e.g. "/*"
+	// for shared assets and "/docs/*" for additional or overriding ones.
+	// All matching patterns apply; the longest one wins for each href.
+	// Headers take precedence. See applyPreload.
+	Preload map[string][]preloadLink `json:"preload" yaml:"preload"`
+
+	// HTMLRewrite maps request path glob patterns, same as in CacheControl,
+	// to rewrites of HTML objects served under multiple hosts or paths:
+	// a <base> element and link URLs pointing to other origins, e.g. a CDN.
+	// Streamed objects are not rewritten. See rewriteHTML.
+	HTMLRewrite map[string]htmlRewrite `json:"html_rewrite" yaml:"html_rewrite"`
+
+	// NoRange is a list of request path glob patterns, same as in CacheControl,
+	// e.g. "/live/*", and media types, e.g. "text/html" or "video/*",
+	// of objects served in full to Range requests, with "Accept-Ranges: none".
+	// Objects compressed on the fly are never served by ranges. See serveRange.
+	NoRange []string `json:"no_range" yaml:"no_range"`
 
-	WebRoot  string `json:"webroot"` // default handler pattern
-	Index    string `json:"index"`   // dir index file name
-	HookPath string `json:"hook"`    // GCS object change notification hook pattern
-	GCSBase  string `json:"gcs"`     // GCS base URL
+	// Downloads is a list of request path prefixes, e.g. "/downloads/",
+	// and file name extensions, e.g. ".zip", of objects served as attachments
+	// with a content-disposition header, prompting browsers to save them.
+	// Headers take precedence. See applyDownload.
+	Downloads []string `json:"downloads" yaml:"downloads"`
+
+	// ExtraVary lists header names added to the Vary header of all object
+	// responses, along with those the server adds itself: Accept-Encoding,
+	// Origin and Host. It is meant for request headers an upstream transform
+	// unknown to the server, such as a CDN rule, makes the response depend on.
+	ExtraVary []string `json:"extra_vary" yaml:"extra_vary"`
+
+	// StripRequestHeaders lists request headers removed, and SetRequestHeaders
+	// maps request headers to values set, before any other request handling,
+	// logging included, e.g. large cookies or internal auth tokens injected
+	// by an upstream proxy. Headers are stripped first.
+	// See requestHeaders.
+	StripRequestHeaders []string          `json:"strip_request_headers" yaml:"strip_request_headers"`
+	SetRequestHeaders   map[string]string `json:"set_request_headers" yaml:"set_request_headers"`
+
+	// CORS enables Cross-Origin Resource Sharing headers on served objects.
+	CORS *corsConfig `json:"cors" yaml:"cors"`
+
+	// StreamThreshold is the size in bytes above which objects are streamed
+	// to clients instead of being read into memory. Streamed objects are
+	// never cached nor compressed on the fly. It defaults to
+	// defaultStreamThreshold; negative value disables streaming.
+	// Like GCSBase, it is applied at startup only.
+	StreamThreshold int64 `json:"stream_threshold" yaml:"stream_threshold"`
+
+	// MaxInlineBytes, if positive, is the maximum size in bytes of objects
+	// read into memory and cached. Larger objects are streamed, or rejected
+	// with 413 status code if streaming is disabled. Applied at startup only.
+	MaxInlineBytes int64 `json:"max_inline_bytes" yaml:"max_inline_bytes"`
+
+	// Manifests is a list of request path glob patterns, same as in
+	// CacheControl, e.g. "/version.json", of generated JSON manifests.
+	// They are served as manifestContentType with no-store cache-control,
+	// regardless of the object metadata, CacheControl and Immutable;
+	// Headers still apply. See applyManifest.
+	Manifests []string `json:"manifests" yaml:"manifests"`
+
+	// Immutable is a list of request path glob patterns, same as in
+	// CacheControl, e.g. "/static/*.*.js", of content-addressed objects
+	// whose contents never change for a given path. They are served with
+	// immutableCacheControl, taking precedence over CacheControl, and with
+	// LocalCache, are cached regardless of its max_entry_bytes and never
+	// revalidated, until evicted or purged by the hook.
+	Immutable []string `json:"immutable" yaml:"immutable"`
+
+	// ImmutableMaxBytes, if greater than StreamThreshold and MaxInlineBytes,
+	// is the maximum size in bytes of Immutable objects read into memory
+	// and cached. Applied at startup only.
+	ImmutableMaxBytes int64 `json:"immutable_max_bytes" yaml:"immutable_max_bytes"`
+
+	// Maintenance, when enabled, makes visitor-facing handlers respond with
+	// a maintenance page and 503 status code to all clients but allowed ones.
+	// It covers objects, redirects, proxies, passthrough and sign paths;
+	// health checks, HookPath, warmup and metrics are unaffected.
+	// It is consulted on every request, so toggling Enabled takes effect
+	// on hot-reload without a restart. See maintenance.
+	Maintenance *maintenanceConfig `json:"maintenance" yaml:"maintenance"`
+
+	// RateLimit, if set, limits the rate of requests to objects, redirects
+	// and proxies per client IP, the request remote address. See clientIP.
+	// Health checks, HookPath, warmup and metrics are not limited.
+	// The limit is enforced per instance. See rateLimit.
+	RateLimit *rateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+
+	// LocalCache enables in-process caching of small objects.
+	// Like GCSBase, it is applied at startup only.
+	LocalCache *localCacheConfig `json:"local_cache" yaml:"local_cache"`
+
+	// Metrics enables collection of request metrics, exposed
+	// at Metrics.Path in Prometheus text format. See serveMetrics.
+	Metrics *metricsConfig `json:"metrics" yaml:"metrics"`
+
+	// BasicAuth protects request path prefixes, e.g. "/preview/*",
+	// with HTTP basic authentication. It applies to objects and redirects.
+	// See basicAuth.
+	BasicAuth []basicAuthRule `json:"basic_auth" yaml:"basic_auth"`
+
+	// SignPath, if not empty, is the pattern of a handler responding with
+	// V4 signed URLs of private objects to signed in users; applied at startup only.
+	// SignPrefixes is a list of "bucket/object-prefix" the signed objects must
+	// start with. SignExpiry is the signed URL validity period, defaultSignExpiry
+	// if zero. See serveSignedURL.
+	SignPath     string   `json:"sign_path" yaml:"sign_path"`
+	SignPrefixes []string `json:"sign_prefixes" yaml:"sign_prefixes"`
+	SignExpiry   duration `json:"sign_expiry" yaml:"sign_expiry"`
+
+	// Trace enables tracing of GCS object fetches in "gcs.fetch" spans,
+	// written to the request log, and propagation of the request
+	// X-Cloud-Trace-Context header to GCS. Applied at startup only.
+	Trace bool `json:"trace" yaml:"trace"`
+
+	// MaxRequestBody, if positive, is the maximum size in bytes of request
+	// bodies accepted by HookPath and Proxies. Larger ones are rejected with
+	// 413 status code; proxied bodies of unknown length are cut at the limit,
+	// failing the upstream request. See limitBody.
+	MaxRequestBody int64 `json:"max_request_body" yaml:"max_request_body"`
+
+	// RequestTimeout limits the time spent serving a request, including
+	// GCS reads, defaultRequestTimeout if zero. Requests timing out before
+	// the response started get 504 status code; streamed responses are
+	// aborted by closing the connection. See newContext.
+	RequestTimeout duration `json:"request_timeout" yaml:"request_timeout"`
+
+	// LogRequests enables structured request logging. See instrument.
+	LogRequests bool `json:"log_requests" yaml:"log_requests"`
+
+	// NotFoundLogSample is the fraction, from 0 to 1, of 404 responses
+	// logged with LogRequests, e.g. 0.01 to keep scanner noise down.
+	// It defaults to 1, logging all of them. Other responses are always
+	// logged. Metrics still count all requests. See logSampled.
+	NotFoundLogSample *float64 `json:"not_found_log_sample" yaml:"not_found_log_sample"`
+	// LogFormat is the request log format: "json" for structured entries,
+	// the default, or "common" and "combined" for Apache httpd Common and
+	// Combined Log Format lines, which identify clients by remote address.
+	LogFormat string `json:"log_format" yaml:"log_format"`
+
+	// RequestIDHeader is the header of request IDs, defaultRequestIDHeader
+	// if empty. Requests with no valid ID get a random UUID. The ID is echoed
+	// in responses and included in request logs. See requestID.
+	RequestIDHeader string `json:"request_id_header" yaml:"request_id_header"`
+
+	// SlowRequestThreshold, if positive, is the duration above which requests
+	// are logged with an additional warning, regardless of LogRequests
+	// and NotFoundLogSample, e.g. to alert on. See writeSlowRequest.
+	SlowRequestThreshold duration `json:"slow_request_threshold" yaml:"slow_request_threshold"`
+
+	// DebugHeaders makes responses include the request bucket, object name
+	// and cache hit or miss in X-Debug-Bucket, X-Debug-Object and X-Debug-Cache
+	// headers. It exposes bucket names, so it should not be enabled publicly.
+	DebugHeaders bool `json:"debug_headers" yaml:"debug_headers"`
+
+	// ServerTiming makes object responses include a Server-Timing header
+	// with time spent in cache lookups and GCS fetches, as "cache" and "gcs"
+	// metrics, shown by browser devtools. See serverTiming.
+	ServerTiming bool `json:"server_timing" yaml:"server_timing"`
+
+	// Warmup is a list of default bucket object paths prefetched into the caches
+	// on App Engine warmup requests, using at most WarmupConcurrency
+	// concurrent requests, defaultWarmupConcurrency if zero. See serveWarmup.
+	Warmup            []string `json:"warmup" yaml:"warmup"`
+	WarmupConcurrency int      `json:"warmup_concurrency" yaml:"warmup_concurrency"`
+
+	// Favicon is the favicon served at /favicon.ico from memory, with long
+	// cache headers: either a default bucket object path, e.g. "/img/icon.ico",
+	// or a base64 "data:" URL. It is loaded on warmup or the first request.
+	// Without it, or if it fails to load, requests get 204 status code
+	// in place of a 404, although the bucket is looked up first when unset.
+	// See serveFavicon.
+	Favicon string `json:"favicon" yaml:"favicon"`
+
+	// CheckBuckets enables a check at startup whether all buckets
+	// of Buckets and BucketPaths exist and are accessible to the app,
+	// logging warnings for those which are not. If CheckBucketsFatal is set,
+	// unreachable buckets fail the startup instead. See checkBuckets.
+	CheckBuckets      bool `json:"check_buckets" yaml:"check_buckets"`
+	CheckBucketsFatal bool `json:"check_buckets_fatal" yaml:"check_buckets_fatal"`
+
+	// VerifyRedirectTargets enables a check whether the relative targets of
+	// exact path Redirects, RootRedirect, LangRedirect and ABRedirects exist
+	// in the default bucket, at startup and on reload, logging warnings for
+	// those which do not. If VerifyRedirectTargetsFatal is set, missing
+	// targets fail the startup, or the reload, which keeps the previous config,
+	// instead. Validate-only mode never contacts GCS, so it is skipped there.
+	// See checkRedirectTargets.
+	VerifyRedirectTargets      bool `json:"verify_redirect_targets" yaml:"verify_redirect_targets"`
+	VerifyRedirectTargetsFatal bool `json:"verify_redirect_targets_fatal" yaml:"verify_redirect_targets_fatal"`
+
+	// ReloadInterval is how often the config file is polled for changes.
+	// Zero value disables hot-reload. See watchConfig.
+	ReloadInterval duration `json:"reload" yaml:"reload"`
+
+	// ShutdownGrace is how long instance shutdown, on /_ah/stop request
+	// or SIGTERM, waits for in-flight requests to finish. New requests are
+	// rejected meanwhile. It defaults to defaultShutdownGrace. See serveStop.
+	ShutdownGrace duration `json:"shutdown_grace" yaml:"shutdown_grace"`
+
+	// sites are Sites merged with the global config; built by loadConfig.
+	sites map[string]*appConfig
+	// redirectPrefixes are prefix Redirects entries; built by loadConfig.
+	redirectPrefixes []redirectPrefix
+	// rewritePrefixes are prefix Rewrites entries; built by loadConfig.
+	rewritePrefixes []rewritePrefix
 }
 
-// readConfig reads file contents from configFile and populates config.
-// JSON is the expected config file format.
-func readConfig() error {
-	r, err := os.Open(configFile)
+// localCacheConfig is the LocalCache section of appConfig.
+type localCacheConfig struct {
+	MaxBytes      int64 `json:"max_bytes" yaml:"max_bytes"`             // total size of cached objects
+	MaxEntryBytes int64 `json:"max_entry_bytes" yaml:"max_entry_bytes"` // objects larger than this are not cached
+	// CacheTTL is how long cached objects are served without
+	// revalidation. Zero means until evicted or purged by the hook.
+	CacheTTL duration `json:"ttl" yaml:"ttl"`
+	// StaleWhileRevalidate is how long past CacheTTL objects are still
+	// served, while a single request refreshes them. Requires CacheTTL.
+	StaleWhileRevalidate duration `json:"stale_while_revalidate" yaml:"stale_while_revalidate"`
+}
+
+// duration is a time.Duration decoded from a string such as "1m30s".
+type duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// currentConfig returns the app config currently in effect.
+// The returned value must not be modified.
+func currentConfig() *appConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// setConfig atomically replaces the app config currently in effect with c.
+func setConfig(c *appConfig) {
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+}
+
+// readConfig loads config file name, see configPath, and populates config.
+func readConfig(name string) error {
+	c, err := loadConfig(name)
+	if err != nil {
+		return err
+	}
+	setConfig(c)
+	configLoaded(name, time.Now())
+	return nil
+}
+
+// loadConfig reads and validates config file name.
+// The file is decoded as YAML if its extension is .yaml or .yml,
+// and as JSON otherwise.
+//
+// Values are resolved in the following order of precedence:
+// non-empty environment variables listed in envOverrides,
+// then the config file, then built-in defaults.
+// The config file is required even if all fields are overridden.
+func loadConfig(name string) (*appConfig, error) {
+	b, err := ioutil.ReadFile(name)
 	if err != nil {
+		return nil, err
+	}
+	c := &appConfig{}
+	if err := decodeConfig(name, b, c); err != nil {
+		return nil, decodeError(name, b, err)
+	}
+	if c.bucketBases, err = decodeBucketBases(name, b); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	c.applyEnv()
+	if c.WebRoot == "" {
+		c.WebRoot = "/"
+	}
+	if c.HookPath == "" {
+		c.HookPath = "/-/hook/gcs"
+	}
+	if c.GCSMaxAttempts == 0 {
+		c.GCSMaxAttempts = defaultGCSMaxAttempts
+	}
+	if c.StreamThreshold == 0 {
+		c.StreamThreshold = defaultStreamThreshold
+	}
+	if c.HealthPath == "" {
+		c.HealthPath = "/healthz"
+	}
+	if c.Metrics != nil && c.Metrics.Path == "" {
+		c.Metrics.Path = defaultMetricsPath
+	}
+	if c.GCSBase == "" {
+		c.GCSBase = weasel.DefaultStorage.Base
+	}
+	if len(c.Index["/"]) == 0 {
+		c.setIndex("/", weasel.DefaultStorage.Index)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	c.redirectPrefixes = c.buildRedirects()
+	c.rewritePrefixes = c.buildRewrites()
+	c.sites = c.buildSites()
+	return c, nil
+}
+
+// applyEnv overrides c fields with values of non-empty
+// environment variables listed in envOverrides.
+func (c *appConfig) applyEnv() {
+	for k, set := range envOverrides {
+		if v := os.Getenv(k); v != "" {
+			set(c, v)
+		}
+	}
+}
+
+// setBucket maps host to a single bucket, allocating c.Buckets if needed.
+func (c *appConfig) setBucket(host, bucket string) {
+	if c.Buckets == nil {
+		c.Buckets = make(map[string]bucketList)
+	}
+	c.Buckets[host] = bucketList{bucket}
+}
+
+// setIndex sets a single index file name of request path prefix.
+func (c *appConfig) setIndex(prefix, name string) {
+	if c.Index == nil {
+		c.Index = make(indexConfig)
+	}
+	c.Index[prefix] = indexList{name}
+}
+
+// validate reports an error if c violates constraints
+// described in appConfig fields documentation.
+func (c *appConfig) validate() error {
+	if c.Buckets["default"].primary() == "" {
+		return fmt.Errorf(`buckets: must contain "default" key`)
+	}
+	for k := range c.Buckets {
+		if strings.Contains(strings.TrimPrefix(k, "*."), "*") {
+			return fmt.Errorf(`buckets[%q]: wildcard must be a leading "*." label`, k)
+		}
+	}
+	for _, m := range []struct {
+		field   string
+		buckets map[string]bucketList
+	}{{"buckets", c.Buckets}, {"bucket_paths", c.BucketPaths}} {
+		for k, l := range m.buckets {
+			if len(l) == 0 {
+				return fmt.Errorf(`%s[%q]: must not be empty`, m.field, k)
+			}
+			for _, b := range l {
+				if b == "" {
+					return fmt.Errorf(`%s[%q]: bucket name must not be empty`, m.field, k)
+				}
+			}
+		}
+	}
+	for k, v := range c.Redirects {
+		if strings.HasSuffix(v.To, "/") && !strings.HasSuffix(k, "/*") {
+			return fmt.Errorf(`redirects[%q]: value must not end with "/"`, k)
+		}
+		if v.Code != 0 && !validRedirectCode(v.Code) {
+			return fmt.Errorf(`redirects[%q]: code %d is not one of 301, 302, 307 or 308`, k, v.Code)
+		}
+	}
+	if v := c.NotFoundLogSample; v != nil && !(*v >= 0 && *v <= 1) {
+		return fmt.Errorf("not_found_log_sample: %v is not within [0, 1]", *v)
+	}
+	if err := c.validateRequestIDHeader(); err != nil {
+		return err
+	}
+	if err := c.validateFavicon(); err != nil {
+		return err
+	}
+	if c.SlowRequestThreshold < 0 {
+		return fmt.Errorf("slow_request_threshold: %v must not be negative", time.Duration(c.SlowRequestThreshold))
+	}
+	if c.HSTS != nil {
+		if err := c.HSTS.validate(); err != nil {
+			return fmt.Errorf("hsts.%v", err)
+		}
+	}
+	if err := c.validateKeyTransform(); err != nil {
+		return err
+	}
+	if err := c.validateMirror(); err != nil {
+		return err
+	}
+	if c.Feed != nil {
+		if err := c.Feed.validate(); err != nil {
+			return fmt.Errorf("feed.%v", err)
+		}
+	}
+	if c.CSP != nil {
+		if err := c.CSP.validate(); err != nil {
+			return fmt.Errorf("csp.%v", err)
+		}
+	}
+	if c.Transport != nil {
+		if err := c.Transport.validate(); err != nil {
+			return fmt.Errorf("transport.%v", err)
+		}
+	}
+	if err := c.validateNegotiate(); err != nil {
+		return err
+	}
+	if err := c.validateCacheVaryQuery(); err != nil {
+		return err
+	}
+	if err := c.validateRequestHeaders(); err != nil {
+		return err
+	}
+	if err := c.validateExtraVary(); err != nil {
+		return err
+	}
+	if err := c.validateMaxRequestBody(); err != nil {
+		return err
+	}
+	if err := c.validateManifests(); err != nil {
+		return err
+	}
+	if err := c.validateImmutable(); err != nil {
+		return err
+	}
+	if err := c.validateABRedirects(); err != nil {
+		return err
+	}
+	if err := c.validateLangRedirect(); err != nil {
+		return err
+	}
+	if err := c.validateRootRedirect(); err != nil {
+		return err
+	}
+	if err := c.checkRedirectChains(); err != nil {
+		return err
+	}
+	if err := c.validateRewrites(); err != nil {
+		return err
+	}
+	for i, a := range c.RedirectExcludeAgents {
+		if a == "" {
+			return fmt.Errorf("redirect_exclude_agents[%d]: must not be empty", i)
+		}
+	}
+	if err := c.Index.validate(); err != nil {
+		return err
+	}
+	for host, hc := range c.Hosts {
+		if err := hc.validate(); err != nil {
+			return fmt.Errorf("hosts[%q].%v", host, err)
+		}
+	}
+	if err := c.validateSites(); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(c.WebRoot, "/") {
+		return fmt.Errorf(`webroot: %q must start with "/"`, c.WebRoot)
+	}
+	if !strings.HasPrefix(c.HookPath, "/") {
+		return fmt.Errorf(`hook: %q must start with "/"`, c.HookPath)
+	}
+	if !strings.HasPrefix(c.HealthPath, "/") {
+		return fmt.Errorf(`health: %q must start with "/"`, c.HealthPath)
+	}
+	if c.Metrics != nil && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf(`metrics.path: %q must start with "/"`, c.Metrics.Path)
+	}
+	for k, v := range c.Proxies {
+		if !strings.HasPrefix(k, "/") {
+			return fmt.Errorf(`proxies[%q]: prefix must start with "/"`, k)
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf(`proxies[%q]: %q is not an absolute http(s) URL`, k, v)
+		}
+	}
+	if err := c.validateNotFoundRedirect(); err != nil {
+		return err
+	}
+	if err := c.validateBucketOverrideKey(); err != nil {
+		return err
+	}
+	if err := c.validateDefaultCharset(); err != nil {
+		return err
+	}
+	if err := c.validateMethods(); err != nil {
+		return err
+	}
+	if err := c.validatePassthroughPaths(); err != nil {
+		return err
+	}
+	if err := c.validatePreload(); err != nil {
+		return err
+	}
+	if err := c.validateHTMLRewrite(); err != nil {
+		return err
+	}
+	if err := c.validateNoRange(); err != nil {
 		return err
 	}
-	defer r.Close()
-	if err := json.NewDecoder(r).Decode(&config); err != nil {
+	for i, d := range c.Downloads {
+		if !strings.HasPrefix(d, "/") && !strings.HasPrefix(d, ".") {
+			return fmt.Errorf(`downloads[%d]: %q must start with "/" or "."`, i, d)
+		}
+	}
+	if err := c.validateCompressible(); err != nil {
 		return err
 	}
-	if config.WebRoot == "" {
-		config.WebRoot = "/"
+	if c.BrotliQuality < 0 || c.BrotliQuality > brotli.BestCompression {
+		return fmt.Errorf("brotli_quality: %d is not within [0, %d]", c.BrotliQuality, brotli.BestCompression)
+	}
+	if c.MaxInlineBytes < 0 {
+		return fmt.Errorf("max_inline_bytes: %d must not be negative", c.MaxInlineBytes)
+	}
+	if lc := c.LocalCache; lc != nil && lc.StaleWhileRevalidate > 0 && lc.CacheTTL <= 0 {
+		return fmt.Errorf("local_cache.stale_while_revalidate: requires ttl")
+	}
+	if c.Maintenance != nil {
+		if err := c.Maintenance.validate(); err != nil {
+			return fmt.Errorf("maintenance.%v", err)
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.validate(); err != nil {
+			return fmt.Errorf("rate_limit.%v", err)
+		}
+	}
+	for i := range c.BasicAuth {
+		if err := c.BasicAuth[i].validate(); err != nil {
+			return fmt.Errorf("basic_auth[%d]: %v", i, err)
+		}
+	}
+	if c.SignPath != "" && !strings.HasPrefix(c.SignPath, "/") {
+		return fmt.Errorf(`sign_path: %q must start with "/"`, c.SignPath)
+	}
+	if c.SignPath != "" && len(c.SignPrefixes) == 0 {
+		return fmt.Errorf(`sign_prefixes: must not be empty when sign_path is set`)
 	}
-	if config.HookPath == "" {
-		config.HookPath = "/-/hook/gcs"
+	if d := time.Duration(c.SignExpiry); d < 0 || d > weasel.MaxSignedURLExpiry {
+		return fmt.Errorf(`sign_expiry: %v is not within [0, %v]`, d, weasel.MaxSignedURLExpiry)
 	}
-	if config.GCSBase == "" {
-		config.GCSBase = weasel.DefaultStorage.Base
+	if c.ShutdownGrace < 0 {
+		return fmt.Errorf("shutdown_grace: %v must not be negative", time.Duration(c.ShutdownGrace))
+	}
+	switch c.LogFormat {
+	case "", logFormatJSON, logFormatCommon, logFormatCombined:
+	default:
+		return fmt.Errorf(`log_format: %q is not one of "json", "common" or "combined"`, c.LogFormat)
+	}
+	switch c.TrailingSlash {
+	case "", slashIgnore, slashAdd, slashRemove:
+	default:
+		return fmt.Errorf(`trailing_slash: %q is not one of "add", "remove" or "ignore"`, c.TrailingSlash)
 	}
 	return nil
 }
+
+// configPath returns the config file name to read, given command line
+// arguments args. The value of configFlag takes precedence, then
+// configFileEnv, then configFile. If configFile does not exist, the first
+// existing configFilesYAML entry is returned. configFile is returned
+// when none of the files exist.
+func configPath(args []string) string {
+	if v, ok := configFlagValue(args); ok {
+		return v
+	}
+	if v := os.Getenv(configFileEnv); v != "" {
+		return v
+	}
+	if _, err := os.Stat(configFile); err == nil {
+		return configFile
+	}
+	for _, name := range configFilesYAML {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return configFile
+}
+
+// configFlagValue returns the non-empty value of the last configFlag
+// among args, if any. Like validateOnly, it does not use the flag package.
+func configFlagValue(args []string) (string, bool) {
+	var v string
+	for i, a := range args {
+		if strings.HasPrefix(a, "--") {
+			a = a[1:]
+		}
+		switch {
+		case a == configFlag && i+1 < len(args):
+			v = args[i+1]
+		case strings.HasPrefix(a, configFlag+"="):
+			v = a[len(configFlag)+1:]
+		}
+	}
+	return v, v != ""
+}
+
+// decodeError returns err of decoding contents b of config file name
+// with the file name and, for JSON errors, the line and column
+// of the offending input, e.g. "config.json:3:2: invalid character...".
+// Type errors also name the field and the expected type.
+func decodeError(name string, b []byte, err error) error {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		line, col := lineCol(b, err.Offset)
+		return fmt.Errorf("%s:%d:%d: %v", name, line, col, err)
+	case *json.UnmarshalTypeError:
+		line, col := lineCol(b, err.Offset)
+		field := err.Field
+		if field == "" {
+			field = "(root)"
+		}
+		return fmt.Errorf("%s:%d:%d: field %s: expected %v, got JSON %s", name, line, col, field, err.Type, err.Value)
+	default:
+		return fmt.Errorf("%s: %v", name, err)
+	}
+}
+
+// lineCol returns 1-based line and column numbers of the last byte
+// read by encoding/json before an error at offset in b,
+// i.e. the offending character or the end of a mistyped value.
+func lineCol(b []byte, offset int64) (line, col int) {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	if offset > 0 {
+		offset--
+	}
+	line, col = 1, 1
+	for _, c := range b[:offset] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// decodeConfig decodes b into c, usually an appConfig, using the format
+// inferred from the file name extension.
+func decodeConfig(name string, b []byte, c interface{}) error {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(b, c)
+	default:
+		return json.Unmarshal(b, c)
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	const (
+		jsonConf = `{"buckets": {"default": "bucket", "host": ["new", "old"]}, "index": "index.html"}`
+		yamlConf = "# comment\nbuckets:\n  default: bucket\n  host: [new, old]\nindex: index.html\n"
+	)
+	want := appConfig{
+		Buckets: map[string]bucketList{"default": {"bucket"}, "host": {"new", "old"}},
+		Index:   indexConfig{"/": {"index.html"}},
+	}
+	tests := []struct{ name, data string }{
+		{"config.json", jsonConf},
+		{"config.yaml", yamlConf},
+		{"config.yml", yamlConf},
+	}
+	for _, test := range tests {
+		var c appConfig
+		if err := decodeConfig(test.name, []byte(test.data), &c); err != nil {
+			t.Errorf("%s: decodeConfig: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s: c = %+v; want %+v", test.name, c, want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct{ name, data, err string }{
+		{"config.json", "{\n  \"buckets\": {\"default\": \"b\"},\n}\n",
+			`config.json:3:1: invalid character '}' looking for beginning of object key string`},
+		{"config.json", "{\"buckets\": {\"default\": \"b\"}",
+			`config.json:1:28: unexpected end of JSON input`},
+		{"config.json", "{\n  \"webroot\": 3\n}",
+			`config.json:2:14: field webroot: expected string, got JSON number`},
+		{"config.json", "{\"local_cache\": {\"max_bytes\": \"1MB\"}}",
+			`config.json:1:35: field local_cache.max_bytes: expected int64, got JSON string`},
+		{"config.json", "[]",
+			`config.json:1:1: field (root): expected server.appConfig, got JSON array`},
+		{"config.json", "{\"buckets\": {\"default\": {\"bucket\": \"b\", \"base\": \"cdn\"}}}",
+			`config.json: buckets["default"]: base "cdn" is not an absolute http(s) URL`},
+		{"config.yaml", "buckets:\n  default: [\n",
+			`config.yaml: yaml: line 2: did not find expected node content`},
+	}
+	for i, test := range tests {
+		name := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(name, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(name)
+		want := filepath.Join(dir, test.err)
+		if err == nil || err.Error() != want {
+			t.Errorf("%d: loadConfig(%q) = %v; want %q", i, test.data, err, want)
+		}
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	touch := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v := configPath(nil); v != configFile {
+		t.Errorf("no files: configPath() = %q; want %q", v, configFile)
+	}
+	touch("config.yaml")
+	if v := configPath(nil); v != "config.yaml" {
+		t.Errorf("yaml only: configPath() = %q; want config.yaml", v)
+	}
+	touch(configFile)
+	if v := configPath(nil); v != configFile {
+		t.Errorf("json and yaml: configPath() = %q; want %q", v, configFile)
+	}
+	t.Setenv(configFileEnv, "config.yaml")
+	if v := configPath(nil); v != "config.yaml" {
+		t.Errorf("%s set: configPath() = %q; want config.yaml", configFileEnv, v)
+	}
+	for _, args := range [][]string{
+		{"-config", "other.yaml"},
+		{"--config=other.yaml"},
+		{"-config=first.json", "-validate", "--config", "other.yaml"},
+	} {
+		if v := configPath(args); v != "other.yaml" {
+			t.Errorf("%q: configPath() = %q; want other.yaml", args, v)
+		}
+	}
+	for _, args := range [][]string{{"-config"}, {"-config="}, {"-configure", "other.yaml"}} {
+		if v := configPath(args); v != "config.yaml" {
+			t.Errorf("%q: configPath() = %q; want config.yaml", args, v)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fixtures", "site.yaml")
+	if err := os.Mkdir(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("buckets:\n  default: fixture-bucket\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *appConfig) { setConfig(c) }(currentConfig())
+
+	if err := readConfig(name); err != nil {
+		t.Fatalf("readConfig(%q): %v", name, err)
+	}
+	if v := currentConfig().Buckets["default"].primary(); v != "fixture-bucket" {
+		t.Errorf("default bucket = %q; want fixture-bucket", v)
+	}
+	if v, _, _ := configStatus(); v != name {
+		t.Errorf("configStatus() name = %q; want %q", v, name)
+	}
+	if err := readConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("readConfig(missing.json): err = nil")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *appConfig {
+		return &appConfig{
+			Redirects:  map[string]redirect{"/old": {To: "https://example.com"}},
+			Buckets:    map[string]bucketList{"default": {"bucket"}},
+			WebRoot:    "/",
+			HookPath:   "/-/hook/gcs",
+			HealthPath: "/healthz",
+		}
+	}
+	if err := valid().validate(); err != nil {
+		t.Fatalf("valid().validate(): %v", err)
+	}
+
+	tests := []struct {
+		edit func(c *appConfig)
+		err  string
+	}{
+		{func(c *appConfig) { c.Buckets = nil }, `buckets: must contain "default" key`},
+		{func(c *appConfig) { c.Buckets = map[string]bucketList{"host": {"b"}} }, `buckets: must contain "default" key`},
+		{func(c *appConfig) { c.Buckets["*"] = bucketList{"b"} }, `buckets["*"]: wildcard must be a leading "*." label`},
+		{func(c *appConfig) { c.Buckets["pr-*.goa.design"] = bucketList{"b"} }, `buckets["pr-*.goa.design"]: wildcard must be a leading "*." label`},
+		{func(c *appConfig) { c.Buckets["host"] = bucketList{} }, `buckets["host"]: must not be empty`},
+		{func(c *appConfig) { c.BucketPaths = map[string]bucketList{"host/a/": {"b", ""}} }, `bucket_paths["host/a/"]: bucket name must not be empty`},
+		{func(c *appConfig) { c.Redirects["/old"] = redirect{To: "https://example.com/"} }, `redirects["/old"]: value must not end with "/"`},
+		{func(c *appConfig) { c.Redirects["/old"] = redirect{To: "/new", Code: 200} }, `redirects["/old"]: code 200 is not one of 301, 302, 307 or 308`},
+		{func(c *appConfig) { c.Redirects["/old"] = redirect{To: "/new", Code: 303} }, `redirects["/old"]: code 303 is not one of 301, 302, 307 or 308`},
+		{func(c *appConfig) { c.RedirectExcludeAgents = []string{"Pingdom", ""} }, `redirect_exclude_agents[1]: must not be empty`},
+		{func(c *appConfig) { c.KeyTransform = map[string]keyTransform{"legacy": {Prefix: "public/"}} }, `key_transform["legacy"]: not a bucket of buckets or bucket_paths`},
+		{func(c *appConfig) { c.KeyTransform = map[string]keyTransform{"bucket": {Prefix: "/public/"}} }, `key_transform["bucket"].prefix: "/public/" must not start with "/"`},
+		{func(c *appConfig) { v := 1.5; c.NotFoundLogSample = &v }, `not_found_log_sample: 1.5 is not within [0, 1]`},
+		{func(c *appConfig) { v := -0.1; c.NotFoundLogSample = &v }, `not_found_log_sample: -0.1 is not within [0, 1]`},
+		{func(c *appConfig) { c.HSTS = &hstsConfig{} }, `hsts.max_age: 0s must be at least 1s`},
+		{func(c *appConfig) {
+			c.HSTS = &hstsConfig{MaxAge: duration(hstsPreloadMinAge), Preload: true}
+		}, `hsts.preload: requires include_subdomains`},
+		{func(c *appConfig) {
+			c.HSTS = &hstsConfig{MaxAge: duration(time.Hour), IncludeSubdomains: true, Preload: true}
+		}, `hsts.preload: max_age 1h0m0s is shorter than 8760h0m0s`},
+		{func(c *appConfig) { c.Compressible = []string{"application/wasm", "wasm"} }, `compressible[1]: "wasm" is not a media type`},
+		{func(c *appConfig) { c.Compressible = []string{"text/html; charset=utf-8"} }, `compressible[0]: "text/html; charset=utf-8" is not a media type`},
+		{func(c *appConfig) { c.ExtraVary = []string{"X-Device", ""} }, `extra_vary[1]: "" is not a header name`},
+		{func(c *appConfig) { c.ExtraVary = []string{"Accept, Origin"} }, `extra_vary[0]: "Accept, Origin" is not a header name`},
+		{func(c *appConfig) { c.Negotiate = map[string][]negotiateCandidate{"api/spec": {{Ext: ".json"}}} }, `negotiate["api/spec"]: must start with "/"`},
+		{func(c *appConfig) { c.Negotiate = map[string][]negotiateCandidate{"/spec.json": {{Ext: ".json"}}} }, `negotiate["/spec.json"]: must be an extensionless path`},
+		{func(c *appConfig) { c.Negotiate = map[string][]negotiateCandidate{"/spec": nil} }, `negotiate["/spec"]: must have a candidate`},
+		{func(c *appConfig) {
+			c.Negotiate = map[string][]negotiateCandidate{"/spec": {{Ext: ".json"}, {Ext: "yaml"}}}
+		}, `negotiate["/spec"][1].ext: "yaml" is not a file extension`},
+		{func(c *appConfig) { c.Negotiate = map[string][]negotiateCandidate{"/spec": {{Ext: ".nosuchext"}}} }, `negotiate["/spec"][0].type: must be set, ".nosuchext" has no known type`},
+		{func(c *appConfig) {
+			c.Negotiate = map[string][]negotiateCandidate{"/spec": {{Ext: ".yaml", Type: "yaml"}}}
+		}, `negotiate["/spec"][0].type: "yaml" is not a media type`},
+		{func(c *appConfig) { c.RequestIDHeader = "X-Request Id" }, `request_id_header: "X-Request Id" is not a header name`},
+		{func(c *appConfig) { c.Favicon = "favicon.ico" }, `favicon: "favicon.ico" must start with "/" or "data:"`},
+		{func(c *appConfig) { c.Favicon = "/" }, `favicon: must name an object`},
+		{func(c *appConfig) { c.Favicon = "data:image/png,raw" }, `favicon: data URL must be base64 encoded`},
+		{func(c *appConfig) { c.Favicon = "data:image/png;base64,!!" }, `favicon: illegal base64 data at input byte 0`},
+		{func(c *appConfig) { c.SlowRequestThreshold = duration(-time.Second) }, `slow_request_threshold: -1s must not be negative`},
+		{func(c *appConfig) { c.CacheVaryQuery = []string{"env", ""} }, `cache_vary_query[1]: must not be empty`},
+		{func(c *appConfig) { c.CacheVaryQuery = []string{"env", "v", "env"} }, `cache_vary_query[2]: "env" is listed twice`},
+		{func(c *appConfig) { c.StripRequestHeaders = []string{"Cookie", "X-Bad Header"} }, `strip_request_headers[1]: "X-Bad Header" is not a header name`},
+		{func(c *appConfig) { c.SetRequestHeaders = map[string]string{"": "v"} }, `set_request_headers[""]: not a header name`},
+		{func(c *appConfig) { c.SetRequestHeaders = map[string]string{"host": "evil.com"} }, `set_request_headers["host"]: host cannot be set`},
+		{func(c *appConfig) { c.SetRequestHeaders = map[string]string{"X-Env": "a\r\nX-Other: b"} }, `set_request_headers["X-Env"]: value must not contain line breaks`},
+		{func(c *appConfig) {
+			c.StripRequestHeaders = []string{"x-auth"}
+			c.SetRequestHeaders = map[string]string{"X-Auth": "none"}
+		}, `set_request_headers["X-Auth"]: conflicts with strip_request_headers`},
+		{func(c *appConfig) { c.RootRedirect = &redirect{} }, `root_redirect.to: must not be empty`},
+		{func(c *appConfig) { c.RootRedirect = &redirect{To: "/?lang=en"} }, `root_redirect.to: "/?lang=en" would redirect "/" to itself`},
+		{func(c *appConfig) { c.RootRedirect = &redirect{To: "/home/", Code: 200} }, `root_redirect.code: 200 is not one of 301, 302, 307 or 308`},
+		{func(c *appConfig) { c.Immutable = []string{"/static/*", "*.js"} }, `immutable[1]: "*.js" must start with "/"`},
+		{func(c *appConfig) { c.Manifests = []string{"version.json"} }, `manifests[0]: "version.json" must start with "/"`},
+		{func(c *appConfig) { c.ImmutableMaxBytes = -1 }, `immutable_max_bytes: -1 must not be negative`},
+		{func(c *appConfig) { c.Mirror = map[string]mirrorConfig{"other": {Bucket: "other-eu"}} }, `mirror["other"]: not a bucket of buckets or bucket_paths`},
+		{func(c *appConfig) { c.Mirror = map[string]mirrorConfig{"bucket": {}} }, `mirror["bucket"].bucket: must not be empty`},
+		{func(c *appConfig) { c.Mirror = map[string]mirrorConfig{"bucket": {Bucket: "bucket"}} }, `mirror["bucket"].bucket: must differ from the primary bucket`},
+		{func(c *appConfig) {
+			c.Mirror = map[string]mirrorConfig{"bucket": {Bucket: "bucket-eu", Base: "storage.example.com"}}
+		}, `mirror["bucket"].base: "storage.example.com" is not an absolute http(s) URL`},
+		{func(c *appConfig) { c.Mirror = map[string]mirrorConfig{"bucket": {Bucket: "bucket-eu", Failures: -1}} }, `mirror["bucket"].failures: -1 must not be negative`},
+		{func(c *appConfig) {
+			c.Mirror = map[string]mirrorConfig{"bucket": {Bucket: "bucket-eu", Cooldown: duration(-time.Second)}}
+		}, `mirror["bucket"].cooldown: -1s must not be negative`},
+		{func(c *appConfig) { c.Feed = &feedConfig{Link: "https://example.com"} }, `feed.title: must not be empty`},
+		{func(c *appConfig) { c.Feed = &feedConfig{Title: "Blog", Link: "example.com"} }, `feed.link: "example.com" is not an absolute http(s) URL`},
+		{func(c *appConfig) {
+			c.Feed = &feedConfig{Title: "Blog", Prefix: "/blog/", Link: "https://example.com"}
+		}, `feed.prefix: "/blog/" must not start with "/"`},
+		{func(c *appConfig) { c.Feed = &feedConfig{Path: "feed.xml", Title: "Blog"} }, `feed.path: "feed.xml" must start with "/"`},
+		{func(c *appConfig) { c.MaxRequestBody = -1 }, `max_request_body: -1 must not be negative`},
+		{func(c *appConfig) { c.ABRedirects = map[string][]abVariant{"landing": {{"/a/", 1}}} }, `ab_redirects["landing"]: must start with "/"`},
+		{func(c *appConfig) { c.ABRedirects = map[string][]abVariant{"/landing": {{"", 1}}} }, `ab_redirects["/landing"][0].target: must not be empty`},
+		{func(c *appConfig) {
+			c.ABRedirects = map[string][]abVariant{"/landing": {{"/a/", 1}, {"/b/", -1}}}
+		}, `ab_redirects["/landing"][1].weight: -1 must not be negative`},
+		{func(c *appConfig) { c.ABRedirects = map[string][]abVariant{"/landing": {{"/a/", 0}}} }, `ab_redirects["/landing"]: must have a variant of positive weight`},
+		{func(c *appConfig) { c.ABRedirects = map[string][]abVariant{"/old": {{"/a/", 1}}} }, `ab_redirects["/old"]: conflicts with redirects["/old"]`},
+		{func(c *appConfig) { c.ABCookie = "ab variant" }, `ab_cookie: "ab variant" is not a cookie name`},
+		{func(c *appConfig) { c.LangRedirect = map[string]langRedirect{"docs": {Default: "/en/"}} }, `lang_redirect["docs"]: must start with "/"`},
+		{func(c *appConfig) { c.LangRedirect = map[string]langRedirect{"/": {}} }, `lang_redirect["/"].default: must not be empty`},
+		{func(c *appConfig) {
+			c.LangRedirect = map[string]langRedirect{"/": {Langs: map[string]string{"fr;q=1": "/fr/"}, Default: "/en/"}}
+		}, `lang_redirect["/"].langs["fr;q=1"]: not a language tag`},
+		{func(c *appConfig) {
+			c.LangRedirect = map[string]langRedirect{"/": {Langs: map[string]string{"fr": ""}, Default: "/en/"}}
+		}, `lang_redirect["/"].langs["fr"]: must not be empty`},
+		{func(c *appConfig) {
+			c.LangRedirect = map[string]langRedirect{"/": {Default: "/en/"}}
+			c.RootRedirect = &redirect{To: "/home/"}
+		}, `lang_redirect["/"]: conflicts with root_redirect`},
+		{func(c *appConfig) {
+			c.LangRedirect = map[string]langRedirect{"/docs": {Default: "/en/"}}
+			c.Redirects = map[string]redirect{"/docs": {To: "/d"}}
+		}, `lang_redirect["/docs"]: conflicts with redirects["/docs"]`},
+		{func(c *appConfig) {
+			c.RootRedirect = &redirect{To: "/home/"}
+			c.Redirects["/"] = redirect{To: "/home"}
+		}, `root_redirect: conflicts with redirects["/"]`},
+		{func(c *appConfig) { c.Rewrites = map[string]string{"old.css": "/new.css"} }, `rewrites["old.css"]: key must start with "/"`},
+		{func(c *appConfig) { c.Rewrites = map[string]string{"/img/*.png": "/png"} }, `rewrites["/img/*.png"]: wildcard must be a trailing "/*"`},
+		{func(c *appConfig) { c.Rewrites = map[string]string{"/old.css": "new.css"} }, `rewrites["/old.css"]: value must start with "/"`},
+		{func(c *appConfig) {
+			c.Redirects = map[string]redirect{"/old.css": {To: "/new.css"}}
+			c.Rewrites = map[string]string{"/old.css": "/new.css"}
+		}, `rewrites["/old.css"]: conflicts with redirects["/old.css"]`},
+		{func(c *appConfig) {
+			c.Redirects = map[string]redirect{"/docs/": {To: "https://docs.example.com"}}
+			c.Rewrites = map[string]string{"/docs/old.css": "/new.css"}
+		}, `rewrites["/docs/old.css"]: conflicts with redirects["/docs/"]`},
+		{func(c *appConfig) {
+			c.Redirects = map[string]redirect{"example.com/img/old/a.png": {To: "/a.png"}}
+			c.Rewrites = map[string]string{"/img/old/*": "/img/new"}
+		}, `rewrites["/img/old/*"]: conflicts with redirects["example.com/img/old/a.png"]`},
+		{func(c *appConfig) { c.Index = indexConfig{"docs/": {"README.html"}} }, `index["docs/"]: prefix must start with "/"`},
+		{func(c *appConfig) { c.Index = indexConfig{"/docs/": {}} }, `index["/docs/"]: must not be empty`},
+		{func(c *appConfig) { c.Index = indexConfig{"/docs/": {"a/README.html"}} }, `index["/docs/"]: "a/README.html" is not a file name`},
+		{func(c *appConfig) { c.Hosts = map[string]hostConfig{"h": {WebRoot: "root"}} }, `hosts["h"].webroot: "root" must start with "/"`},
+		{func(c *appConfig) { c.Hosts = map[string]hostConfig{"h": {Index: indexConfig{"/": {""}}}} }, `hosts["h"].index["/"]: "" is not a file name`},
+		{func(c *appConfig) { c.Sites = map[string]*appConfig{"default": {}} }, `sites["default"]: not a host`},
+		{func(c *appConfig) { c.Sites = map[string]*appConfig{"a.example.com": nil} }, `sites["a.example.com"]: must not be empty`},
+		{func(c *appConfig) {
+			c.Hosts = map[string]hostConfig{"a.example.com": {}}
+			c.Sites = map[string]*appConfig{"a.example.com": {}}
+		}, `sites["a.example.com"]: conflicts with hosts["a.example.com"]`},
+		{func(c *appConfig) { c.Sites = map[string]*appConfig{"a.example.com": {WebRoot: "/a"}} }, `sites["a.example.com"].webroot: not supported per site`},
+		{func(c *appConfig) {
+			c.Sites = map[string]*appConfig{"a.example.com": {Index: indexConfig{"/docs/": {}}}}
+		}, `sites["a.example.com"].index["/docs/"]: must not be empty`},
+		{func(c *appConfig) { c.WebRoot = "root" }, `webroot: "root" must start with "/"`},
+		{func(c *appConfig) { c.HookPath = "" }, `hook: "" must start with "/"`},
+		{func(c *appConfig) { c.HealthPath = "health" }, `health: "health" must start with "/"`},
+		{func(c *appConfig) { c.Proxies = map[string]string{"search/": "https://search.example.com"} }, `proxies["search/"]: prefix must start with "/"`},
+		{func(c *appConfig) { c.Proxies = map[string]string{"/search/": "search.example.com"} }, `proxies["/search/"]: "search.example.com" is not an absolute http(s) URL`},
+		{func(c *appConfig) { c.Transport = &transportConfig{MaxIdleConns: -1} }, `transport.max_idle_conns: -1 must not be negative`},
+		{func(c *appConfig) { c.Transport = &transportConfig{DialTimeout: duration(-time.Second)} }, `transport.dial_timeout: -1s must not be negative`},
+		{func(c *appConfig) { c.BucketOverrideKey = "short" }, `bucket_override_key: must be at least 16 characters long`},
+		{func(c *appConfig) { c.CSP = &cspConfig{} }, `csp.report_only: must not be empty`},
+		{func(c *appConfig) {
+			c.CSP = &cspConfig{ReportOnly: "default-src 'self'; report-uri https://example.com/r"}
+		}, `csp.report_only: report endpoints are set to /_csp-report`},
+		{func(c *appConfig) { c.NotFoundRedirect = map[string]string{"docs/": "/search"} }, `not_found_redirect["docs/"]: prefix must start with "/"`},
+		{func(c *appConfig) { c.NotFoundRedirect = map[string]string{"/docs/": "search"} }, `not_found_redirect["/docs/"]: "search" is neither a path nor an absolute http(s) URL`},
+		{func(c *appConfig) { c.NotFoundRedirect = map[string]string{"/docs/": "//evil.example.com/"} }, `not_found_redirect["/docs/"]: "//evil.example.com/" is neither a path nor an absolute http(s) URL`},
+		{func(c *appConfig) { c.NotFoundRedirect = map[string]string{"/docs/": "/search/{path}"} }, `not_found_redirect["/docs/"]: {path} must be in the query of "/search/{path}"`},
+		{func(c *appConfig) { c.DefaultCharset = "utf 8" }, `default_charset: "utf 8" is not a charset name`},
+		{func(c *appConfig) { c.Methods = map[string][]string{"forms/": {"POST"}} }, `methods["forms/"]: prefix must start with "/"`},
+		{func(c *appConfig) { c.Methods = map[string][]string{"/forms/": {}} }, `methods["/forms/"]: must not be empty`},
+		{func(c *appConfig) { c.Methods = map[string][]string{"/forms/": {"post"}} }, `methods["/forms/"]: "post" is not an upper case method name`},
+		{func(c *appConfig) { c.Methods = map[string][]string{"/forms/": {"GET", "GET"}} }, `methods["/forms/"]: "GET" is listed twice`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"admin/"} }, `passthrough[0]: "admin/" must start with "/"`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"/"} }, `passthrough[0]: "/" would shadow all paths`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"/_ah/admin"} }, `passthrough[0]: "/_ah/admin" is reserved for App Engine`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"/a/", "/a/"} }, `passthrough[1]: duplicate "/a/"`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"/-/"} }, `passthrough[0]: "/-/" would shadow hook "/-/hook/gcs"`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"/healthz"} }, `passthrough[0]: "/healthz" would shadow health "/healthz"`},
+		{func(c *appConfig) { c.PassthroughPaths = []string{"/.well-known/"} }, `passthrough[0]: "/.well-known/" would shadow acme "/.well-known/acme-challenge/"`},
+		{func(c *appConfig) { c.Preload = map[string][]preloadLink{"/*": {{As: "style"}}} }, `preload["/*"][0].href: must not be empty`},
+		{func(c *appConfig) { c.Preload = map[string][]preloadLink{"/*": {{Href: "/a b.css", As: "style"}}} }, `preload["/*"][0].href: "/a b.css" is not a valid URL reference`},
+		{func(c *appConfig) {
+			c.Preload = map[string][]preloadLink{"/*": {{Href: "/app.css", As: "style; nopush"}}}
+		}, `preload["/*"][0].as: "style; nopush" is not a request destination`},
+		{func(c *appConfig) {
+			c.HTMLRewrite = map[string]htmlRewrite{"/*": {Origins: map[string]string{"static/": "https://cdn.example.com"}}}
+		}, `html_rewrite["/*"].origins["static/"]: prefix must be a path starting with "/"`},
+		{func(c *appConfig) {
+			c.HTMLRewrite = map[string]htmlRewrite{"/*": {Origins: map[string]string{"/static/": "https://cdn.example.com/assets"}}}
+		}, `html_rewrite["/*"].origins["/static/"]: "https://cdn.example.com/assets" is not an http(s) origin`},
+		{func(c *appConfig) { c.NoRange = []string{"/live/*", "video"} }, `no_range[1]: "video" is not a path or a media type`},
+		{func(c *appConfig) { c.NoRange = []string{"text/html; charset=utf-8"} }, `no_range[0]: "text/html; charset=utf-8" is not a path or a media type`},
+		{func(c *appConfig) { c.Downloads = []string{"zip"} }, `downloads[0]: "zip" must start with "/" or "."`},
+		{func(c *appConfig) { c.BrotliQuality = 12 }, `brotli_quality: 12 is not within [0, 11]`},
+		{func(c *appConfig) { c.MaxInlineBytes = -1 }, `max_inline_bytes: -1 must not be negative`},
+		{func(c *appConfig) { c.ShutdownGrace = duration(-time.Second) }, `shutdown_grace: -1s must not be negative`},
+		{func(c *appConfig) { c.LogFormat = "apache" }, `log_format: "apache" is not one of "json", "common" or "combined"`},
+		{func(c *appConfig) {
+			c.LocalCache = &localCacheConfig{MaxBytes: 1 << 20, StaleWhileRevalidate: duration(time.Minute)}
+		}, `local_cache.stale_while_revalidate: requires ttl`},
+		{func(c *appConfig) { c.Maintenance = &maintenanceConfig{Allow: []allowRule{{IP: "10.0.0.0/33"}}} }, `maintenance.allow[0]: "10.0.0.0/33" is not an IP address or CIDR`},
+		{func(c *appConfig) {
+			c.Maintenance = &maintenanceConfig{Allow: []allowRule{{IP: "10.0.0.1"}, {Header: "X-Preview-Key"}}}
+		}, `maintenance.allow[1].equals: must not be empty`},
+		{func(c *appConfig) { c.RateLimit = &rateLimitConfig{} }, `rate_limit.rps: 0 must be positive`},
+		{func(c *appConfig) { c.RateLimit = &rateLimitConfig{RPS: 1, Burst: -1} }, `rate_limit.burst: -1 must not be negative`},
+		{func(c *appConfig) { c.RateLimit = &rateLimitConfig{RPS: 1, ExemptCIDRs: []string{"a"}} }, `rate_limit.exempt_cidrs[0]: "a" is not an IP address or CIDR`},
+		{func(c *appConfig) { c.BasicAuth = []basicAuthRule{{Prefix: "preview/"}} }, `basic_auth[0]: prefix "preview/" must start with "/"`},
+		{func(c *appConfig) { c.BasicAuth = []basicAuthRule{{Prefix: "/preview/"}} }, `basic_auth[0]: users: must not be empty`},
+		{func(c *appConfig) {
+			c.BasicAuth = []basicAuthRule{{Prefix: "/p/", Users: map[string]string{"u": "plain"}}}
+		}, `basic_auth[0]: users["u"]: crypto/bcrypt: hashedSecret too short to be a bcrypted password`},
+		{func(c *appConfig) { c.SignPath = "sign" }, `sign_path: "sign" must start with "/"`},
+		{func(c *appConfig) { c.SignPath = "/sign" }, `sign_prefixes: must not be empty when sign_path is set`},
+		{func(c *appConfig) { c.SignExpiry = duration(8 * 24 * time.Hour) }, `sign_expiry: 192h0m0s is not within [0, 168h0m0s]`},
+		{func(c *appConfig) { c.TrailingSlash = "keep" }, `trailing_slash: "keep" is not one of "add", "remove" or "ignore"`},
+	}
+	for i, test := range tests {
+		c := valid()
+		test.edit(c)
+		err := c.validate()
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%d: c.validate() = %v; want %q", i, err, test.err)
+		}
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	c := &appConfig{
+		Buckets: map[string]bucketList{"default": {"bucket"}, "host": {"host-bucket"}},
+		WebRoot: "/",
+		Index:   indexConfig{"/": {"index.html"}, "/docs/": {"README.html"}},
+		GCSBase: "https://storage.googleapis.com",
+	}
+	t.Setenv("GOA_GCS_BASE", "https://gcs.example.com")
+	t.Setenv("GOA_DEFAULT_BUCKET", "staging")
+	t.Setenv("GOA_WEBROOT", "")
+	t.Setenv("GOA_INDEX", "README.html")
+	t.Setenv("GOA_HOOK_PATH", "/hook")
+	t.Setenv("GOA_HOOK_TOKEN", "secret")
+	c.applyEnv()
+
+	want := &appConfig{
+		Buckets:   map[string]bucketList{"default": {"staging"}, "host": {"host-bucket"}},
+		WebRoot:   "/",
+		Index:     indexConfig{"/": {"README.html"}, "/docs/": {"README.html"}},
+		HookPath:  "/hook",
+		HookToken: "secret",
+		GCSBase:   "https://gcs.example.com",
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("c = %+v; want %+v", c, want)
+	}
+
+	// env overrides must work with no buckets in the file
+	c = &appConfig{}
+	c.applyEnv()
+	if v := c.Buckets["default"].primary(); v != "staging" {
+		t.Errorf("c.Buckets[default] = %q; want staging", v)
+	}
+}
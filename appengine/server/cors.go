@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMethods is the default value of corsConfig.AllowMethods.
+var defaultCORSMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+// corsConfig is the Cross-Origin Resource Sharing section of appConfig.
+type corsConfig struct {
+	// AllowOrigins is a list of origins allowed to access served objects,
+	// e.g. "https://app.example.com". A single "*" allows any origin.
+	AllowOrigins []string `json:"allow_origins" yaml:"allow_origins"`
+	// AllowMethods defaults to defaultCORSMethods.
+	AllowMethods []string `json:"allow_methods" yaml:"allow_methods"`
+	// MaxAge is how long preflight responses may be cached.
+	MaxAge duration `json:"max_age" yaml:"max_age"`
+}
+
+// allowOrigin returns Access-Control-Allow-Origin value for the request origin,
+// or an empty string if the origin is not allowed.
+func (c *corsConfig) allowOrigin(origin string) string {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// serveCORS sets CORS response headers if the current config has CORS section
+// and r comes from an allowed origin. Requests without Origin header are ignored.
+// It returns true if r is a preflight request, in which case the response
+// has been written.
+func serveCORS(w http.ResponseWriter, r *http.Request) bool {
+	c := currentConfig().CORS
+	origin := r.Header.Get("origin")
+	if c == nil || origin == "" {
+		return false
+	}
+	h := w.Header()
+	allow := c.allowOrigin(origin)
+	if allow != "*" {
+		addVary(h, "Origin")
+	}
+	if allow == "" {
+		return false
+	}
+	h.Set("access-control-allow-origin", allow)
+	if r.Method != "OPTIONS" || r.Header.Get("access-control-request-method") == "" {
+		return false
+	}
+
+	// preflight
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	h.Set("access-control-allow-methods", strings.Join(methods, ", "))
+	if v := r.Header.Get("access-control-request-headers"); v != "" {
+		h.Set("access-control-allow-headers", v)
+	}
+	if c.MaxAge > 0 {
+		h.Set("access-control-max-age", strconv.Itoa(int(time.Duration(c.MaxAge)/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
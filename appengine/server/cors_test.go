@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe_CORS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		allow          []string
+		method, origin string
+		preflight      bool
+		code           int
+		acao           string
+		varyOrigin     bool
+	}{
+		{[]string{"https://app.example.com"}, "GET", "https://app.example.com", false, http.StatusOK, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "GET", "https://evil.example.com", false, http.StatusOK, "", true},
+		{[]string{"https://app.example.com"}, "GET", "", false, http.StatusOK, "", false},
+		{[]string{"*"}, "GET", "https://any.example.com", false, http.StatusOK, "*", false},
+		{[]string{"https://app.example.com"}, "OPTIONS", "https://app.example.com", true, http.StatusNoContent, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "OPTIONS", "https://evil.example.com", true, http.StatusNoContent, "", true},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.CORS = &corsConfig{AllowOrigins: test.allow, MaxAge: duration(time.Hour)}
+		})
+		req, _ := testInstance.NewRequest(test.method, "/manifest.json", nil)
+		if test.origin != "" {
+			req.Header.Set("origin", test.origin)
+		}
+		if test.preflight {
+			req.Header.Set("access-control-request-method", "GET")
+			req.Header.Set("access-control-request-headers", "x-custom")
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != test.code {
+			t.Errorf("%d: res.Code = %d; want %d", i, res.Code, test.code)
+		}
+		if v := res.Header().Get("access-control-allow-origin"); v != test.acao {
+			t.Errorf("%d: access-control-allow-origin = %q; want %q", i, v, test.acao)
+		}
+		vary := strings.Join(res.Header()["Vary"], ", ")
+		if v := strings.Contains(vary, "Origin"); v != test.varyOrigin {
+			t.Errorf("%d: vary = %q; want Origin: %v", i, vary, test.varyOrigin)
+		}
+		// disallowed preflights are answered as plain OPTIONS requests
+		if test.code != http.StatusNoContent || test.acao == "" {
+			continue
+		}
+		if v := res.Header().Get("access-control-allow-methods"); v != "GET, HEAD, OPTIONS" {
+			t.Errorf("%d: access-control-allow-methods = %q", i, v)
+		}
+		if v := res.Header().Get("access-control-allow-headers"); v != "x-custom" {
+			t.Errorf("%d: access-control-allow-headers = %q; want x-custom", i, v)
+		}
+		if v := res.Header().Get("access-control-max-age"); v != "3600" {
+			t.Errorf("%d: access-control-max-age = %q; want 3600", i, v)
+		}
+	}
+}
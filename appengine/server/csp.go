@@ -0,0 +1,255 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// cspReportPath is the path of the CSP violation report handler.
+	cspReportPath = "/_csp-report"
+	// cspEndpoint is the Reporting-Endpoints name of cspReportPath.
+	cspEndpoint = "csp-endpoint"
+	// maxCSPReportBody is the size limit of serveCSPReport request bodies,
+	// regardless of MaxRequestBody, since anyone may post them.
+	maxCSPReportBody = 64 << 10
+)
+
+// cspConfig is the CSP section of appConfig.
+type cspConfig struct {
+	// ReportOnly is the Content-Security-Policy-Report-Only policy
+	// of responses, e.g. "default-src 'self'". Violations are reported
+	// to cspReportPath; the policy must not name a report endpoint itself.
+	ReportOnly string `json:"report_only" yaml:"report_only"`
+	// ReportSample is the fraction, from 0 to 1, of violation reports
+	// which are logged, e.g. 0.1 to keep a flood of them down.
+	// It defaults to 1, logging all of them.
+	ReportSample *float64 `json:"report_sample" yaml:"report_sample"`
+}
+
+// value returns Content-Security-Policy-Report-Only header value of cc:
+// its policy with report directives of cspReportPath appended.
+// The report-uri directive is for browsers ignoring report-to.
+func (cc *cspConfig) value() string {
+	return strings.TrimRight(strings.TrimSpace(cc.ReportOnly), ";") +
+		"; report-uri " + cspReportPath + "; report-to " + cspEndpoint
+}
+
+// sampled reports whether a violation report is logged under cc.ReportSample.
+func (cc *cspConfig) sampled() bool {
+	return cc.ReportSample == nil || rand.Float64() < *cc.ReportSample
+}
+
+// validate reports an error if cc has no policy, its policy names a report
+// endpoint or contains a line break, or ReportSample is not within [0, 1].
+func (cc *cspConfig) validate() error {
+	p := strings.ToLower(cc.ReportOnly)
+	switch {
+	case strings.TrimSpace(p) == "":
+		return fmt.Errorf("report_only: must not be empty")
+	case strings.ContainsAny(p, "\r\n"):
+		return fmt.Errorf("report_only: must not contain line breaks")
+	case strings.Contains(p, "report-uri") || strings.Contains(p, "report-to"):
+		return fmt.Errorf("report_only: report endpoints are set to %s", cspReportPath)
+	}
+	if v := cc.ReportSample; v != nil && !(*v >= 0 && *v <= 1) {
+		return fmt.Errorf("report_sample: %v is not within [0, 1]", *v)
+	}
+	return nil
+}
+
+// cspReportOnly wraps h with Content-Security-Policy-Report-Only
+// and Reporting-Endpoints headers of the current config CSP.
+func cspReportOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cc := currentConfig().CSP; cc != nil {
+			w.Header().Set("content-security-policy-report-only", cc.value())
+			w.Header().Set("reporting-endpoints", cspEndpoint+`="`+cspReportPath+`"`)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// cspViolation is a CSP violation report, in either format of
+// parseCSPReports, as logged by writeCSPViolation.
+type cspViolation struct {
+	Report      bool   `json:"csp_report"` // marks the log entry kind
+	ID          string `json:"request_id,omitempty"`
+	DocumentURL string `json:"document_url"`
+	BlockedURL  string `json:"blocked_url,omitempty"`
+	Directive   string `json:"directive"`
+	Disposition string `json:"disposition,omitempty"`
+	SourceFile  string `json:"source_file,omitempty"`
+	Line        int    `json:"line,omitempty"`
+	Column      int    `json:"column,omitempty"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Sample      string `json:"sample,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+// legacyCSPReport is an application/csp-report body.
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		ColumnNumber       int    `json:"column-number"`
+		StatusCode         int    `json:"status-code"`
+		ScriptSample       string `json:"script-sample"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport is an element of an application/reports+json body.
+type reportingAPIReport struct {
+	Type      string `json:"type"`
+	UserAgent string `json:"user_agent"`
+	Body      struct {
+		DocumentURL        string `json:"documentURL"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+		ColumnNumber       int    `json:"columnNumber"`
+		StatusCode         int    `json:"statusCode"`
+		Sample             string `json:"sample"`
+	} `json:"body"`
+}
+
+// parseCSPReports decodes CSP violation reports of body with media type t,
+// either application/csp-report or application/reports+json, in which case
+// reports other than "csp-violation" are skipped.
+func parseCSPReports(t string, body []byte) ([]*cspViolation, error) {
+	switch t {
+	case "application/csp-report":
+		var rep legacyCSPReport
+		if err := json.Unmarshal(body, &rep); err != nil {
+			return nil, err
+		}
+		cr := rep.Report
+		v := &cspViolation{
+			DocumentURL: cr.DocumentURI,
+			BlockedURL:  cr.BlockedURI,
+			Directive:   cr.EffectiveDirective,
+			Disposition: cr.Disposition,
+			SourceFile:  cr.SourceFile,
+			Line:        cr.LineNumber,
+			Column:      cr.ColumnNumber,
+			StatusCode:  cr.StatusCode,
+			Sample:      cr.ScriptSample,
+		}
+		if v.Directive == "" {
+			v.Directive = cr.ViolatedDirective
+		}
+		return []*cspViolation{v}, nil
+	case "application/reports+json":
+		var reps []reportingAPIReport
+		if err := json.Unmarshal(body, &reps); err != nil {
+			return nil, err
+		}
+		var list []*cspViolation
+		for _, rep := range reps {
+			if rep.Type != "csp-violation" {
+				continue
+			}
+			b := rep.Body
+			list = append(list, &cspViolation{
+				DocumentURL: b.DocumentURL,
+				BlockedURL:  b.BlockedURL,
+				Directive:   b.EffectiveDirective,
+				Disposition: b.Disposition,
+				SourceFile:  b.SourceFile,
+				Line:        b.LineNumber,
+				Column:      b.ColumnNumber,
+				StatusCode:  b.StatusCode,
+				Sample:      b.Sample,
+				UserAgent:   rep.UserAgent,
+			})
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unsupported content type %q", t)
+}
+
+// writeCSPViolation sends a CSP violation log entry to App Engine logs
+// at warning level, as JSON. Tests may replace it.
+var writeCSPViolation = func(ctx context.Context, v *cspViolation) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf(ctx, "json.Marshal: %v", err)
+		return
+	}
+	log.Warningf(ctx, "%s", b)
+}
+
+// serveCSPReport logs CSP violation reports of a POST request body,
+// sampled with the current config CSP ReportSample, and responds with 204.
+// Bodies of other types than those of parseCSPReports get 415 status code,
+// malformed ones 400 and those over maxCSPReportBody 413. It responds with 404 if CSP is not configured.
+func serveCSPReport(w http.ResponseWriter, r *http.Request) {
+	cc := currentConfig().CSP
+	if cc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("allow", "POST")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	t, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	if t != "application/csp-report" && t != "application/reports+json" {
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportBody))
+	if err != nil {
+		http.Error(w, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+	list, err := parseCSPReports(t, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := newContext(r)
+	id := requestIDFrom(ctx)
+	for _, v := range list {
+		if !cc.sampled() {
+			continue
+		}
+		v.Report, v.ID = true, id
+		if v.UserAgent == "" {
+			v.UserAgent = r.UserAgent()
+		}
+		writeCSPViolation(ctx, v)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
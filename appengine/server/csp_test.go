@@ -0,0 +1,150 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestServe_CSPReportOnly(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.CSP = &cspConfig{ReportOnly: "default-src 'self';"}
+	})()
+	req, _ := testInstance.NewRequest("GET", "/missing.html", nil)
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	want := "default-src 'self'; report-uri /_csp-report; report-to csp-endpoint"
+	if v := res.Header().Get("content-security-policy-report-only"); v != want {
+		t.Errorf("content-security-policy-report-only = %q; want %q", v, want)
+	}
+	if v := res.Header().Get("reporting-endpoints"); v != `csp-endpoint="/_csp-report"` {
+		t.Errorf("reporting-endpoints = %q; want csp-endpoint=\"/_csp-report\"", v)
+	}
+}
+
+func TestServe_CSPReport(t *testing.T) {
+	var logged []*cspViolation
+	defer func(f func(context.Context, *cspViolation)) { writeCSPViolation = f }(writeCSPViolation)
+	writeCSPViolation = func(_ context.Context, v *cspViolation) {
+		logged = append(logged, v)
+	}
+	zero := 0.0
+
+	const legacy = `{"csp-report": {
+		"document-uri": "https://example.com/page.html",
+		"referrer": "",
+		"violated-directive": "script-src-elem",
+		"effective-directive": "script-src-elem",
+		"original-policy": "default-src 'self'; report-uri /_csp-report",
+		"disposition": "report",
+		"blocked-uri": "https://evil.example.net/x.js",
+		"line-number": 12,
+		"column-number": 3,
+		"source-file": "https://example.com/page.html",
+		"status-code": 200,
+		"script-sample": ""
+	}}`
+	const reporting = `[{
+		"age": 10,
+		"type": "csp-violation",
+		"url": "https://example.com/page.html",
+		"user_agent": "Browser/1.0",
+		"body": {
+			"blockedURL": "inline",
+			"documentURL": "https://example.com/page.html",
+			"effectiveDirective": "style-src-attr",
+			"disposition": "report",
+			"lineNumber": 7,
+			"statusCode": 200,
+			"sample": "color: red"
+		}
+	}, {"type": "deprecation", "body": {}}]`
+
+	tests := []struct {
+		method, ctype, body string
+		sample              *float64
+		code                int
+		logged              []*cspViolation
+	}{
+		{"POST", "application/csp-report", legacy, nil, http.StatusNoContent, []*cspViolation{{
+			Report:      true,
+			DocumentURL: "https://example.com/page.html",
+			BlockedURL:  "https://evil.example.net/x.js",
+			Directive:   "script-src-elem",
+			Disposition: "report",
+			SourceFile:  "https://example.com/page.html",
+			Line:        12,
+			Column:      3,
+			StatusCode:  200,
+			UserAgent:   "Test/1.0",
+		}}},
+		{"POST", "application/reports+json", reporting, nil, http.StatusNoContent, []*cspViolation{{
+			Report:      true,
+			DocumentURL: "https://example.com/page.html",
+			BlockedURL:  "inline",
+			Directive:   "style-src-attr",
+			Disposition: "report",
+			Line:        7,
+			StatusCode:  200,
+			Sample:      "color: red",
+			UserAgent:   "Browser/1.0",
+		}}},
+		{"POST", "application/csp-report", legacy, &zero, http.StatusNoContent, nil},
+		{"POST", "application/csp-report", `{"csp-report": `, nil, http.StatusBadRequest, nil},
+		{"POST", "application/json", legacy, nil, http.StatusUnsupportedMediaType, nil},
+		{"POST", "application/csp-report", strings.Repeat(" ", maxCSPReportBody) + legacy, nil, http.StatusRequestEntityTooLarge, nil},
+		{"GET", "", "", nil, http.StatusMethodNotAllowed, nil},
+	}
+	for i, test := range tests {
+		logged = nil
+		restore := withConfig(func(c *appConfig) {
+			c.CSP = &cspConfig{ReportOnly: "default-src 'self'", ReportSample: test.sample}
+		})
+		req, _ := testInstance.NewRequest(test.method, cspReportPath, strings.NewReader(test.body))
+		req.Header.Set("content-type", test.ctype)
+		req.Header.Set("user-agent", "Test/1.0")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != test.code {
+			t.Errorf("%d: res.Code = %d; want %d", i, res.Code, test.code)
+		}
+		for _, v := range logged {
+			if v.ID == "" {
+				t.Errorf("%d: logged violation has no request ID", i)
+			}
+			v.ID = ""
+		}
+		if !reflect.DeepEqual(logged, test.logged) {
+			t.Errorf("%d: logged %+v; want %+v", i, logged, test.logged)
+		}
+	}
+
+	// disabled
+	req, _ := testInstance.NewRequest("POST", cspReportPath, strings.NewReader(legacy))
+	req.Header.Set("content-type", "application/csp-report")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("disabled: res.Code = %d; want 404", res.Code)
+	}
+}
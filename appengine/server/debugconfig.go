@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	// debugConfigPath is the path of the effective config handler.
+	debugConfigPath = "/_config"
+	// redactedValue replaces secrets in redacted configs.
+	redactedValue = "REDACTED"
+)
+
+// validBearer reports whether r carries token in its Authorization header.
+func validBearer(r *http.Request, token string) bool {
+	auth := r.Header.Get("authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
+// redacted returns a copy of c with secrets replaced by redactedValue.
+// Secret fields added to appConfig must be redacted here.
+func (c *appConfig) redacted() *appConfig {
+	rc := *c
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	redact(&rc.HookToken)
+	redact(&rc.BucketOverrideKey)
+	redact(&rc.ConfigToken)
+	if c.Metrics != nil {
+		mc := *c.Metrics
+		redact(&mc.Token)
+		rc.Metrics = &mc
+	}
+	if c.Maintenance != nil {
+		mc := *c.Maintenance
+		mc.Allow = make([]allowRule, len(c.Maintenance.Allow))
+		for i, a := range c.Maintenance.Allow {
+			redact(&a.Equals)
+			mc.Allow[i] = a
+		}
+		rc.Maintenance = &mc
+	}
+	if c.BasicAuth != nil {
+		rc.BasicAuth = make([]basicAuthRule, len(c.BasicAuth))
+		for i, rule := range c.BasicAuth {
+			users := make(map[string]string, len(rule.Users))
+			for name := range rule.Users {
+				users[name] = redactedValue
+			}
+			rule.Users = users
+			rc.BasicAuth[i] = rule
+		}
+	}
+	return &rc
+}
+
+// serveConfig responds with the current config, including applied
+// environment overrides and defaults, as JSON with secrets redacted.
+// Requests must carry the current config ConfigToken as a bearer token
+// in Authorization header. It responds with 404 if ConfigToken is empty.
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	c := currentConfig()
+	if c.ConfigToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !validBearer(r, c.ConfigToken) {
+		w.Header().Set("www-authenticate", "Bearer")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	b, err := json.MarshalIndent(c.redacted(), "", "  ")
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.Write(b)
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe_Config(t *testing.T) {
+	restore := withConfig(func(c *appConfig) {
+		c.ConfigToken = "config-secret"
+		c.HookToken = "hook-secret"
+		c.BucketOverrideKey = "bucket-override-secret"
+		c.Metrics = &metricsConfig{Path: "/metrics", Token: "metrics-secret"}
+		c.BasicAuth = []basicAuthRule{{Prefix: "/p/", Users: map[string]string{"alice": "$2a$hash-secret"}}}
+		c.SignExpiry = duration(15 * time.Minute)
+		c.Maintenance = &maintenanceConfig{Allow: []allowRule{{IP: "10.0.0.0/8"}, {Header: "X-Preview-Key", Equals: "preview-secret"}}}
+	})
+	defer restore()
+
+	tests := []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"config-secret", http.StatusUnauthorized},
+		{"Bearer config-secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/_config", nil)
+		if test.auth != "" {
+			req.Header.Set("authorization", test.auth)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q: res.Code = %d; want %d", test.auth, res.Code, test.code)
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		body := res.Body.String()
+		if strings.Contains(body, "secret") {
+			t.Errorf("%q: res.Body contains secrets:\n%s", test.auth, body)
+		}
+		var got struct {
+			HookToken  string                   `json:"hook_token"`
+			Buckets    map[string][]string      `json:"buckets"`
+			SignExpiry string                   `json:"sign_expiry"`
+			BasicAuth  []map[string]interface{} `json:"basic_auth"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil {
+			t.Fatalf("json.Unmarshal: %v\n%s", err, body)
+		}
+		if got.HookToken != redactedValue {
+			t.Errorf("hook_token = %q; want %q", got.HookToken, redactedValue)
+		}
+		if got.Buckets["default"] == nil {
+			t.Errorf("buckets = %v; want default bucket", got.Buckets)
+		}
+		if got.SignExpiry != "15m0s" {
+			t.Errorf("sign_expiry = %q; want 15m0s", got.SignExpiry)
+		}
+	}
+	if c := currentConfig(); c.HookToken != "hook-secret" || c.Metrics.Token != "metrics-secret" ||
+		c.BasicAuth[0].Users["alice"] != "$2a$hash-secret" || c.Maintenance.Allow[1].Equals != "preview-secret" {
+		t.Errorf("current config is modified: %+v", c)
+	}
+
+	restore()
+	req, _ := http.NewRequest("GET", "http://example.com/_config", nil)
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("no config_token: res.Code = %d; want 404", res.Code)
+	}
+}
+
+// TestConfigRedactedFields fails when a secret-looking field is added
+// to appConfig but not covered by redacted.
+func TestConfigRedactedFields(t *testing.T) {
+	const secret = "zzsecretzz"
+	c := &appConfig{}
+	var fill func(v reflect.Value)
+	fill = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			f, ft := v.Field(i), v.Type().Field(i)
+			if ft.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.ToLower(ft.Name)
+			secretName := strings.Contains(name, "token") || strings.Contains(name, "password") ||
+				strings.Contains(name, "secret") || name == "users"
+			switch f.Kind() {
+			case reflect.String:
+				if secretName {
+					f.SetString(secret)
+				}
+			case reflect.Map:
+				if secretName && f.Type().Elem().Kind() == reflect.String {
+					f.Set(reflect.MakeMap(f.Type()))
+					f.SetMapIndex(reflect.ValueOf("user"), reflect.ValueOf(secret))
+				}
+			case reflect.Ptr:
+				if f.Type().Elem().Kind() == reflect.Struct {
+					f.Set(reflect.New(f.Type().Elem()))
+					fill(f.Elem())
+				}
+			case reflect.Slice:
+				if f.Type().Elem().Kind() == reflect.Struct {
+					f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+					fill(f.Index(0))
+				}
+			}
+		}
+	}
+	fill(reflect.ValueOf(c).Elem())
+	b, err := json.Marshal(c.redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), secret) {
+		t.Errorf("redacted config contains secrets: %s", b)
+	}
+}
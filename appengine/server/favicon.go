@@ -0,0 +1,167 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// faviconPath is the path browsers request favicons from.
+	faviconPath = "/favicon.ico"
+	// faviconCacheControl is cache-control of favicons served from memory.
+	faviconCacheControl = "public, max-age=604800"
+	// noFaviconCacheControl is cache-control of 204 responses
+	// to favicon requests with no favicon to serve.
+	noFaviconCacheControl = "public, max-age=86400"
+)
+
+// faviconCache holds the favicon served by serveFavicon in memory.
+type faviconCache struct {
+	mu  sync.Mutex
+	src string         // Favicon config value o was loaded from
+	o   *weasel.Object // never streamed
+}
+
+// favicon is the app favicon, loaded by warmup requests or the first
+// favicon request, and kept for as long as the Favicon config stays the same.
+var favicon faviconCache
+
+// get returns the favicon of Favicon config value src, loading it if
+// it is not loaded yet. Concurrent callers wait for the same load.
+// Failed loads are retried on the next call.
+func (fc *faviconCache) get(ctx context.Context, src string) (*weasel.Object, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.o != nil && fc.src == src {
+		return fc.o, nil
+	}
+	o, err := loadFavicon(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	fc.src, fc.o = src, o
+	return o, nil
+}
+
+// loadFavicon returns the favicon of Favicon config value src: either
+// decoded from a base64 data URL, or read from the default bucket object.
+func loadFavicon(ctx context.Context, src string) (*weasel.Object, error) {
+	if strings.HasPrefix(src, "data:") {
+		ct, b, err := decodeDataURL(src)
+		if err != nil {
+			return nil, err
+		}
+		return &weasel.Object{Meta: map[string]string{
+			"content-type":  ct,
+			"cache-control": faviconCacheControl,
+		}, Body: b}, nil
+	}
+	o, err := storageFrom(ctx).ReadObject(ctx, currentConfig().Buckets["default"].primary(), strings.TrimPrefix(src, "/"))
+	if err != nil {
+		return nil, err
+	}
+	o = cloneObject(applyContentType(faviconPath, o))
+	if o.Stream != nil {
+		defer o.Stream.Close()
+		if o.Body, err = ioutil.ReadAll(o.Stream); err != nil {
+			return nil, err
+		}
+		o.Stream = nil
+	}
+	o.Meta["cache-control"] = faviconCacheControl
+	return o, nil
+}
+
+// decodeDataURL returns the media type and contents of a base64
+// "data:" URL u. The media type defaults to image/x-icon.
+func decodeDataURL(u string) (string, []byte, error) {
+	i := strings.IndexByte(u, ',')
+	if i < 0 || !strings.HasSuffix(u[:i], ";base64") {
+		return "", nil, fmt.Errorf("data URL must be base64 encoded")
+	}
+	ct := strings.TrimSuffix(strings.TrimPrefix(u[:i], "data:"), ";base64")
+	if ct == "" {
+		ct = "image/x-icon"
+	}
+	b, err := base64.StdEncoding.DecodeString(u[i+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return ct, b, nil
+}
+
+// serveFavicon responds to faviconPath requests with the current config
+// Favicon from memory. If it cannot be loaded, the response has 204 status
+// code. It returns false if no response was written, including when Favicon
+// is not set, so that the request bucket is looked up. See serveNoFavicon.
+func serveFavicon(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	src := currentConfig().Favicon
+	if src == "" || r.URL.Path != faviconPath {
+		return false
+	}
+	o, err := favicon.get(ctx, src)
+	if err != nil {
+		log.Errorf(ctx, "favicon %s: %v", src, err)
+		return serveNoFavicon(w, r)
+	}
+	if o.NotModified(r.Header.Get("if-none-match"), r.Header.Get("if-modified-since")) {
+		weasel.ServeNotModified(w, o)
+		return true
+	}
+	if err := weasel.ServeObject(w, applyHeaders(r.URL.Path, o), r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "favicon %s: %v", src, err)
+	}
+	return true
+}
+
+// serveNoFavicon responds to faviconPath requests with 204 status code,
+// in place of a 404, so that browsers don't keep requesting it.
+// It returns false if no response was written.
+func serveNoFavicon(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != faviconPath {
+		return false
+	}
+	w.Header().Set("cache-control", noFaviconCacheControl)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// validateFavicon reports an error if c.Favicon is neither an object path
+// nor a valid base64 data URL.
+func (c *appConfig) validateFavicon() error {
+	switch v := c.Favicon; {
+	case v == "/":
+		return fmt.Errorf("favicon: must name an object")
+	case v == "" || strings.HasPrefix(v, "/"):
+		return nil
+	case strings.HasPrefix(v, "data:"):
+		if _, _, err := decodeDataURL(v); err != nil {
+			return fmt.Errorf("favicon: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf(`favicon: %q must start with "/" or "data:"`, c.Favicon)
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Favicon(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = make(map[string]int)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/bucket/img/icon.ico" {
+			w.Header().Set("content-type", "application/octet-stream")
+			w.Write([]byte("object icon"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	resetFavicon := func() {
+		favicon.mu.Lock()
+		favicon.src, favicon.o = "", nil
+		favicon.mu.Unlock()
+	}
+	defer resetFavicon()
+
+	inline := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("inline icon"))
+	tests := []struct {
+		favicon         string
+		code            int
+		ctype, cc, body string
+		fetches         int // of /bucket/favicon.ico and the favicon object
+	}{
+		{"/img/icon.ico", http.StatusOK, typeByExtension(".ico"), faviconCacheControl, "object icon", 1},
+		{inline, http.StatusOK, "image/png", faviconCacheControl, "inline icon", 0},
+		{"", http.StatusNoContent, "", noFaviconCacheControl, "", 2},
+		{"/img/missing.ico", http.StatusNoContent, "", noFaviconCacheControl, "", 2},
+	}
+	for _, test := range tests {
+		resetFavicon()
+		mu.Lock()
+		fetches = make(map[string]int)
+		mu.Unlock()
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.Favicon = test.favicon
+		})
+		for i := 0; i < 2; i++ {
+			req, _ := testInstance.NewRequest("GET", faviconPath, nil)
+			if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+				t.Fatal(err)
+			}
+			res := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(res, req)
+			if res.Code != test.code {
+				t.Errorf("%.30q: res.Code = %d; want %d", test.favicon, res.Code, test.code)
+			}
+			if v := res.Header().Get("content-type"); test.ctype != "" && v != test.ctype {
+				t.Errorf("%.30q: content-type = %q; want %q", test.favicon, v, test.ctype)
+			}
+			if v := res.Header().Get("cache-control"); v != test.cc {
+				t.Errorf("%.30q: cache-control = %q; want %q", test.favicon, v, test.cc)
+			}
+			if v := res.Body.String(); v != test.body {
+				t.Errorf("%.30q: body = %q; want %q", test.favicon, v, test.body)
+			}
+		}
+		restore()
+
+		mu.Lock()
+		n := fetches["/bucket/favicon.ico"] + fetches["/bucket"+test.favicon]
+		mu.Unlock()
+		if n != test.fetches {
+			t.Errorf("%.30q: %d GCS fetches; want %d", test.favicon, n, test.fetches)
+		}
+	}
+}
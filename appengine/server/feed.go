@@ -0,0 +1,324 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// defaultFeedPath is the default value of feedConfig.Path.
+	defaultFeedPath = "/feed.xml"
+	// defaultFeedLimit is the default value of feedConfig.Limit.
+	defaultFeedLimit = 20
+	// defaultFeedTTL is the default value of feedConfig.TTL.
+	defaultFeedTTL = 10 * time.Minute
+	// feedMetaTitle and feedMetaDate are object metadata entries
+	// of feed item titles and dates, taking precedence over sidecars.
+	feedMetaTitle = "x-goog-meta-title"
+	feedMetaDate  = "x-goog-meta-date"
+)
+
+// feedConfig is the Feed section of appConfig.
+type feedConfig struct {
+	// Path is the feed request path, defaultFeedPath if empty.
+	Path string `json:"path" yaml:"path"`
+	// Prefix is the object name prefix of feed items, e.g. "blog/".
+	// HTML objects under it are listed in the feed.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Title is the feed title, also its author if Author is empty.
+	Title string `json:"title" yaml:"title"`
+	// Author is the feed author name.
+	Author string `json:"author" yaml:"author"`
+	// Link is the absolute base URL of item links, e.g. "https://goa.design".
+	Link string `json:"link" yaml:"link"`
+	// Limit is the maximum number of items, the latest ones,
+	// defaultFeedLimit if zero.
+	Limit int `json:"limit" yaml:"limit"`
+	// TTL is how long generated feeds are cached, defaultFeedTTL if zero.
+	// Object change notifications purge them earlier.
+	TTL duration `json:"ttl" yaml:"ttl"`
+}
+
+// path returns f.Path or its default.
+func (f *feedConfig) path() string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return defaultFeedPath
+}
+
+// validate reports an error if f has no title, prefix or link, its link
+// is not an absolute http(s) URL, or its path, limit or TTL are invalid.
+func (f *feedConfig) validate() error {
+	switch {
+	case f.Path != "" && !strings.HasPrefix(f.Path, "/"):
+		return fmt.Errorf(`path: %q must start with "/"`, f.Path)
+	case f.Title == "":
+		return fmt.Errorf("title: must not be empty")
+	case strings.HasPrefix(f.Prefix, "/"):
+		return fmt.Errorf(`prefix: %q must not start with "/"`, f.Prefix)
+	case f.Limit < 0:
+		return fmt.Errorf("limit: %d must not be negative", f.Limit)
+	case f.TTL < 0:
+		return fmt.Errorf("ttl: %v must not be negative", time.Duration(f.TTL))
+	}
+	u, err := url.Parse(f.Link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("link: %q is not an absolute http(s) URL", f.Link)
+	}
+	return nil
+}
+
+// feedItem is a feed entry generated from an HTML object.
+type feedItem struct {
+	path    string // object request path
+	title   string
+	summary string
+	date    time.Time
+}
+
+// feedSidecar is the JSON object of a feed item sidecar, named as
+// the item object with a .json extension, e.g. "blog/post.json".
+type feedSidecar struct {
+	Title   string `json:"title"`
+	Date    string `json:"date"` // RFC 3339 or a 2006-01-02 date
+	Summary string `json:"summary"`
+}
+
+// feedCache holds generated feed items.
+var feedCache = struct {
+	sync.Mutex
+	m map[string]feedEntry // keyed by bucket
+}{m: make(map[string]feedEntry)}
+
+// feedEntry is a cached list of feed items.
+type feedEntry struct {
+	items   []feedItem
+	expires time.Time
+}
+
+// purgeFeed removes the cached feed items of the bucket, if any.
+func purgeFeed(bucket string) {
+	feedCache.Lock()
+	delete(feedCache.m, bucket)
+	feedCache.Unlock()
+}
+
+// feedItems returns the latest HTML objects under f.Prefix of the bucket,
+// up to f.Limit, from cache or GCS, sorted by date descending.
+func feedItems(ctx context.Context, f *feedConfig, bucket string) ([]feedItem, error) {
+	feedCache.Lock()
+	e, ok := feedCache.m[bucket]
+	feedCache.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.items, nil
+	}
+	all, err := storageFrom(ctx).ListAll(ctx, bucket, f.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(all))
+	for _, o := range all {
+		names[o.Name] = true
+	}
+	var items []feedItem
+	for _, o := range all {
+		if ext := path.Ext(o.Name); ext != ".html" && ext != ".htm" {
+			continue
+		}
+		item, err := readFeedItem(ctx, bucket, o, names)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].date.Equal(items[j].date) {
+			return items[i].date.After(items[j].date)
+		}
+		return items[i].path < items[j].path
+	})
+	limit := f.Limit
+	if limit == 0 {
+		limit = defaultFeedLimit
+	}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	ttl := time.Duration(f.TTL)
+	if ttl == 0 {
+		ttl = defaultFeedTTL
+	}
+	feedCache.Lock()
+	feedCache.m[bucket] = feedEntry{items: items, expires: time.Now().Add(ttl)}
+	feedCache.Unlock()
+	return items, nil
+}
+
+// readFeedItem returns the feed item of listed HTML object o. Its title and
+// date are taken from the object metadata, if the storage reports them,
+// or else its sidecar, if names contains one. Otherwise, the title is
+// the object base name and the date its last update.
+// Index objects map to their "directory" paths.
+func readFeedItem(ctx context.Context, bucket string, o *weasel.ListEntry, names map[string]bool) (feedItem, error) {
+	item := feedItem{path: "/" + o.Name, date: o.Updated}
+	dir, base := path.Split(o.Name)
+	item.title = strings.TrimSuffix(base, path.Ext(base))
+	if base == storage.IndexName(dir) {
+		item.path = "/" + dir
+		if dir != "" {
+			item.title = path.Base(dir)
+		}
+	}
+	if sidecar := strings.TrimSuffix(o.Name, path.Ext(o.Name)) + ".json"; names[sidecar] {
+		so, err := storageFrom(ctx).ReadObject(ctx, bucket, sidecar)
+		if err != nil {
+			return item, err
+		}
+		var sc feedSidecar
+		if err := json.Unmarshal(so.Body, &sc); err != nil {
+			return item, fmt.Errorf("%s: %v", sidecar, err)
+		}
+		item.summary = sc.Summary
+		item.setMeta(sc.Title, sc.Date)
+	}
+	meta, err := storageFrom(ctx).Stat(ctx, bucket, o.Name)
+	if err != nil {
+		return item, err
+	}
+	item.setMeta(meta.Meta[feedMetaTitle], meta.Meta[feedMetaDate])
+	return item, nil
+}
+
+// setMeta sets non-empty title and parsable date of the item.
+func (item *feedItem) setMeta(title, date string) {
+	if title != "" {
+		item.title = title
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			item.date = t
+			break
+		}
+	}
+}
+
+// atomFeed is the Atom feed XML document, see RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary,omitempty"`
+}
+
+// serveFeed responds with an Atom feed of the request bucket HTML objects
+// under the current config Feed prefix, if r is a request of its path.
+// Item links are URLs of Feed.Link. It returns false if no response
+// was written.
+func serveFeed(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string) bool {
+	f := currentConfig().Feed
+	if f == nil || r.URL.Path != f.path() {
+		return false
+	}
+	items, err := feedItems(ctx, f, bucket)
+	if err != nil {
+		log.Errorf(ctx, "feedItems(%q): %v", bucket, err)
+		return false
+	}
+
+	link := strings.TrimSuffix(f.Link, "/")
+	feed := atomFeed{
+		Title: f.Title,
+		ID:    link + f.path(),
+		Links: []atomLink{
+			{Href: link + f.path(), Rel: "self"},
+			{Href: link + "/"},
+		},
+		Author: atomAuthor{Name: f.Author},
+	}
+	if feed.Author.Name == "" {
+		feed.Author.Name = f.Title
+	}
+	var updated time.Time
+	for _, item := range items {
+		u := link + item.path
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   item.title,
+			ID:      u,
+			Link:    atomLink{Href: u},
+			Updated: item.date.UTC().Format(time.RFC3339),
+			Summary: item.summary,
+		})
+		if item.date.After(updated) {
+			updated = item.date
+		}
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Errorf(ctx, "feed: %v", err)
+		return false
+	}
+	b.WriteByte('\n')
+
+	o := &weasel.Object{
+		Meta: map[string]string{"content-type": "application/atom+xml; charset=utf-8"},
+		Body: b.Bytes(),
+	}
+	o = applyHeaders(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s: %v", f.path(), err)
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Feed(t *testing.T) {
+	m := &weasel.MemBackend{}
+	html := map[string]string{"content-type": "text/html"}
+	m.Put("blog-bucket", "blog/first.html", []byte("<h1>First</h1>"), map[string]string{
+		"content-type": "text/html",
+		feedMetaTitle:  "First post",
+		feedMetaDate:   "2016-01-02",
+	})
+	m.Put("blog-bucket", "blog/second.html", []byte("<h1>Second</h1>"), html)
+	m.Put("blog-bucket", "blog/second.json", []byte(`{"title": "Second <post>", "date": "2016-03-04T05:06:07Z", "summary": "More & more"}`), nil)
+	m.Put("blog-bucket", "blog/third/index.html", []byte("<h1>Third</h1>"), html)
+	m.Put("blog-bucket", "blog/third/index.json", []byte(`{"date": "2016-02-03"}`), nil)
+	m.Put("blog-bucket", "blog/oldest.html", []byte("<h1>Oldest</h1>"), map[string]string{
+		"content-type": "text/html",
+		feedMetaDate:   "2015-01-01",
+	})
+	m.Put("blog-bucket", "blog/style.css", []byte("h1 {}"), nil)
+	m.Put("blog-bucket", "about.html", []byte("<h1>About</h1>"), html)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"blog-bucket"}}
+		c.Feed = &feedConfig{Prefix: "blog/", Title: "Blog", Link: "https://example.com/", Limit: 3}
+	})()
+	defer purgeFeed("blog-bucket")
+
+	get := func() atomFeed {
+		req, _ := testInstance.NewRequest("GET", "/feed.xml", nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("res.Code = %d; want %d", res.Code, http.StatusOK)
+		}
+		if v := res.Header().Get("content-type"); !strings.HasPrefix(v, "application/atom+xml") {
+			t.Errorf("content-type = %q; want application/atom+xml", v)
+		}
+		var feed atomFeed
+		if err := xml.Unmarshal(res.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("xml.Unmarshal: %v\n%s", err, res.Body)
+		}
+		return feed
+	}
+
+	feed := get()
+	if feed.XMLName.Space != "http://www.w3.org/2005/Atom" || feed.Title != "Blog" || feed.Author.Name != "Blog" {
+		t.Errorf("feed %v %q by %q; want Atom Blog by Blog", feed.XMLName, feed.Title, feed.Author.Name)
+	}
+	if feed.ID != "https://example.com/feed.xml" || feed.Updated != "2016-03-04T05:06:07Z" {
+		t.Errorf("feed id, updated = %q, %q; want https://example.com/feed.xml, 2016-03-04T05:06:07Z", feed.ID, feed.Updated)
+	}
+	want := []atomEntry{
+		{
+			Title:   "Second <post>",
+			ID:      "https://example.com/blog/second.html",
+			Link:    atomLink{Href: "https://example.com/blog/second.html"},
+			Updated: "2016-03-04T05:06:07Z",
+			Summary: "More & more",
+		},
+		{
+			Title:   "third",
+			ID:      "https://example.com/blog/third/",
+			Link:    atomLink{Href: "https://example.com/blog/third/"},
+			Updated: "2016-02-03T00:00:00Z",
+		},
+		{
+			Title:   "First post",
+			ID:      "https://example.com/blog/first.html",
+			Link:    atomLink{Href: "https://example.com/blog/first.html"},
+			Updated: "2016-01-02T00:00:00Z",
+		},
+	}
+	if !reflect.DeepEqual(feed.Entries, want) {
+		t.Errorf("entries = %+v\nwant %+v", feed.Entries, want)
+	}
+
+	// cached until the hook reports a change
+	m.Put("blog-bucket", "blog/newest.html", []byte("<h1>Newest</h1>"), map[string]string{
+		"content-type": "text/html",
+		feedMetaDate:   "2017-01-01",
+	})
+	if feed := get(); len(feed.Entries) != 3 || feed.Entries[0].Title != "Second <post>" {
+		t.Errorf("cached entries = %+v; want unchanged", feed.Entries)
+	}
+	body := `{"bucket": "blog-bucket", "name": "blog/newest.html"}`
+	req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+	req.Header.Set("x-goog-resource-state", "exists")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("hook res.Code = %d; want 200", res.Code)
+	}
+	if feed := get(); len(feed.Entries) != 3 || feed.Entries[0].Title != "newest" {
+		t.Errorf("entries after hook = %+v; want newest first", feed.Entries)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "strings"
+
+// matchGlob reports whether name matches the glob pattern,
+// where "*" matches any sequence of characters, including "/",
+// and any other character matches itself.
+func matchGlob(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, p)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(p):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// bestGlob returns the most specific of patterns matching name,
+// which is the longest one. Ties are broken in lexical order.
+func bestGlob(name string, patterns []string) (string, bool) {
+	var best string
+	var found bool
+	for _, p := range patterns {
+		if !matchGlob(p, name) {
+			continue
+		}
+		if !found || len(p) > len(best) || len(p) == len(best) && p < best {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// stringKeys returns keys of m in no particular order.
+func stringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// serveHead responds to a HEAD request with headers of object oname
+// the same as a GET request would get, stat-ing the object instead of
+// reading its contents, if the current config HeadMetadata is enabled.
+// It returns false if no response was written, including when the object
+// cannot be stat-ed or its GET response headers depend on the contents,
+// e.g. it would be compressed on the fly. The full object should be
+// served instead.
+func serveHead(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, oname string) bool {
+	if r.Method != "HEAD" || !currentConfig().HeadMetadata {
+		return false
+	}
+	o, err := statDir(ctx, bucket, oname)
+	if err != nil {
+		// let the full object handling deal with it, e.g. NotFound
+		return false
+	}
+	if o.Redirect() == "" {
+		o = applyContentType(storageFrom(ctx).FileName(oname), o)
+		if !headMatchesGet(r, o) {
+			return false
+		}
+		if compressible(o.Meta["content-type"]) {
+			addVary(w.Header(), "Accept-Encoding")
+		}
+		if noRangeType(o.Meta["content-type"]) {
+			w.Header().Set("accept-ranges", "none")
+		}
+	}
+	o = applyManifest(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	o = applyHeaders(r.URL.Path, applyPreload(r.URL.Path, applyDownload(r.URL.Path, o)))
+	if err := weasel.ServeObject(w, o, false); err != nil {
+		log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+	}
+	return true
+}
+
+// headMatchesGet reports whether headers of stat-ed object o are those
+// of its GET response to r: its length is known and it is served
+// with no content coding applied or removed, nor HTML rewritten, on the fly.
+func headMatchesGet(r *http.Request, o *weasel.Object) bool {
+	if _, ok := findHTMLRewrite(r, o); ok {
+		return false
+	}
+	n, err := strconv.Atoi(o.Meta["content-length"])
+	switch {
+	case err != nil || o.Meta["content-encoding"] != "":
+		return false
+	case compressible(o.Meta["content-type"]):
+		return compressCoding(r, n) == ""
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_HeadMetadata(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		gets []string
+	)
+	page := strings.Repeat("<p>page</p>", 200)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			gets = append(gets, r.URL.Path)
+			mu.Unlock()
+		}
+		switch r.URL.Path {
+		case "/bucket/page.html", "/bucket/docs/index.html":
+			w.Header().Set("content-type", "text/html")
+			w.Header().Set("content-length", strconv.Itoa(len(page)))
+			w.Header().Set("etag", `"v1"`)
+			w.Header().Set("last-modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			w.Write([]byte(page))
+		case "/bucket/app.zip":
+			w.Header().Set("content-type", "application/zip")
+			w.Write([]byte("zip"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.HeadMetadata = true
+		c.CacheControl = map[string]string{"/*": "public, max-age=60"}
+		c.Headers = map[string]map[string]string{"/*": {"X-Content-Type-Options": "nosniff"}}
+		c.Downloads = []string{".zip"}
+	})()
+
+	tests := []struct {
+		path, accept string
+		get          bool // whether HEAD reads the contents
+	}{
+		{"/page.html", "", false},
+		{"/app.zip", "gzip", false},
+		{"/docs", "", false},
+		{"/docs/", "", false},
+		// compressed on the fly
+		{"/page.html", "gzip", true},
+	}
+	for _, test := range tests {
+		get := func(method string) *httptest.ResponseRecorder {
+			req, _ := testInstance.NewRequest(method, test.path, nil)
+			// the same for both, so that the headers are comparable
+			req.Header.Set(defaultRequestIDHeader, "head-metadata")
+			if test.accept != "" {
+				req.Header.Set("accept-encoding", test.accept)
+			}
+			if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+				t.Fatal(err)
+			}
+			storage.Cache.RemovePrefix("")
+			res := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(res, req)
+			return res
+		}
+		mu.Lock()
+		gets = nil
+		mu.Unlock()
+		head := get("HEAD")
+		mu.Lock()
+		if test.get != (len(gets) > 0) {
+			t.Errorf("%s (%s): HEAD fetched %q; want contents read %v", test.path, test.accept, gets, test.get)
+		}
+		mu.Unlock()
+		full := get("GET")
+
+		if head.Code != full.Code {
+			t.Errorf("%s (%s): HEAD code = %d; want %d", test.path, test.accept, head.Code, full.Code)
+		}
+		if head.Body.Len() != 0 {
+			t.Errorf("%s (%s): HEAD body = %q; want empty", test.path, test.accept, head.Body)
+		}
+		if !reflect.DeepEqual(head.Header(), full.Header()) {
+			t.Errorf("%s (%s): HEAD headers = %v; want %v", test.path, test.accept, head.Header(), full.Header())
+		}
+		if full.Code == http.StatusOK && full.Header().Get("content-encoding") == "" {
+			if v := head.Header().Get("content-length"); v != strconv.Itoa(full.Body.Len()) {
+				t.Errorf("%s (%s): HEAD content-length = %q; want %d", test.path, test.accept, v, full.Body.Len())
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"mime"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// defaultCacheControl is the cache-control of objects which have none
+// and whose path does not match any of appConfig.CacheControl patterns.
+const defaultCacheControl = "no-cache"
+
+// applyCacheControl returns o with cache-control header value of the most
+// specific current config CacheControl pattern matching request path p.
+// If none matches, the object's own cache-control is kept,
+// or defaultCacheControl is used if it has none.
+// Paths matching Immutable patterns get immutableCacheControl instead.
+// The object is returned as is when CacheControl is empty and p is not
+// an immutablePath.
+func applyCacheControl(p string, o *weasel.Object) *weasel.Object {
+	cc := currentConfig().CacheControl
+	immutable := immutablePath(p)
+	if len(cc) == 0 && !immutable {
+		return o
+	}
+	v := o.Meta["cache-control"]
+	if g, ok := bestGlob(p, stringKeys(cc)); ok {
+		v = cc[g]
+	}
+	if immutable {
+		v = immutableCacheControl
+	}
+	if v == "" {
+		v = defaultCacheControl
+	}
+	o = cloneObject(o)
+	o.Meta["cache-control"] = v
+	return o
+}
+
+// applyHeaders returns o with headers of all current config Headers patterns
+// matching request path p. Headers of more specific, longer patterns take
+// precedence. An empty header value removes the header.
+// The object is returned as is when no pattern matches or o is a redirect.
+func applyHeaders(p string, o *weasel.Object) *weasel.Object {
+	hc := currentConfig().Headers
+	if len(hc) == 0 || o.Redirect() != "" {
+		return o
+	}
+	var patterns []string
+	for g := range hc {
+		if matchGlob(g, p) {
+			patterns = append(patterns, g)
+		}
+	}
+	if len(patterns) == 0 {
+		return o
+	}
+	// least specific first; ties in reverse lexical order, same as bestGlob
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := patterns[i], patterns[j]
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a > b
+	})
+	o = cloneObject(o)
+	for _, g := range patterns {
+		for k, v := range hc[g] {
+			k = strings.ToLower(k)
+			if v == "" {
+				delete(o.Meta, k)
+			} else {
+				o.Meta[k] = v
+			}
+		}
+	}
+	return o
+}
+
+// applyDownload returns o with an attachment content-disposition header
+// if request path p matches any of the current config Downloads entries,
+// so that browsers save the object under its base name instead of rendering it.
+// The object is returned as is otherwise, or when o is a redirect.
+func applyDownload(p string, o *weasel.Object) *weasel.Object {
+	name := path.Base(p)
+	if strings.HasSuffix(p, "/") || name == "/" || o.Redirect() != "" || !isDownload(p) {
+		return o
+	}
+	o = cloneObject(o)
+	o.Meta["content-disposition"] = attachment(name)
+	return o
+}
+
+// isDownload reports whether request path p starts with one of the current
+// config Downloads prefixes or has one of their extensions.
+func isDownload(p string) bool {
+	ext := path.Ext(p)
+	for _, d := range currentConfig().Downloads {
+		if strings.HasPrefix(d, "/") && strings.HasPrefix(p, d) ||
+			strings.HasPrefix(d, ".") && strings.EqualFold(d, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachment returns an RFC 6266 attachment content-disposition value
+// for file name. Names other than printable ASCII get an additional
+// RFC 5987 encoded filename* parameter, with "_" replacing unsafe
+// characters in the plain filename.
+func attachment(name string) string {
+	plain := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	v := `attachment; filename="` + plain + `"`
+	if plain == name {
+		return v
+	}
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		}
+	}
+	return v + "; filename*=UTF-8''" + b.String()
+}
+
+// isAttrChar reports whether c is an RFC 5987 attr-char,
+// which needs no percent-encoding in extended parameter values.
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// typeOverride returns the current config ContentTypes value
+// of file name extension ext, e.g. ".wasm". Extensions are case-insensitive
+// and may be configured with or without the leading dot.
+func typeOverride(ext string) string {
+	for k, v := range currentConfig().ContentTypes {
+		if strings.EqualFold("."+strings.TrimPrefix(k, "."), ext) {
+			return v
+		}
+	}
+	return ""
+}
+
+// typeByExtension is similar to mime.TypeByExtension
+// except ContentTypes overrides take precedence.
+func typeByExtension(ext string) string {
+	if ct := typeOverride(ext); ct != "" {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// applyContentType returns o with content-type of the object name extension
+// from the current config ContentTypes, overriding the type reported by GCS.
+// If no override exists and o has an empty or application/octet-stream type,
+// mime.TypeByExtension is used instead. Otherwise, the type is kept as is.
+// Text-like types with no charset get DefaultCharset; see applyCharset.
+// The query of variant names is ignored, see queryVariant.
+func applyContentType(name string, o *weasel.Object) *weasel.Object {
+	ext := path.Ext(variantBase(name))
+	if ext == "" || o.Redirect() != "" {
+		return applyCharset(o)
+	}
+	ct := typeOverride(ext)
+	if ct == "" {
+		if t, _, _ := mime.ParseMediaType(o.Meta["content-type"]); t != "" && t != "application/octet-stream" {
+			return applyCharset(o)
+		}
+		ct = mime.TypeByExtension(ext)
+	}
+	if ct == "" || ct == o.Meta["content-type"] {
+		return applyCharset(o)
+	}
+	o = cloneObject(o)
+	o.Meta["content-type"] = ct
+	return applyCharset(o)
+}
@@ -0,0 +1,292 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"/static/*", "/static/app.js", true},
+		{"/static/*", "/static/js/app.js", true},
+		{"/static/*", "/static", false},
+		{"/*.html", "/index.html", true},
+		{"/*.html", "/blog/post.html", true},
+		{"/*.html", "/blog/post.htm", false},
+		{"/a/*/c/*.js", "/a/b/c/d.js", true},
+		{"/a/*/c/*.js", "/a/b/d.js", false},
+		{"/exact", "/exact", true},
+		{"/exact", "/exact/", false},
+		{"/*", "/", true},
+	}
+	for _, test := range tests {
+		if v := matchGlob(test.pattern, test.name); v != test.match {
+			t.Errorf("matchGlob(%q, %q) = %v; want %v", test.pattern, test.name, v, test.match)
+		}
+	}
+}
+
+func TestServe_CacheControl(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/own.txt" {
+			w.Header().Set("cache-control", "private")
+		}
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.CacheControl = map[string]string{
+			"/static/*":      "public, max-age=31536000, immutable",
+			"/*.html":        "public, max-age=300",
+			"/static/*.html": "public, max-age=60",
+		}
+	})()
+
+	tests := []struct{ path, cc string }{
+		{"/static/app.css", "public, max-age=31536000, immutable"},
+		{"/docs/page.html", "public, max-age=300"},
+		{"/static/page.html", "public, max-age=60"},
+		{"/own.txt", "private"},
+		{"/other.txt", defaultCacheControl},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if v := res.Header().Get("cache-control"); v != test.cc {
+			t.Errorf("%s: cache-control = %q; want %q", test.path, v, test.cc)
+		}
+	}
+}
+
+func TestServe_Headers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Redirects = map[string]redirect{"/old": {To: "/new"}}
+		c.Headers = map[string]map[string]string{
+			"/*": {
+				"X-Content-Type-Options":    "nosniff",
+				"Strict-Transport-Security": "max-age=31536000",
+				"Content-Security-Policy":   "default-src 'self'",
+				"X-Frame-Options":           "DENY",
+			},
+			"/embed/*": {
+				"Content-Security-Policy": "frame-ancestors *",
+				"X-Frame-Options":         "",
+			},
+			"/embed/*.html": {"Content-Security-Policy": "frame-ancestors https://example.com"},
+		}
+	})()
+
+	tests := []struct {
+		path   string
+		header map[string]string
+	}{
+		{"/page.html", map[string]string{
+			"x-content-type-options":  "nosniff",
+			"content-security-policy": "default-src 'self'",
+			"x-frame-options":         "DENY",
+			"content-type":            "text/html; charset=utf-8",
+		}},
+		{"/embed/widget.js", map[string]string{
+			"x-content-type-options":    "nosniff",
+			"strict-transport-security": "max-age=31536000",
+			"content-security-policy":   "frame-ancestors *",
+			"x-frame-options":           "",
+		}},
+		{"/embed/widget.html", map[string]string{
+			"x-content-type-options":  "nosniff",
+			"content-security-policy": "frame-ancestors https://example.com",
+			"x-frame-options":         "",
+		}},
+		{"/old", map[string]string{
+			"location":                "/new/old",
+			"x-content-type-options":  "",
+			"content-security-policy": "",
+		}},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		for k, v := range test.header {
+			if h := res.Header().Get(k); h != v {
+				t.Errorf("%s: %s = %q; want %q", test.path, k, h, v)
+			}
+		}
+	}
+}
+
+func TestServe_RangeHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		if r.Header.Get("range") != "" {
+			w.Header().Set("content-range", "bytes 0-3/8")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("cont"))
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.CacheControl = map[string]string{"/*.html": "public, max-age=300"}
+		c.Preload = map[string][]preloadLink{"/*": {{Href: "/app.css", As: "style"}}}
+		c.Headers = map[string]map[string]string{"/*": {"X-Frame-Options": "DENY"}}
+	})()
+
+	req, _ := testInstance.NewRequest("GET", "/page.html", nil)
+	req.Header.Set("range", "bytes=0-3")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusPartialContent {
+		t.Fatalf("res.Code = %d; want %d", res.Code, http.StatusPartialContent)
+	}
+	for k, v := range map[string]string{
+		"cache-control":   "public, max-age=300",
+		"link":            "</app.css>; rel=preload; as=style",
+		"x-frame-options": "DENY",
+	} {
+		if h := res.Header().Get(k); h != v {
+			t.Errorf("%s = %q; want %q", k, h, v)
+		}
+	}
+}
+
+func TestServe_ContentTypes(t *testing.T) {
+	types := map[string]string{
+		"/bucket/app.wasm":          "application/octet-stream",
+		"/bucket/site.webmanifest":  "",
+		"/bucket/photo.AVIF":        "application/octet-stream",
+		"/bucket/data.bin":          "application/octet-stream",
+		"/bucket/style.css":         "text/css",
+		"/bucket/page.html":         "text/html; charset=utf-8",
+		"/bucket/feed.xml":          "text/plain",
+		"/bucket/unknown.extension": "",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := types[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header()["Content-Type"] = []string{ct}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.GzipMinSize = -1
+		c.ContentTypes = map[string]string{
+			".webmanifest": "application/manifest+json",
+			"avif":         "image/avif",
+			".xml":         "application/xml",
+		}
+	})()
+
+	tests := []struct{ path, ctype string }{
+		// override
+		{"/site.webmanifest", "application/manifest+json"},
+		{"/photo.AVIF", "image/avif"},
+		{"/feed.xml", "application/xml; charset=utf-8"},
+		// fallback
+		{"/app.wasm", "application/wasm"},
+		// pass-through
+		{"/data.bin", "application/octet-stream"},
+		{"/style.css", "text/css; charset=utf-8"},
+		{"/page.html", "text/html; charset=utf-8"},
+		{"/unknown.extension", ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if v := res.Header().Get("content-type"); v != test.ctype {
+			t.Errorf("%s: content-type = %q; want %q", test.path, v, test.ctype)
+		}
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	tests := []struct{ name, v string }{
+		{"report.pdf", `attachment; filename="report.pdf"`},
+		{`a "b".csv`, `attachment; filename="a _b_.csv"; filename*=UTF-8''a%20%22b%22.csv`},
+		{"résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+	}
+	for _, test := range tests {
+		if v := attachment(test.name); v != test.v {
+			t.Errorf("attachment(%q) = %q; want %q", test.name, v, test.v)
+		}
+	}
+}
+
+func TestServe_Downloads(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Downloads = []string{"/downloads/", ".CSV"}
+	})()
+
+	tests := []struct{ path, v string }{
+		{"/downloads/goa.zip", `attachment; filename="goa.zip"`},
+		{"/downloads/docs/résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"/data/stats.csv", `attachment; filename="stats.csv"`},
+		{"/downloads/", ""},
+		{"/docs/goa.zip", ""},
+		{"/stats.csv.html", ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if v := res.Header().Get("content-disposition"); v != test.v {
+			t.Errorf("%s: content-disposition = %q; want %q", test.path, v, test.v)
+		}
+	}
+}
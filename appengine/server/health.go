@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine/log"
+)
+
+// healthPathAppEngine is the path of App Engine health checks.
+// The health handler is always registered at this path in addition to HealthPath.
+const healthPathAppEngine = "/_ah/health"
+
+// healthStatus is the response body of serveHealth.
+type healthStatus struct {
+	Status        string `json:"status"`
+	DefaultBucket string `json:"default_bucket,omitempty"`
+	Error         string `json:"error,omitempty"`
+
+	// ConfigLoaded is when the config in effect was loaded
+	// and ConfigModified is the current mtime of its file.
+	ConfigLoaded   *time.Time `json:"config_loaded,omitempty"`
+	ConfigModified *time.Time `json:"config_modified,omitempty"`
+	// ReloadError is the error of the latest failed hot-reload, if any.
+	ReloadError string `json:"reload_error,omitempty"`
+	// ConfigStale reports whether the config file was modified later than
+	// the config was loaded, by more than ReloadInterval.
+	ConfigStale bool `json:"config_stale"`
+}
+
+// setConfigStatus populates res config fields from configStatus,
+// considering a file modified more than interval after the load stale.
+func (res *healthStatus) setConfigStatus(interval time.Duration) {
+	name, loaded, err := configStatus()
+	if name == "" {
+		return
+	}
+	res.ConfigLoaded = &loaded
+	if err != nil {
+		res.ReloadError = err.Error()
+	}
+	if mtime := modTime(name); !mtime.IsZero() {
+		res.ConfigModified = &mtime
+		res.ConfigStale = mtime.Sub(loaded) > interval
+	}
+}
+
+// serveHealth responds with 200 status code when the config is loaded
+// and contains the default bucket, or 503 otherwise, including once
+// the instance shutdown has begun.
+// The response reports whether the config file changes took effect,
+// which does not affect the status code.
+// With "deep" query parameter present, it also sends a HEAD request
+// for the default bucket index object, bypassing the caches.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	res := healthStatus{Status: "ok"}
+	if c := currentConfig(); c != nil {
+		res.DefaultBucket = c.Buckets["default"].primary()
+		res.setConfigStatus(time.Duration(c.ReloadInterval))
+	}
+	switch {
+	case inflight.isStopping():
+		// let the load balancer stop routing requests here
+		code = http.StatusServiceUnavailable
+		res.Status = "unavailable"
+		res.Error = "shutting down"
+	case res.DefaultBucket == "":
+		code = http.StatusServiceUnavailable
+		res.Status = "unavailable"
+		res.Error = "default bucket is not configured"
+	case r.URL.Query()["deep"] != nil:
+		ctx := newContext(r)
+		if _, err := storage.Head(ctx, res.DefaultBucket, storage.FileName("")); err != nil {
+			log.Errorf(ctx, "health: %v", err)
+			code = http.StatusServiceUnavailable
+			res.Status = "unavailable"
+			res.Error = err.Error()
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServe_Health(t *testing.T) {
+	var heads int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("r.Method = %q; want HEAD", r.Method)
+		}
+		heads++
+		if r.URL.Path != "/bucket/index.html" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		path, bucket string
+		code         int
+		heads        int
+	}{
+		{"/healthz", "bucket", http.StatusOK, 0},
+		{"/_ah/health", "bucket", http.StatusOK, 0},
+		{"/healthz?deep", "bucket", http.StatusOK, 1},
+		{"/healthz?deep", "missing", http.StatusServiceUnavailable, 1},
+		{"/healthz", "", http.StatusServiceUnavailable, 0},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {test.bucket}}
+		})
+		heads = 0
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != test.code {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.path, test.bucket, res.Code, test.code)
+		}
+		if heads != test.heads {
+			t.Errorf("%s %q: heads = %d; want %d", test.path, test.bucket, heads, test.heads)
+		}
+		if v := res.Header().Get("content-type"); v != "application/json" {
+			t.Errorf("%s %q: content-type = %q; want application/json", test.path, test.bucket, v)
+		}
+		var body healthStatus
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %q: %v", test.path, test.bucket, err)
+		}
+		if body.DefaultBucket != test.bucket {
+			t.Errorf("%s %q: body.DefaultBucket = %q; want %q", test.path, test.bucket, body.DefaultBucket, test.bucket)
+		}
+		if ok := body.Status == "ok"; ok != (test.code == http.StatusOK) {
+			t.Errorf("%s %q: body.Status = %q", test.path, test.bucket, body.Status)
+		}
+	}
+}
+
+func TestServe_HealthConfigStatus(t *testing.T) {
+	defer setConfig(currentConfig())
+	defer func(name string, loaded time.Time, err error) {
+		configLoaded(name, loaded)
+		configReloadFailed(err)
+	}(configStatus())
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(name, []byte(`{"buckets": {"default": "bucket"}, "reload": "1m"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := readConfig(name); err != nil {
+		t.Fatal(err)
+	}
+	_, loaded, _ := configStatus()
+
+	tests := []struct {
+		mtime   time.Time
+		reload  error
+		stale   bool
+		errText string
+	}{
+		{loaded.Add(-time.Hour), nil, false, ""},
+		{loaded.Add(30 * time.Second), nil, false, ""},
+		{loaded.Add(2 * time.Minute), nil, true, ""},
+		{loaded.Add(2 * time.Minute), errors.New("config.json:1:2: bad"), true, "config.json:1:2: bad"},
+	}
+	for i, test := range tests {
+		if err := os.Chtimes(name, test.mtime, test.mtime); err != nil {
+			t.Fatal(err)
+		}
+		configReloadFailed(test.reload)
+		req, _ := testInstance.NewRequest("GET", "/healthz", nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%d: res.Code = %d; want 200", i, res.Code)
+		}
+		var body healthStatus
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if body.ConfigLoaded == nil || !body.ConfigLoaded.Equal(loaded) {
+			t.Errorf("%d: body.ConfigLoaded = %v; want %v", i, body.ConfigLoaded, loaded)
+		}
+		if body.ConfigModified == nil || !body.ConfigModified.Equal(test.mtime) {
+			t.Errorf("%d: body.ConfigModified = %v; want %v", i, body.ConfigModified, test.mtime)
+		}
+		if body.ConfigStale != test.stale {
+			t.Errorf("%d: body.ConfigStale = %v; want %v", i, body.ConfigStale, test.stale)
+		}
+		if body.ReloadError != test.errText {
+			t.Errorf("%d: body.ReloadError = %q; want %q", i, body.ReloadError, test.errText)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+// serveHook verifies GCS notification channel token, if configured,
+// and passes the request to storage.HandleChangeHook, which calls
+// objectChanged for changed objects.
+// Requests with a missing or mismatching X-Goog-Channel-Token header
+// are rejected with 401 status code, and bodies larger than MaxRequestBody
+// with 413.
+func serveHook(w http.ResponseWriter, r *http.Request) {
+	if !validHookToken(currentConfig().HookToken, r.Header.Get("x-goog-channel-token")) {
+		http.Error(w, "invalid channel token", http.StatusUnauthorized)
+		return
+	}
+	if !limitBody(w, r, true) {
+		return
+	}
+	storage.HandleChangeHook(w, r)
+}
+
+// objectChanged is weasel.Storage.ObjectChanged of the server storage.
+// It invalidates the generated sitemap and feed of the bucket and logs
+// public URLs of the object on hosts the bucket is mapped to.
+// See hostsForBucket.
+func objectChanged(ctx context.Context, bucket, name string) {
+	purgeSitemap(bucket)
+	purgeFeed(bucket)
+	hosts := hostsForBucket(bucket)
+	if len(hosts) == 0 {
+		log.Debugf(ctx, "%s/%s: bucket is not mapped to any host", bucket, name)
+	}
+	for _, h := range hosts {
+		log.Infof(ctx, "invalidated https://%s/%s", h, name)
+	}
+}
+
+// hostsForBucket returns hosts of the current config Buckets and BucketPaths
+// keys mapping to the bucket, including those where it is not the primary one,
+// sorted and with no duplicates. Wildcard keys are returned as is.
+// The global "default" key is omitted, since it has no host of its own;
+// that of a Sites entry stands for the site host.
+func hostsForBucket(bucket string) []string {
+	c := currentConfig()
+	seen := make(map[string]bool)
+	var hosts []string
+	add := func(site string, m map[string]bucketList) {
+		for k, l := range m {
+			h := k
+			if i := strings.IndexByte(k, '/'); i >= 0 {
+				h = k[:i]
+			}
+			if h == "default" {
+				// a site's default buckets are those of its own host
+				h = site
+			}
+			if h == "" || seen[h] || !l.contains(bucket) {
+				continue
+			}
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	add("", c.Buckets)
+	add("", c.BucketPaths)
+	for host, sc := range c.Sites {
+		if sc == nil {
+			continue
+		}
+		add(host, sc.Buckets)
+		add(host, sc.BucketPaths)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// validHookToken reports whether the client token matches the configured one,
+// using constant time comparison. An empty configured token accepts any client token.
+func validHookToken(token, client string) bool {
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(client)) == 1
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_HookToken(t *testing.T) {
+	defer withConfig(func(c *appConfig) { c.HookToken = "secret" })()
+
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"secret", http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+		{"secret2", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		body := `{"bucket": "dummy", "name": "path/obj"}`
+		req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+		req.Header.Set("x-goog-resource-state", "exists")
+		if test.token != "" {
+			req.Header.Set("x-goog-channel-token", test.token)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q: res.Code = %d; want %d", test.token, res.Code, test.code)
+		}
+	}
+}
+
+func TestValidHookToken(t *testing.T) {
+	tests := []struct {
+		token, client string
+		ok            bool
+	}{
+		{"", "", true},
+		{"", "any", true},
+		{"secret", "secret", true},
+		{"secret", "", false},
+		{"secret", "Secret", false},
+	}
+	for _, test := range tests {
+		if ok := validHookToken(test.token, test.client); ok != test.ok {
+			t.Errorf("validHookToken(%q, %q) = %v; want %v", test.token, test.client, ok, test.ok)
+		}
+	}
+}
+
+func TestServe_HookMemBackend(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "page.txt", []byte("v1"), map[string]string{"content-type": "text/plain"})
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	get := func() string {
+		req, _ := testInstance.NewRequest("GET", "/page.txt", nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		return res.Body.String()
+	}
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(); v != "v1" {
+		t.Fatalf("body = %q; want v1", v)
+	}
+	m.Put("bucket", "page.txt", []byte("v2"), map[string]string{"content-type": "text/plain"})
+	if v := get(); v != "v1" {
+		t.Errorf("cached body = %q; want v1", v)
+	}
+
+	body := `{"bucket": "bucket", "name": "page.txt"}`
+	req, _ = testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+	req.Header.Set("x-goog-resource-state", "exists")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("hook res.Code = %d; want 200", res.Code)
+	}
+	if v := get(); v != "v2" {
+		t.Errorf("body after hook = %q; want v2", v)
+	}
+}
+
+func TestServe_HookKeyTransform(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "public/docs/page.txt", []byte("v1"), map[string]string{"content-type": "text/plain"})
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer func(kt map[string]weasel.KeyTransform) { storage.KeyTransforms = kt }(storage.KeyTransforms)
+	storage.KeyTransforms = map[string]weasel.KeyTransform{"bucket": {Prefix: "public/", Lowercase: true}}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	get := func(p string) string {
+		req, _ := testInstance.NewRequest("GET", p, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		return res.Body.String()
+	}
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("/Docs/Page.txt"); v != "v1" {
+		t.Fatalf("body = %q; want v1", v)
+	}
+	m.Put("bucket", "public/docs/page.txt", []byte("v2"), map[string]string{"content-type": "text/plain"})
+
+	body := `{"bucket": "bucket", "name": "public/docs/page.txt"}`
+	req, _ = testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+	req.Header.Set("x-goog-resource-state", "exists")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("hook res.Code = %d; want 200", res.Code)
+	}
+	for _, p := range []string{"/Docs/Page.txt", "/docs/page.txt"} {
+		if v := get(p); v != "v2" {
+			t.Errorf("%s: body after hook = %q; want v2", p, v)
+		}
+	}
+}
+
+func TestHostsForBucket(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{
+			"default":              {"site"},
+			"goa.design":           {"site"},
+			"www.goa.design":       {"new", "site"},
+			"*.preview.goa.design": {"preview"},
+			"other.com":            {"other"},
+		}
+		c.BucketPaths = map[string]bucketList{
+			"other.com/assets/":  {"assets"},
+			"goa.design/assets/": {"assets", "site"},
+		}
+	})()
+	tests := []struct {
+		bucket string
+		hosts  []string
+	}{
+		{"site", []string{"goa.design", "www.goa.design"}},
+		{"new", []string{"www.goa.design"}},
+		{"preview", []string{"*.preview.goa.design"}},
+		{"assets", []string{"goa.design", "other.com"}},
+		{"unmapped", nil},
+	}
+	for _, test := range tests {
+		if v := hostsForBucket(test.bucket); !reflect.DeepEqual(v, test.hosts) {
+			t.Errorf("hostsForBucket(%q) = %v; want %v", test.bucket, v, test.hosts)
+		}
+	}
+}
+
+func TestServe_HookSitemaps(t *testing.T) {
+	defer purgeSitemaps()
+	for _, b := range []string{"site", "other"} {
+		sitemapCache.m[b] = sitemapEntry{expires: time.Now().Add(time.Hour)}
+	}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"site"}, "other.com": {"other"}}
+	})()
+	body := `{"bucket": "site", "name": "docs/index.html"}`
+	req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+	req.Header.Set("x-goog-resource-state", "exists")
+	http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+	if _, ok := sitemapCache.m["site"]; ok {
+		t.Error("site sitemap is not invalidated")
+	}
+	if _, ok := sitemapCache.m["other"]; !ok {
+		t.Error("other sitemap is invalidated")
+	}
+}
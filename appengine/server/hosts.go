@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// hostConfig is a Hosts entry of appConfig, overriding global
+// settings for requests to a single host. Zero fields fall back
+// to the global ones.
+type hostConfig struct {
+	// Index replaces the global Index mapping for the host.
+	// The global "/" value applies if Index has no "/" key.
+	Index indexConfig `json:"index" yaml:"index"`
+	// WebRoot is applied at startup only, same as the global WebRoot.
+	// Paths of the host outside WebRoot get 404.
+	WebRoot string `json:"webroot" yaml:"webroot"`
+	// NotFound is the host's not found object path.
+	NotFound string `json:"not_found" yaml:"not_found"`
+}
+
+// validate reports an error if hc fields are malformed.
+func (hc *hostConfig) validate() error {
+	if hc.WebRoot != "" && !strings.HasPrefix(hc.WebRoot, "/") {
+		return fmt.Errorf(`webroot: %q must start with "/"`, hc.WebRoot)
+	}
+	return hc.Index.validate()
+}
+
+// notFound returns the NotFound object path of host.
+func (c *appConfig) notFound(host string) string {
+	if hc, ok := c.Hosts[host]; ok && hc.NotFound != "" {
+		return hc.NotFound
+	}
+	return c.site(host).NotFound
+}
+
+// handleObjects registers serveObject with mux at c.WebRoot
+// and the WebRoot of each c.Hosts entry which has one.
+func handleObjects(mux *http.ServeMux, c *appConfig) {
+	mux.HandleFunc(c.WebRoot, serveObject)
+	for host, hc := range c.Hosts {
+		if hc.WebRoot == "" {
+			continue
+		}
+		mux.HandleFunc(host+hc.WebRoot, serveObject)
+		if hc.WebRoot != "/" {
+			mux.Handle(host+"/", http.NotFoundHandler())
+		}
+	}
+}
+
+// storageKey is the context key of the request storage.
+type storageKey struct{}
+
+// withHostStorage returns a copy of ctx carrying a copy of storage
+// with the Index of host, if the current config Hosts or Sites override it.
+// Otherwise, ctx is returned as is. See storageFrom.
+func withHostStorage(ctx context.Context, host string) context.Context {
+	c := currentConfig()
+	index := c.Hosts[host].Index
+	if sc := c.site(host); sc != c {
+		index = sc.Index
+	}
+	if index == nil {
+		return ctx
+	}
+	s := *storage
+	if l := index["/"]; len(l) > 0 {
+		s.Indexes = l
+	}
+	s.IndexPaths = index.objectPaths()
+	return context.WithValue(ctx, storageKey{}, &s)
+}
+
+// storageFrom returns the storage of a context created with withHostStorage,
+// or the global storage. It should be used in place of the latter
+// for index-dependent reads of client requests.
+func storageFrom(ctx context.Context) *weasel.Storage {
+	if s, ok := ctx.Value(storageKey{}).(*weasel.Storage); ok {
+		return s
+	}
+	return storage
+}
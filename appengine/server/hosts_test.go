@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Hosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/index.html", "/bucket/docs/README.html", "/bucket/guide/README.html",
+			"/bucket/404.html", "/bucket/404-docs.html":
+			w.Header().Set("content-type", "text/html")
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	restore := withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.NotFound = "/404.html"
+		c.Hosts = map[string]hostConfig{
+			"docs.example.com": {Index: indexConfig{"/": {"README.html"}}, NotFound: "/404-docs.html"},
+			"blog.example.com": {WebRoot: "/blog/"},
+		}
+	})
+	defer restore()
+
+	tests := []struct {
+		host, path string
+		code       int
+		object     string
+	}{
+		// apex host uses globals
+		{"example.com", "/", http.StatusOK, "/bucket/index.html"},
+		{"example.com", "/missing", http.StatusNotFound, "/bucket/404.html"},
+		// overrides
+		{"docs.example.com", "/", http.StatusNotFound, "/bucket/404-docs.html"},
+		{"docs.example.com", "/docs/", http.StatusOK, "/bucket/docs/README.html"},
+		{"docs.example.com", "/guide", http.StatusMovedPermanently, ""},
+		{"docs.example.com", "/missing", http.StatusNotFound, "/bucket/404-docs.html"},
+		// no leaks to other hosts
+		{"other.example.com", "/docs/", http.StatusNotFound, "/bucket/404.html"},
+		{"blog.example.com", "/", http.StatusOK, "/bucket/index.html"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s%s: res.Code = %d; want %d", test.host, test.path, res.Code, test.code)
+		}
+		if v := res.Body.String(); test.object != "" && v != test.object {
+			t.Errorf("%s%s: served %q; want %q", test.host, test.path, v, test.object)
+		}
+	}
+}
+
+func TestHandleObjects(t *testing.T) {
+	mux := http.NewServeMux()
+	handleObjects(mux, &appConfig{
+		WebRoot: "/",
+		Hosts: map[string]hostConfig{
+			"blog.example.com": {WebRoot: "/blog/"},
+			"docs.example.com": {NotFound: "/404.html"},
+		},
+	})
+	tests := []struct{ url, pattern string }{
+		{"http://example.com/page", "/"},
+		{"http://docs.example.com/page", "/"},
+		{"http://blog.example.com/blog/post", "blog.example.com/blog/"},
+		{"http://blog.example.com/other", "blog.example.com/"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		if _, p := mux.Handler(req); p != test.pattern {
+			t.Errorf("%s: pattern = %q; want %q", test.url, p, test.pattern)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// hstsPreloadMinAge is the shortest max-age accepted for HSTS preload lists,
+// see https://hstspreload.org.
+const hstsPreloadMinAge = 365 * 24 * time.Hour
+
+// hstsConfig is the HTTP Strict Transport Security section of appConfig.
+type hstsConfig struct {
+	// MaxAge is how long browsers remember to use HTTPS only.
+	// It is sent in whole seconds.
+	MaxAge duration `json:"max_age" yaml:"max_age"`
+	// IncludeSubdomains extends the policy to all subdomains of the host.
+	IncludeSubdomains bool `json:"include_subdomains" yaml:"include_subdomains"`
+	// Preload consents to inclusion in browser HSTS preload lists.
+	// It requires IncludeSubdomains and MaxAge of at least hstsPreloadMinAge.
+	Preload bool `json:"preload" yaml:"preload"`
+}
+
+// value returns Strict-Transport-Security header value of hc.
+func (hc *hstsConfig) value() string {
+	v := "max-age=" + strconv.FormatInt(int64(time.Duration(hc.MaxAge)/time.Second), 10)
+	if hc.IncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if hc.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// validate reports an error if hc has non-positive MaxAge
+// or does not meet the preload requirements while Preload is set.
+func (hc *hstsConfig) validate() error {
+	d := time.Duration(hc.MaxAge)
+	switch {
+	case d < time.Second:
+		return fmt.Errorf("max_age: %v must be at least 1s", d)
+	case hc.Preload && !hc.IncludeSubdomains:
+		return fmt.Errorf("preload: requires include_subdomains")
+	case hc.Preload && d < hstsPreloadMinAge:
+		return fmt.Errorf("preload: max_age %v is shorter than %v", d, hstsPreloadMinAge)
+	}
+	return nil
+}
+
+// hsts wraps h with Strict-Transport-Security header of the current config
+// HSTS on responses to requests with X-Forwarded-Proto header set to https.
+// Plain HTTP responses never carry it, as browsers ignore it there at best,
+// and requests with no X-Forwarded-Proto are not known to be secure.
+func hsts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hc := currentConfig().HSTS; hc != nil && r.Header.Get("x-forwarded-proto") == "https" {
+			w.Header().Set("strict-transport-security", hc.value())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHSTSValue(t *testing.T) {
+	year := duration(hstsPreloadMinAge)
+	tests := []struct {
+		hc   hstsConfig
+		want string
+	}{
+		{hstsConfig{MaxAge: duration(time.Hour)}, "max-age=3600"},
+		{hstsConfig{MaxAge: duration(1500 * time.Millisecond)}, "max-age=1"},
+		{hstsConfig{MaxAge: year, IncludeSubdomains: true}, "max-age=31536000; includeSubDomains"},
+		{hstsConfig{MaxAge: year, IncludeSubdomains: true, Preload: true}, "max-age=31536000; includeSubDomains; preload"},
+	}
+	for _, test := range tests {
+		if v := test.hc.value(); v != test.want {
+			t.Errorf("%+v.value() = %q; want %q", test.hc, v, test.want)
+		}
+	}
+}
+
+func TestServe_HSTS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hsts"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.HSTS = &hstsConfig{MaxAge: duration(hstsPreloadMinAge), IncludeSubdomains: true, Preload: true}
+		c.CanonicalHost = canonicalHost{"www.goa.design": "goa.design"}
+		c.ForceHTTPS = true
+	})()
+
+	const want = "max-age=31536000; includeSubDomains; preload"
+	tests := []struct {
+		host, proto string
+		code        int
+		hsts        string
+	}{
+		{"goa.design", "https", http.StatusOK, want},
+		{"www.goa.design", "https", http.StatusMovedPermanently, want},
+		{"goa.design", "http", http.StatusMovedPermanently, ""},
+		{"www.goa.design", "http", http.StatusMovedPermanently, ""},
+		{"goa.design", "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/TestServe_HSTS.txt", nil)
+		req.Host = test.host
+		if test.proto != "" {
+			req.Header.Set("x-forwarded-proto", test.proto)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s %s: res.Code = %d; want %d", test.proto, test.host, res.Code, test.code)
+		}
+		if v := res.Header().Get("strict-transport-security"); v != test.hsts {
+			t.Errorf("%s %s: strict-transport-security = %q; want %q", test.proto, test.host, v, test.hsts)
+		}
+	}
+}
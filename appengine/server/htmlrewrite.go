@@ -0,0 +1,173 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// htmlRewrite is an HTMLRewrite entry.
+type htmlRewrite struct {
+	// Base is the href of a <base> element replacing that of the document,
+	// or inserted at the start of its <head> if it has none.
+	// "{scheme}", "{host}" and "{dir}" are replaced with the request scheme,
+	// host and path directory, e.g. "{scheme}://{host}{dir}".
+	Base string `json:"base" yaml:"base"`
+	// Origins maps URL path prefixes, e.g. "/static/", to origins, e.g.
+	// "https://cdn.example.com", prepended to link URLs starting with them.
+	// The longest prefix wins.
+	Origins map[string]string `json:"origins" yaml:"origins"`
+}
+
+var (
+	// baseTagRegexp matches a <base> element, capturing its href value.
+	baseTagRegexp = regexp.MustCompile(`(?is)<base\b[^>]*?\bhref\s*=\s*("[^"]*"|'[^']*'|[^\s>]*)[^>]*>`)
+	// headTagRegexp matches the start tag of <head> element.
+	headTagRegexp = regexp.MustCompile(`(?is)<head\b[^>]*>`)
+	// linkAttrRegexp matches a quoted URL attribute of an element,
+	// capturing the attribute up to the value and the quoted value.
+	linkAttrRegexp = regexp.MustCompile(`(?is)(\s(?:href|src|action|poster)\s*=\s*)("[^"]*"|'[^']*')`)
+)
+
+// rewriteHTML returns a copy of HTML object o with its body rewritten as
+// configured in the most specific current config HTMLRewrite pattern
+// matching r's path. Other objects, including streamed and encoded ones,
+// are returned as is, and so is o when no pattern matches.
+func rewriteHTML(r *http.Request, o *weasel.Object) *weasel.Object {
+	rw, ok := findHTMLRewrite(r, o)
+	if !ok || o.Stream != nil {
+		return o
+	}
+	body := o.Body
+	if rw.Base != "" {
+		body = setBaseHref(body, rw.baseHref(r))
+	}
+	if len(rw.Origins) > 0 {
+		body = rw.rewriteOrigins(body)
+	}
+	o = cloneObject(o)
+	o.Body = body
+	delete(o.Meta, "content-length")
+	return o
+}
+
+// findHTMLRewrite returns the most specific current config HTMLRewrite
+// entry matching r's path if o is an HTML object with no content coding.
+func findHTMLRewrite(r *http.Request, o *weasel.Object) (htmlRewrite, bool) {
+	hc := currentConfig().HTMLRewrite
+	if len(hc) == 0 || o.Redirect() != "" || o.Meta["content-encoding"] != "" {
+		return htmlRewrite{}, false
+	}
+	if t, _, err := mime.ParseMediaType(o.Meta["content-type"]); err != nil || t != "text/html" {
+		return htmlRewrite{}, false
+	}
+	patterns := make([]string, 0, len(hc))
+	for g := range hc {
+		patterns = append(patterns, g)
+	}
+	g, ok := bestGlob(r.URL.Path, patterns)
+	return hc[g], ok
+}
+
+// baseHref returns rw.Base with placeholders replaced for request r.
+func (rw htmlRewrite) baseHref(r *http.Request) string {
+	dir := r.URL.Path
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+		if dir != "/" {
+			dir += "/"
+		}
+	}
+	return strings.NewReplacer(
+		"{scheme}", requestScheme(r),
+		"{host}", r.Host,
+		"{dir}", dir,
+	).Replace(rw.Base)
+}
+
+// setBaseHref returns HTML document b with the href of its <base> element
+// replaced with href, or a <base> element inserted at the start of
+// its <head>. b is returned as is if it has neither.
+func setBaseHref(b []byte, href string) []byte {
+	attr := `"` + html.EscapeString(href) + `"`
+	if loc := baseTagRegexp.FindSubmatchIndex(b); loc != nil {
+		return concat(b[:loc[2]], []byte(attr), b[loc[3]:])
+	}
+	if loc := headTagRegexp.FindIndex(b); loc != nil {
+		return concat(b[:loc[1]], []byte("<base href="+attr+">"), b[loc[1]:])
+	}
+	return b
+}
+
+// rewriteOrigins returns HTML document b with link URLs starting with
+// any of rw.Origins prefixes prefixed with the corresponding origin.
+func (rw htmlRewrite) rewriteOrigins(b []byte) []byte {
+	prefixes := make([]string, 0, len(rw.Origins))
+	for p := range rw.Origins {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return linkAttrRegexp.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := linkAttrRegexp.FindSubmatch(m)
+		q, v := sub[2][:1], string(sub[2][1:len(sub[2])-1])
+		for _, p := range prefixes {
+			if strings.HasPrefix(html.UnescapeString(v), p) {
+				origin := html.EscapeString(strings.TrimSuffix(rw.Origins[p], "/"))
+				return concat(sub[1], q, []byte(origin+v), q)
+			}
+		}
+		return m
+	})
+}
+
+// concat returns a new slice with the contents of parts.
+func concat(parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	b := make([]byte, 0, n)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// validateHTMLRewrite reports an error if any of c.HTMLRewrite origins
+// is not an absolute http(s) URL with no path, or a prefix is not a path.
+func (c *appConfig) validateHTMLRewrite() error {
+	for g, rw := range c.HTMLRewrite {
+		for p, o := range rw.Origins {
+			if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+				return fmt.Errorf(`html_rewrite[%q].origins[%q]: prefix must be a path starting with "/"`, g, p)
+			}
+			u, err := url.Parse(o)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+				return fmt.Errorf(`html_rewrite[%q].origins[%q]: %q is not an http(s) origin`, g, p, o)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestSetBaseHref(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{`<html><head><title>a</title></head></html>`,
+			`<html><head><base href="https://example.com/docs/"><title>a</title></head></html>`},
+		{`<HTML><HEAD lang="en">`, `<HTML><HEAD lang="en"><base href="https://example.com/docs/">`},
+		{`<head><base href="/old/" target="_top"></head>`, `<head><base href="https://example.com/docs/" target="_top"></head>`},
+		{`<head><BASE target=_top HREF='/old/'></head>`, `<head><BASE target=_top HREF="https://example.com/docs/"></head>`},
+		{`<head><base href=/old/></head>`, `<head><base href="https://example.com/docs/"></head>`},
+		// <header> is not <head>
+		{`<body><header>a</header></body>`, `<body><header>a</header></body>`},
+	}
+	for _, test := range tests {
+		if v := string(setBaseHref([]byte(test.in), "https://example.com/docs/")); v != test.out {
+			t.Errorf("setBaseHref(%s) = %s; want %s", test.in, v, test.out)
+		}
+	}
+}
+
+func TestRewriteOrigins(t *testing.T) {
+	rw := htmlRewrite{Origins: map[string]string{
+		"/static/":     "https://cdn.example.com/",
+		"/static/img/": "https://img.example.com",
+	}}
+	tests := []struct{ in, out string }{
+		{`<link rel="stylesheet" href="/static/app.css">`, `<link rel="stylesheet" href="https://cdn.example.com/static/app.css">`},
+		{`<script src='/static/app.js'></script>`, `<script src='https://cdn.example.com/static/app.js'></script>`},
+		{`<img SRC="/static/img/logo.png" alt="/static/x">`, `<img SRC="https://img.example.com/static/img/logo.png" alt="/static/x">`},
+		{`<a href="/docs/">docs</a> /static/app.css`, `<a href="/docs/">docs</a> /static/app.css`},
+		{`<a href="//static/x">`, `<a href="//static/x">`},
+		{`<a href="/static/a?x=1&amp;y=2">`, `<a href="https://cdn.example.com/static/a?x=1&amp;y=2">`},
+	}
+	for _, test := range tests {
+		if v := string(rw.rewriteOrigins([]byte(test.in))); v != test.out {
+			t.Errorf("rewriteOrigins(%s) = %s; want %s", test.in, v, test.out)
+		}
+	}
+}
+
+func TestServe_HTMLRewrite(t *testing.T) {
+	const page = `<!doctype html><html><head><title>Docs</title>` +
+		`<link rel="stylesheet" href="/static/app.css"></head>` +
+		`<body><img src="logo.png"></body></html>`
+	binary := "\x89PNG\r\n<head><link href=\"/static/app.css\">\x00\xff"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/docs/index.html", "/bucket/other/page.html":
+			w.Header().Set("content-type", "text/html; charset=utf-8")
+			w.Write([]byte(page))
+		case "/bucket/docs/logo.png":
+			w.Header().Set("content-type", "image/png")
+			w.Write([]byte(binary))
+		case "/bucket/docs/page.txt":
+			w.Header().Set("content-type", "text/plain")
+			w.Write([]byte(page))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.HTMLRewrite = map[string]htmlRewrite{
+			"/docs/*": {
+				Base:    "{scheme}://{host}{dir}",
+				Origins: map[string]string{"/static/": "https://cdn.example.com"},
+			},
+		}
+	})()
+
+	tests := []struct{ path, body string }{
+		{"/docs/", `<!doctype html><html><head><base href="http://mirror.example.com/docs/"><title>Docs</title>` +
+			`<link rel="stylesheet" href="https://cdn.example.com/static/app.css"></head>` +
+			`<body><img src="logo.png"></body></html>`},
+		{"/docs/logo.png", binary},
+		{"/docs/page.txt", page},
+		// no matching pattern
+		{"/other/page.html", page},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = "mirror.example.com"
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: res.Code = %d; want 200", test.path, res.Code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, v, test.body)
+		}
+		if v := res.Header().Get("content-length"); v != "" && v != strconv.Itoa(len(test.body)) {
+			t.Errorf("%s: content-length = %s; want %d", test.path, v, len(test.body))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// immutableCacheControl is the cache-control of objects whose path
+// matches any of appConfig.Immutable patterns.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// immutablePath reports whether request path p matches any of
+// the current config Immutable patterns.
+func immutablePath(p string) bool {
+	for _, g := range currentConfig().Immutable {
+		if matchGlob(g, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// immutableObject is the weasel.Storage Immutable function,
+// reporting whether the request path of object name is immutablePath.
+func immutableObject(bucket, name string) bool {
+	return immutablePath("/" + name)
+}
+
+// validateImmutable reports an error if any of c.Immutable entries
+// is not a path glob, or c.ImmutableMaxBytes is negative.
+func (c *appConfig) validateImmutable() error {
+	for i, g := range c.Immutable {
+		if !strings.HasPrefix(g, "/") {
+			return fmt.Errorf(`immutable[%d]: %q must start with "/"`, i, g)
+		}
+	}
+	if c.ImmutableMaxBytes < 0 {
+		return fmt.Errorf("immutable_max_bytes: %d must not be negative", c.ImmutableMaxBytes)
+	}
+	return nil
+}
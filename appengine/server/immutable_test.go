@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Immutable(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = make(map[string]int)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("content-type", "application/javascript")
+		w.Write([]byte("console.log('contents of a fingerprinted asset')"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer func(c *weasel.LRU, ttl time.Duration) { storage.Cache, storage.CacheTTL = c, ttl }(storage.Cache, storage.CacheTTL)
+	// entries are below the size of the objects and expire right away
+	storage.Cache = weasel.NewLRU(1<<20, 16)
+	storage.CacheTTL = time.Nanosecond
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.CacheControl = map[string]string{"/static/*": "public, max-age=60"}
+		c.Immutable = []string{"/static/*.*.js"}
+	})()
+
+	tests := []struct {
+		path, cc string
+		fetches  int
+	}{
+		{"/static/app.3f9a1c.js", immutableCacheControl, 1},
+		{"/static/app.js", "public, max-age=60", 2},
+		{"/app.3f9a1c.js", defaultCacheControl, 2},
+	}
+	for _, test := range tests {
+		for i := 0; i < 2; i++ {
+			req, _ := testInstance.NewRequest("GET", test.path, nil)
+			if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+				t.Fatal(err)
+			}
+			res := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(res, req)
+			if res.Code != http.StatusOK {
+				t.Fatalf("%s: res.Code = %d; want 200", test.path, res.Code)
+			}
+			if v := res.Header().Get("cache-control"); v != test.cc {
+				t.Errorf("%s: cache-control = %q; want %q", test.path, v, test.cc)
+			}
+		}
+		mu.Lock()
+		n := fetches["/bucket"+test.path]
+		mu.Unlock()
+		if n != test.fetches {
+			t.Errorf("%s: fetches = %d; want %d", test.path, n, test.fetches)
+		}
+	}
+}
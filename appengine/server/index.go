@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// indexConfig maps request path prefixes to directory index file names,
+// tried in order. The "/" key is the default for paths with no more
+// specific prefix.
+type indexConfig map[string]indexList
+
+// indexList is an ordered list of directory index file names.
+type indexList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts either an index file name or a list for all paths, or a mapping.
+func (ic *indexConfig) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && (b[0] == '"' || b[0] == '[') {
+		var l indexList
+		if err := json.Unmarshal(b, &l); err != nil {
+			return err
+		}
+		*ic = indexConfig{"/": l}
+		return nil
+	}
+	return json.Unmarshal(b, (*map[string]indexList)(ic))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// It accepts either an index file name or a sequence for all paths, or a mapping.
+func (ic *indexConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var l indexList
+	if err := unmarshal(&l); err == nil {
+		*ic = indexConfig{"/": l}
+		return nil
+	}
+	return unmarshal((*map[string]indexList)(ic))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts either a single index file name or a list.
+func (l *indexList) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var name string
+		if err := json.Unmarshal(b, &name); err != nil {
+			return err
+		}
+		*l = indexList{name}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// It accepts either a single index file name or a sequence.
+func (l *indexList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*l = indexList{name}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
+}
+
+// objectPaths returns ic prefixes other than "/" as object name prefixes,
+// suitable for weasel.Storage.IndexPaths.
+func (ic indexConfig) objectPaths() map[string][]string {
+	m := make(map[string][]string, len(ic))
+	for k, v := range ic {
+		if k != "/" {
+			m[strings.TrimPrefix(k, "/")] = v
+		}
+	}
+	return m
+}
+
+// validate reports an error if any ic prefix does not start with "/",
+// has no index file names, or any of them is empty or contains "/".
+func (ic indexConfig) validate() error {
+	for k, l := range ic {
+		if !strings.HasPrefix(k, "/") {
+			return fmt.Errorf(`index[%q]: prefix must start with "/"`, k)
+		}
+		if len(l) == 0 {
+			return fmt.Errorf(`index[%q]: must not be empty`, k)
+		}
+		for _, v := range l {
+			if v == "" || strings.Contains(v, "/") {
+				return fmt.Errorf(`index[%q]: %q is not a file name`, k, v)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDecodeIndexConfig(t *testing.T) {
+	tests := []struct {
+		json, yaml string
+		want       indexConfig
+	}{
+		{`"index.html"`, `index.html`, indexConfig{"/": {"index.html"}}},
+		{`{"/": "index.html", "/docs/": "README.html"}`, `{/: index.html, /docs/: README.html}`,
+			indexConfig{"/": {"index.html"}, "/docs/": {"README.html"}}},
+		{`["index.html", "README.html"]`, `[index.html, README.html]`, indexConfig{"/": {"index.html", "README.html"}}},
+		{`{"/": ["index.html", "index.htm"], "/docs/": "README.html"}`, `{/: [index.html, index.htm], /docs/: README.html}`,
+			indexConfig{"/": {"index.html", "index.htm"}, "/docs/": {"README.html"}}},
+	}
+	for _, test := range tests {
+		var ic indexConfig
+		if err := json.Unmarshal([]byte(test.json), &ic); err != nil || !reflect.DeepEqual(ic, test.want) {
+			t.Errorf("json %s: ic = %v, err = %v; want %v", test.json, ic, err, test.want)
+		}
+		ic = nil
+		if err := yaml.Unmarshal([]byte(test.yaml), &ic); err != nil || !reflect.DeepEqual(ic, test.want) {
+			t.Errorf("yaml %s: ic = %v, err = %v; want %v", test.yaml, ic, err, test.want)
+		}
+	}
+	ic := indexConfig{"/": {"index.html"}, "/docs/": {"README.html"}, "/blog/": {"home.html", "index.html"}}
+	want := map[string][]string{"docs/": {"README.html"}, "blog/": {"home.html", "index.html"}}
+	if v := ic.objectPaths(); !reflect.DeepEqual(v, want) {
+		t.Errorf("objectPaths() = %v; want %v", v, want)
+	}
+}
+
+func TestServe_IndexPaths(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+	orig := storage.IndexPaths
+	storage.IndexPaths = map[string][]string{"docs/": {"README.html"}, "docs/api/": {"api.html"}}
+	defer func() { storage.IndexPaths = orig }()
+
+	tests := []struct{ path, object string }{
+		{"/", "/bucket/index.html"},
+		{"/blog/", "/bucket/blog/index.html"},
+		{"/docs/", "/bucket/docs/README.html"},
+		{"/docs/guide/", "/bucket/docs/guide/README.html"},
+		{"/docs/api/", "/bucket/docs/api/api.html"},
+		{"/docs/page.html", "/bucket/docs/page.html"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: res.Code = %d; want 200", test.path, res.Code)
+		}
+		if v := res.Body.String(); v != test.object {
+			t.Errorf("%s: served %q; want %q", test.path, v, test.object)
+		}
+	}
+}
+
+func TestServe_IndexCandidates(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "a/index.htm", []byte("a index.htm"), map[string]string{"content-type": "text/html"})
+	m.Put("bucket", "a/README.html", []byte("a README.html"), map[string]string{"content-type": "text/html"})
+	m.Put("bucket", "b/README.html", []byte("b README.html"), map[string]string{"content-type": "text/html"})
+	m.Put("bucket", "c/other.html", []byte("c other.html"), map[string]string{"content-type": "text/html"})
+	defer func(b weasel.Backend, idx []string) {
+		storage.Backend, storage.Indexes = b, idx
+	}(storage.Backend, storage.Indexes)
+	storage.Backend = m
+	storage.Indexes = []string{"index.html", "index.htm", "README.html"}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/a/", http.StatusOK, "a index.htm"},
+		{"/b/", http.StatusOK, "b README.html"},
+		{"/b", http.StatusMovedPermanently, ""},
+		{"/c/", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, res.Body, test.body)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// botAgents are User-Agent substrings, matched case-insensitively,
+// of crawlers which get the default LangRedirect target, so that
+// they index a single canonical page.
+var botAgents = []string{"bot", "crawler", "spider", "slurp"}
+
+// langRedirect is a LangRedirect config map value.
+type langRedirect struct {
+	// Langs maps language prefixes, e.g. "pt" or "pt-BR",
+	// to redirect targets. Keys are case-insensitive.
+	Langs map[string]string `json:"langs" yaml:"langs"`
+	// Default is the target of requests with no matching language.
+	Default string `json:"default" yaml:"default"`
+}
+
+// target returns the redirect target of Accept-Language header value al:
+// the Langs entry of the most preferred language range with a match,
+// or Default if none matches. A range matches the longest key equal to it
+// or to its prefix ending before a "-", e.g. "pt-BR" matches "pt".
+func (lr langRedirect) target(al string) string {
+	for _, rng := range parseAcceptLanguage(al) {
+		if rng == "*" {
+			break
+		}
+		best, n := "", 0
+		for k, v := range lr.Langs {
+			k = strings.ToLower(k)
+			if len(k) > n && (rng == k || strings.HasPrefix(rng, k+"-")) {
+				best, n = v, len(k)
+			}
+		}
+		if n > 0 {
+			return best
+		}
+	}
+	return lr.Default
+}
+
+// parseAcceptLanguage returns lowercase language ranges of Accept-Language
+// header value h with positive q-values, from the highest q-value.
+// Ranges of equal q-values keep their order. Malformed q-values exclude
+// the range.
+func parseAcceptLanguage(h string) []string {
+	type weighted struct {
+		rng string
+		q   float64
+	}
+	var list []weighted
+	for _, part := range strings.Split(h, ",") {
+		params := strings.Split(part, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+		if rng == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") && !strings.HasPrefix(p, "Q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(p[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		if q > 0 {
+			list = append(list, weighted{rng, q})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].q > list[j].q })
+	ranges := make([]string, len(list))
+	for i, w := range list {
+		ranges[i] = w.rng
+	}
+	return ranges
+}
+
+// isBot reports whether user agent ua contains one of botAgents.
+func isBot(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, b := range botAgents {
+		if strings.Contains(ua, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLangRedirect responds with a temporary redirect if the path of r
+// is a key of the current config LangRedirect, to the target of its
+// Accept-Language, or the default one for bots. The request query is kept.
+// It returns false if no response was written.
+func serveLangRedirect(w http.ResponseWriter, r *http.Request) bool {
+	lr, ok := currentConfig().LangRedirect[r.URL.Path]
+	if !ok {
+		return false
+	}
+	to := lr.Default
+	if !isBot(r.UserAgent()) {
+		to = lr.target(r.Header.Get("accept-language"))
+	}
+	addVary(w.Header(), "Accept-Language", "User-Agent")
+	redirect{To: to, Code: http.StatusFound}.serveTo(w, r, to)
+	return true
+}
+
+// validateLangRedirect reports an error if a c.LangRedirect key is not
+// a path, an entry has an empty target or default, or a key is also
+// redirected by c.RootRedirect or a c.Redirects entry.
+func (c *appConfig) validateLangRedirect() error {
+	for p, lr := range c.LangRedirect {
+		switch {
+		case !strings.HasPrefix(p, "/"):
+			return fmt.Errorf(`lang_redirect[%q]: must start with "/"`, p)
+		case lr.Default == "":
+			return fmt.Errorf("lang_redirect[%q].default: must not be empty", p)
+		case p == "/" && c.RootRedirect != nil:
+			return fmt.Errorf("lang_redirect[%q]: conflicts with root_redirect", p)
+		}
+		if _, ok := c.Redirects[p]; ok {
+			return fmt.Errorf("lang_redirect[%q]: conflicts with redirects[%q]", p, p)
+		}
+		for lang, to := range lr.Langs {
+			if lang == "" || strings.ContainsAny(lang, " ,;*") {
+				return fmt.Errorf("lang_redirect[%q].langs[%q]: not a language tag", p, lang)
+			}
+			if to == "" {
+				return fmt.Errorf("lang_redirect[%q].langs[%q]: must not be empty", p, lang)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		h    string
+		want []string
+	}{
+		{"", []string{}},
+		{"fr", []string{"fr"}},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr-ch", "fr", "en", "de", "*"}},
+		{"en;q=0.5, pt-BR", []string{"pt-br", "en"}},
+		{"de;q=0.8, fr;q=0.8", []string{"de", "fr"}},
+		{"en;q=0, fr;q=bad, es", []string{"es"}},
+		{" , DE ", []string{"de"}},
+	}
+	for _, test := range tests {
+		if v := parseAcceptLanguage(test.h); !reflect.DeepEqual(v, test.want) {
+			t.Errorf("parseAcceptLanguage(%q) = %q; want %q", test.h, v, test.want)
+		}
+	}
+}
+
+func TestLangRedirectTarget(t *testing.T) {
+	lr := langRedirect{
+		Langs:   map[string]string{"fr": "/fr/", "pt": "/pt/", "pt-BR": "/br/"},
+		Default: "/en/",
+	}
+	tests := []struct {
+		al, want string
+	}{
+		{"", "/en/"},
+		{"fr", "/fr/"},
+		{"FR-ca", "/fr/"},
+		{"pt-PT", "/pt/"},
+		{"pt-br", "/br/"},
+		{"pt", "/pt/"},
+		{"fra", "/en/"},
+		{"de, fr;q=0.5", "/fr/"},
+		{"fr;q=0.5, pt-BR;q=0.9", "/br/"},
+		{"fr;q=0, de", "/en/"},
+		{"de, *;q=0.5, fr;q=0.1", "/en/"},
+	}
+	for _, test := range tests {
+		if v := lr.target(test.al); v != test.want {
+			t.Errorf("target(%q) = %q; want %q", test.al, v, test.want)
+		}
+	}
+}
+
+func TestServe_LangRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.LangRedirect = map[string]langRedirect{"/": {
+			Langs:   map[string]string{"fr": "/fr/", "ja": "/ja/"},
+			Default: "/en/",
+		}}
+	})()
+
+	tests := []struct {
+		url, lang, agent string
+		code             int
+		location         string
+	}{
+		{"/", "ja-JP,ja;q=0.9", "", http.StatusFound, "/ja/"},
+		{"/?ref=x", "fr", "", http.StatusFound, "/fr/?ref=x"},
+		{"/", "", "", http.StatusFound, "/en/"},
+		{"/", "de", "", http.StatusFound, "/en/"},
+		{"/", "fr", "Mozilla/5.0 (compatible; Googlebot/2.1)", http.StatusFound, "/en/"},
+		{"/fr/", "ja", "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.url, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		if test.lang != "" {
+			req.Header.Set("accept-language", test.lang)
+		}
+		req.Header.Set("user-agent", test.agent)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.url, test.lang, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%s %q: location = %q; want %q", test.url, test.lang, v, test.location)
+		}
+		if test.code == http.StatusFound {
+			if v := res.Header().Get("vary"); v != "Accept-Language, User-Agent" {
+				t.Errorf("%s %q: vary = %q; want Accept-Language, User-Agent", test.url, test.lang, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// LogFormat values.
+const (
+	logFormatJSON     = "json"     // requestLog as JSON, the default
+	logFormatCommon   = "common"   // Common Log Format
+	logFormatCombined = "combined" // Combined Log Format
+)
+
+// clfTime is the time layout of Common Log Format entries.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// requestLog is a structured request log entry, written once per request
+// when LogRequests is enabled. It is also the source of request metrics.
+type requestLog struct {
+	ID       string  `json:"request_id,omitempty"`
+	Method   string  `json:"method"`
+	Host     string  `json:"host"`
+	Path     string  `json:"path"`
+	Bucket   string  `json:"bucket,omitempty"`
+	Object   string  `json:"object,omitempty"`
+	Status   int     `json:"status"`
+	Bytes    int64   `json:"bytes"`
+	Cache    string  `json:"cache,omitempty"` // "hit" or "miss"
+	Duration float64 `json:"duration_ms"`
+
+	// fields of common and combined LogFormat only
+	Time      time.Time `json:"-"`
+	RemoteIP  string    `json:"-"` // see clientIP
+	User      string    `json:"-"` // basic auth user name
+	URI       string    `json:"-"` // request target, including the query
+	Proto     string    `json:"-"`
+	Referer   string    `json:"-"`
+	UserAgent string    `json:"-"`
+}
+
+// writeRequestLog sends a request log entry to App Engine logs,
+// formatted as the current config LogFormat. Tests may replace it.
+var writeRequestLog = func(ctx context.Context, e *requestLog) {
+	b, err := formatRequestLog(currentConfig().LogFormat, e)
+	if err != nil {
+		log.Errorf(ctx, "json.Marshal: %v", err)
+		return
+	}
+	log.Infof(ctx, "%s", b)
+}
+
+// slowRequestLog is a warning log entry of a request which took longer
+// than SlowRequestThreshold.
+type slowRequestLog struct {
+	Slow      bool    `json:"slow_request"` // always true, to filter on
+	ID        string  `json:"request_id,omitempty"`
+	Method    string  `json:"method"`
+	Host      string  `json:"host"`
+	Path      string  `json:"path"`
+	Bucket    string  `json:"bucket,omitempty"`
+	Object    string  `json:"object,omitempty"`
+	Status    int     `json:"status"`
+	Duration  float64 `json:"duration_ms"`
+	Threshold float64 `json:"threshold_ms"`
+}
+
+// writeSlowRequest sends a slow request log entry to App Engine logs
+// at warning level, as JSON. Tests may replace it.
+var writeSlowRequest = func(ctx context.Context, e *slowRequestLog) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf(ctx, "json.Marshal: %v", err)
+		return
+	}
+	log.Warningf(ctx, "%s", b)
+}
+
+// formatRequestLog returns e formatted as LogFormat format.
+func formatRequestLog(format string, e *requestLog) ([]byte, error) {
+	switch format {
+	case logFormatCommon, logFormatCombined:
+	default:
+		return json.Marshal(e)
+	}
+	var b bytes.Buffer
+	bytesSent := "-"
+	if e.Bytes > 0 {
+		bytesSent = strconv.FormatInt(e.Bytes, 10)
+	}
+	fmt.Fprintf(&b, "%s - %s [%s] \"%s\" %d %s",
+		clfField(e.RemoteIP), clfField(e.User), e.Time.Format(clfTime),
+		clfEscape(e.Method+" "+e.URI+" "+e.Proto), e.Status, bytesSent)
+	if format == logFormatCombined {
+		fmt.Fprintf(&b, ` "%s" "%s"`, clfEscape(orDash(e.Referer)), clfEscape(orDash(e.UserAgent)))
+	}
+	return b.Bytes(), nil
+}
+
+// clfField returns an unquoted Common Log Format field value of s,
+// which is "-" if s is empty. Spaces are escaped along with clfEscape.
+func clfField(s string) string {
+	return strings.Replace(clfEscape(orDash(s)), " ", `\x20`, -1)
+}
+
+// orDash returns s or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfEscape escapes quotes, backslashes and control characters of s
+// the same way Apache httpd does in its access log.
+func clfEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// logWriter is an http.ResponseWriter which records response status
+// and size, and object attribution for requestLog.
+// If debug is set, the attribution is also sent in X-Debug-* response headers,
+// and if timing is set, cache and fetch times are sent in Server-Timing.
+type logWriter struct {
+	http.ResponseWriter
+	entry  requestLog
+	cache  *weasel.CacheStatus
+	debug  bool
+	timing bool
+}
+
+func (w *logWriter) WriteHeader(code int) {
+	if w.entry.Status == 0 {
+		w.entry.Status = code
+		w.writeDebugHeaders()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	if w.entry.Status == 0 {
+		w.entry.Status = http.StatusOK
+		w.writeDebugHeaders()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.entry.Bytes += int64(n)
+	return n, err
+}
+
+// writeDebugHeaders sets X-Debug-Bucket, X-Debug-Object and X-Debug-Cache
+// response headers of the request attribution known so far, if w.debug is set,
+// and Server-Timing if w.timing is set. Unknown values are omitted.
+func (w *logWriter) writeDebugHeaders() {
+	h := w.Header()
+	if v := serverTiming(w.cache); w.timing && v != "" {
+		h.Set("server-timing", v)
+	}
+	if !w.debug {
+		return
+	}
+	for k, v := range map[string]string{
+		"X-Debug-Bucket": w.entry.Bucket,
+		"X-Debug-Object": w.entry.Object,
+		"X-Debug-Cache":  cacheResult(w.cache),
+	} {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+}
+
+// cacheResult returns "miss" if cs has any misses, "hit" if it has hits only,
+// or an empty string if cs is nil or recorded no lookups.
+func cacheResult(cs *weasel.CacheStatus) string {
+	switch {
+	case cs == nil:
+		return ""
+	case cs.Misses() > 0:
+		return "miss"
+	case cs.Hits() > 0:
+		return "hit"
+	}
+	return ""
+}
+
+// instrument wraps h with structured request logging if LogRequests is enabled,
+// requests metrics collection if Metrics is configured,
+// debug response headers if DebugHeaders or ServerTiming is enabled,
+// and slow request warnings if SlowRequestThreshold is set.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if !c.LogRequests && c.Metrics == nil && !c.DebugHeaders && !c.ServerTiming && c.SlowRequestThreshold <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		lw := &logWriter{ResponseWriter: w, debug: c.DebugHeaders, timing: c.ServerTiming}
+		h.ServeHTTP(lw, r)
+
+		e := &lw.entry
+		e.ID = r.Header.Get(c.requestIDHeader())
+		e.Method = r.Method
+		e.Host = r.Host
+		e.Path = r.URL.Path
+		if c.LogFormat == logFormatCommon || c.LogFormat == logFormatCombined {
+			e.Time = start
+			e.RemoteIP = clientIP(r)
+			e.User, _, _ = r.BasicAuth()
+			e.URI = r.URL.RequestURI()
+			e.Proto = r.Proto
+			e.Referer = r.Referer()
+			e.UserAgent = r.UserAgent()
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.Cache = cacheResult(lw.cache)
+		elapsed := time.Since(start)
+		e.Duration = float64(elapsed) / float64(time.Millisecond)
+		if c.Metrics != nil {
+			metricsRegistry.observeRequest(e)
+		}
+		if c.LogRequests && c.logSampled(e.Status) {
+			// this is not a client request, so don't use newContext.
+			writeRequestLog(appengine.NewContext(r), e)
+		}
+		if d := time.Duration(c.SlowRequestThreshold); d > 0 && elapsed > d {
+			writeSlowRequest(appengine.NewContext(r), &slowRequestLog{
+				Slow:      true,
+				ID:        e.ID,
+				Method:    e.Method,
+				Host:      e.Host,
+				Path:      e.Path,
+				Bucket:    e.Bucket,
+				Object:    e.Object,
+				Status:    e.Status,
+				Duration:  e.Duration,
+				Threshold: float64(d) / float64(time.Millisecond),
+			})
+		}
+	})
+}
+
+// logSampled reports whether a request with response status code is logged
+// under c.NotFoundLogSample. Only 404 responses are sampled, with math/rand,
+// which is cheap and good enough for the purpose.
+func (c *appConfig) logSampled(code int) bool {
+	if code != http.StatusNotFound || c.NotFoundLogSample == nil {
+		return true
+	}
+	return rand.Float64() < *c.NotFoundLogSample
+}
+
+// attributeRequest records bucket and object name in the request log entry,
+// if w is a logWriter, and returns ctx which counts cache hits and misses.
+// Otherwise, ctx is returned unmodified. Subsequent calls with the same w
+// only update the bucket and object names.
+func attributeRequest(ctx context.Context, w http.ResponseWriter, bucket, oname string) context.Context {
+	lw, ok := w.(*logWriter)
+	if !ok {
+		return ctx
+	}
+	lw.entry.Bucket = bucket
+	lw.entry.Object = oname
+	if lw.cache == nil {
+		ctx, lw.cache = weasel.WithCacheStatus(ctx)
+	}
+	return ctx
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_LogRequests(t *testing.T) {
+	const contents = "logged"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/TestServe_LogRequests.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(contents))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.LogRequests = true
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	var entries []*requestLog
+	orig := writeRequestLog
+	writeRequestLog = func(_ context.Context, e *requestLog) { entries = append(entries, e) }
+	defer func() { writeRequestLog = orig }()
+
+	tests := []struct {
+		path  string
+		entry requestLog
+	}{
+		{"/TestServe_LogRequests.txt", requestLog{
+			Method: "GET",
+			Host:   "example.com",
+			Path:   "/TestServe_LogRequests.txt",
+			Bucket: "bucket",
+			Object: "TestServe_LogRequests.txt",
+			Status: http.StatusOK,
+			Bytes:  int64(len(contents)),
+			Cache:  "miss",
+		}},
+		{"/TestServe_LogRequests.txt", requestLog{
+			Method: "GET",
+			Host:   "example.com",
+			Path:   "/TestServe_LogRequests.txt",
+			Bucket: "bucket",
+			Object: "TestServe_LogRequests.txt",
+			Status: http.StatusOK,
+			Bytes:  int64(len(contents)),
+			Cache:  "hit",
+		}},
+		{"/TestServe_LogRequests/missing", requestLog{
+			Method: "GET",
+			Host:   "example.com",
+			Path:   "/TestServe_LogRequests/missing",
+			Bucket: "bucket",
+			Object: "TestServe_LogRequests/missing",
+			Status: http.StatusNotFound,
+			Bytes:  int64(len(http.StatusText(http.StatusNotFound))),
+			Cache:  "miss",
+		}},
+	}
+	for i, test := range tests {
+		entries = nil
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = "example.com"
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+
+		if len(entries) != 1 {
+			t.Fatalf("%d: len(entries) = %d; want 1", i, len(entries))
+		}
+		e := *entries[0]
+		if e.Duration <= 0 {
+			t.Errorf("%d: e.Duration = %v; want > 0", i, e.Duration)
+		}
+		if e.ID == "" {
+			t.Errorf("%d: e.ID is empty; want a request ID", i)
+		}
+		e.Duration, e.ID = 0, ""
+		if e != test.entry {
+			t.Errorf("%d: e = %+v; want %+v", i, e, test.entry)
+		}
+	}
+}
+
+func TestFormatRequestLog(t *testing.T) {
+	e := &requestLog{
+		Method:    "GET",
+		Host:      "example.com",
+		Path:      "/docs/page.html",
+		Status:    http.StatusOK,
+		Bytes:     2326,
+		Cache:     "hit",
+		Duration:  1.5,
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteIP:  "203.0.113.7",
+		URI:       "/docs/page.html?q=1",
+		Proto:     "HTTP/1.1",
+		Referer:   "https://example.com/",
+		UserAgent: `Mozilla/5.0 "quoted"`,
+	}
+	tests := []struct{ format, line string }{
+		{"", `{"method":"GET","host":"example.com","path":"/docs/page.html","status":200,"bytes":2326,"cache":"hit","duration_ms":1.5}`},
+		{logFormatJSON, `{"method":"GET","host":"example.com","path":"/docs/page.html","status":200,"bytes":2326,"cache":"hit","duration_ms":1.5}`},
+		{logFormatCommon, `203.0.113.7 - - [10/Oct/2000:13:55:36 -0700] "GET /docs/page.html?q=1 HTTP/1.1" 200 2326`},
+		{logFormatCombined, `203.0.113.7 - - [10/Oct/2000:13:55:36 -0700] "GET /docs/page.html?q=1 HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0 \"quoted\""`},
+	}
+	for _, test := range tests {
+		b, err := formatRequestLog(test.format, e)
+		if err != nil {
+			t.Errorf("%q: formatRequestLog: %v", test.format, err)
+			continue
+		}
+		if v := string(b); v != test.line {
+			t.Errorf("%q: formatRequestLog = %s; want %s", test.format, v, test.line)
+		}
+	}
+
+	// empty values and escaping
+	e = &requestLog{Method: "GET", URI: "/a\nb", Proto: "HTTP/1.0", Status: http.StatusNotModified,
+		Time: e.Time, RemoteIP: "198.51.100.1", User: "j doe"}
+	want := `198.51.100.1 - j\x20doe [10/Oct/2000:13:55:36 -0700] "GET /a\x0ab HTTP/1.0" 304 - "-" "-"`
+	if b, _ := formatRequestLog(logFormatCombined, e); string(b) != want {
+		t.Errorf("formatRequestLog = %s; want %s", b, want)
+	}
+}
+
+func TestServe_LogFormat(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.LogRequests = true
+		c.LogFormat = logFormatCombined
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	var entries []*requestLog
+	orig := writeRequestLog
+	writeRequestLog = func(_ context.Context, e *requestLog) { entries = append(entries, e) }
+	defer func() { writeRequestLog = orig }()
+
+	req, _ := testInstance.NewRequest("GET", "/log-format.txt?v=2", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("referer", "https://example.com/")
+	req.Header.Set("user-agent", "test-agent")
+	req.SetBasicAuth("jdoe", "secret")
+	before := time.Now()
+	http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d; want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Time.Before(before.Add(-time.Second)) || e.Time.After(time.Now()) {
+		t.Errorf("e.Time = %v; want about %v", e.Time, before)
+	}
+	if e.RemoteIP != "203.0.113.7" || e.User != "jdoe" || e.URI != "/log-format.txt?v=2" ||
+		e.Proto != req.Proto || e.Referer != "https://example.com/" || e.UserAgent != "test-agent" {
+		t.Errorf("e = %+v; want access log fields of req", e)
+	}
+}
+
+func TestServe_DebugHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/debug.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		debug                bool
+		path                 string
+		bucket, object, hits string
+	}{
+		{false, "/debug.txt", "", "", ""},
+		{true, "/debug.txt", "bucket", "debug.txt", "hit"},
+		{true, "/missing.txt", "bucket", "missing.txt", "miss"},
+		{false, "/missing.txt", "", "", ""},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.DebugHeaders = test.debug
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		for k, v := range map[string]string{
+			"X-Debug-Bucket": test.bucket,
+			"X-Debug-Object": test.object,
+			"X-Debug-Cache":  test.hits,
+		} {
+			if _, ok := res.Header()[k]; v == "" && ok {
+				t.Errorf("%d: %s is present with debug_headers = %v", i, k, test.debug)
+			}
+			if h := res.Header().Get(k); h != v {
+				t.Errorf("%d: %s = %q; want %q", i, k, h, v)
+			}
+		}
+	}
+}
+
+func TestServe_NotFoundLogSample(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/denied.txt" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	var entries []*requestLog
+	orig := writeRequestLog
+	writeRequestLog = func(_ context.Context, e *requestLog) { entries = append(entries, e) }
+	defer func() { writeRequestLog = orig }()
+
+	serve := func(p string, n int) {
+		for i := 0; i < n; i++ {
+			req, _ := testInstance.NewRequest("GET", p, nil)
+			http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+	tests := []struct {
+		sample   *float64
+		min, max int // logged 404s out of 1000
+	}{
+		{nil, 1000, 1000},
+		{floatPtr(1), 1000, 1000},
+		{floatPtr(0), 0, 0},
+		{floatPtr(0.3), 200, 400},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.LogRequests = true
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.NotFoundLogSample = test.sample
+		})
+		entries = nil
+		serve("/scanner/wp-login.php", 1000)
+		serve("/denied.txt", 10)
+		restore()
+		notFound, denied := 0, 0
+		for _, e := range entries {
+			switch e.Status {
+			case http.StatusNotFound:
+				notFound++
+			case http.StatusForbidden:
+				denied++
+			}
+		}
+		if notFound < test.min || notFound > test.max {
+			t.Errorf("sample %v: %d 404s logged; want [%d, %d]", test.sample, notFound, test.min, test.max)
+		}
+		if denied != 10 {
+			t.Errorf("sample %v: %d 403s logged; want 10", test.sample, denied)
+		}
+	}
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestServe_SlowRequestThreshold(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/slow.txt" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	var entries []*slowRequestLog
+	orig := writeSlowRequest
+	writeSlowRequest = func(_ context.Context, e *slowRequestLog) { entries = append(entries, e) }
+	defer func() { writeSlowRequest = orig }()
+
+	tests := []struct {
+		threshold time.Duration
+		path      string
+		slow      bool
+	}{
+		{20 * time.Millisecond, "/slow.txt", true},
+		{20 * time.Millisecond, "/fast.txt", false},
+		{time.Minute, "/slow.txt", false},
+		{0, "/slow.txt", false},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.SlowRequestThreshold = duration(test.threshold)
+		})
+		entries = nil
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+		restore()
+
+		if n := len(entries); test.slow != (n == 1) || n > 1 {
+			t.Errorf("%v %s: %d slow entries; want slow: %v", test.threshold, test.path, n, test.slow)
+			continue
+		}
+		if !test.slow {
+			continue
+		}
+		e := entries[0]
+		if !e.Slow || e.Path != test.path || e.Bucket != "bucket" || e.Status != http.StatusOK ||
+			e.Duration < 50 || e.Threshold != 20 {
+			t.Errorf("%v %s: e = %+v; want slow entry of the request", test.threshold, test.path, e)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// maintenanceRetryAfter is the retry-after header value in seconds
+// of maintenance responses.
+const maintenanceRetryAfter = 120
+
+// maintenanceConfig is the Maintenance section of appConfig.
+type maintenanceConfig struct {
+	// Enabled turns maintenance mode on.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Object is the path of the maintenance page object in the request bucket,
+	// e.g. "/maintenance.html". A plain text response is used if empty or missing.
+	Object string `json:"object" yaml:"object"`
+	// Allow is a list of rules of requests bypassing the maintenance mode.
+	// See allowRule.
+	Allow []allowRule `json:"allow" yaml:"allow"`
+}
+
+// allowRule is an entry of maintenanceConfig.Allow. It is decoded either from
+// a string, a client IP address or CIDR range, e.g. "203.0.113.7" or "10.0.0.0/8",
+// or from a request header match, e.g. {header: X-Preview-Key, equals: secret}.
+type allowRule struct {
+	IP     string `json:"-" yaml:"-"`
+	Header string `json:"header" yaml:"header"`
+	Equals string `json:"equals" yaml:"equals"`
+}
+
+// headerRule is allowRule decoded from an object.
+type headerRule allowRule
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *allowRule) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*a = allowRule{}
+		return json.Unmarshal(b, &a.IP)
+	}
+	return json.Unmarshal(b, (*headerRule)(a))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (a *allowRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ip string
+	if err := unmarshal(&ip); err == nil {
+		*a = allowRule{IP: ip}
+		return nil
+	}
+	return unmarshal((*headerRule)(a))
+}
+
+// MarshalJSON implements json.Marshaler, encoding IP rules as strings.
+func (a allowRule) MarshalJSON() ([]byte, error) {
+	if a.Header == "" {
+		return json.Marshal(a.IP)
+	}
+	return json.Marshal(headerRule(a))
+}
+
+// matches reports whether a allows request r. Header values are compared
+// in constant time.
+func (a *allowRule) matches(r *http.Request) bool {
+	if a.Header == "" {
+		return ipListed(r.RemoteAddr, []string{a.IP})
+	}
+	v := r.Header.Get(a.Header)
+	return v != "" && subtle.ConstantTimeCompare([]byte(v), []byte(a.Equals)) == 1
+}
+
+// validate reports an error if any of mc.Allow IP rules is neither an IP
+// address nor a CIDR, or any header rule has no value to compare with.
+func (mc *maintenanceConfig) validate() error {
+	for i, a := range mc.Allow {
+		switch {
+		case a.Header != "" && a.Equals == "":
+			return fmt.Errorf("allow[%d].equals: must not be empty", i)
+		case a.Header == "" && a.Equals != "":
+			return fmt.Errorf("allow[%d].header: must not be empty", i)
+		case a.Header == "" && !isIPOrCIDR(a.IP):
+			return fmt.Errorf("allow[%d]: %q is not an IP address or CIDR", i, a.IP)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether request r matches one of mc.Allow rules.
+func (mc *maintenanceConfig) allowed(r *http.Request) bool {
+	for i := range mc.Allow {
+		if mc.Allow[i].matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateIPList reports an error if any of the config field list entries
+// is neither an IP address nor a CIDR.
+func validateIPList(field string, list []string) error {
+	for i, a := range list {
+		if !isIPOrCIDR(a) {
+			return fmt.Errorf("%s[%d]: %q is not an IP address or CIDR", field, i, a)
+		}
+	}
+	return nil
+}
+
+// isIPOrCIDR reports whether a is an IP address or a CIDR range.
+func isIPOrCIDR(a string) bool {
+	_, _, err := net.ParseCIDR(a)
+	return err == nil || net.ParseIP(a) != nil
+}
+
+// ipListed reports whether client address addr, with or without a port,
+// matches one of the IP addresses or CIDR ranges of list.
+func ipListed(addr string, list []string) bool {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		addr = h
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, a := range list {
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenance wraps h with maintenance responses to requests
+// not allowed by the current config Maintenance, while it is enabled.
+// It responds with the Maintenance.Object from the request bucket,
+// 503 status code and retry-after header.
+func maintenance(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mc := currentConfig().Maintenance
+		if mc == nil || !mc.Enabled || mc.allowed(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("retry-after", strconv.Itoa(maintenanceRetryAfter))
+		if mc.Object == "" {
+			serveError(w, http.StatusServiceUnavailable, "")
+			return
+		}
+		ctx := newContext(r)
+		bucket, name := resolveBucket(r.Host, r.URL.Path), strings.TrimPrefix(mc.Object, "/")
+		o, err := storageFrom(ctx).ReadObject(ctx, bucket, name)
+		if err != nil {
+			log.Errorf(ctx, "%s/%s: %v", bucket, name, err)
+			serveError(w, http.StatusServiceUnavailable, "")
+			return
+		}
+		// the page must not be cached in place of the requested URL
+		o = cloneObject(applyContentType(name, o))
+		o.Meta["cache-control"] = "no-store"
+		if err := weasel.ServeObjectCode(w, o, http.StatusServiceUnavailable, r.Method == "GET"); err != nil {
+			log.Errorf(ctx, "%s/%s: %v", bucket, name, err)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMaintenanceAllowed(t *testing.T) {
+	mc := &maintenanceConfig{Allow: []allowRule{
+		{IP: "203.0.113.7"}, {IP: "10.0.0.0/8"}, {IP: "2001:db8::/32"},
+		{Header: "X-Preview-Key", Equals: "preview"},
+	}}
+	tests := []struct {
+		addr, key string
+		ok        bool
+	}{
+		{"203.0.113.7", "", true},
+		{"203.0.113.7:1234", "", true},
+		{"203.0.113.8", "", false},
+		{"10.1.2.3", "", true},
+		{"11.0.0.1", "", false},
+		{"[2001:db8::1]:443", "", true},
+		{"2001:db9::1", "", false},
+		{"", "", false},
+		{"203.0.113.8", "preview", true},
+		{"203.0.113.8", "preview2", false},
+		{"203.0.113.8", "previe", false},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = test.addr
+		if test.key != "" {
+			r.Header.Set("x-preview-key", test.key)
+		}
+		if v := mc.allowed(r); v != test.ok {
+			t.Errorf("allowed(%q, key %q) = %v; want %v", test.addr, test.key, v, test.ok)
+		}
+	}
+}
+
+func TestDecodeAllowRules(t *testing.T) {
+	const (
+		js = `["10.0.0.0/8", {"header": "X-Preview-Key", "equals": "preview"}]`
+		ym = `[10.0.0.0/8, {header: X-Preview-Key, equals: preview}]`
+	)
+	want := []allowRule{{IP: "10.0.0.0/8"}, {Header: "X-Preview-Key", Equals: "preview"}}
+	var rules []allowRule
+	if err := json.Unmarshal([]byte(js), &rules); err != nil || !reflect.DeepEqual(rules, want) {
+		t.Errorf("json: rules = %+v, err = %v; want %+v", rules, err, want)
+	}
+	rules = nil
+	if err := yaml.Unmarshal([]byte(ym), &rules); err != nil || !reflect.DeepEqual(rules, want) {
+		t.Errorf("yaml: rules = %+v, err = %v; want %+v", rules, err, want)
+	}
+	b, err := json.Marshal(want)
+	if v := `["10.0.0.0/8",{"header":"X-Preview-Key","equals":"preview"}]`; err != nil || string(b) != v {
+		t.Errorf("json.Marshal = %s, %v; want %s", b, err, v)
+	}
+}
+
+func TestServe_Maintenance(t *testing.T) {
+	const page = "<h1>back soon</h1>"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/maintenance.html":
+			w.Header().Set("content-type", "text/html")
+			w.Header().Set("cache-control", "public,max-age=3600")
+			w.Write([]byte(page))
+		case "/bucket/page.txt":
+			w.Write([]byte("contents"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		mc         *maintenanceConfig
+		path, addr string
+		code       int
+		body       string
+	}{
+		{nil, "/page.txt", "198.51.100.1", http.StatusOK, "contents"},
+		{&maintenanceConfig{Object: "/maintenance.html"}, "/page.txt", "198.51.100.1", http.StatusOK, "contents"},
+		{&maintenanceConfig{Enabled: true, Object: "/maintenance.html"}, "/page.txt", "198.51.100.1", http.StatusServiceUnavailable, page},
+		{&maintenanceConfig{Enabled: true, Object: "/maintenance.html", Allow: []allowRule{{IP: "198.51.100.0/24"}}},
+			"/page.txt", "198.51.100.1:5000", http.StatusOK, "contents"},
+		{&maintenanceConfig{Enabled: true, Object: "/maintenance.html", Allow: []allowRule{{IP: "198.51.100.2"}}},
+			"/page.txt", "198.51.100.1", http.StatusServiceUnavailable, page},
+		{&maintenanceConfig{Enabled: true, Object: "/missing.html"}, "/page.txt", "198.51.100.1", http.StatusServiceUnavailable, "Service Unavailable"},
+		{&maintenanceConfig{Enabled: true}, "/page.txt", "198.51.100.1", http.StatusServiceUnavailable, "Service Unavailable"},
+		{&maintenanceConfig{Enabled: true, Object: "/maintenance.html"}, "/healthz", "198.51.100.1", http.StatusOK, ""},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.Maintenance = test.mc
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.RemoteAddr = test.addr
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != test.code {
+			t.Errorf("%d: res.Code = %d; want %d", i, res.Code, test.code)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%d: res.Body = %q; want %q", i, res.Body, test.body)
+		}
+		if test.code != http.StatusServiceUnavailable {
+			continue
+		}
+		if v := res.Header().Get("retry-after"); v != "120" {
+			t.Errorf("%d: retry-after = %q; want 120", i, v)
+		}
+		if v := res.Header().Get("cache-control"); test.body == page && v != "no-store" {
+			t.Errorf("%d: cache-control = %q; want no-store", i, v)
+		}
+	}
+}
+
+func TestServe_MaintenanceAllowHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Maintenance = &maintenanceConfig{Enabled: true, Allow: []allowRule{
+			{IP: "203.0.113.7"},
+			{Header: "X-Preview-Key", Equals: "preview"},
+		}}
+	})()
+
+	tests := []struct {
+		addr, key string
+		code      int
+	}{
+		{"198.51.100.1", "preview", http.StatusOK},
+		{"203.0.113.7", "", http.StatusOK},
+		{"198.51.100.1", "wrong", http.StatusServiceUnavailable},
+		{"198.51.100.1", "", http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/page.txt", nil)
+		req.RemoteAddr = test.addr
+		if test.key != "" {
+			req.Header.Set("X-Preview-Key", test.key)
+		}
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s, key %q: res.Code = %d; want %d", test.addr, test.key, res.Code, test.code)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// manifestContentType is the content-type of objects whose path matches
+// any of appConfig.Manifests patterns.
+const manifestContentType = "application/json; charset=utf-8"
+
+// applyManifest returns o with manifestContentType and no-store
+// cache-control if request path p matches any of the current config
+// Manifests patterns, overriding the object metadata, CacheControl and
+// Immutable. CORS headers are set by serveCORS, same as for other objects.
+// The object is returned as is when no pattern matches or o is a redirect.
+func applyManifest(p string, o *weasel.Object) *weasel.Object {
+	if o.Redirect() != "" || !manifestPath(p) {
+		return o
+	}
+	o = cloneObject(o)
+	o.Meta["content-type"] = manifestContentType
+	o.Meta["cache-control"] = "no-store"
+	return o
+}
+
+// manifestPath reports whether request path p matches any of
+// the current config Manifests patterns.
+func manifestPath(p string) bool {
+	for _, g := range currentConfig().Manifests {
+		if matchGlob(g, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateManifests reports an error if any of c.Manifests entries
+// is not a path glob.
+func (c *appConfig) validateManifests() error {
+	for i, g := range c.Manifests {
+		if !strings.HasPrefix(g, "/") {
+			return fmt.Errorf(`manifests[%d]: %q must start with "/"`, i, g)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Manifests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.Header().Set("cache-control", "public, max-age=3600")
+		w.Write([]byte(`{"version": "1.2.3"}`))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.CacheControl = map[string]string{"/*.json": "public, max-age=60"}
+		c.Immutable = []string{"/meta/*"}
+		c.Manifests = []string{"/version.json", "/meta/*.json"}
+		c.CORS = &corsConfig{AllowOrigins: []string{"*"}}
+	})()
+
+	tests := []struct {
+		path, ct, cc string
+	}{
+		{"/version.json", manifestContentType, "no-store"},
+		{"/meta/flags.json", manifestContentType, "no-store"},
+		{"/other.json", "text/plain; charset=utf-8", "public, max-age=60"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("origin", "https://app.example.com")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: res.Code = %d; want 200", test.path, res.Code)
+		}
+		if v := res.Header().Get("content-type"); v != test.ct {
+			t.Errorf("%s: content-type = %q; want %q", test.path, v, test.ct)
+		}
+		if v := res.Header().Get("cache-control"); v != test.cc {
+			t.Errorf("%s: cache-control = %q; want %q", test.path, v, test.cc)
+		}
+		if v := res.Header().Get("access-control-allow-origin"); v != "*" {
+			t.Errorf("%s: access-control-allow-origin = %q; want *", test.path, v)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// findMethods returns the current config Methods entry with the longest
+// prefix matching path p, or nil if none matches.
+func findMethods(p string) []string {
+	var (
+		methods []string
+		n       = -1
+	)
+	for prefix, m := range currentConfig().Methods {
+		if len(prefix) > n && strings.HasPrefix(p, prefix) {
+			methods, n = m, len(prefix)
+		}
+	}
+	return methods
+}
+
+// allowMethod reports whether objects at path p may be requested with method m,
+// along with Allow header value for p. Unless overridden by the current config
+// Methods, only the methods of weasel.ValidMethod are allowed.
+func allowMethod(p, m string) (ok bool, allow string) {
+	methods := findMethods(p)
+	if methods == nil {
+		return weasel.ValidMethod(m), weasel.AllowHeader()
+	}
+	for _, v := range methods {
+		if v == m {
+			ok = true
+			break
+		}
+	}
+	return ok, strings.Join(methods, ", ")
+}
+
+// serveMethod responds with 405 status code and Allow header of the request
+// path if r method is not allowed; see allowMethod. Allowed methods other than
+// GET, HEAD and OPTIONS are served like GET, so the returned request should be
+// used in place of r. It reports whether the request was handled.
+func serveMethod(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	ok, allow := allowMethod(r.URL.Path, r.Method)
+	if !ok {
+		w.Header().Set("allow", allow)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return r, true
+	}
+	if !weasel.ValidMethod(r.Method) {
+		r2 := *r
+		r2.Method = "GET"
+		r = &r2
+	}
+	return r, false
+}
+
+// validateMethods reports an error if a c.Methods key is not a path prefix,
+// or its value is empty, lists a method twice or an invalid method name.
+// Methods are case-sensitive and must be upper case.
+func (c *appConfig) validateMethods() error {
+	keys := make([]string, 0, len(c.Methods))
+	for k := range c.Methods {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "/") {
+			return fmt.Errorf(`methods[%q]: prefix must start with "/"`, k)
+		}
+		v := c.Methods[k]
+		if len(v) == 0 {
+			return fmt.Errorf("methods[%q]: must not be empty", k)
+		}
+		seen := make(map[string]bool, len(v))
+		for _, m := range v {
+			if !validHeaderName(m) || m != strings.ToUpper(m) {
+				return fmt.Errorf("methods[%q]: %q is not an upper case method name", k, m)
+			}
+			if seen[m] {
+				return fmt.Errorf("methods[%q]: %q is listed twice", k, m)
+			}
+			seen[m] = true
+		}
+	}
+	return nil
+}
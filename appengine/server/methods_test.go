@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_MethodsConfig(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "file.txt", []byte("static"), nil)
+	m.Put("bucket", "forms/thanks.html", []byte("thanks"), map[string]string{"content-type": "text/html"})
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Methods = map[string][]string{"/forms/": {"GET", "POST"}}
+	})()
+
+	tests := []struct {
+		method, path string
+		code         int
+		allow        string
+		body         string
+	}{
+		{"POST", "/file.txt", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", ""},
+		{"PUT", "/file.txt", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", ""},
+		{"DELETE", "/missing.txt", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", ""},
+		{"GET", "/file.txt", http.StatusOK, "GET, HEAD, OPTIONS", "static"},
+		{"POST", "/forms/thanks.html", http.StatusOK, "GET, HEAD, OPTIONS", "thanks"},
+		{"HEAD", "/forms/thanks.html", http.StatusMethodNotAllowed, "GET, POST", ""},
+		{"DELETE", "/forms/thanks.html", http.StatusMethodNotAllowed, "GET, POST", ""},
+	}
+	for i, test := range tests {
+		req, _ := testInstance.NewRequest(test.method, test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%d: %s %s: res.Code = %d; want %d", i, test.method, test.path, res.Code, test.code)
+		}
+		if v := res.Header().Get("allow"); v != test.allow {
+			t.Errorf("%d: %s %s: allow = %q; want %q", i, test.method, test.path, v, test.allow)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%d: %s %s: body = %q; want %q", i, test.method, test.path, res.Body.String(), test.body)
+		}
+	}
+}
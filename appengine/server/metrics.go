@@ -0,0 +1,253 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMetricsPath is the default value of metricsConfig.Path.
+const defaultMetricsPath = "/metrics"
+
+// fetchDurationBuckets are upper bounds in seconds
+// of gcs_fetch_duration_seconds histogram buckets.
+var fetchDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricsConfig is the metrics section of appConfig.
+type metricsConfig struct {
+	// Path is the metrics handler pattern, applied at startup only.
+	// It defaults to defaultMetricsPath.
+	Path string `json:"path" yaml:"path"`
+	// Token, if not empty, is required as a bearer token
+	// in Authorization header of metrics requests.
+	Token string `json:"token" yaml:"token"`
+}
+
+// metricsRegistry collects the server metrics while Metrics is configured.
+// Tests may replace it.
+var metricsRegistry = newMetrics()
+
+// metrics is a registry of the server metrics,
+// exposed in Prometheus text format. It is safe for concurrent use.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]int64  // requests_total
+	cache    map[string]int64      // cache_lookups_total by result
+	fetches  map[string]*histogram // gcs_fetch_duration_seconds by bucket
+	egress   map[egressKey]int64   // response_bytes_total
+}
+
+// requestKey are requests_total labels.
+type requestKey struct {
+	status int
+	bucket string
+}
+
+// egressKey are response_bytes_total labels.
+type egressKey struct {
+	bucket string
+	host   string
+}
+
+// histogram is a cumulative histogram with fetchDurationBuckets.
+type histogram struct {
+	counts []int64 // per fetchDurationBuckets
+	count  int64
+	sum    float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestKey]int64),
+		cache:    make(map[string]int64),
+		fetches:  make(map[string]*histogram),
+		egress:   make(map[egressKey]int64),
+	}
+}
+
+// observeRequest records a served request described by e.
+func (m *metrics) observeRequest(e *requestLog) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{e.Status, e.Bucket}]++
+	if e.Cache != "" {
+		m.cache[e.Cache]++
+	}
+	if e.Bytes > 0 {
+		m.egress[egressKey{e.Bucket, e.Host}] += e.Bytes
+	}
+}
+
+// observeFetch records duration d of a GCS request to the bucket.
+func (m *metrics) observeFetch(bucket string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.fetches[bucket]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(fetchDurationBuckets))}
+		m.fetches[bucket] = h
+	}
+	sec := d.Seconds()
+	for i, le := range fetchDurationBuckets {
+		if sec <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += sec
+}
+
+// requestCount returns requests_total value with the given labels.
+func (m *metrics) requestCount(status int, bucket string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests[requestKey{status, bucket}]
+}
+
+// cacheCount returns cache_lookups_total value with the given result label.
+func (m *metrics) cacheCount(result string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cache[result]
+}
+
+// fetchCount returns the number of observed GCS requests to the bucket.
+func (m *metrics) fetchCount(bucket string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h := m.fetches[bucket]; h != nil {
+		return h.count
+	}
+	return 0
+}
+
+// egressBytes returns response_bytes_total value with the given labels.
+func (m *metrics) egressBytes(bucket, host string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.egress[egressKey{bucket, host}]
+}
+
+// writeTo writes all metrics to w in Prometheus text exposition format,
+// sorted by labels.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP requests_total Number of served requests.")
+	fmt.Fprintln(w, "# TYPE requests_total counter")
+	reqs := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqs = append(reqs, k)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].bucket != reqs[j].bucket {
+			return reqs[i].bucket < reqs[j].bucket
+		}
+		return reqs[i].status < reqs[j].status
+	})
+	for _, k := range reqs {
+		fmt.Fprintf(w, "requests_total{bucket=%s,status=\"%d\"} %d\n", quoteLabel(k.bucket), k.status, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP cache_lookups_total Number of object cache lookups by result.")
+	fmt.Fprintln(w, "# TYPE cache_lookups_total counter")
+	results := make([]string, 0, len(m.cache))
+	for r := range m.cache {
+		results = append(results, r)
+	}
+	sort.Strings(results)
+	for _, r := range results {
+		fmt.Fprintf(w, "cache_lookups_total{result=%s} %d\n", quoteLabel(r), m.cache[r])
+	}
+
+	fmt.Fprintln(w, "# HELP response_bytes_total Response body bytes sent to clients, after compression.")
+	fmt.Fprintln(w, "# TYPE response_bytes_total counter")
+	egress := make([]egressKey, 0, len(m.egress))
+	for k := range m.egress {
+		egress = append(egress, k)
+	}
+	sort.Slice(egress, func(i, j int) bool {
+		if egress[i].bucket != egress[j].bucket {
+			return egress[i].bucket < egress[j].bucket
+		}
+		return egress[i].host < egress[j].host
+	})
+	for _, k := range egress {
+		fmt.Fprintf(w, "response_bytes_total{bucket=%s,host=%s} %d\n", quoteLabel(k.bucket), quoteLabel(k.host), m.egress[k])
+	}
+
+	fmt.Fprintln(w, "# HELP gcs_fetch_duration_seconds Duration of GCS requests.")
+	fmt.Fprintln(w, "# TYPE gcs_fetch_duration_seconds histogram")
+	buckets := make([]string, 0, len(m.fetches))
+	for b := range m.fetches {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+	for _, b := range buckets {
+		h := m.fetches[b]
+		q := quoteLabel(b)
+		for i, le := range fetchDurationBuckets {
+			fmt.Fprintf(w, "gcs_fetch_duration_seconds_bucket{bucket=%s,le=\"%s\"} %d\n", q, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(w, "gcs_fetch_duration_seconds_bucket{bucket=%s,le=\"+Inf\"} %d\n", q, h.count)
+		fmt.Fprintf(w, "gcs_fetch_duration_seconds_sum{bucket=%s} %s\n", q, formatFloat(h.sum))
+		fmt.Fprintf(w, "gcs_fetch_duration_seconds_count{bucket=%s} %d\n", q, h.count)
+	}
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// serveMetrics responds with metricsRegistry contents.
+// If Metrics.Token is configured, requests without a matching bearer token
+// are rejected with 401 status code.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	mc := currentConfig().Metrics
+	if mc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if mc.Token != "" && !validBearer(r, mc.Token) {
+		w.Header().Set("www-authenticate", "Bearer")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	w.Header().Set("cache-control", "no-store")
+	metricsRegistry.writeTo(w)
+}
+
+// observeFetch is weasel.Storage.ObserveFetch of the server storage.
+func observeFetch(bucket string, d time.Duration) {
+	if currentConfig().Metrics != nil {
+		metricsRegistry.observeFetch(bucket, d)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe_Metrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/TestServe_Metrics.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("metrics"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Metrics = &metricsConfig{Path: "/metrics", Token: "secret"}
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+	orig := metricsRegistry
+	metricsRegistry = newMetrics()
+	defer func() { metricsRegistry = orig }()
+
+	for _, p := range []string{"/TestServe_Metrics.txt", "/TestServe_Metrics.txt", "/TestServe_Metrics.css"} {
+		req, _ := testInstance.NewRequest("GET", p, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+	}
+	if n := metricsRegistry.requestCount(http.StatusOK, "bucket"); n != 2 {
+		t.Errorf("requestCount(200, bucket) = %d; want 2", n)
+	}
+	if n := metricsRegistry.requestCount(http.StatusNotFound, "bucket"); n != 1 {
+		t.Errorf("requestCount(404, bucket) = %d; want 1", n)
+	}
+	if n := metricsRegistry.cacheCount("hit"); n != 1 {
+		t.Errorf("cacheCount(hit) = %d; want 1", n)
+	}
+	if n := metricsRegistry.cacheCount("miss"); n != 2 {
+		t.Errorf("cacheCount(miss) = %d; want 2", n)
+	}
+	if n := metricsRegistry.fetchCount("bucket"); n != 2 {
+		t.Errorf("fetchCount(bucket) = %d; want 2", n)
+	}
+
+	tests := []struct {
+		auth string
+		code int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		if test.auth != "" {
+			req.Header.Set("authorization", test.auth)
+		}
+		res := httptest.NewRecorder()
+		serveMetrics(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q: res.Code = %d; want %d", test.auth, res.Code, test.code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	serveMetrics(res, req)
+	body := res.Body.String()
+	for _, line := range []string{
+		`requests_total{bucket="bucket",status="200"} 2`,
+		`requests_total{bucket="bucket",status="404"} 1`,
+		`cache_lookups_total{result="hit"} 1`,
+		`gcs_fetch_duration_seconds_count{bucket="bucket"} 2`,
+		`gcs_fetch_duration_seconds_bucket{bucket="bucket",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics body does not contain %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestServe_MetricsEgress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/a.txt":
+			w.Write([]byte("egress"))
+		case "/bucket/site.css":
+			w.Header().Set("content-type", "text/css")
+			w.Write([]byte(strings.Repeat("body{}", 1000)))
+		case "/bucket/big.bin":
+			w.Write([]byte(strings.Repeat("x", 10000)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer func(n int64) { storage.StreamThreshold = n }(storage.StreamThreshold)
+	storage.StreamThreshold = 1 << 13
+	defer withConfig(func(c *appConfig) {
+		c.Metrics = &metricsConfig{Path: "/metrics"}
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+	orig := metricsRegistry
+	metricsRegistry = newMetrics()
+	defer func() { metricsRegistry = orig }()
+
+	tests := []struct {
+		host, path, accept string
+	}{
+		{"example.com", "/a.txt", ""},
+		{"example.com", "/site.css", "gzip"},
+		{"example.com", "/big.bin", ""},
+		{"www.example.com", "/a.txt", ""},
+	}
+	want := make(map[string]int64)
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if test.accept != "" {
+			req.Header.Set("accept-encoding", test.accept)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s%s: res.Code = %d; want 200", test.host, test.path, res.Code)
+		}
+		if test.accept != "" && res.Body.Len() >= 6000 {
+			t.Errorf("%s%s: len(res.Body) = %d; want compressed", test.host, test.path, res.Body.Len())
+		}
+		want[test.host] += int64(res.Body.Len())
+	}
+	for host, n := range want {
+		if v := metricsRegistry.egressBytes("bucket", host); v != n {
+			t.Errorf("egressBytes(bucket, %s) = %d; want %d", host, v, n)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	serveMetrics(res, httptest.NewRequest("GET", "/metrics", nil))
+	line := `response_bytes_total{bucket="bucket",host="www.example.com"} 6`
+	if !strings.Contains(res.Body.String(), line+"\n") {
+		t.Errorf("metrics body does not contain %q:\n%s", line, res.Body)
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newMetrics()
+	m.observeFetch("b", 3*time.Millisecond)
+	m.observeFetch("b", 200*time.Millisecond)
+	m.observeFetch("b", time.Minute)
+	h := m.fetches["b"]
+	want := []int64{1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2}
+	for i, n := range h.counts {
+		if n != want[i] {
+			t.Errorf("h.counts[%d] = %d; want %d", i, n, want[i])
+		}
+	}
+	if h.count != 3 {
+		t.Errorf("h.count = %d; want 3", h.count)
+	}
+}
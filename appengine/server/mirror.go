@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// mirrorConfig is a Mirror config map value, a bucket holding a copy of
+// a primary bucket, which reads fail over to. See weasel.Mirror.
+type mirrorConfig struct {
+	// Bucket is the mirror bucket name.
+	Bucket string `json:"bucket" yaml:"bucket"`
+	// Base is the GCS base URL of Bucket, GCSBase if empty.
+	Base string `json:"base" yaml:"base"`
+	// Failures is the number of consecutive failed reads opening
+	// the circuit breaker; 5 if zero.
+	Failures int `json:"failures" yaml:"failures"`
+	// Window is how long consecutive failures are counted; 1m if zero.
+	Window duration `json:"window" yaml:"window"`
+	// Cooldown is how long reads go to the mirror before the primary
+	// bucket is probed again; 30s if zero.
+	Cooldown duration `json:"cooldown" yaml:"cooldown"`
+}
+
+// mirrors returns weasel.Storage Mirrors of c.Mirror, or nil if it is empty.
+func (c *appConfig) mirrors() map[string]*weasel.Mirror {
+	if len(c.Mirror) == 0 {
+		return nil
+	}
+	m := make(map[string]*weasel.Mirror, len(c.Mirror))
+	for b, mc := range c.Mirror {
+		m[b] = &weasel.Mirror{
+			Bucket:   mc.Bucket,
+			Base:     strings.TrimSuffix(mc.Base, "/"),
+			Failures: mc.Failures,
+			Window:   time.Duration(mc.Window),
+			Cooldown: time.Duration(mc.Cooldown),
+		}
+	}
+	return m
+}
+
+// validateMirror reports an error if a c.Mirror key is not one of
+// c distinct buckets, or its value has no bucket, a base which is not
+// an absolute http(s) URL or conflicts with that of a served bucket,
+// or negative breaker settings.
+func (c *appConfig) validateMirror() error {
+	buckets := c.distinctBuckets()
+	for b, m := range c.Mirror {
+		if i := sort.SearchStrings(buckets, b); i == len(buckets) || buckets[i] != b {
+			return fmt.Errorf("mirror[%q]: not a bucket of buckets or bucket_paths", b)
+		}
+		switch {
+		case m.Bucket == "":
+			return fmt.Errorf("mirror[%q].bucket: must not be empty", b)
+		case m.Bucket == b:
+			return fmt.Errorf("mirror[%q].bucket: must differ from the primary bucket", b)
+		case m.Failures < 0:
+			return fmt.Errorf("mirror[%q].failures: %d must not be negative", b, m.Failures)
+		case m.Window < 0:
+			return fmt.Errorf("mirror[%q].window: %v must not be negative", b, time.Duration(m.Window))
+		case m.Cooldown < 0:
+			return fmt.Errorf("mirror[%q].cooldown: %v must not be negative", b, time.Duration(m.Cooldown))
+		}
+		if m.Base == "" {
+			continue
+		}
+		u, err := url.Parse(m.Base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("mirror[%q].base: %q is not an absolute http(s) URL", b, m.Base)
+		}
+		if v, ok := c.bucketBases[m.Bucket]; ok && v != strings.TrimSuffix(m.Base, "/") {
+			return fmt.Errorf("mirror[%q].base: %q conflicts with base %q of bucket %q", b, m.Base, v, m.Bucket)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// negotiateCandidate is an element of a Negotiate config map value:
+// a sibling object of the request path with extension Ext, served as Type.
+type negotiateCandidate struct {
+	Ext  string `json:"ext" yaml:"ext"`   // e.g. ".json"
+	Type string `json:"type" yaml:"type"` // defaults to the Ext type
+}
+
+// contentType returns c.Type or, if empty, the type of c.Ext.
+func (c negotiateCandidate) contentType() string {
+	if c.Type != "" {
+		return c.Type
+	}
+	return typeByExtension(c.Ext)
+}
+
+// mediaRange is an element of an Accept header.
+type mediaRange struct {
+	typ, sub string // lowercase, possibly "*"
+	q        float64
+}
+
+// parseAccept parses Accept header value h.
+// Ranges with malformed q-values are not acceptable, and malformed ranges
+// are ignored. An empty header accepts anything, same as "*/*".
+func parseAccept(h string) []mediaRange {
+	if strings.TrimSpace(h) == "" {
+		return []mediaRange{{"*", "*", 1}}
+	}
+	var list []mediaRange
+	for _, part := range strings.Split(h, ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		i := strings.IndexByte(mt, '/')
+		if i <= 0 || i == len(mt)-1 {
+			continue
+		}
+		mr := mediaRange{typ: mt[:i], sub: mt[i+1:], q: 1}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") && !strings.HasPrefix(p, "Q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(p[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			mr.q = v
+		}
+		list = append(list, mr)
+	}
+	return list
+}
+
+// acceptQ returns the q-value of content type ct under the most specific
+// of ranges matching it, or 0 if none does.
+func acceptQ(ranges []mediaRange, ct string) float64 {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return 0
+	}
+	var typ, sub string
+	if i := strings.IndexByte(mt, '/'); i >= 0 {
+		typ, sub = mt[:i], mt[i+1:]
+	}
+	q, best := 0.0, -1
+	for _, mr := range ranges {
+		var spec int
+		switch {
+		case mr.typ == typ && mr.sub == sub:
+			spec = 2
+		case mr.typ == typ && mr.sub == "*":
+			spec = 1
+		case mr.typ == "*" && mr.sub == "*":
+			spec = 0
+		default:
+			continue
+		}
+		if spec > best {
+			q, best = mr.q, spec
+		}
+	}
+	return q
+}
+
+// preferredCandidates returns acceptable candidates under ranges, i.e. with
+// positive q-values, from the highest q-value. Equal ones keep their order.
+func preferredCandidates(ranges []mediaRange, cands []negotiateCandidate) []negotiateCandidate {
+	type cq struct {
+		c negotiateCandidate
+		q float64
+	}
+	var list []cq
+	for _, c := range cands {
+		if q := acceptQ(ranges, c.contentType()); q > 0 {
+			list = append(list, cq{c, q})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].q > list[j].q })
+	res := make([]negotiateCandidate, len(list))
+	for i, v := range list {
+		res[i] = v.c
+	}
+	return res
+}
+
+// negotiateCandidates returns the current config Negotiate candidates
+// of the most specific pattern matching extensionless request path p.
+func negotiateCandidates(p string) []negotiateCandidate {
+	n := currentConfig().Negotiate
+	if len(n) == 0 || strings.HasSuffix(p, "/") || path.Ext(p) != "" {
+		return nil
+	}
+	patterns := make([]string, 0, len(n))
+	for k := range n {
+		patterns = append(patterns, k)
+	}
+	if g, ok := bestGlob(p, patterns); ok {
+		return n[g]
+	}
+	return nil
+}
+
+// serveNegotiated responds with the sibling of object oname with the extension
+// of the candidate most preferred by r's Accept header, among those of
+// the current config Negotiate which exist in the bucket. The response
+// varies on Accept, and its content type is that of the candidate.
+// It returns false if no response was written, e.g. the request path is not
+// negotiated or no acceptable candidate exists.
+func serveNegotiated(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, oname string) bool {
+	cands := negotiateCandidates(r.URL.Path)
+	if len(cands) == 0 {
+		return false
+	}
+	addVary(w.Header(), "Accept")
+	for _, c := range preferredCandidates(parseAccept(r.Header.Get("accept")), cands) {
+		name := oname + c.Ext
+		o, err := storageFrom(ctx).ReadObject(ctx, bucket, name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			serveReadError(ctx, w, r, bucket, name, err)
+			return true
+		}
+		o = cloneObject(o)
+		o.Meta["content-type"] = withCharset(c.contentType())
+		o = applyManifest(r.URL.Path, applyCacheControl(r.URL.Path, o))
+		// ranges of the negotiated object are not served
+		w.Header().Set("accept-ranges", "none")
+		if o.NotModified(r.Header.Get("if-none-match"), r.Header.Get("if-modified-since")) {
+			weasel.ServeNotModified(w, notModifiedObject(r, o))
+			return true
+		}
+		o = applyHeaders(r.URL.Path, applyPreload(r.URL.Path, compressObject(w, r, rewriteHTML(r, applyDownload(r.URL.Path, o)))))
+		if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+			log.Errorf(ctx, "%s/%s: %v", bucket, name, err)
+			abortTimedOut(ctx)
+		}
+		return true
+	}
+	return false
+}
+
+// validateNegotiate reports an error if a c.Negotiate key is not a path
+// or has an extension, or a candidate has no extension or content type.
+func (c *appConfig) validateNegotiate() error {
+	for k, cands := range c.Negotiate {
+		switch {
+		case !strings.HasPrefix(k, "/"):
+			return fmt.Errorf(`negotiate[%q]: must start with "/"`, k)
+		case path.Ext(k) != "" || strings.HasSuffix(k, "/"):
+			return fmt.Errorf("negotiate[%q]: must be an extensionless path", k)
+		case len(cands) == 0:
+			return fmt.Errorf("negotiate[%q]: must have a candidate", k)
+		}
+		for i, cand := range cands {
+			if !strings.HasPrefix(cand.Ext, ".") || len(cand.Ext) < 2 || strings.Contains(cand.Ext, "/") {
+				return fmt.Errorf(`negotiate[%q][%d].ext: %q is not a file extension`, k, i, cand.Ext)
+			}
+			ct := cand.contentType()
+			if ct == "" {
+				return fmt.Errorf("negotiate[%q][%d].type: must be set, %q has no known type", k, i, cand.Ext)
+			}
+			if mt, _, err := mime.ParseMediaType(ct); err != nil || !strings.Contains(mt, "/") {
+				return fmt.Errorf("negotiate[%q][%d].type: %q is not a media type", k, i, ct)
+			}
+		}
+	}
+	return nil
+}
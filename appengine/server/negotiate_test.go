@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Negotiate(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "api/spec.json", []byte(`{"openapi": "3.0.0"}`), nil)
+	m.Put("bucket", "api/spec.yaml", []byte("openapi: 3.0.0"), nil)
+	m.Put("bucket", "api/v1.yaml", []byte("swagger: 2.0"), nil)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Negotiate = map[string][]negotiateCandidate{
+			"/api/*": {{Ext: ".json"}, {Ext: ".yaml", Type: "application/yaml"}},
+		}
+	})()
+
+	tests := []struct {
+		path, accept string
+		code         int
+		ctype, body  string
+	}{
+		{"/api/spec", "application/json", http.StatusOK, "application/json", `{"openapi": "3.0.0"}`},
+		{"/api/spec", "application/yaml, application/json;q=0.5", http.StatusOK, "application/yaml", "openapi: 3.0.0"},
+		{"/api/spec", "application/*;q=0.8, application/json;q=0.2", http.StatusOK, "application/yaml", "openapi: 3.0.0"},
+		{"/api/spec", "*/*", http.StatusOK, "application/json", `{"openapi": "3.0.0"}`},
+		{"/api/spec", "", http.StatusOK, "application/json", `{"openapi": "3.0.0"}`},
+		{"/api/spec", "text/html, */*;q=0.1", http.StatusOK, "application/json", `{"openapi": "3.0.0"}`},
+		{"/api/v1", "*/*", http.StatusOK, "application/yaml", "swagger: 2.0"}, // first existing
+		{"/api/spec", "text/html", http.StatusNotFound, "", ""},
+		{"/api/spec.yaml", "application/json", http.StatusOK, "", "openapi: 3.0.0"}, // as is
+		{"/api/missing", "*/*", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("accept", test.accept)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.path, test.accept, res.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if test.ctype != "" {
+			if v := res.Header().Get("content-type"); v != test.ctype {
+				t.Errorf("%s %q: content-type = %q; want %q", test.path, test.accept, v, test.ctype)
+			}
+			if v := strings.Join(res.Header()["Vary"], ", "); !strings.Contains(v, "Accept") {
+				t.Errorf("%s %q: vary = %q; want Accept", test.path, test.accept, v)
+			}
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s %q: body = %q; want %q", test.path, test.accept, v, test.body)
+		}
+	}
+}
+
+func TestAcceptQ(t *testing.T) {
+	ranges := parseAccept("text/*;q=0.5, text/html, */*;q=0.1, application/json;q=bad, image")
+	tests := []struct {
+		ct string
+		q  float64
+	}{
+		{"text/html; charset=utf-8", 1},
+		{"text/plain", 0.5},
+		{"application/yaml", 0.1},
+		{"application/json", 0},
+		{"not a type", 0},
+	}
+	for _, test := range tests {
+		if q := acceptQ(ranges, test.ct); q != test.q {
+			t.Errorf("acceptQ(%q) = %v; want %v", test.ct, q, test.q)
+		}
+	}
+}
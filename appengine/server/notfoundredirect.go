@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// notFoundPathParam is the placeholder of NotFoundRedirect targets
+// replaced with the query-escaped request path.
+const notFoundPathParam = "{path}"
+
+// findNotFoundRedirect returns the current config NotFoundRedirect target
+// of the longest prefix matching path p. A trailing "*" of prefixes is ignored.
+func findNotFoundRedirect(p string) (string, bool) {
+	var (
+		target string
+		n      = -1
+	)
+	for k, v := range currentConfig().NotFoundRedirect {
+		prefix := strings.TrimSuffix(k, "*")
+		if len(prefix) > n && strings.HasPrefix(p, prefix) {
+			target, n = v, len(prefix)
+		}
+	}
+	return target, n >= 0
+}
+
+// serveNotFoundRedirect responds to a request for a missing object with
+// a temporary redirect to the NotFoundRedirect target of the request path,
+// and reports whether it did. The target notFoundPathParam is replaced with
+// the request path. Requests for the target path itself are not redirected,
+// so that a missing target gets 404 rather than a redirect loop.
+func serveNotFoundRedirect(w http.ResponseWriter, r *http.Request) bool {
+	target, ok := findNotFoundRedirect(r.URL.Path)
+	if !ok {
+		return false
+	}
+	to := strings.Replace(target, notFoundPathParam, url.QueryEscape(r.URL.Path), -1)
+	if u, err := url.Parse(to); err != nil || u.Host == "" && u.Path == r.URL.Path {
+		return false
+	}
+	http.Redirect(w, r, to, http.StatusFound)
+	return true
+}
+
+// validateNotFoundRedirect reports an error if a c.NotFoundRedirect key is not
+// a path prefix, or its target is neither a path nor an absolute http(s) URL,
+// or has notFoundPathParam outside of its query.
+func (c *appConfig) validateNotFoundRedirect() error {
+	keys := make([]string, 0, len(c.NotFoundRedirect))
+	for k := range c.NotFoundRedirect {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := c.NotFoundRedirect[k]
+		if !strings.HasPrefix(k, "/") {
+			return fmt.Errorf(`not_found_redirect[%q]: prefix must start with "/"`, k)
+		}
+		u, err := url.Parse(strings.Replace(v, notFoundPathParam, "", -1))
+		switch {
+		case err != nil,
+			u.Host == "" && (!strings.HasPrefix(v, "/") || strings.HasPrefix(v, "//")),
+			u.Host != "" && u.Scheme != "http" && u.Scheme != "https":
+			return fmt.Errorf("not_found_redirect[%q]: %q is neither a path nor an absolute http(s) URL", k, v)
+		}
+		if i := strings.Index(v, notFoundPathParam); i >= 0 && !strings.Contains(v[:i], "?") {
+			return fmt.Errorf("not_found_redirect[%q]: %s must be in the query of %q", k, notFoundPathParam, v)
+		}
+	}
+	return nil
+}
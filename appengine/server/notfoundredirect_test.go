@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_NotFoundRedirect(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "docs/intro.html", []byte("intro"), map[string]string{"content-type": "text/html"})
+	m.Put("bucket", "404.html", []byte("not found page"), map[string]string{"content-type": "text/html"})
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.NotFound = "404.html"
+		c.NotFoundRedirect = map[string]string{
+			"/docs/*":        "/docs/search?q={path}",
+			"/docs/api/":     "https://api.example.com/reference?from={path}&v=2",
+			"/blog/archive/": "/blog/",
+		}
+	})()
+
+	tests := []struct {
+		path     string
+		code     int
+		location string
+		body     string
+	}{
+		{"/docs/intro.html", http.StatusOK, "", "intro"},
+		{"/docs/missing.html", http.StatusFound, "/docs/search?q=%2Fdocs%2Fmissing.html", ""},
+		{"/docs/a%20b/c&d.html", http.StatusFound, "/docs/search?q=%2Fdocs%2Fa+b%2Fc%26d.html", ""},
+		{"/docs/api/v1/users", http.StatusFound, "https://api.example.com/reference?from=%2Fdocs%2Fapi%2Fv1%2Fusers&v=2", ""},
+		{"/blog/archive/2015/", http.StatusFound, "/blog/", ""},
+		// the missing target itself
+		{"/docs/search", http.StatusNotFound, "", "not found page"},
+		// unmatched
+		{"/missing.html", http.StatusNotFound, "", "not found page"},
+		{"/blog/missing.html", http.StatusNotFound, "", "not found page"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%s: location = %q; want %q", test.path, v, test.location)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, res.Body.String(), test.body)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// serveOptions responds to an OPTIONS request, other than a CORS preflight
+// handled by serveCORS, with 204 status code and Allow header if object oname
+// exists in one of buckets, or 404 otherwise. CORS headers, if any, have been
+// set by serveCORS already. It returns false if r is not an OPTIONS request.
+func serveOptions(ctx context.Context, w http.ResponseWriter, r *http.Request, buckets bucketList, oname string) bool {
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	for _, b := range buckets {
+		_, err := statDir(ctx, b, oname)
+		if err == nil {
+			weasel.ServeOptions(w)
+			return true
+		}
+		if !isNotFound(err) {
+			serveReadError(ctx, w, r, b, oname, err)
+			return true
+		}
+	}
+	serveError(w, http.StatusNotFound, "")
+	return true
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Options(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/file.txt", "/bucket/docs/index.html":
+			w.Write([]byte("contents"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		path, origin string
+		code         int
+		allow, acao  string
+	}{
+		{"/file.txt", "", http.StatusNoContent, "GET, HEAD, OPTIONS", ""},
+		{"/docs/", "", http.StatusNoContent, "GET, HEAD, OPTIONS", ""},
+		{"/file.txt", "https://app.example.com", http.StatusNoContent, "GET, HEAD, OPTIONS", "https://app.example.com"},
+		{"/missing.txt", "", http.StatusNotFound, "", ""},
+		{"/missing.txt", "https://app.example.com", http.StatusNotFound, "", "https://app.example.com"},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.CORS = &corsConfig{AllowOrigins: []string{"https://app.example.com"}}
+		})
+		req, _ := testInstance.NewRequest("OPTIONS", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		if test.origin != "" {
+			req.Header.Set("origin", test.origin)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != test.code {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.path, test.origin, res.Code, test.code)
+		}
+		if v := res.Header().Get("allow"); v != test.allow {
+			t.Errorf("%s %q: allow = %q; want %q", test.path, test.origin, v, test.allow)
+		}
+		if v := res.Header().Get("access-control-allow-origin"); v != test.acao {
+			t.Errorf("%s %q: access-control-allow-origin = %q; want %q", test.path, test.origin, v, test.acao)
+		}
+		if test.code == http.StatusNoContent && res.Body.Len() != 0 {
+			t.Errorf("%s %q: body = %q; want empty", test.path, test.origin, res.Body)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// bucketOverrideHeader is the request header of a bucket
+	// overriding the one of resolveBuckets. See overrideBuckets.
+	bucketOverrideHeader = "X-Goa-Bucket"
+	// bucketOverrideSigHeader is the request header of
+	// bucketOverrideHeader value signature.
+	bucketOverrideSigHeader = "X-Goa-Bucket-Sig"
+	// bucketOverrideExpiresHeader is the request header of the time,
+	// in Unix seconds, the signature expires at.
+	bucketOverrideExpiresHeader = "X-Goa-Bucket-Expires"
+)
+
+// maxBucketOverrideExpiry is how far in the future an override signature
+// may expire, so that a leaked one does not grant access for long.
+const maxBucketOverrideExpiry = 7 * 24 * time.Hour
+
+// bucketNameRe matches GCS bucket names, dotted ones included.
+var bucketNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+
+// bucketSig returns the signature of bucket with key, expiring at Unix time
+// expires: hex-encoded HMAC-SHA256 of the bucket name, a newline and expires
+// in decimal.
+func bucketSig(key, bucket string, expires int64) string {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(bucket + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// overrideBuckets returns the bucket of r bucketOverrideHeader if the current
+// config BucketOverrideKey is set and bucketOverrideSigHeader carries its
+// valid signature, see bucketSig, expiring at bucketOverrideExpiresHeader time,
+// which is neither past nor more than maxBucketOverrideExpiry ahead.
+// It returns resolveBuckets of the request host and path otherwise,
+// ignoring the override.
+func overrideBuckets(r *http.Request) bucketList {
+	key := currentConfig().BucketOverrideKey
+	bucket := r.Header.Get(bucketOverrideHeader)
+	if key == "" || bucket == "" || !bucketNameRe.MatchString(bucket) {
+		return resolveBuckets(r.Host, r.URL.Path)
+	}
+	expires, err := strconv.ParseInt(r.Header.Get(bucketOverrideExpiresHeader), 10, 64)
+	now := time.Now()
+	if err != nil || expires < now.Unix() || expires > now.Add(maxBucketOverrideExpiry).Unix() {
+		return resolveBuckets(r.Host, r.URL.Path)
+	}
+	sig, err := hex.DecodeString(r.Header.Get(bucketOverrideSigHeader))
+	want, _ := hex.DecodeString(bucketSig(key, bucket, expires))
+	if err != nil || !hmac.Equal(sig, want) {
+		return resolveBuckets(r.Host, r.URL.Path)
+	}
+	return bucketList{bucket}
+}
+
+// validateBucketOverrideKey reports an error if c.BucketOverrideKey
+// is set but too short to resist guessing.
+func (c *appConfig) validateBucketOverrideKey() error {
+	if c.BucketOverrideKey != "" && len(c.BucketOverrideKey) < 16 {
+		return fmt.Errorf("bucket_override_key: must be at least 16 characters long")
+	}
+	return nil
+}
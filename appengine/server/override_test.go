@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_BucketOverride(t *testing.T) {
+	const key = "0123456789abcdef"
+	m := &weasel.MemBackend{}
+	m.Put("main-bucket", "page.html", []byte("main page"), nil)
+	m.Put("preview-pr-42", "page.html", []byte("preview page"), nil)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+
+	valid := time.Now().Add(time.Hour).Unix()
+	expired := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(maxBucketOverrideExpiry + time.Hour).Unix()
+	tests := []struct {
+		key, bucket, sig string
+		expires          int64
+		body             string
+	}{
+		// no header
+		{key, "", "", 0, "main page"},
+		// valid signature
+		{key, "preview-pr-42", bucketSig(key, "preview-pr-42", valid), valid, "preview page"},
+		// invalid signatures
+		{key, "preview-pr-42", "", valid, "main page"},
+		{key, "preview-pr-42", bucketSig("another key, long", "preview-pr-42", valid), valid, "main page"},
+		{key, "preview-pr-42", bucketSig(key, "main-bucket", valid), valid, "main page"},
+		{key, "preview-pr-42", "not hex", valid, "main page"},
+		// expired, too far ahead, missing or tampered expiry
+		{key, "preview-pr-42", bucketSig(key, "preview-pr-42", expired), expired, "main page"},
+		{key, "preview-pr-42", bucketSig(key, "preview-pr-42", future), future, "main page"},
+		{key, "preview-pr-42", bucketSig(key, "preview-pr-42", valid), 0, "main page"},
+		{key, "preview-pr-42", bucketSig(key, "preview-pr-42", valid), valid + 60, "main page"},
+		// disabled
+		{"", "preview-pr-42", bucketSig("", "preview-pr-42", valid), valid, "main page"},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"main-bucket"}}
+			c.BucketOverrideKey = test.key
+		})
+		req, _ := testInstance.NewRequest("GET", "/page.html", nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		if test.bucket != "" {
+			req.Header.Set(bucketOverrideHeader, test.bucket)
+		}
+		if test.sig != "" {
+			req.Header.Set(bucketOverrideSigHeader, test.sig)
+		}
+		if test.expires != 0 {
+			req.Header.Set(bucketOverrideExpiresHeader, strconv.FormatInt(test.expires, 10))
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != http.StatusOK {
+			t.Errorf("%d: res.Code = %d; want 200", i, res.Code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%d: res.Body = %q; want %q", i, v, test.body)
+		}
+		if v := res.Header().Get("vary"); test.key != "" && !strings.HasPrefix(v, bucketOverrideHeader) {
+			t.Errorf("%d: vary = %q; want %s first", i, v, bucketOverrideHeader)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// reservedPathPrefix is the prefix of App Engine internal paths,
+// such as healthPathAppEngine and warmupPath.
+const reservedPathPrefix = "/_ah/"
+
+var (
+	passthroughMu       sync.RWMutex
+	passthroughHandlers = make(map[string]http.Handler)
+)
+
+// HandlePassthrough registers h as the handler of requests matching
+// PassthroughPaths entry prefix. It may be called before or after
+// the server is initialized, e.g. from init of an admin API package.
+// Requests to passthrough paths with no registered handler get 404.
+func HandlePassthrough(prefix string, h http.Handler) {
+	passthroughMu.Lock()
+	passthroughHandlers[prefix] = h
+	passthroughMu.Unlock()
+}
+
+// passthrough creates a new handler of PassthroughPaths entry prefix.
+// It delegates to the handler registered with HandlePassthrough, if any,
+// and responds with 404 status code otherwise. GCS is never consulted.
+func passthrough(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passthroughMu.RLock()
+		h := passthroughHandlers[prefix]
+		passthroughMu.RUnlock()
+		if h == nil {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handlePassthroughPaths registers passthrough handlers of c.PassthroughPaths with mux.
+func handlePassthroughPaths(mux *http.ServeMux, c *appConfig) {
+	for _, p := range c.PassthroughPaths {
+		mux.Handle(p, drain(maintenance(passthrough(p))))
+	}
+}
+
+// validatePassthroughPaths reports an error if any of c.PassthroughPaths
+// is malformed, duplicate, or would shadow one of the paths the server
+// handles itself: HookPath, HealthPath, Metrics.Path, SignPath, debugConfigPath,
+// purgePath, acmePath and App Engine internal paths under reservedPathPrefix.
+func (c *appConfig) validatePassthroughPaths() error {
+	reserved := map[string]string{
+		"hook":         c.HookPath,
+		"health":       c.HealthPath,
+		"config_token": debugConfigPath,
+		"cache purge":  purgePath,
+		"csp report":   cspReportPath,
+		"acme":         acmePath,
+	}
+	if c.Metrics != nil {
+		reserved["metrics.path"] = c.Metrics.Path
+	}
+	if c.SignPath != "" {
+		reserved["sign_path"] = c.SignPath
+	}
+	seen := make(map[string]bool, len(c.PassthroughPaths))
+	for i, p := range c.PassthroughPaths {
+		switch {
+		case !strings.HasPrefix(p, "/"):
+			return fmt.Errorf(`passthrough[%d]: %q must start with "/"`, i, p)
+		case p == "/":
+			return fmt.Errorf(`passthrough[%d]: "/" would shadow all paths`, i)
+		case strings.HasPrefix(p, reservedPathPrefix) || p+"/" == reservedPathPrefix:
+			return fmt.Errorf(`passthrough[%d]: %q is reserved for App Engine`, i, p)
+		case seen[p]:
+			return fmt.Errorf(`passthrough[%d]: duplicate %q`, i, p)
+		}
+		seen[p] = true
+		for field, r := range reserved {
+			if p == r || strings.HasSuffix(p, "/") && strings.HasPrefix(r, p) {
+				return fmt.Errorf(`passthrough[%d]: %q would shadow %s %q`, i, p, field, r)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPassthroughPaths(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("object"))
+	})
+	handlePassthroughPaths(mux, &appConfig{PassthroughPaths: []string{"/admin/", "/status"}})
+	HandlePassthrough("/admin/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin " + r.URL.Path))
+	}))
+	defer func() {
+		passthroughMu.Lock()
+		delete(passthroughHandlers, "/admin/")
+		passthroughMu.Unlock()
+	}()
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/admin/users", http.StatusOK, "admin /admin/users"},
+		{"/admin/", http.StatusOK, "admin /admin/"},
+		{"/status", http.StatusNotFound, "404 page not found\n"},
+		{"/status/sub", http.StatusOK, "object"},
+		{"/page.html", http.StatusOK, "object"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, v, test.body)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// preloadLink is a Preload entry, an asset HTML pages should preload.
+type preloadLink struct {
+	// Href is the asset URL, e.g. "/static/app.css".
+	Href string `json:"href" yaml:"href"`
+	// As is the asset destination, e.g. "style", "script" or "font".
+	// Empty value removes an entry of the same Href of less specific patterns.
+	As string `json:"as" yaml:"as"`
+}
+
+// String returns l formatted as a Link header value.
+func (l preloadLink) String() string {
+	return fmt.Sprintf("<%s>; rel=preload; as=%s", l.Href, l.As)
+}
+
+// applyPreload returns o with a link header preloading assets of all current
+// config Preload patterns matching request path p, if o is an HTML object.
+// Entries of more specific, longer patterns override those of the same Href.
+// The object is returned as is when no pattern matches or o is a redirect.
+func applyPreload(p string, o *weasel.Object) *weasel.Object {
+	pc := currentConfig().Preload
+	if len(pc) == 0 || o.Redirect() != "" {
+		return o
+	}
+	if t, _, err := mime.ParseMediaType(o.Meta["content-type"]); err != nil || t != "text/html" {
+		return o
+	}
+	var patterns []string
+	for g := range pc {
+		if matchGlob(g, p) {
+			patterns = append(patterns, g)
+		}
+	}
+	// least specific first; ties in reverse lexical order, same as applyHeaders
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := patterns[i], patterns[j]
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a > b
+	})
+	var links []preloadLink
+	for _, g := range patterns {
+	next:
+		for _, l := range pc[g] {
+			for i := range links {
+				if links[i].Href == l.Href {
+					links[i].As = l.As
+					continue next
+				}
+			}
+			links = append(links, l)
+		}
+	}
+	var values []string
+	for _, l := range links {
+		if l.As != "" {
+			values = append(values, l.String())
+		}
+	}
+	if len(values) == 0 {
+		return o
+	}
+	o = cloneObject(o)
+	o.Meta["link"] = strings.Join(values, ", ")
+	return o
+}
+
+// validatePreload reports an error if any of c.Preload entries
+// has an empty href or a value which would break the Link header format.
+func (c *appConfig) validatePreload() error {
+	for g, list := range c.Preload {
+		for i, l := range list {
+			switch {
+			case l.Href == "":
+				return fmt.Errorf("preload[%q][%d].href: must not be empty", g, i)
+			case strings.ContainsAny(l.Href, "<> \t"):
+				return fmt.Errorf("preload[%q][%d].href: %q is not a valid URL reference", g, i, l.Href)
+			case strings.IndexFunc(l.As, func(r rune) bool { return !('a' <= r && r <= 'z') }) >= 0:
+				return fmt.Errorf("preload[%q][%d].as: %q is not a request destination", g, i, l.As)
+			}
+		}
+	}
+	return nil
+}
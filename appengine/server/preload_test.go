@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Preload(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Ext(r.URL.Path) {
+		case ".html", ".htm":
+			w.Header().Set("content-type", "text/html; charset=utf-8")
+		case ".css":
+			w.Header().Set("content-type", "text/css")
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Redirects = map[string]redirect{"/old.html": {To: "/new"}}
+		c.Preload = map[string][]preloadLink{
+			"/*.html": {
+				{Href: "/static/app.css", As: "style"},
+				{Href: "/static/app.js", As: "script"},
+			},
+			"/docs/*.html": {
+				{Href: "/static/docs.css", As: "style"},
+				{Href: "/static/app.js", As: ""},
+			},
+			"/docs/api/*.html": {{Href: "/static/app.js", As: "script"}},
+			"/fonts/*":         {{Href: "/fonts/body.woff2", As: "font"}},
+		}
+	})()
+
+	tests := []struct{ path, link string }{
+		{"/page.html", "</static/app.css>; rel=preload; as=style, </static/app.js>; rel=preload; as=script"},
+		{"/docs/page.html", "</static/app.css>; rel=preload; as=style, </static/docs.css>; rel=preload; as=style"},
+		{"/docs/api/page.html", "</static/app.css>; rel=preload; as=style, </static/app.js>; rel=preload; as=script, </static/docs.css>; rel=preload; as=style"},
+		// not HTML
+		{"/fonts/site.css", ""},
+		// no matching pattern
+		{"/page.htm", ""},
+		// redirect
+		{"/old.html", ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if v := res.Header()["Link"]; len(v) > 1 {
+			t.Errorf("%s: link = %q; want a single header", test.path, v)
+		}
+		if v := res.Header().Get("link"); v != test.link {
+			t.Errorf("%s: link = %q; want %q", test.path, v, test.link)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"path"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// prettyExt is the file extension tried for extensionless paths
+// when PrettyURLs is enabled.
+const prettyExt = ".html"
+
+// prettyName reports whether oname is subject to PrettyURLs lookups:
+// a non-root name with no file extension and no trailing slash.
+func prettyName(oname string) bool {
+	return currentConfig().PrettyURLs && oname != "" && oname[len(oname)-1] != '/' && path.Ext(oname) == ""
+}
+
+// readPretty reads oname + prettyExt in place of a missing or directory-like
+// object oname, using read to fetch it, e.g. storage.ReadObject.
+// It returns a nil object and error if the object does not exist either,
+// so that the caller may proceed with the directory index.
+// The content type is resolved from the object name actually read.
+func readPretty(ctx context.Context, bucket, oname string, read func(context.Context, string, string) (*weasel.Object, error)) (*weasel.Object, error) {
+	o, err := read(ctx, bucket, oname+prettyExt)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return applyContentType(oname+prettyExt, o), nil
+}
+
+// isNotFound reports whether err is a 404 storage error.
+func isNotFound(err error) bool {
+	errf, ok := err.(*weasel.FetchError)
+	return ok && errf.Code == http.StatusNotFound
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_PrettyURLs(t *testing.T) {
+	m := &weasel.MemBackend{}
+	html := map[string]string{"content-type": "text/html"}
+	m.Put("bucket", "about.html", []byte("about page"), html)
+	m.Put("bucket", "team/index.html", []byte("team index"), html)
+	m.Put("bucket", "docs.html", []byte("docs page"), html)
+	m.Put("bucket", "docs/index.html", []byte("docs index"), html)
+	m.Put("bucket", "index.html", []byte("root index"), html)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+
+	tests := []struct {
+		policy string
+		spa    bool
+		path   string
+		code   int
+		body   string
+	}{
+		{"", false, "/about", http.StatusOK, "about page"},
+		{"", false, "/about.html", http.StatusOK, "about page"},
+		{"", false, "/team", http.StatusOK, "team index"},
+		{"", false, "/team/", http.StatusOK, "team index"},
+		{"", false, "/docs", http.StatusOK, "docs page"}, // .html first
+		{"", false, "/docs/", http.StatusOK, "docs index"},
+		{"", false, "/missing", http.StatusNotFound, ""},
+		{"", false, "/missing.css", http.StatusNotFound, ""},
+		{"", true, "/missing", http.StatusOK, "root index"},
+		{slashRemove, false, "/about", http.StatusOK, "about page"},
+		{slashRemove, false, "/team", http.StatusOK, "team index"},
+		{slashAdd, false, "/about", http.StatusMovedPermanently, ""},
+		{slashAdd, false, "/team/", http.StatusOK, "team index"},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.PrettyURLs = true
+			c.TrailingSlash = test.policy
+			c.SPAFallback = test.spa
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Header.Set("accept", "text/html")
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != test.code {
+			t.Errorf("%q %s: res.Code = %d; want %d", test.policy, test.path, res.Code, test.code)
+			continue
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%q %s: body = %q; want %q", test.policy, test.path, res.Body.String(), test.body)
+		}
+		if test.code == http.StatusOK {
+			if v := res.Header().Get("location"); v != "" {
+				t.Errorf("%q %s: location = %q; want none", test.policy, test.path, v)
+			}
+			if v := res.Header().Get("content-type"); v != "text/html" && v != "text/html; charset=utf-8" {
+				t.Errorf("%q %s: content-type = %q; want text/html", test.policy, test.path, v)
+			}
+		}
+	}
+}
+
+func TestServeHead_PrettyURLs(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "about.html", []byte("about page"), map[string]string{"content-type": "text/html"})
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer withConfig(func(c *appConfig) {
+		c.PrettyURLs = true
+		c.HeadMetadata = true
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	req, _ := testInstance.NewRequest("HEAD", "/about", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusOK)
+	}
+	if v := res.Header().Get("content-length"); v != "10" {
+		t.Errorf("content-length = %q; want 10", v)
+	}
+}
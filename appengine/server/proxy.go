@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// findProxy returns the upstream base URL of the longest
+// current config Proxies prefix matching path.
+func findProxy(path string) (string, bool) {
+	var (
+		upstream string
+		n        = -1
+	)
+	for p, u := range currentConfig().Proxies {
+		if len(p) > n && strings.HasPrefix(path, p) {
+			upstream, n = u, len(p)
+		}
+	}
+	return upstream, n >= 0
+}
+
+// proxyOr reverse-proxies requests matching one of the current config Proxies
+// prefixes to the upstream, or delegates to h otherwise.
+// Upstream requests are made with urlfetch. Hop-by-hop headers are stripped
+// in both directions, and X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto
+// are set to the client address, original host and scheme.
+// Request bodies are limited by limitBody. Proxy errors result in
+// 502 status code.
+func proxyOr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream, ok := findProxy(r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !limitBody(w, r, false) {
+			return
+		}
+		ctx := newContext(r)
+		u, err := url.Parse(upstream)
+		if err != nil {
+			// config is validated, so this is unlikely
+			log.Errorf(ctx, "proxy %s: %v", upstream, err)
+			serveError(w, http.StatusBadGateway, "")
+			return
+		}
+		p := httputil.NewSingleHostReverseProxy(u)
+		director := p.Director
+		p.Director = func(req *http.Request) {
+			director(req)
+			req.Host = u.Host
+			req.Header.Set("x-forwarded-host", r.Host)
+			req.Header.Set("x-forwarded-proto", requestScheme(r))
+		}
+		p.Transport = &urlfetch.Transport{Context: ctx}
+		p.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Errorf(ctx, "proxy %s%s: %v", upstream, r.URL.Path, err)
+			serveError(w, http.StatusBadGateway, "")
+		}
+		p.ServeHTTP(w, r)
+	})
+}
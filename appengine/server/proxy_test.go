@@ -0,0 +1,108 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServe_Proxy(t *testing.T) {
+	var upstreamReq *http.Request
+	var upstreamBody string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		upstreamReq, upstreamBody = r, string(b)
+		w.Header().Set("connection", "close")
+		w.Header().Set("x-upstream", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("proxied"))
+	}))
+	defer up.Close()
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("object"))
+	}))
+	defer gcs.Close()
+	storage.Base = gcs.URL
+	restore := withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Proxies = map[string]string{
+			"/api/":        up.URL + "/base",
+			"/api/closed/": "http://127.0.0.1:1",
+		}
+	})
+	defer restore()
+
+	req, _ := testInstance.NewRequest("POST", "/api/search?q=goa", strings.NewReader("query"))
+	req.Host = "goa.design"
+	req.Header.Set("x-forwarded-proto", "https")
+	req.Header.Set("connection", "x-hop")
+	req.Header.Set("x-hop", "1")
+	req.Header.Set("x-custom", "v")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusCreated {
+		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusCreated)
+	}
+	if v := res.Body.String(); v != "proxied" {
+		t.Errorf("res.Body = %q; want proxied", v)
+	}
+	if v := res.Header().Get("x-upstream"); v != "yes" {
+		t.Errorf("x-upstream = %q; want yes", v)
+	}
+	if v := res.Header().Get("connection"); v != "" {
+		t.Errorf("connection = %q; want none", v)
+	}
+	if upstreamReq == nil {
+		t.Fatal("upstream not called")
+	}
+	if upstreamReq.Method != "POST" || upstreamBody != "query" {
+		t.Errorf("upstream %s body %q; want POST query", upstreamReq.Method, upstreamBody)
+	}
+	if v := upstreamReq.URL.RequestURI(); v != "/base/api/search?q=goa" {
+		t.Errorf("upstream URI = %q; want /base/api/search?q=goa", v)
+	}
+	h := upstreamReq.Header
+	for k, want := range map[string]string{
+		"x-forwarded-host":  "goa.design",
+		"x-forwarded-proto": "https",
+		"x-custom":          "v",
+		"x-hop":             "",
+	} {
+		if v := h.Get(k); v != want {
+			t.Errorf("upstream %s = %q; want %q", k, v, want)
+		}
+	}
+	if h.Get("x-forwarded-for") == "" {
+		t.Error("upstream x-forwarded-for is empty")
+	}
+
+	req, _ = testInstance.NewRequest("GET", "/api/closed/x", nil)
+	res = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusBadGateway {
+		t.Errorf("closed upstream: res.Code = %d; want %d", res.Code, http.StatusBadGateway)
+	}
+
+	req, _ = testInstance.NewRequest("GET", "/page.txt", nil)
+	res = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if v := res.Body.String(); res.Code != http.StatusOK || v != "object" {
+		t.Errorf("GCS: res.Code = %d, res.Body = %q; want 200 object", res.Code, v)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+// purgePath is the path of the manual cache purge handler.
+const purgePath = "/_cache/purge"
+
+// purgeRequest is the request body of servePurge.
+type purgeRequest struct {
+	// Bucket is the bucket of Objects.
+	Bucket string `json:"bucket"`
+	// Objects are object paths, e.g. "/css/site.css", or prefixes ending
+	// in "*", e.g. "/css/*". Paths ending in "/" refer to their index object.
+	Objects []string `json:"objects"`
+	// All purges all objects of Bucket, or the whole cache if Bucket is empty.
+	All bool `json:"all"`
+}
+
+// purgeResponse is the response body of servePurge.
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// servePurge evicts objects listed in a JSON purgeRequest body from
+// the in-memory cache and responds with the number of evicted ones.
+// Exact object paths are removed from memcache as well, but not counted.
+// Requests must be POST and authorized as described in serveConfig.
+func servePurge(w http.ResponseWriter, r *http.Request) {
+	c := currentConfig()
+	if c.ConfigToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("allow", "POST")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validBearer(r, c.ConfigToken) {
+		w.Header().Set("www-authenticate", "Bearer")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" && !req.All {
+		http.Error(w, "bucket: must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	ctx := newContext(r)
+	var res purgeResponse
+	switch {
+	case req.All && req.Bucket == "":
+		res.Purged = storage.PurgeAll()
+	case req.All:
+		res.Purged = storage.PurgeLocal(req.Bucket, "")
+	default:
+		res.Purged = purgeObjects(ctx, req.Bucket, req.Objects)
+	}
+	log.Infof(ctx, "purged %d cached objects of %q", res.Purged, req.Bucket)
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
+
+// purgeObjects evicts objects of the bucket at paths, see purgeRequest,
+// and returns the number of objects evicted from the in-memory cache.
+func purgeObjects(ctx context.Context, bucket string, paths []string) int {
+	n := 0
+	for _, p := range paths {
+		name := strings.TrimPrefix(p, "/")
+		if strings.HasSuffix(name, "*") {
+			n += storage.PurgeLocal(bucket, strings.TrimSuffix(name, "*"))
+			continue
+		}
+		name = storage.FileName(name)
+		if storage.Cache.Remove(storage.CacheKey(bucket, name)) {
+			n++
+		}
+		if err := storage.PurgeCache(ctx, bucket, name); err != nil {
+			log.Errorf(ctx, "purge %s/%s: %v", bucket, name, err)
+		}
+	}
+	return n
+}
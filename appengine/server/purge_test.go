@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+func TestServe_Purge(t *testing.T) {
+	defer func(c *weasel.LRU) { storage.Cache = c }(storage.Cache)
+	defer withConfig(func(c *appConfig) { c.ConfigToken = "config-secret" })()
+	cached := []struct{ bucket, name string }{
+		{"bucket", "index.html"},
+		{"bucket", "css/site.css"},
+		{"bucket", "css/print.css"},
+		{"bucket", "cssx.txt"},
+		{"other", "css/site.css"},
+	}
+
+	tests := []struct {
+		method, auth, body string
+		code               int
+		purged             int
+		left               int
+	}{
+		{"POST", "Bearer config-secret", `{"bucket": "bucket", "objects": ["/css/site.css"]}`, http.StatusOK, 1, 4},
+		{"POST", "Bearer config-secret", `{"bucket": "bucket", "objects": ["/"]}`, http.StatusOK, 1, 4},
+		{"POST", "Bearer config-secret", `{"bucket": "bucket", "objects": ["/missing.txt"]}`, http.StatusOK, 0, 5},
+		{"POST", "Bearer config-secret", `{"bucket": "bucket", "objects": ["/css/*"]}`, http.StatusOK, 2, 3},
+		{"POST", "Bearer config-secret", `{"bucket": "bucket", "objects": ["/css*", "/index.html"]}`, http.StatusOK, 4, 1},
+		{"POST", "Bearer config-secret", `{"bucket": "bucket", "all": true}`, http.StatusOK, 4, 1},
+		{"POST", "Bearer config-secret", `{"all": true}`, http.StatusOK, 5, 0},
+		{"POST", "Bearer config-secret", `{"objects": ["/index.html"]}`, http.StatusBadRequest, 0, 5},
+		{"POST", "Bearer config-secret", `{"bucket": `, http.StatusBadRequest, 0, 5},
+		{"POST", "Bearer wrong", `{"all": true}`, http.StatusUnauthorized, 0, 5},
+		{"GET", "Bearer config-secret", "", http.StatusMethodNotAllowed, 0, 5},
+	}
+	for _, test := range tests {
+		storage.Cache = weasel.NewLRU(1<<20, 0)
+		for _, o := range cached {
+			storage.Cache.Add(storage.CacheKey(o.bucket, o.name), &weasel.Object{Body: []byte(o.name)})
+		}
+		req, _ := http.NewRequest(test.method, "http://example.com/_cache/purge", strings.NewReader(test.body))
+		req.Header.Set("authorization", test.auth)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s %s: res.Code = %d; want %d", test.method, test.body, res.Code, test.code)
+		}
+		if n := storage.Cache.Len(); n != test.left {
+			t.Errorf("%s %s: storage.Cache.Len() = %d; want %d", test.method, test.body, n, test.left)
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		var body purgeResponse
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body.Purged != test.purged {
+			t.Errorf("%s %s: purged = %d, err = %v; want %d", test.method, test.body, body.Purged, err, test.purged)
+		}
+	}
+
+	restore := withConfig(func(c *appConfig) { c.ConfigToken = "" })
+	defer restore()
+	req, _ := http.NewRequest("POST", "http://example.com/_cache/purge", strings.NewReader(`{"all": true}`))
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("no config_token: res.Code = %d; want 404", res.Code)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// serveRange responds with a byte range of object oname requested
+// in r's Range header. Only a single range of GET requests is supported.
+// It returns false if no response was written, in which case
+// the full object should be served instead.
+//
+// Ranges are ignored for request paths and objects matching the current
+// config NoRange entries, and for objects compressed on the fly when
+// served in full, which advertise "Accept-Ranges: none" instead.
+// They are also ignored if r's If-Range header does not match the object,
+// see ifRangeMatch.
+func serveRange(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, oname string) bool {
+	rng := r.Header.Get("range")
+	if r.Method != "GET" || !isSingleRange(rng) || noRangePath(r.URL.Path) {
+		return false
+	}
+	o, err := storageFrom(ctx).ReadRange(ctx, bucket, oname, rng)
+	if err != nil {
+		if errf, ok := err.(*weasel.FetchError); !ok || errf.Code != http.StatusRequestedRangeNotSatisfiable {
+			// let the full object handling deal with it
+			return false
+		}
+		so, err := storageFrom(ctx).StatFile(ctx, bucket, oname)
+		if err == nil && noRangeType(so.Meta["content-type"]) {
+			w.Header().Set("accept-ranges", "none")
+			return false
+		}
+		if err == nil && so.Meta["content-length"] != "" {
+			w.Header().Set("content-range", "bytes */"+so.Meta["content-length"])
+		}
+		serveError(w, http.StatusRequestedRangeNotSatisfiable, "")
+		return true
+	}
+	if !rangeAllowed(r, o) {
+		o.Close()
+		w.Header().Set("accept-ranges", "none")
+		return false
+	}
+	if ir := r.Header.Get("if-range"); ir != "" && !ifRangeMatch(ir, o) {
+		// changed since the client got its part of the object
+		o.Close()
+		return false
+	}
+	code := http.StatusOK
+	if o.Meta["content-range"] != "" {
+		code = http.StatusPartialContent
+	}
+	if o.Stream == nil {
+		w.Header().Set("content-length", strconv.Itoa(len(o.Body)))
+	}
+	o = applyContentType(storageFrom(ctx).FileName(oname), o)
+	o = applyManifest(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	o = applyHeaders(r.URL.Path, applyPreload(r.URL.Path, applyDownload(r.URL.Path, o)))
+	if err := weasel.ServeObjectCode(w, o, code, true); err != nil {
+		log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+		abortTimedOut(ctx)
+	}
+	return true
+}
+
+// ifRangeMatch reports whether If-Range header value ir matches object o:
+// either its strong etag or, for a date, its last-modified time.
+// Weak etags never match, as required by RFC 7233, section 3.2.
+func ifRangeMatch(ir string, o *weasel.Object) bool {
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		etag := o.Meta["etag"]
+		return etag != "" && !strings.HasPrefix(etag, "W/") && etag == ir
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	mod, err := http.ParseTime(o.Meta["last-modified"])
+	return err == nil && mod.Equal(t)
+}
+
+// isSingleRange reports whether rng is a syntactically valid
+// HTTP Range header value with a single byte range.
+func isSingleRange(rng string) bool {
+	if !strings.HasPrefix(rng, "bytes=") {
+		return false
+	}
+	spec := strings.TrimSpace(rng[len("bytes="):])
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return false
+	}
+	start, end := spec[:i], spec[i+1:]
+	if start == "" {
+		// suffix range, e.g. "-500"
+		n, err := strconv.ParseInt(end, 10, 64)
+		return err == nil && n > 0
+	}
+	a, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || a < 0 {
+		return false
+	}
+	if end == "" {
+		return true
+	}
+	b, err := strconv.ParseInt(end, 10, 64)
+	return err == nil && a <= b
+}
+
+// noRangePath reports whether request path p matches any of the current
+// config NoRange path glob patterns.
+func noRangePath(p string) bool {
+	for _, v := range currentConfig().NoRange {
+		if strings.HasPrefix(v, "/") && matchGlob(v, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// noRangeType reports whether content type ct matches any of the current
+// config NoRange media types. Media type parameters are ignored.
+func noRangeType(ct string) bool {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, v := range currentConfig().NoRange {
+		v = strings.ToLower(v)
+		if v == t || strings.HasSuffix(v, "/*") && strings.HasPrefix(t, v[:len(v)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeAllowed reports whether a byte range of the object, as read by
+// ReadRange, may be served to r: its type is not one of NoRange and
+// it would not be compressed on the fly if served in full.
+func rangeAllowed(r *http.Request, o *weasel.Object) bool {
+	ct := o.Meta["content-type"]
+	if noRangeType(ct) {
+		return false
+	}
+	if !compressible(ct) || o.Meta["content-encoding"] != "" {
+		return true
+	}
+	size := int64(len(o.Body))
+	if i := strings.LastIndexByte(o.Meta["content-range"], '/'); i >= 0 {
+		size, _ = strconv.ParseInt(o.Meta["content-range"][i+1:], 10, 64)
+	} else if n, err := strconv.ParseInt(o.Meta["content-length"], 10, 64); err == nil {
+		size = n
+	}
+	return compressCoding(r, int(size)) == ""
+}
+
+// validateNoRange reports an error if any of c.NoRange entries
+// is neither a path glob nor a media type.
+func (c *appConfig) validateNoRange() error {
+	for i, v := range c.NoRange {
+		if strings.HasPrefix(v, "/") {
+			continue
+		}
+		if j := strings.IndexByte(v, '/'); j <= 0 || j == len(v)-1 || strings.ContainsAny(v, " ;,") {
+			return fmt.Errorf(`no_range[%d]: %q is not a path or a media type`, i, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_NoRange(t *testing.T) {
+	page := strings.Repeat("<p>0123456789</p>", 100)
+	types := map[string]string{".html": "text/html", ".pdf": "application/pdf", ".mp4": "video/mp4"}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", types[path.Ext(r.URL.Path)])
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(page))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.NoRange = []string{"/live/*", "video/*"}
+	})()
+
+	tests := []struct {
+		path, rng, accept string
+		code              int
+		body              string
+		acceptRanges      string
+	}{
+		{"/doc.pdf", "bytes=3-6", "gzip", http.StatusPartialContent, "0123", "bytes"},
+		{"/page.html", "bytes=3-6", "", http.StatusPartialContent, "0123", "bytes"},
+		// compressed on the fly
+		{"/page.html", "bytes=3-6", "gzip", http.StatusOK, page, "none"},
+		{"/page.html", "", "gzip", http.StatusOK, page, "none"},
+		// NoRange paths and types
+		{"/live/doc.pdf", "bytes=2-5", "", http.StatusOK, page, "none"},
+		{"/video.mp4", "bytes=2-5", "", http.StatusOK, page, "none"},
+		{"/video.mp4", "bytes=5000-", "", http.StatusOK, page, "none"},
+		{"/video.mp4", "", "", http.StatusOK, page, "none"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if test.rng != "" {
+			req.Header.Set("range", test.rng)
+		}
+		if test.accept != "" {
+			req.Header.Set("accept-encoding", test.accept)
+		}
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		storage.Cache.RemovePrefix("")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s %q: res.Code = %d; want %d", test.path, test.rng, res.Code, test.code)
+		}
+		body := res.Body.String()
+		if res.Header().Get("content-encoding") == "gzip" {
+			zr, err := gzip.NewReader(res.Body)
+			if err != nil {
+				t.Errorf("%s %q: gzip.NewReader: %v", test.path, test.rng, err)
+				continue
+			}
+			b, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Errorf("%s %q: gunzip: %v", test.path, test.rng, err)
+			}
+			body = string(b)
+		} else if test.accept == "gzip" && test.code == http.StatusOK && strings.HasSuffix(test.path, ".html") {
+			t.Errorf("%s %q: content-encoding = %q; want gzip", test.path, test.rng, res.Header().Get("content-encoding"))
+		}
+		if body != test.body {
+			t.Errorf("%s %q: body = %q; want %q", test.path, test.rng, body, test.body)
+		}
+		if v := res.Header().Get("accept-ranges"); v != test.acceptRanges {
+			t.Errorf("%s %q: accept-ranges = %q; want %q", test.path, test.rng, v, test.acceptRanges)
+		}
+		if test.code == http.StatusOK && res.Header().Get("content-range") != "" {
+			t.Errorf("%s %q: content-range = %q; want none", test.path, test.rng, res.Header().Get("content-range"))
+		}
+	}
+}
+
+func TestServe_IfRange(t *testing.T) {
+	const contents = "0123456789"
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/pdf")
+		w.Header().Set("etag", `"v2"`)
+		http.ServeContent(w, r, "", mod, strings.NewReader(contents))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	tests := []struct {
+		ifRange string
+		code    int
+		body    string
+	}{
+		{`"v2"`, http.StatusPartialContent, "2345"},
+		{mod.Format(http.TimeFormat), http.StatusPartialContent, "2345"},
+		// changed since, or weak: the full object
+		{`"v1"`, http.StatusOK, contents},
+		{`W/"v2"`, http.StatusOK, contents},
+		{mod.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, contents},
+		{"garbage", http.StatusOK, contents},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/doc.pdf", nil)
+		req.Header.Set("range", "bytes=2-5")
+		req.Header.Set("if-range", test.ifRange)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q: res.Code = %d; want %d", test.ifRange, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%q: res.Body = %q; want %q", test.ifRange, v, test.body)
+		}
+	}
+}
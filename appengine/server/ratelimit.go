@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitGCInterval is how often idle client buckets are dropped.
+const rateLimitGCInterval = time.Minute
+
+// rateLimitConfig is the RateLimit section of appConfig.
+type rateLimitConfig struct {
+	// RPS is the sustained rate of requests per second allowed per client IP.
+	RPS float64 `json:"rps" yaml:"rps"`
+	// Burst is the number of requests a client may make at once.
+	// It defaults to RPS rounded up.
+	Burst int `json:"burst" yaml:"burst"`
+	// ExemptCIDRs is a list of client IP addresses or CIDR ranges
+	// which are not rate limited, e.g. "10.0.0.0/8".
+	ExemptCIDRs []string `json:"exempt_cidrs" yaml:"exempt_cidrs"`
+}
+
+// validate reports an error if rc.RPS is not positive, rc.Burst is negative
+// or any of rc.ExemptCIDRs is neither an IP address nor a CIDR.
+func (rc *rateLimitConfig) validate() error {
+	if rc.RPS <= 0 {
+		return fmt.Errorf("rps: %v must be positive", rc.RPS)
+	}
+	if rc.Burst < 0 {
+		return fmt.Errorf("burst: %d must not be negative", rc.Burst)
+	}
+	return validateIPList("exempt_cidrs", rc.ExemptCIDRs)
+}
+
+// burst returns rc.Burst or its default value.
+func (rc *rateLimitConfig) burst() float64 {
+	if rc.Burst > 0 {
+		return float64(rc.Burst)
+	}
+	return math.Ceil(rc.RPS)
+}
+
+// tokenBucket is the rate limiting state of a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds token buckets keyed by client IP.
+// Buckets which have refilled are dropped every rateLimitGCInterval,
+// since they are equivalent to new ones, which bounds memory
+// to the clients seen within the refill time.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	gc      time.Time
+}
+
+// limiter is the rate limiter of this instance.
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token from the bucket of client ip at time now.
+// If none is available, it reports false along with the time
+// until the next token.
+func (l *rateLimiter) allow(ip string, now time.Time, rps, burst float64) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.gc) >= rateLimitGCInterval {
+		l.collect(now, rps, burst)
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rps)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// collect drops buckets which would be full at time now.
+// l.mu must be held.
+func (l *rateLimiter) collect(now time.Time, rps, burst float64) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rps >= burst {
+			delete(l.buckets, ip)
+		}
+	}
+	l.gc = now
+}
+
+// clientIP returns r.RemoteAddr without a port, which App Engine sets to
+// the client address. X-Forwarded-For is ignored, since clients control
+// its first hops.
+func clientIP(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return h
+	}
+	return r.RemoteAddr
+}
+
+// rateLimit wraps h with per client IP rate limiting, if the current config
+// RateLimit is set. Clients over the limit get 429 status code and retry-after
+// header. Clients in RateLimit.ExemptCIDRs are not limited.
+//
+// The limiter state is kept in the instance memory, so the effective limit
+// of a client is multiplied by the number of instances serving it.
+func rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := currentConfig().RateLimit
+		if rc == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if ipListed(ip, rc.ExemptCIDRs) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := limiter.allow(ip, time.Now(), rc.RPS, rc.burst())
+		if !ok {
+			w.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			serveError(w, http.StatusTooManyRequests, "")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	tests := []struct {
+		ip   string
+		dt   time.Duration
+		ok   bool
+		wait time.Duration
+	}{
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, time.Second},
+		{"b", 0, true, 0},
+		{"a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"a", 500 * time.Millisecond, true, 0},
+		{"a", 0, false, time.Second},
+		// refills up to burst only
+		{"a", time.Hour, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, time.Second},
+	}
+	for i, test := range tests {
+		now = now.Add(test.dt)
+		ok, wait := l.allow(test.ip, now, 1, 3)
+		if ok != test.ok || wait != test.wait {
+			t.Errorf("%d: allow(%q) = %v, %v; want %v, %v", i, test.ip, ok, wait, test.ok, test.wait)
+		}
+	}
+}
+
+func TestRateLimiterCollect(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	l.allow("idle", now, 1, 2)
+	now = now.Add(rateLimitGCInterval - time.Second)
+	l.allow("busy", now, 1, 2)
+	l.allow("busy", now, 1, 2)
+	now = now.Add(time.Second)
+	l.allow("new", now, 1, 2)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket is not collected")
+	}
+	for _, ip := range []string{"busy", "new"} {
+		if _, ok := l.buckets[ip]; !ok {
+			t.Errorf("%s bucket is collected", ip)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct{ xff, remote, ip string }{
+		// client supplied, ignored
+		{"10.0.0.1", "203.0.113.7:1234", "203.0.113.7"},
+		{"10.0.0.1, 198.51.100.1", "203.0.113.7:1234", "203.0.113.7"},
+		{"", "10.0.0.1:1234", "10.0.0.1"},
+		{"", "10.0.0.1", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := &http.Request{Header: http.Header{}, RemoteAddr: test.remote}
+		if test.xff != "" {
+			r.Header.Set("x-forwarded-for", test.xff)
+		}
+		if v := clientIP(r); v != test.ip {
+			t.Errorf("clientIP(%q, %q) = %q; want %q", test.xff, test.remote, v, test.ip)
+		}
+	}
+}
+
+func TestServe_RateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer func(l *rateLimiter) { limiter = l }(limiter)
+	limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.RateLimit = &rateLimitConfig{RPS: 0.01, Burst: 2, ExemptCIDRs: []string{"10.0.0.0/8"}}
+	})()
+
+	tests := []struct {
+		path, remote, xff string
+		code              int
+	}{
+		{"/page.txt", "203.0.113.7:1234", "", http.StatusOK},
+		{"/page.txt", "203.0.113.7:1234", "", http.StatusOK},
+		{"/page.txt", "203.0.113.7:1234", "", http.StatusTooManyRequests},
+		// forged X-Forwarded-For neither resets nor exempts the client
+		{"/page.txt", "203.0.113.7:1234", "198.51.100.9", http.StatusTooManyRequests},
+		{"/page.txt", "203.0.113.7:1234", "10.1.1.1", http.StatusTooManyRequests},
+		{"/healthz", "203.0.113.7:1234", "", http.StatusOK},
+		{warmupPath, "203.0.113.7:1234", "", http.StatusOK},
+		{"/page.txt", "198.51.100.1:1234", "", http.StatusOK},
+		{"/page.txt", "10.1.1.1:1234", "", http.StatusOK},
+		{"/page.txt", "10.1.1.1:1234", "", http.StatusOK},
+		{"/page.txt", "10.1.1.1:1234", "", http.StatusOK},
+	}
+	for i, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.RemoteAddr = test.remote
+		if test.xff != "" {
+			req.Header.Set("x-forwarded-for", test.xff)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%d: %s from %s: res.Code = %d; want %d", i, test.path, test.remote, res.Code, test.code)
+		}
+		if test.code != http.StatusTooManyRequests {
+			continue
+		}
+		if v := res.Header().Get("retry-after"); v != "100" {
+			t.Errorf("%d: retry-after = %q; want 100", i, v)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// defaultMaxRedirects is the default value of appConfig.MaxRedirects.
+const defaultMaxRedirects = 5
+
+// redirect is a Redirects config map value.
+// It serves redirects to To with the original request path appended.
+type redirect struct {
+	To   string `json:"to" yaml:"to"`     // target URL
+	Code int    `json:"code" yaml:"code"` // HTTP status; see code method
+
+	// PreserveQuery controls whether the request query string is carried over
+	// to the target. It defaults to true. When To has its own query string,
+	// the two are merged, with To parameters taking precedence.
+	PreserveQuery *bool `json:"preserve_query" yaml:"preserve_query"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts either a target URL string or an object.
+func (r *redirect) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*r = redirect{}
+		return json.Unmarshal(b, &r.To)
+	}
+	type plain redirect
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// It accepts either a target URL string or a mapping.
+func (r *redirect) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var to string
+	if err := unmarshal(&to); err == nil {
+		*r = redirect{To: to}
+		return nil
+	}
+	type plain redirect
+	return unmarshal((*plain)(r))
+}
+
+// code returns HTTP response status of the redirect.
+// It defaults to http.StatusMovedPermanently.
+// The status is sent as is, so 307 and 308 redirects preserve
+// the request method and body, unlike 301 and 302 which clients
+// commonly follow with GET.
+func (r redirect) code() int {
+	if r.Code == 0 {
+		return http.StatusMovedPermanently
+	}
+	return r.Code
+}
+
+// validRedirectCode reports whether code is one of the redirect statuses
+// a redirect may be configured with: 301, 302, 307 or 308.
+func validRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// preserveQuery reports whether r.PreserveQuery is set or unspecified.
+func (r redirect) preserveQuery() bool {
+	return r.PreserveQuery == nil || *r.PreserveQuery
+}
+
+// ServeHTTP implements http.Handler.
+func (r redirect) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.serve(w, req, req.URL.Path)
+}
+
+// target returns r.To with suffix appended to its path.
+func (r redirect) target(suffix string) string {
+	u, query := splitQuery(r.To)
+	u = strings.TrimSuffix(u, "/") + suffix
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+// serve responds to req with a redirect to r.target(suffix).
+func (r redirect) serve(w http.ResponseWriter, req *http.Request, suffix string) {
+	r.serveTo(w, req, r.target(suffix))
+}
+
+// serveTo responds to req with a redirect to URL u as is,
+// merging the request query as configured.
+func (r redirect) serveTo(w http.ResponseWriter, req *http.Request, u string) {
+	u, query := splitQuery(u)
+	if r.preserveQuery() {
+		query = mergeQuery(query, req.URL.RawQuery)
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	http.Redirect(w, req, u, r.code())
+}
+
+// splitQuery splits URL u into the part preceding "?" and the raw query.
+func splitQuery(u string) (string, string) {
+	if i := strings.IndexByte(u, '?'); i >= 0 {
+		return u[:i], u[i+1:]
+	}
+	return u, ""
+}
+
+// mergeQuery adds parameters of the raw query string q2 to those of q1
+// unless q1 already has them, and returns the result encoded.
+// Either of the arguments is returned as is if the other one is empty.
+func mergeQuery(q1, q2 string) string {
+	if q1 == "" {
+		return q2
+	}
+	if q2 == "" {
+		return q1
+	}
+	// the values parsed before an error, if any, are still usable
+	v1, _ := url.ParseQuery(q1)
+	v2, _ := url.ParseQuery(q2)
+	for k, v := range v2 {
+		if _, ok := v1[k]; !ok {
+			v1[k] = v
+		}
+	}
+	return v1.Encode()
+}
+
+// redirectPrefix is a Redirects entry matching a path prefix.
+type redirectPrefix struct {
+	key    string // Redirects key
+	prefix string // host and path prefix the entry matches
+	// remainder is true for keys ending in "/*", which carry
+	// only the remainder of the path following prefix to the target.
+	// Other prefix keys end in "/" and carry the whole path.
+	remainder bool
+	r         redirect
+}
+
+// buildRedirects returns prefix entries of c.Redirects,
+// sorted by descending prefix length.
+func (c *appConfig) buildRedirects() []redirectPrefix {
+	var list []redirectPrefix
+	for k, v := range c.Redirects {
+		switch {
+		case strings.HasSuffix(k, "/*"):
+			list = append(list, redirectPrefix{key: k, prefix: k[:len(k)-1], remainder: true, r: v})
+		case strings.HasSuffix(k, "/"):
+			list = append(list, redirectPrefix{key: k, prefix: k, r: v})
+		}
+	}
+	sort.Sort(byPrefixLen(list))
+	return list
+}
+
+// byPrefixLen sorts redirect prefixes, longest first.
+type byPrefixLen []redirectPrefix
+
+func (a byPrefixLen) Len() int      { return len(a) }
+func (a byPrefixLen) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPrefixLen) Less(i, j int) bool {
+	if len(a[i].prefix) != len(a[j].prefix) {
+		return len(a[i].prefix) > len(a[j].prefix)
+	}
+	return a[i].key < a[j].key
+}
+
+// findRedirect returns the c.Redirects entry matching host and path,
+// and the suffix to append to its target.
+// Keys are either a path or a host followed by a path.
+// Exact keys take precedence over prefix keys, host qualified exact keys
+// over those with path only, and among prefix keys the longest prefix wins.
+func (c *appConfig) findRedirect(host, path string) (r redirect, suffix string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if r, ok := c.Redirects[host+path]; ok {
+		return r, path, true
+	}
+	if r, ok := c.Redirects[path]; ok {
+		return r, path, true
+	}
+	for _, p := range c.redirectPrefixes {
+		var rest string
+		switch {
+		case strings.HasPrefix(host+path, p.prefix):
+			rest = (host + path)[len(p.prefix):]
+		case strings.HasPrefix(path, p.prefix):
+			rest = path[len(p.prefix):]
+		default:
+			continue
+		}
+		if p.remainder {
+			return p.r, "/" + rest, true
+		}
+		return p.r, path, true
+	}
+	return redirect{}, "", false
+}
+
+// matchRedirect returns redirect target URL and HTTP status code
+// of the c.Redirects entry matching host and path.
+// See findRedirect for matching rules.
+func (c *appConfig) matchRedirect(host, path string) (target string, code int, ok bool) {
+	r, suffix, ok := c.findRedirect(host, path)
+	if !ok {
+		return "", 0, false
+	}
+	return r.target(suffix), r.code(), true
+}
+
+// redirectOr serves redirects of the current config of the request host,
+// if the request matches one of the config Redirects keys, or delegates
+// to h otherwise. See appConfig.site.
+// Requests of RedirectExcludeAgents are always delegated to h.
+func redirectOr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig().site(r.Host)
+		if c.redirectExcluded(r.UserAgent()) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if c.RootRedirect != nil && r.URL.Path == "/" {
+			c.RootRedirect.serveTo(w, r, c.RootRedirect.To)
+			return
+		}
+		if serveLangRedirect(w, r) {
+			return
+		}
+		if serveABRedirect(w, r) {
+			return
+		}
+		if rd, suffix, ok := c.findRedirect(r.Host, r.URL.Path); ok {
+			rd.serve(w, r, suffix)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validateRootRedirect reports an error if c.RootRedirect is set
+// but has no target, an unsupported code, would redirect "/" to itself,
+// or overlaps with a "/" key of c.Redirects.
+func (c *appConfig) validateRootRedirect() error {
+	rr := c.RootRedirect
+	if rr == nil {
+		return nil
+	}
+	switch u, _ := splitQuery(rr.To); {
+	case rr.To == "":
+		return fmt.Errorf("root_redirect.to: must not be empty")
+	case u == "/":
+		return fmt.Errorf(`root_redirect.to: %q would redirect "/" to itself`, rr.To)
+	case rr.Code != 0 && !validRedirectCode(rr.Code):
+		return fmt.Errorf("root_redirect.code: %d is not one of 301, 302, 307 or 308", rr.Code)
+	}
+	if _, ok := c.Redirects["/"]; ok {
+		return fmt.Errorf(`root_redirect: conflicts with redirects["/"]`)
+	}
+	return nil
+}
+
+// redirectExcluded reports whether user agent ua contains one of
+// c.RedirectExcludeAgents, ignoring case.
+func (c *appConfig) redirectExcluded(ua string) bool {
+	if ua == "" {
+		return false
+	}
+	ua = strings.ToLower(ua)
+	for _, a := range c.RedirectExcludeAgents {
+		if a != "" && strings.Contains(ua, strings.ToLower(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirectChains follows c.Redirects starting from every key
+// and reports an error if it finds a loop or a chain longer than c.MaxRedirects.
+// Only relative targets and absolute targets with the source host are followed.
+func (c *appConfig) checkRedirectChains() error {
+	max := c.MaxRedirects
+	if max <= 0 {
+		max = defaultMaxRedirects
+	}
+	cc := *c
+	cc.redirectPrefixes = c.buildRedirects()
+	keys := make([]string, 0, len(c.Redirects))
+	for k := range c.Redirects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		host, path := k, ""
+		if i := strings.IndexByte(k, '/'); i >= 0 {
+			host, path = k[:i], k[i:]
+		}
+		path = strings.TrimSuffix(path, "*")
+		chain := []string{host + path}
+		seen := map[string]bool{host + path: true}
+		for {
+			r, suffix, ok := cc.findRedirect(host, path)
+			if !ok {
+				break
+			}
+			u, err := url.Parse(r.target(suffix))
+			if err != nil {
+				return fmt.Errorf("redirects[%q]: %v", k, err)
+			}
+			if u.Host != "" && u.Host != host {
+				break
+			}
+			path = u.Path
+			node := host + path
+			chain = append(chain, node)
+			if seen[node] {
+				return fmt.Errorf("redirects[%q]: loop: %s", k, strings.Join(chain, " -> "))
+			}
+			seen[node] = true
+			if len(chain) > max+1 {
+				return fmt.Errorf("redirects[%q]: chain exceeds max depth %d: %s", k, max, strings.Join(chain, " -> "))
+			}
+		}
+	}
+	return nil
+}
+
+// redirectTarget is a redirect target URL of a config field, see redirectTargets.
+type redirectTarget struct {
+	field, target string
+}
+
+// redirectTargets returns targets of exact path keys of c.Redirects, with
+// the path appended, c.RootRedirect, c.LangRedirect and c.ABRedirects,
+// sorted by field. Prefix and host qualified keys of c.Redirects are skipped,
+// as are absolute targets: the objects they lead to are not known.
+func (c *appConfig) redirectTargets() []redirectTarget {
+	var list []redirectTarget
+	add := func(field, target string) {
+		if u, err := url.Parse(target); err == nil && u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/") {
+			list = append(list, redirectTarget{field, target})
+		}
+	}
+	for k, r := range c.Redirects {
+		if strings.HasPrefix(k, "/") && !strings.HasSuffix(k, "/") && !strings.HasSuffix(k, "/*") {
+			add(fmt.Sprintf("redirects[%q]", k), r.target(k))
+		}
+	}
+	if rr := c.RootRedirect; rr != nil {
+		add("root_redirect", rr.To)
+	}
+	for k, lr := range c.LangRedirect {
+		add(fmt.Sprintf("lang_redirect[%q].default", k), lr.Default)
+		for lang, to := range lr.Langs {
+			add(fmt.Sprintf("lang_redirect[%q].langs[%q]", k, lang), to)
+		}
+	}
+	for k, variants := range c.ABRedirects {
+		for i, v := range variants {
+			add(fmt.Sprintf("ab_redirects[%q][%d]", k, i), v.Target)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].field < list[j].field })
+	return list
+}
+
+// checkRedirectTargets stats the objects of c.redirectTargets in the default
+// bucket, logging a warning for those which do not exist. Targets redirected
+// further by c.Redirects are skipped; checkRedirectChains covers those.
+// It returns an error listing the missing targets, as opposed to those which
+// could not be checked, e.g. due to transient failures.
+func checkRedirectTargets(ctx context.Context, c *appConfig) error {
+	bucket := c.Buckets["default"].primary()
+	var missing []string
+	for _, t := range c.redirectTargets() {
+		p, _ := splitQuery(t.target)
+		if _, _, ok := c.findRedirect("", p); ok {
+			continue
+		}
+		_, err := storage.ReadFileMeta(ctx, bucket, strings.TrimPrefix(p, "/"))
+		if err == nil {
+			continue
+		}
+		if isNotFound(err) {
+			missing = append(missing, t.field+" -> "+t.target)
+			stdlog.Printf("warning: %s: target %s does not exist in bucket %q", t.field, t.target, bucket)
+		} else {
+			stdlog.Printf("warning: %s: target %s could not be checked: %v", t.field, t.target, err)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("verify_redirect_targets: missing targets: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
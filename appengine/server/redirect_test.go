@@ -0,0 +1,407 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestDecodeRedirects(t *testing.T) {
+	const (
+		jsonConf = `{"redirects": {
+			"/perm": "https://example.com/perm",
+			"/temp": {"to": "https://example.com/temp", "code": 302}
+		}}`
+		yamlConf = `
+redirects:
+  /perm: https://example.com/perm
+  /temp:
+    to: https://example.com/temp
+    code: 302
+`
+	)
+	want := map[string]redirect{
+		"/perm": {To: "https://example.com/perm"},
+		"/temp": {To: "https://example.com/temp", Code: http.StatusFound},
+	}
+	for name, data := range map[string]string{"config.json": jsonConf, "config.yaml": yamlConf} {
+		var c appConfig
+		if err := decodeConfig(name, []byte(data), &c); err != nil {
+			t.Errorf("%s: decodeConfig: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Redirects, want) {
+			t.Errorf("%s: c.Redirects = %+v; want %+v", name, c.Redirects, want)
+		}
+	}
+}
+
+func TestServe_Redirects(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Redirects = map[string]redirect{
+			"/perm": {To: "https://example.com"},
+			"/temp": {To: "https://example.com", Code: http.StatusFound},
+		}
+		c.redirectPrefixes = c.buildRedirects()
+	})()
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/perm", http.StatusMovedPermanently},
+		{"/temp", http.StatusFound},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		loc := "https://example.com" + test.path
+		if v := res.Header().Get("location"); v != loc {
+			t.Errorf("%s: location = %q; want %q", test.path, v, loc)
+		}
+	}
+}
+
+// frontendTransport serves requests to host with http.DefaultServeMux
+// and the rest with http.DefaultTransport, so that a client may follow
+// redirects from the frontend to a test server.
+type frontendTransport struct {
+	t    *testing.T
+	host string
+}
+
+func (ft frontendTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != ft.host {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+	req, err := testInstance.NewRequest(r.Method, r.URL.String(), r.Body)
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+	req.Header = r.Header
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	return res.Result(), nil
+}
+
+func TestServe_RedirectPreserveMethod(t *testing.T) {
+	type received struct{ method, body string }
+	var got received
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = received{r.Method + " " + r.URL.RequestURI(), string(b)}
+	}))
+	defer ts.Close()
+	defer withConfig(func(c *appConfig) {
+		c.Redirects = map[string]redirect{
+			"/api/v1/items": {To: ts.URL, Code: http.StatusPermanentRedirect},
+			"/api/v1/tmp":   {To: ts.URL, Code: http.StatusTemporaryRedirect},
+			"/api/v1/old":   {To: ts.URL, Code: http.StatusFound},
+		}
+		c.redirectPrefixes = c.buildRedirects()
+	})()
+	client := &http.Client{Transport: frontendTransport{t, "goa.design"}}
+
+	const body = `{"name": "item"}`
+	tests := []struct {
+		path string
+		want received
+	}{
+		{"/api/v1/items", received{"POST /api/v1/items?id=1", body}},
+		{"/api/v1/tmp", received{"POST /api/v1/tmp?id=1", body}},
+		{"/api/v1/old", received{"GET /api/v1/old?id=1", ""}}, // downgraded by the client
+	}
+	for _, test := range tests {
+		got = received{}
+		res, err := client.Post("http://goa.design"+test.path+"?id=1", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		res.Body.Close()
+		if got != test.want {
+			t.Errorf("%s: target received %+v; want %+v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestServe_RedirectExcludeAgents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Redirects = map[string]redirect{"/old.html": {To: "https://example.com/new"}}
+		c.redirectPrefixes = c.buildRedirects()
+		c.RedirectExcludeAgents = []string{"pingdom", "UptimeRobot"}
+		c.ForceHTTPS = true
+	})()
+
+	tests := []struct {
+		ua, proto string
+		code      int
+		location  string
+	}{
+		{"Pingdom.com_bot_version_1.4", "https", http.StatusOK, ""},
+		{"Mozilla/5.0+(compatible; uptimerobot/2.0)", "https", http.StatusOK, ""},
+		{"Mozilla/5.0", "https", http.StatusMovedPermanently, "https://example.com/new/old.html"},
+		{"", "https", http.StatusMovedPermanently, "https://example.com/new/old.html"},
+		// security redirects still apply
+		{"Pingdom.com_bot_version_1.4", "http", http.StatusMovedPermanently, "https://goa.design/old.html"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/old.html", nil)
+		req.Host = "goa.design"
+		req.Header.Set("user-agent", test.ua)
+		req.Header.Set("x-forwarded-proto", test.proto)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q %s: res.Code = %d; want %d", test.ua, test.proto, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%q %s: location = %q; want %q", test.ua, test.proto, v, test.location)
+		}
+		if test.code == http.StatusOK && res.Body.String() != "/bucket/old.html" {
+			t.Errorf("%q %s: res.Body = %q; want /bucket/old.html", test.ua, test.proto, res.Body)
+		}
+	}
+}
+
+func TestServe_RootRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.RootRedirect = &redirect{To: "/home/", Code: http.StatusFound}
+	})()
+
+	tests := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"/", http.StatusFound, "/home/"},
+		{"/?lang=en", http.StatusFound, "/home/?lang=en"},
+		{"/anything", http.StatusOK, ""},
+		{"/home/", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.url, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.url, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%s: location = %q; want %q", test.url, v, test.location)
+		}
+	}
+}
+
+func TestRedirectQuery(t *testing.T) {
+	no := false
+	tests := []struct {
+		r        redirect
+		url, loc string
+	}{
+		{redirect{To: "https://example.com"}, "/p?utm_source=a", "https://example.com/p?utm_source=a"},
+		{redirect{To: "https://example.com"}, "/p", "https://example.com/p"},
+		{redirect{To: "https://example.com"}, "/p?", "https://example.com/p"},
+		{redirect{To: "https://example.com", PreserveQuery: &no}, "/p?utm_source=a", "https://example.com/p"},
+		{redirect{To: "https://example.com?ref=x"}, "/p", "https://example.com/p?ref=x"},
+		{redirect{To: "https://example.com?ref=x", PreserveQuery: &no}, "/p?a=1", "https://example.com/p?ref=x"},
+		{redirect{To: "https://example.com?ref=x"}, "/p?ref=y&utm_source=a", "https://example.com/p?ref=x&utm_source=a"},
+	}
+	for i, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.url, nil)
+		res := httptest.NewRecorder()
+		test.r.ServeHTTP(res, req)
+		if v := res.Header().Get("location"); v != test.loc {
+			t.Errorf("%d: location = %q; want %q", i, v, test.loc)
+		}
+	}
+}
+
+func TestMatchRedirect(t *testing.T) {
+	c := &appConfig{Redirects: map[string]redirect{
+		"/docs/v1/*":         {To: "/docs/v2/"},
+		"/docs/v1/old/*":     {To: "https://old.example.com", Code: http.StatusFound},
+		"/docs/v1/exact":     {To: "https://exact.example.com"},
+		"/blog/":             {To: "https://blog.example.com"},
+		"example.org/blog/":  {To: "https://blog.example.org"},
+		"example.org/docs/*": {To: "https://docs.example.org"},
+		"example.org/about":  {To: "https://about.example.org"},
+		"/about":             {To: "https://about.example.com"},
+	}}
+	c.redirectPrefixes = c.buildRedirects()
+
+	tests := []struct {
+		host, path string
+		target     string
+		code       int
+	}{
+		// exact over prefix
+		{"example.com", "/docs/v1/exact", "https://exact.example.com/docs/v1/exact", http.StatusMovedPermanently},
+		// prefix remainder
+		{"example.com", "/docs/v1/intro", "/docs/v2/intro", http.StatusMovedPermanently},
+		{"example.com", "/docs/v1/", "/docs/v2/", http.StatusMovedPermanently},
+		// longest prefix wins
+		{"example.com", "/docs/v1/old/page", "https://old.example.com/page", http.StatusFound},
+		// subtree keys carry the whole path
+		{"example.com", "/blog/post", "https://blog.example.com/blog/post", http.StatusMovedPermanently},
+		// host qualified keys
+		{"example.org:8080", "/blog/post", "https://blog.example.org/blog/post", http.StatusMovedPermanently},
+		{"example.org", "/about", "https://about.example.org/about", http.StatusMovedPermanently},
+		{"example.com", "/about", "https://about.example.com/about", http.StatusMovedPermanently},
+		// host qualified prefix is longer than path only one
+		{"example.org", "/docs/v1/intro", "https://docs.example.org/v1/intro", http.StatusMovedPermanently},
+	}
+	for _, test := range tests {
+		target, code, ok := c.matchRedirect(test.host, test.path)
+		if !ok {
+			t.Errorf("%s%s: no match", test.host, test.path)
+			continue
+		}
+		if target != test.target || code != test.code {
+			t.Errorf("%s%s: matchRedirect = %q, %d; want %q, %d", test.host, test.path, target, code, test.target, test.code)
+		}
+	}
+	for _, p := range []string{"/docs/v1", "/docs", "/blog", "/about/"} {
+		if target, _, ok := c.matchRedirect("example.com", p); ok {
+			t.Errorf("%s: matchRedirect = %q; want no match", p, target)
+		}
+	}
+}
+
+func TestCheckRedirectChains(t *testing.T) {
+	tests := []struct {
+		redirects map[string]redirect
+		max       int
+		err       string
+	}{
+		{
+			redirects: map[string]redirect{"/a": {To: "/b"}, "/c": {To: "https://example.com"}},
+		},
+		{
+			// different hosts do not form a loop
+			redirects: map[string]redirect{
+				"a.example.com/": {To: "https://b.example.com"},
+				"b.example.com/": {To: "https://a.example.com"},
+			},
+		},
+		{
+			redirects: map[string]redirect{"/a": {To: ""}, "/b": {To: ""}},
+			err:       `redirects["/a"]: loop: /a -> /a`,
+		},
+		{
+			redirects: map[string]redirect{"/a/*": {To: "/b/"}, "/b/*": {To: "/a/"}},
+			err:       `redirects["/a/*"]: loop: /a/ -> /b/ -> /a/`,
+		},
+		{
+			redirects: map[string]redirect{
+				"example.com/a/": {To: "https://example.com/b"},
+				"example.com/b/": {To: ""},
+			},
+			err: `redirects["example.com/a/"]: loop: example.com/a/ -> example.com/b/a/ -> example.com/b/a/`,
+		},
+		{
+			redirects: map[string]redirect{"/x/*": {To: "/x/y/"}},
+			max:       2,
+			err:       `redirects["/x/*"]: chain exceeds max depth 2: /x/ -> /x/y/ -> /x/y/y/ -> /x/y/y/y/`,
+		},
+	}
+	for i, test := range tests {
+		c := &appConfig{Redirects: test.redirects, MaxRedirects: test.max}
+		err := c.checkRedirectChains()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%d: checkRedirectChains: %v", i, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%d: checkRedirectChains = %v; want %q", i, err, test.err)
+		}
+	}
+}
+
+func TestCheckRedirectTargets(t *testing.T) {
+	m := &weasel.MemBackend{}
+	m.Put("bucket", "new.html", []byte("new"), nil)
+	m.Put("bucket", "docs/v2/index.html", []byte("docs"), nil)
+	m.Put("bucket", "home/index.html", []byte("home"), nil)
+	m.Put("bucket", "en/index.html", []byte("en"), nil)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+
+	c := &appConfig{
+		Buckets: map[string]bucketList{"default": {"bucket"}},
+		Redirects: map[string]redirect{
+			"/v2":          {To: "/docs"},               // -> /docs/v2
+			"/docs":        {To: "/docs/v2"},            // -> /docs/v2/docs, missing
+			"/guide":       {To: "/docs/v2?from=guide"}, // -> /docs/v2/guide?from=guide, missing
+			"/old":         {To: ""},                    // -> /old, a loop
+			"/chained":     {To: "/new"},                // -> /new/chained, redirected further
+			"/new/chained": {To: "https://example.com"}, // absolute
+			"/v1/*":        {To: "/missing"},            // prefix
+			"other.host/x": {To: "/missing"},            // host qualified
+		},
+		RootRedirect: &redirect{To: "/home/"},
+		LangRedirect: map[string]langRedirect{"/welcome": {
+			Default: "/en/",
+			Langs:   map[string]string{"fr": "/fr/"},
+		}},
+		ABRedirects: map[string][]abVariant{"/landing": {{Target: "/new.html", Weight: 1}, {Target: "/b.html", Weight: 1}}},
+	}
+	c.redirectPrefixes = c.buildRedirects()
+
+	err := checkRedirectTargets(ctx, c)
+	want := `verify_redirect_targets: missing targets: ab_redirects["/landing"][1] -> /b.html, ` +
+		`lang_redirect["/welcome"].langs["fr"] -> /fr/, redirects["/docs"] -> /docs/v2/docs, ` +
+		`redirects["/guide"] -> /docs/v2/guide?from=guide`
+	if err == nil || err.Error() != want {
+		t.Errorf("checkRedirectTargets: %v; want %s", err, want)
+	}
+
+	c.Redirects, c.LangRedirect, c.ABRedirects = nil, nil, nil
+	c.redirectPrefixes = nil
+	if err := checkRedirectTargets(ctx, c); err != nil {
+		t.Errorf("checkRedirectTargets: %v; want nil", err)
+	}
+}
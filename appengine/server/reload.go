@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	stdlog "log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// reloadStatus is the outcome of the latest config file loads,
+// reported by the health endpoint.
+var reloadStatus struct {
+	sync.Mutex
+	name   string    // config file name
+	loaded time.Time // when the config in effect was loaded from name
+	err    error     // error of the latest failed reload, if any
+}
+
+// configLoaded records a successful load of config file name at time t,
+// clearing a previous reload error.
+func configLoaded(name string, t time.Time) {
+	reloadStatus.Lock()
+	reloadStatus.name, reloadStatus.loaded, reloadStatus.err = name, t, nil
+	reloadStatus.Unlock()
+}
+
+// configReloadFailed records a failed reload of the config file.
+// The config loaded previously stays in effect.
+func configReloadFailed(err error) {
+	reloadStatus.Lock()
+	reloadStatus.err = err
+	reloadStatus.Unlock()
+}
+
+// configStatus returns the file name and load time of the config in effect
+// along with the latest reload error. Name is empty if no file was loaded.
+func configStatus() (name string, loaded time.Time, err error) {
+	reloadStatus.Lock()
+	defer reloadStatus.Unlock()
+	return reloadStatus.name, reloadStatus.loaded, reloadStatus.err
+}
+
+// reloadAttempts is the number of times watchConfig tries to load
+// a changed config file before giving up until the next poll.
+const reloadAttempts = 4
+
+var (
+	// reloadDebounce is how long the config file modification time must stay
+	// unchanged before watchConfig loads it, so that a file being written
+	// is loaded once, when complete.
+	reloadDebounce = 100 * time.Millisecond
+	// reloadBackoff is the delay before the first retry of a failed load,
+	// doubled after each attempt and jittered by up to a half.
+	reloadBackoff = 100 * time.Millisecond
+)
+
+// watchConfig polls config file name modification time every ReloadInterval
+// of the current config, until ctx is done or the interval is no longer positive.
+// When the file changes and then stays unchanged for reloadDebounce, it is loaded
+// into a new config which replaces the current one. A config that fails to load
+// or validate is retried up to reloadAttempts times, with jittered exponential
+// backoff, since it may have been read mid-write. If it still fails, or fails
+// to pass fatal VerifyRedirectTargets, it is logged, the previous one is kept
+// in effect and the change is retried on the next poll.
+// It logs with the standard logger: ctx is not a request context,
+// which App Engine log calls require.
+func watchConfig(ctx context.Context, name string) {
+	mtime := modTime(name) // of the config in effect
+	for {
+		d := time.Duration(currentConfig().ReloadInterval)
+		if d <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+		t := modTime(name)
+		if t.Equal(mtime) {
+			continue
+		}
+		t, ok := settledModTime(ctx, name, t)
+		if !ok {
+			return
+		}
+		c, err := loadConfigRetry(ctx, name)
+		if err != nil {
+			stdlog.Printf("warning: reload %s: %v", name, err)
+			configReloadFailed(err)
+			continue
+		}
+		if c.VerifyRedirectTargets {
+			if err := checkRedirectTargets(ctx, c); err != nil && c.VerifyRedirectTargetsFatal {
+				stdlog.Printf("warning: reload %s: %v", name, err)
+				configReloadFailed(err)
+				continue
+			}
+		}
+		mtime = t
+		setConfig(c)
+		configLoaded(name, time.Now())
+		stdlog.Printf("reloaded %s", name)
+	}
+}
+
+// settledModTime waits until file name modification time, last seen as t,
+// stays unchanged for reloadDebounce, and returns it.
+// It reports false if ctx is done meanwhile.
+func settledModTime(ctx context.Context, name string, t time.Time) (time.Time, bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return t, false
+		case <-time.After(reloadDebounce):
+		}
+		t2 := modTime(name)
+		if t2.Equal(t) {
+			return t, true
+		}
+		t = t2
+	}
+}
+
+// loadConfigRetry loads config file name with loadConfig, retrying failures
+// up to reloadAttempts times in total, with jittered exponential backoff.
+// It returns the last error if all attempts fail.
+// Like watchConfig, it logs with the standard logger.
+func loadConfigRetry(ctx context.Context, name string) (*appConfig, error) {
+	backoff := reloadBackoff
+	for attempt := 1; ; attempt++ {
+		c, err := loadConfig(name)
+		if err == nil || attempt >= reloadAttempts {
+			return c, err
+		}
+		stdlog.Printf("warning: reload %s: attempt %d: %v", name, attempt, err)
+		d := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		select {
+		case <-time.After(d):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// modTime returns modification time of file name,
+// or zero time if the file cannot be stat-ed.
+func modTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWatchConfig(t *testing.T) {
+	defer setConfig(currentConfig())
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.json")
+	mtime := time.Now()
+	write := func(data string) {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// make sure the change is noticed regardless of fs time resolution
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitBucket := func(want string) {
+		for end := time.Now().Add(time.Second); time.Now().Before(end); {
+			if currentConfig().Buckets["default"].primary() == want {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("default bucket = %q; want %q", currentConfig().Buckets["default"].primary(), want)
+	}
+
+	write(`{"buckets": {"default": "one"}, "reload": "5ms"}`)
+	if err := readConfig(name); err != nil {
+		t.Fatal(err)
+	}
+	// not a request context, like the one watchConfig runs with when deployed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfig(ctx, name)
+
+	// invalid config must not replace the current one
+	write(`{"buckets": {"host": "two"}, "reload": "5ms"}`)
+	time.Sleep(50 * time.Millisecond)
+	waitBucket("one")
+
+	write(`{"buckets": {"default": "three"}, "reload": "5ms"}`)
+	waitBucket("three")
+	if _, _, err := configStatus(); err != nil {
+		t.Errorf("configStatus: reload error %v after a valid config", err)
+	}
+}
+
+func TestWatchConfig_Truncated(t *testing.T) {
+	defer setConfig(currentConfig())
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.json")
+	mtime := time.Now()
+	write := func(data string) {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"buckets": {"default": "one"}, "reload": "5ms"}`)
+	if err := readConfig(name); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfig(ctx, name)
+
+	// written in two steps, within reloadDebounce
+	write(`{"buckets": {"default": "tw`)
+	time.Sleep(reloadDebounce / 10)
+	write(`{"buckets": {"default": "two"}, "reload": "5ms"}`)
+	for end := time.Now().Add(time.Second); time.Now().Before(end); {
+		if _, _, err := configStatus(); err != nil {
+			t.Fatalf("configStatus: reload error %v while writing", err)
+		}
+		if currentConfig().Buckets["default"].primary() == "two" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("default bucket = %q; want two", currentConfig().Buckets["default"].primary())
+}
+
+func TestLoadConfigRetry(t *testing.T) {
+	defer func(d time.Duration) { reloadBackoff = d }(reloadBackoff)
+	reloadBackoff = 20 * time.Millisecond
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(name, []byte(`{"buckets": {"default": "on`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// truncated for good
+	if _, err := loadConfigRetry(ctx, name); err == nil {
+		t.Fatal("loadConfigRetry: no error for a truncated file")
+	}
+
+	// completed during the first backoff
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(reloadBackoff / 2)
+		done <- ioutil.WriteFile(name, []byte(`{"buckets": {"default": "one"}}`), 0644)
+	}()
+	c, err := loadConfigRetry(ctx, name)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatalf("loadConfigRetry: %v", err)
+	}
+	if v := c.Buckets["default"].primary(); v != "one" {
+		t.Errorf("default bucket = %q; want one", v)
+	}
+}
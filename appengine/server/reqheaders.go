@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// requestHeaders wraps h with the current config StripRequestHeaders
+// removed from requests and SetRequestHeaders set on them, before h and
+// anything it calls sees them, be it logging, proxies or redirects.
+// The request headers are copied, never modified in place.
+func requestHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if len(c.StripRequestHeaders) == 0 && len(c.SetRequestHeaders) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r2 := *r
+		r2.Header = make(http.Header, len(r.Header)+len(c.SetRequestHeaders))
+		for k, v := range r.Header {
+			r2.Header[k] = v
+		}
+		for _, k := range c.StripRequestHeaders {
+			r2.Header.Del(k)
+		}
+		for k, v := range c.SetRequestHeaders {
+			r2.Header.Set(k, v)
+		}
+		h.ServeHTTP(w, &r2)
+	})
+}
+
+// validHeaderName reports whether name is a non-empty RFC 7230 token.
+func validHeaderName(name string) bool {
+	return name != "" && strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) < 0
+}
+
+// validateRequestHeaders reports an error if c.StripRequestHeaders or
+// c.SetRequestHeaders has an invalid header name, a set value spans lines,
+// or the same header is both stripped and set. The Host header cannot be
+// set, as requests are routed by their host before any header is looked at.
+func (c *appConfig) validateRequestHeaders() error {
+	strip := make(map[string]bool, len(c.StripRequestHeaders))
+	for i, k := range c.StripRequestHeaders {
+		if !validHeaderName(k) {
+			return fmt.Errorf("strip_request_headers[%d]: %q is not a header name", i, k)
+		}
+		strip[http.CanonicalHeaderKey(k)] = true
+	}
+	for k, v := range c.SetRequestHeaders {
+		switch ck := http.CanonicalHeaderKey(k); {
+		case !validHeaderName(k):
+			return fmt.Errorf("set_request_headers[%q]: not a header name", k)
+		case ck == "Host":
+			return fmt.Errorf("set_request_headers[%q]: host cannot be set", k)
+		case strip[ck]:
+			return fmt.Errorf("set_request_headers[%q]: conflicts with strip_request_headers", k)
+		case strings.ContainsAny(v, "\r\n"):
+			return fmt.Errorf("set_request_headers[%q]: value must not contain line breaks", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_RequestHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	defer withConfig(func(c *appConfig) {
+		c.LogRequests = true
+		c.LogFormat = logFormatCombined
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Proxies = map[string]string{"/api/": ts.URL}
+		c.StripRequestHeaders = []string{"cookie", "Referer", "X-Internal-Auth"}
+		c.SetRequestHeaders = map[string]string{"user-agent": "frontend", "X-Env": "prod"}
+	})()
+
+	var entries []*requestLog
+	orig := writeRequestLog
+	writeRequestLog = func(_ context.Context, e *requestLog) { entries = append(entries, e) }
+	defer func() { writeRequestLog = orig }()
+
+	req, _ := testInstance.NewRequest("GET", "/api/items", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("cookie", "session=0123456789")
+	req.Header.Set("referer", "https://internal.example.com/")
+	req.Header.Set("x-internal-auth", "secret")
+	req.Header.Set("user-agent", "test-agent")
+	req.Header.Set("accept", "application/json")
+	http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d; want 1", len(entries))
+	}
+	if e := entries[0]; e.Referer != "" || e.UserAgent != "frontend" {
+		t.Errorf("logged referer %q, user agent %q; want none and frontend", e.Referer, e.UserAgent)
+	}
+	for _, k := range []string{"Cookie", "Referer", "X-Internal-Auth"} {
+		if v := got.Get(k); v != "" {
+			t.Errorf("proxied %s = %q; want none", k, v)
+		}
+	}
+	if v := got.Get("x-env"); v != "prod" {
+		t.Errorf("proxied X-Env = %q; want prod", v)
+	}
+	if v := got.Get("accept"); v != "application/json" {
+		t.Errorf("proxied Accept = %q; want application/json", v)
+	}
+	// the original request is left intact
+	if v := req.Header.Get("cookie"); v != "session=0123456789" {
+		t.Errorf("req cookie = %q; want unmodified", v)
+	}
+}
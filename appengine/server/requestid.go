@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultRequestIDHeader is the default value of RequestIDHeader.
+	defaultRequestIDHeader = "X-Request-Id"
+	// maxRequestIDLen is the maximum length of incoming request IDs.
+	maxRequestIDLen = 128
+)
+
+// requestIDKey is the context key of request IDs. See requestIDFrom.
+type requestIDKey struct{}
+
+// requestIDHeader returns c.RequestIDHeader or its default value.
+func (c *appConfig) requestIDHeader() string {
+	if c.RequestIDHeader == "" {
+		return defaultRequestIDHeader
+	}
+	return c.RequestIDHeader
+}
+
+// requestID wraps h with request IDs of the current config RequestIDHeader:
+// requests carrying a valid one keep it, others get a new random UUID.
+// The ID is set on the request, so that handlers, logs and proxied upstreams
+// see it, and echoed in the response header. See newContext.
+func requestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := currentConfig().requestIDHeader()
+		id := r.Header.Get(name)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r2 := *r
+			r2.Header = make(http.Header, len(r.Header)+1)
+			for k, v := range r.Header {
+				r2.Header[k] = v
+			}
+			r2.Header.Set(name, id)
+			r = &r2
+		}
+		w.Header().Set(name, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestIDFrom returns the request ID carried by ctx, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether incoming request ID id may be used as is:
+// it is non-empty, at most maxRequestIDLen long, and made of printable ASCII
+// characters other than space, so that it cannot break log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validateRequestIDHeader reports an error if c.RequestIDHeader
+// is set but not a header name.
+func (c *appConfig) validateRequestIDHeader() error {
+	if c.RequestIDHeader != "" && !validHeaderName(c.RequestIDHeader) {
+		return fmt.Errorf("request_id_header: %q is not a header name", c.RequestIDHeader)
+	}
+	return nil
+}
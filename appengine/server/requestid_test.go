@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+var uuidRE = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestServe_RequestID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	var entries []*requestLog
+	orig := writeRequestLog
+	writeRequestLog = func(_ context.Context, e *requestLog) { entries = append(entries, e) }
+	defer func() { writeRequestLog = orig }()
+
+	tests := []struct {
+		header, in string
+		keep       bool
+	}{
+		{"", "", false},
+		{"", "client-id-0123", true},
+		{"", "has space", false},
+		{"", strings.Repeat("x", maxRequestIDLen+1), false},
+		{"X-Correlation-Id", "", false},
+		{"X-Correlation-Id", "corr-42", true},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.LogRequests = true
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.RequestIDHeader = test.header
+		})
+		name := test.header
+		if name == "" {
+			name = defaultRequestIDHeader
+		}
+		entries = nil
+		req, _ := testInstance.NewRequest("GET", "/file.txt", nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		if test.in != "" {
+			req.Header.Set(name, test.in)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		id := res.Header().Get(name)
+		if test.keep && id != test.in {
+			t.Errorf("%s %.20q: response id = %q; want preserved", name, test.in, id)
+		}
+		if !test.keep && !uuidRE.MatchString(id) {
+			t.Errorf("%s %.20q: response id = %q; want a new UUID", name, test.in, id)
+		}
+		if len(entries) != 1 || entries[0].ID != id {
+			t.Errorf("%s %.20q: logged %d entries %+v; want one with id %q", name, test.in, len(entries), entries, id)
+		}
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	a, b := newRequestID(), newRequestID()
+	if !uuidRE.MatchString(a) || !uuidRE.MatchString(b) || a == b {
+		t.Errorf("newRequestID() = %q, %q; want distinct UUIDs", a, b)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// rewritePrefix is a Rewrites entry with a key ending in "/*".
+type rewritePrefix struct {
+	prefix string // path prefix the entry matches, ending in "/"
+	to     string // target path the remainder is appended to
+}
+
+// buildRewrites returns prefix entries of c.Rewrites,
+// sorted by descending prefix length.
+func (c *appConfig) buildRewrites() []rewritePrefix {
+	var list []rewritePrefix
+	for k, v := range c.Rewrites {
+		if strings.HasSuffix(k, "/*") {
+			list = append(list, rewritePrefix{prefix: k[:len(k)-1], to: v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].prefix) != len(list[j].prefix) {
+			return len(list[i].prefix) > len(list[j].prefix)
+		}
+		return list[i].prefix < list[j].prefix
+	})
+	return list
+}
+
+// findRewrite returns the target path of the c.Rewrites entry matching path.
+// Exact keys take precedence over prefix keys, and among prefix keys
+// the longest prefix wins.
+func (c *appConfig) findRewrite(path string) (string, bool) {
+	if to, ok := c.Rewrites[path]; ok {
+		return to, true
+	}
+	for _, p := range c.rewritePrefixes {
+		if strings.HasPrefix(path, p.prefix) {
+			return strings.TrimSuffix(p.to, "/") + "/" + path[len(p.prefix):], true
+		}
+	}
+	return "", false
+}
+
+// rewrite wraps h with internal rewrites of request paths matching
+// one of the current config Rewrites keys. Unlike redirects, the client
+// is not involved: h serves the target path in place of the original one.
+func rewrite(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to, ok := currentConfig().findRewrite(r.URL.Path); ok {
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path, u.RawPath = to, ""
+			r2.URL = &u
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validateRewrites reports an error if any of c.Rewrites keys or values
+// is not a path, a key has a wildcard other than a trailing "/*",
+// or a key matches paths also matched by c.Redirects.
+func (c *appConfig) validateRewrites() error {
+	keys := make([]string, 0, len(c.Rewrites))
+	for k := range c.Rewrites {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rkeys := make([]string, 0, len(c.Redirects))
+	for k := range c.Redirects {
+		rkeys = append(rkeys, k)
+	}
+	sort.Strings(rkeys)
+	for _, k := range keys {
+		switch {
+		case !strings.HasPrefix(k, "/"):
+			return fmt.Errorf(`rewrites[%q]: key must start with "/"`, k)
+		case strings.Contains(strings.TrimSuffix(k, "/*"), "*"):
+			return fmt.Errorf(`rewrites[%q]: wildcard must be a trailing "/*"`, k)
+		case !strings.HasPrefix(c.Rewrites[k], "/"):
+			return fmt.Errorf(`rewrites[%q]: value must start with "/"`, k)
+		}
+		for _, rk := range rkeys {
+			if rewriteOverlaps(k, rk) {
+				return fmt.Errorf(`rewrites[%q]: conflicts with redirects[%q]`, k, rk)
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteOverlaps reports whether any path matched by Rewrites key k
+// is also matched by Redirects key rk, on any host.
+func rewriteOverlaps(k, rk string) bool {
+	if i := strings.IndexByte(rk, '/'); i > 0 {
+		rk = rk[i:] // host qualified
+	}
+	if !strings.HasSuffix(k, "/*") {
+		return redirectKeyMatches(rk, k)
+	}
+	prefix := k[:len(k)-1]
+	return redirectKeyMatches(rk, prefix) || strings.HasPrefix(strings.TrimSuffix(rk, "*"), prefix)
+}
+
+// redirectKeyMatches reports whether Redirects key rk, without a host,
+// matches path. See findRedirect.
+func redirectKeyMatches(rk, path string) bool {
+	switch {
+	case strings.HasSuffix(rk, "/*"):
+		return strings.HasPrefix(path, rk[:len(rk)-1])
+	case strings.HasSuffix(rk, "/"):
+		return strings.HasPrefix(path, rk)
+	}
+	return rk == path
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestFindRewrite(t *testing.T) {
+	c := &appConfig{Rewrites: map[string]string{
+		"/css/old.css":   "/css/new.css",
+		"/img/old/*":     "/img/new",
+		"/img/old/sub/*": "/img/sub/",
+		"/img/old/x.png": "/img/x2.png",
+	}}
+	c.rewritePrefixes = c.buildRewrites()
+	tests := []struct {
+		path, to string
+		ok       bool
+	}{
+		{"/css/old.css", "/css/new.css", true},
+		{"/css/old.css/", "", false},
+		{"/img/old/logo.png", "/img/new/logo.png", true},
+		{"/img/old/", "/img/new/", true},
+		{"/img/old", "", false},
+		{"/img/old/sub/a.png", "/img/sub/a.png", true},
+		{"/img/old/x.png", "/img/x2.png", true},
+		{"/img/other.png", "", false},
+	}
+	for _, test := range tests {
+		to, ok := c.findRewrite(test.path)
+		if to != test.to || ok != test.ok {
+			t.Errorf("findRewrite(%q) = %q, %v; want %q, %v", test.path, to, ok, test.to, test.ok)
+		}
+	}
+}
+
+func TestServe_Rewrites(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.Redirects = map[string]redirect{"/moved.css": {To: "/css/site.css"}}
+		c.redirectPrefixes = c.buildRedirects()
+		c.Rewrites = map[string]string{
+			"/css/old.css":  "/css/new.css",
+			"/img/v1/*":     "/img/v2",
+			"/css/site.css": "/css/site.min.css",
+		}
+		c.rewritePrefixes = c.buildRewrites()
+	})()
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/css/old.css", http.StatusOK, "/bucket/css/new.css"},
+		{"/img/v1/logo.png", http.StatusOK, "/bucket/img/v2/logo.png"},
+		{"/img/v2/logo.png", http.StatusOK, "/bucket/img/v2/logo.png"},
+		{"/moved.css", http.StatusMovedPermanently, ""},
+		{"/css/site.css", http.StatusOK, "/bucket/css/site.min.css"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, res.Body, test.body)
+		}
+	}
+}
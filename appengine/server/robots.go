@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// robotsPath is the request path of robots.txt.
+const robotsPath = "/robots.txt"
+
+// robotsConfig is the robots.txt section of appConfig.
+type robotsConfig struct {
+	// Content is raw robots.txt content. It takes precedence over
+	// Allow and Disallow rules.
+	Content string `json:"content" yaml:"content"`
+	// Allow and Disallow are path prefixes rules for all user agents.
+	Allow    []string `json:"allow" yaml:"allow"`
+	Disallow []string `json:"disallow" yaml:"disallow"`
+	// Sitemap is the sitemap URL or path. Paths are prefixed with
+	// the request host.
+	Sitemap string `json:"sitemap" yaml:"sitemap"`
+}
+
+// render returns robots.txt contents for requests to the host.
+func (rc *robotsConfig) render(host string) []byte {
+	var b bytes.Buffer
+	if rc.Content != "" {
+		b.WriteString(rc.Content)
+		if !strings.HasSuffix(rc.Content, "\n") {
+			b.WriteByte('\n')
+		}
+	} else {
+		b.WriteString("User-agent: *\n")
+		for _, p := range rc.Allow {
+			fmt.Fprintf(&b, "Allow: %s\n", p)
+		}
+		for _, p := range rc.Disallow {
+			fmt.Fprintf(&b, "Disallow: %s\n", p)
+		}
+		if len(rc.Allow)+len(rc.Disallow) == 0 {
+			b.WriteString("Disallow:\n")
+		}
+	}
+	if s := rc.Sitemap; s != "" {
+		if strings.HasPrefix(s, "/") {
+			s = "https://" + host + s
+		}
+		fmt.Fprintf(&b, "Sitemap: %s\n", s)
+	}
+	return b.Bytes()
+}
+
+// serveRobots responds with robots.txt generated from the current config
+// Robots section, if any. It is used only when the bucket has no robots.txt.
+// It returns false if no response was written.
+func serveRobots(w http.ResponseWriter, r *http.Request) bool {
+	rc := currentConfig().Robots
+	if rc == nil || r.URL.Path != robotsPath {
+		return false
+	}
+	o := &weasel.Object{
+		Meta: map[string]string{"content-type": "text/plain; charset=utf-8"},
+		Body: rc.render(r.Host),
+	}
+	o = applyHeaders(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+		log.Errorf(newContext(r), "%s: %v", robotsPath, err)
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Robots(t *testing.T) {
+	const bucketRobots = "User-agent: *\nDisallow: /private/\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/with-robots/robots.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte(bucketRobots))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		bucket string
+		robots *robotsConfig
+		code   int
+		body   string
+	}{
+		{"with-robots", &robotsConfig{Disallow: []string{"/"}}, http.StatusOK, bucketRobots},
+		{"bucket", &robotsConfig{Disallow: []string{"/"}}, http.StatusOK, "User-agent: *\nDisallow: /\n"},
+		{"bucket", &robotsConfig{}, http.StatusOK, "User-agent: *\nDisallow:\n"},
+		{"bucket", &robotsConfig{Allow: []string{"/docs/"}, Disallow: []string{"/"}, Sitemap: "/sitemap.xml"}, http.StatusOK,
+			"User-agent: *\nAllow: /docs/\nDisallow: /\nSitemap: https://www.example.com/sitemap.xml\n"},
+		{"bucket", &robotsConfig{Content: "User-agent: bot\nDisallow: /tmp/", Sitemap: "https://cdn.example.com/sitemap.xml"}, http.StatusOK,
+			"User-agent: bot\nDisallow: /tmp/\nSitemap: https://cdn.example.com/sitemap.xml\n"},
+		{"bucket", nil, http.StatusNotFound, http.StatusText(http.StatusNotFound)},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {test.bucket}}
+			c.Robots = test.robots
+		})
+		req, _ := testInstance.NewRequest("GET", "/robots.txt", nil)
+		req.Host = "www.example.com"
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != test.code {
+			t.Errorf("%d: res.Code = %d; want %d", i, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%d: res.Body = %q; want %q", i, v, test.body)
+		}
+	}
+}
@@ -15,7 +15,13 @@
 package server
 
 import (
+	stdlog "log"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -28,62 +34,352 @@ import (
 // storage is used by the weasel server to serve GCS objects.
 var storage *weasel.Storage
 
+const (
+	// retryAfter is the retry-after header value in seconds
+	// of responses to requests failed due to transient storage errors.
+	retryAfter = 5
+	// defaultRequestTimeout is the default value of RequestTimeout.
+	defaultRequestTimeout = 10 * time.Second
+)
+
 func init() {
-	if err := readConfig(); err != nil {
+	name := configPath(os.Args[1:])
+	if validateOnly(os.Args[1:]) {
+		os.Exit(validateConfig(os.Stderr, name))
+	}
+	if err := readConfig(name); err != nil {
 		panic(err)
 	}
-	storage = &weasel.Storage{Base: config.GCSBase, Index: config.Index}
-	for host, redir := range config.Redirects {
-		http.Handle(host, redirectHandler(redir, http.StatusMovedPermanently))
+	c := currentConfig()
+	storage = &weasel.Storage{
+		Base:          c.GCSBase,
+		BucketBases:   c.bucketBases,
+		KeyTransforms: c.keyTransforms(),
+		Mirrors:       c.mirrors(),
+		Indexes:       c.Index["/"],
+		IndexPaths:    c.Index.objectPaths(),
+		MaxAttempts:   c.GCSMaxAttempts,
+	}
+	if c.StreamThreshold > 0 {
+		storage.StreamThreshold = c.StreamThreshold
+	}
+	storage.MaxInlineBytes = c.MaxInlineBytes
+	storage.Immutable = immutableObject
+	storage.ImmutableMaxBytes = c.ImmutableMaxBytes
+	storage.AcceptGzip = c.GzipPassthrough
+	storage.CoalesceFetches = c.CoalesceFetches
+	if c.Transport != nil {
+		storage.Transport = c.Transport.transport()
+	}
+	if c.Trace {
+		storage.Tracer = logTracer{}
+	}
+	if lc := c.LocalCache; lc != nil {
+		storage.Cache = weasel.NewLRU(lc.MaxBytes, lc.MaxEntryBytes)
+		storage.CacheTTL = time.Duration(lc.CacheTTL)
+		storage.StaleWhileRevalidate = time.Duration(lc.StaleWhileRevalidate)
+	}
+	if c.LocalRoot != "" {
+		storage.Backend = &weasel.DirBackend{Root: c.LocalRoot}
+		stdlog.Printf("warning: serving objects from local directory %s instead of GCS", c.LocalRoot)
+	}
+	storage.ObserveFetch = observeFetch
+	storage.ObjectChanged = objectChanged
+	if c.CheckBuckets {
+		ctx, cancel := context.WithTimeout(appengine.BackgroundContext(), 30*time.Second)
+		err := checkBuckets(ctx, c)
+		cancel()
+		if err != nil && c.CheckBucketsFatal {
+			panic(err)
+		}
+	}
+	if c.VerifyRedirectTargets {
+		ctx, cancel := context.WithTimeout(appengine.BackgroundContext(), 30*time.Second)
+		err := checkRedirectTargets(ctx, c)
+		cancel()
+		if err != nil && c.VerifyRedirectTargetsFatal {
+			panic(err)
+		}
+	}
+	objects := http.NewServeMux()
+	handleObjects(objects, c)
+	http.Handle("/", drain(requestHeaders(requestID(instrument(hsts(cspReportOnly(rateLimit(maintenance(canonical(basicAuth(redirectOr(rewrite(proxyOr(objects))))))))))))))
+	http.Handle(acmePath, drain(requestHeaders(requestID(instrument(hsts(http.HandlerFunc(serveACME)))))))
+	handlePassthroughPaths(http.DefaultServeMux, c)
+	http.HandleFunc(c.HookPath, serveHook)
+	http.HandleFunc(c.HealthPath, serveHealth)
+	if c.Metrics != nil {
+		http.HandleFunc(c.Metrics.Path, serveMetrics)
+	}
+	http.HandleFunc(warmupPath, serveWarmup)
+	http.HandleFunc(stopPath, serveStop)
+	http.HandleFunc(debugConfigPath, serveConfig)
+	http.HandleFunc(purgePath, servePurge)
+	http.Handle(cspReportPath, drain(requestID(instrument(rateLimit(http.HandlerFunc(serveCSPReport))))))
+	if c.SignPath != "" {
+		http.Handle(c.SignPath, drain(maintenance(http.HandlerFunc(serveSignedURL))))
+	}
+	if c.HealthPath != healthPathAppEngine {
+		http.HandleFunc(healthPathAppEngine, serveHealth)
 	}
-	http.HandleFunc(config.WebRoot, serveObject)
-	http.HandleFunc(config.HookPath, storage.HandleChangeHook)
+	if c.HookToken == "" {
+		stdlog.Printf("warning: hook_token is not set; %s accepts unauthenticated notifications", c.HookPath)
+	}
+	if c.ReloadInterval > 0 {
+		go watchConfig(appengine.BackgroundContext(), name)
+	}
+	stopOnSignal()
 }
 
 // serveObject responds with a GCS object contents, preserving its original headers
 // listed in objectHeaders.
-// The bucket is identifed by matching r.Host against config.Buckets map keys.
-// Default bucket is used if no match is found.
+// The bucket is identifed by resolveBuckets, unless overridden by a signed
+// request header; see overrideBuckets. If more than one is mapped,
+// the object is served from the first bucket which contains it.
 //
-// Only GET, HEAD and OPTIONS methods are allowed.
+// Only GET, HEAD and OPTIONS methods are allowed unless overridden by Methods;
+// see serveMethod, and serveOptions for the latter.
+// Request paths are cleaned by cleanPath; unsafe ones are rejected with 400.
 func serveObject(w http.ResponseWriter, r *http.Request) {
-	if !weasel.ValidMethod(r.Method) {
-		http.Error(w, "", http.StatusMethodNotAllowed)
+	var done bool
+	if r, done = serveMethod(w, r); done {
+		return
+	}
+	// the path is decoded exactly once, into the object name
+	raw := r.URL.EscapedPath()
+	p, ok := cleanPath(raw)
+	if !ok {
+		serveError(w, http.StatusBadRequest, "")
+		return
+	}
+	if p != raw {
+		r2, u := *r, *r.URL
+		u.Path, _ = url.PathUnescape(p)
+		u.RawPath = p
+		r2.URL = &u
+		r = &r2
+	}
+	addVary(w.Header(), currentConfig().vary()...)
+	if serveCORS(w, r) {
+		return
+	}
+	if serveTrailingSlash(w, r) {
 		return
 	}
 
+	buckets := overrideBuckets(r)
+	bucket := buckets.primary()
 	ctx := newContext(r)
-	bucket := bucketForHost(r.Host)
-	oname := r.URL.Path[1:]
+	oname, variant := queryVariant(ctx, r)
+	ctx = attributeRequest(ctx, w, bucket, oname)
+	if serveCanonicalIndex(ctx, w, r) {
+		return
+	}
+	if serveFavicon(ctx, w, r) {
+		return
+	}
+	if serveOptions(ctx, w, r, buckets, oname) {
+		return
+	}
+	if serveSitemap(ctx, w, r, bucket) {
+		return
+	}
+	if serveFeed(ctx, w, r, bucket) {
+		return
+	}
+	if !variant && serveNegotiated(ctx, w, r, bucket, oname) {
+		return
+	}
 
-	o, err := storage.ReadFile(ctx, bucket, oname)
-	if err != nil {
-		code := http.StatusInternalServerError
-		if errf, ok := err.(*weasel.FetchError); ok {
-			code = errf.Code
+	// find the bucket first, since other lookups don't fall back
+	var (
+		o   *weasel.Object
+		err error
+	)
+	if len(buckets) > 1 {
+		bucket, o, err = readChain(ctx, buckets, oname)
+		attributeRequest(ctx, w, bucket, oname)
+		if err != nil {
+			serveReadError(ctx, w, r, bucket, oname, err)
+			return
 		}
-		serveError(w, code, "")
-		if code != http.StatusNotFound {
-			log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+		// a streamed object may not be served below
+		defer o.Close()
+	}
+
+	// avoid fetching object contents if the client has an up to date copy
+	inm, ims := r.Header.Get("if-none-match"), r.Header.Get("if-modified-since")
+	if inm != "" || ims != "" {
+		if o, err := storageFrom(ctx).StatFile(ctx, bucket, oname); err == nil && o.NotModified(inm, ims) {
+			weasel.ServeNotModified(w, notModifiedObject(r, applyManifest(r.URL.Path, applyCacheControl(r.URL.Path, o))))
+			return
 		}
+	}
+
+	if noRangePath(r.URL.Path) {
+		w.Header().Set("accept-ranges", "none")
+	} else {
+		w.Header().Set("accept-ranges", "bytes")
+	}
+	if serveRange(ctx, w, r, bucket, oname) {
+		return
+	}
+	// pre-compressed siblings are looked up by plain object names only
+	if currentConfig().NegotiateEncodings && !variant && serveEncoded(ctx, w, r, bucket, oname) {
+		return
+	}
+	if o == nil && serveHead(ctx, w, r, bucket, oname) {
+		return
+	}
+
+	if o == nil {
+		o, err = readDir(ctx, bucket, oname)
+	}
+	if err != nil {
+		serveReadError(ctx, w, r, bucket, oname, err)
 		return
 	}
 
+	o = applyContentType(storageFrom(ctx).FileName(oname), o)
+	o = applyManifest(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	if noRangeType(o.Meta["content-type"]) {
+		w.Header().Set("accept-ranges", "none")
+	}
+	if o.NotModified(inm, ims) {
+		weasel.ServeNotModified(w, notModifiedObject(r, o))
+		return
+	}
+	o = applyHeaders(r.URL.Path, applyPreload(r.URL.Path, compressObject(w, r, rewriteHTML(r, applyDownload(r.URL.Path, o)))))
 	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
 		log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+		abortTimedOut(ctx)
+	}
+}
+
+// abortTimedOut aborts the response by closing the client connection
+// if ctx deadline has been exceeded, e.g. while streaming an object body,
+// so that the client does not take a truncated body as complete.
+func abortTimedOut(ctx context.Context) {
+	if ctx.Err() == context.DeadlineExceeded {
+		panic(http.ErrAbortHandler)
 	}
 }
 
+// serveReadError responds to a failed read of the bucket object oname.
+// Reads exceeding the request deadline result in 504 status code.
+// Transient storage errors result in 503 status code with retry-after header.
+// Responses with 5xx status codes are served by serveServerError.
+// Missing objects are handled by serveNoFavicon, serveRobots, serveAutoIndex,
+// serveNotFoundRedirect, serveSPA or serveNotFound, in that order, if enabled.
+func serveReadError(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, oname string, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Errorf(ctx, "%s/%s: timeout: %v", bucket, oname, err)
+		serveServerError(ctx, w, r, bucket, http.StatusGatewayTimeout)
+		return
+	}
+	if weasel.IsTransient(err) {
+		log.Errorf(ctx, "%s/%s: transient: %v", bucket, oname, err)
+		w.Header().Set("retry-after", strconv.Itoa(retryAfter))
+		serveServerError(ctx, w, r, bucket, http.StatusServiceUnavailable)
+		return
+	}
+	code := http.StatusInternalServerError
+	if errf, ok := err.(*weasel.FetchError); ok {
+		code = errf.Code
+	}
+	if code == http.StatusNotFound && (serveNoFavicon(w, r) || serveRobots(w, r) || serveAutoIndex(ctx, w, r, bucket, oname) ||
+		serveNotFoundRedirect(w, r) || serveSPA(ctx, w, r, bucket) || serveNotFound(ctx, w, r, bucket)) {
+		return
+	}
+	if code != http.StatusNotFound {
+		log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+	}
+	if code >= 500 {
+		serveServerError(ctx, w, r, bucket, code)
+		return
+	}
+	serveError(w, code, "")
+}
+
+// serveServerError responds with the ServerError object of the current config
+// from the bucket and 5xx status code, or a plain text response if it is not
+// set or cannot be read, e.g. within an exceeded deadline of ctx.
+func serveServerError(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string, code int) {
+	name := currentConfig().ServerError
+	if name == "" {
+		serveError(w, code, "")
+		return
+	}
+	o, err := storageFrom(ctx).ReadObject(ctx, bucket, strings.TrimPrefix(name, "/"))
+	if err != nil {
+		log.Errorf(ctx, "%s%s: %v", bucket, name, err)
+		serveError(w, code, "")
+		return
+	}
+	// the page must not be cached in place of the requested URL
+	o = cloneObject(applyContentType(name, o))
+	o.Meta["cache-control"] = "no-store"
+	if err := weasel.ServeObjectCode(w, o, code, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s%s: %v", bucket, name, err)
+	}
+}
+
+// cloneObject returns a copy of o with its own Meta map.
+// The body and stream are shared.
+func cloneObject(o *weasel.Object) *weasel.Object {
+	meta := make(map[string]string, len(o.Meta)+1)
+	for k, v := range o.Meta {
+		meta[k] = v
+	}
+	return &weasel.Object{Meta: meta, Body: o.Body, Stream: o.Stream}
+}
+
 // redirectHandler creates a new handler which redirects all requests
 // to the specified url, preserving original path and raw query.
 func redirectHandler(url string, code int) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		u := url + r.URL.Path
-		if r.URL.RawQuery != "" {
-			u += "?" + r.URL.RawQuery
+	return redirect{To: url, Code: code}
+}
+
+// serveSPA responds with the index object from the bucket root
+// if the current config SPAFallback is enabled and r accepts HTML.
+// It returns false if no response was written.
+func serveSPA(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string) bool {
+	if !currentConfig().SPAFallback || !strings.Contains(r.Header.Get("accept"), "text/html") {
+		return false
+	}
+	index := storageFrom(ctx).FileName("")
+	o, err := storageFrom(ctx).ReadFile(ctx, bucket, "")
+	if err != nil {
+		log.Errorf(ctx, "%s/%s: %v", bucket, index, err)
+		return false
+	}
+	o = applyHeaders(r.URL.Path, applyPreload(r.URL.Path, rewriteHTML(r, applyContentType(index, o))))
+	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s/%s: %v", bucket, index, err)
+	}
+	return true
+}
+
+// serveNotFound responds with the NotFound object of the request host
+// from the bucket and 404 status code.
+// It returns false if no response was written, e.g. the object does not exist.
+func serveNotFound(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string) bool {
+	name := currentConfig().notFound(r.Host)
+	if name == "" {
+		return false
+	}
+	o, err := storageFrom(ctx).ReadObject(ctx, bucket, strings.TrimPrefix(name, "/"))
+	if err != nil {
+		if errf, ok := err.(*weasel.FetchError); !ok || errf.Code != http.StatusNotFound {
+			log.Errorf(ctx, "%s%s: %v", bucket, name, err)
 		}
-		http.Redirect(w, r, u, code)
-	})
+		return false
+	}
+	o = applyHeaders(r.URL.Path, applyContentType(name, o))
+	if err := weasel.ServeObjectCode(w, o, http.StatusNotFound, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s%s: %v", bucket, name, err)
+	}
+	return true
 }
 
 func serveError(w http.ResponseWriter, code int, msg string) {
@@ -95,19 +391,95 @@ func serveError(w http.ResponseWriter, code int, msg string) {
 	w.Write([]byte(msg))
 }
 
-// bucketForHost returns a bucket name mapped to the host.
-// Default bucket name is return if no match found.
-func bucketForHost(host string) string {
-	if b, ok := config.Buckets[host]; ok {
+// cleanPath collapses duplicate slashes and "." segments of escaped request
+// path p, see url.URL.EscapedPath, keeping a trailing slash, if any.
+// Only literal "/" separates segments, so that an encoded %2F is kept within
+// its segment as part of the object name. It reports false if p does not
+// start with "/", is malformed, or contains ".." segments once decoded,
+// including %2e%2e and those formed with %2F, which could otherwise map p
+// to an object outside of the requested "directory".
+func cleanPath(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		d, err := url.PathUnescape(s)
+		if err != nil {
+			return "", false
+		}
+		for _, ds := range strings.Split(d, "/") {
+			if ds == ".." {
+				return "", false
+			}
+		}
+		if d == "." {
+			segs[i] = "."
+		}
+	}
+	c := path.Clean(strings.Join(segs, "/"))
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+	return c, true
+}
+
+// resolveBuckets returns buckets mapped to the host and request path.
+// The longest of the current config BucketPaths prefixes matching host and path
+// takes precedence over the Buckets host mapping, where an exact host key
+// takes precedence over a wildcard one, e.g. "*.preview.goa.design",
+// which matches a single label subdomain only.
+// Default buckets are returned if no match found.
+// Sites entries of host replace the global mappings. See appConfig.site.
+func resolveBuckets(host, path string) bucketList {
+	c := currentConfig().site(host)
+	var (
+		buckets bucketList
+		n       int
+	)
+	for k, b := range c.BucketPaths {
+		p := strings.TrimSuffix(k, "*")
+		if len(p) > n && strings.HasPrefix(host+path, p) {
+			buckets, n = b, len(p)
+		}
+	}
+	if len(buckets) > 0 {
+		return buckets
+	}
+	if b, ok := c.Buckets[host]; ok {
 		return b
 	}
-	return config.Buckets["default"]
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		if b, ok := c.Buckets["*"+host[i:]]; ok {
+			return b
+		}
+	}
+	return c.Buckets["default"]
+}
+
+// resolveBucket returns the primary bucket of resolveBuckets.
+func resolveBucket(host, path string) string {
+	return resolveBuckets(host, path).primary()
 }
 
-// newContext creates a new context from a client in-flight request.
+// newContext creates a new context from a client in-flight request,
+// with the current config RequestTimeout deadline.
 // It should not be used for server-to-server, such as web hooks.
+// The request trace context is propagated to GCS if tracing is enabled,
+// and the context carries the request ID and host storage.
+// See requestIDFrom and storageFrom.
 func newContext(r *http.Request) context.Context {
 	c := appengine.NewContext(r)
-	c, _ = context.WithTimeout(c, 10*time.Second)
-	return c
+	timeout := time.Duration(currentConfig().RequestTimeout)
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	c, _ = context.WithTimeout(c, timeout)
+	if tc := r.Header.Get(weasel.TraceHeader); tc != "" && storage.Tracer != nil {
+		c = weasel.WithTraceContext(c, tc)
+	}
+	if id := r.Header.Get(currentConfig().requestIDHeader()); id != "" {
+		c = context.WithValue(c, requestIDKey{}, id)
+	}
+	return withHostStorage(c, r.Host)
 }
@@ -15,10 +15,19 @@
 package server
 
 import (
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/goadesign/goa.design/appengine"
 
@@ -27,7 +36,7 @@ import (
 )
 
 func TestServerConfig(t *testing.T) {
-	if b := config.Buckets["default"]; b == "" {
+	if b := config.Buckets["default"].primary(); b == "" {
 		t.Errorf("want default bucket in %+v", config)
 	}
 }
@@ -91,7 +100,7 @@ func TestServe_DefaultGCS(t *testing.T) {
 	}))
 	defer ts.Close()
 	storage.Base = ts.URL
-	config.Buckets = map[string]string{"default": bucket}
+	config.Buckets = map[string]bucketList{"default": {bucket}}
 
 	req, _ := testInstance.NewRequest("GET", reqFile, nil)
 	req.Header.Set("accept-encoding", "client/accept")
@@ -109,8 +118,8 @@ func TestServe_DefaultGCS(t *testing.T) {
 	if v := res.Header().Get("cache-control"); v != cacheControl {
 		t.Errorf("cache-control = %q; want %q", v, cacheControl)
 	}
-	if v := res.Header().Get("content-type"); v != contentType {
-		t.Errorf("content-type = %q; want %q", v, contentType)
+	if v, want := res.Header().Get("content-type"), contentType+"; charset=utf-8"; v != want {
+		t.Errorf("content-type = %q; want %q", v, want)
 	}
 	if v := res.Header().Get("x-test"); v != "" {
 		t.Errorf("found x-test header: %q", v)
@@ -127,14 +136,14 @@ func TestServe_Methods(t *testing.T) {
 	}))
 	defer ts.Close()
 	storage.Base = ts.URL
-	config.Buckets = map[string]string{"default": "bucket"}
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
 
 	tests := []struct {
 		method, body string
 		code         int
 	}{
 		{"HEAD", "", http.StatusOK},
-		{"OPTIONS", "", http.StatusOK},
+		{"OPTIONS", "", http.StatusNoContent},
 		// it is important that GET comes last to verify requests like HEAD
 		// do not corrupt object cache
 		{"GET", "methods test", http.StatusOK},
@@ -167,7 +176,7 @@ func TestServe_Memcache(t *testing.T) {
 	// make sure we don't hit real GCS
 	storage.Base = "invalid"
 	// overwrite global config
-	config.Buckets = map[string]string{"default": bucket}
+	config.Buckets = map[string]bucketList{"default": {bucket}}
 
 	req, _ := testInstance.NewRequest("GET", "/"+file, nil)
 	ctx := appengine.NewContext(req)
@@ -194,8 +203,8 @@ func TestServe_Memcache(t *testing.T) {
 	if v := res.Header().Get("cache-control"); v != cacheControl {
 		t.Errorf("cache-control = %q; want %q", v, cacheControl)
 	}
-	if v := res.Header().Get("content-type"); v != contentType {
-		t.Errorf("content-type = %q; want %q", v, contentType)
+	if v, want := res.Header().Get("content-type"), contentType+"; charset=utf-8"; v != want {
+		t.Errorf("content-type = %q; want %q", v, want)
 	}
 	if s := res.Body.String(); s != contents {
 		t.Errorf("res.Body = %q; want %q", s, contents)
@@ -234,7 +243,7 @@ func TestServe_NoTrailSlash(t *testing.T) {
 	}))
 	defer ts.Close()
 	storage.Base = ts.URL
-	config.Buckets = map[string]string{"default": "bucket"}
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
 
 	req, _ := testInstance.NewRequest("GET", "/dir-one/two", nil)
 	// make sure we're not getting memcached results
@@ -253,30 +262,920 @@ func TestServe_NoTrailSlash(t *testing.T) {
 }
 
 func TestHook(t *testing.T) {
+	storage.Cache = weasel.NewLRU(1024, 0)
+	defer func() { storage.Cache = nil }()
 	body := `{"bucket": "dummy", "name": "path/obj"}`
 	cacheKey := storage.CacheKey("dummy", "path/obj")
-	req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
-	ctx := appengine.NewContext(req)
-	item := &memcache.Item{Key: cacheKey, Value: []byte("ignored")}
-	if err := memcache.Set(ctx, item); err != nil {
-		t.Fatal(err)
+
+	for _, state := range []string{"exists", "not_exists"} {
+		req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+		req.Header.Set("x-goog-resource-state", state)
+		ctx := appengine.NewContext(req)
+		item := &memcache.Item{Key: cacheKey, Value: []byte("ignored")}
+		if err := memcache.Set(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		storage.Cache.Add(cacheKey, &weasel.Object{Body: []byte("ignored")})
+
+		// must remove cached item
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: res.Code = %d; want %d", state, res.Code, http.StatusOK)
+		}
+		if _, err := memcache.Get(ctx, cacheKey); err != memcache.ErrCacheMiss {
+			t.Fatalf("%s: memcache.Get(%q): %v; want ErrCacheMiss", state, cacheKey, err)
+		}
+		if _, ok := storage.Cache.Get(cacheKey); ok {
+			t.Errorf("%s: found %q in local cache", state, cacheKey)
+		}
 	}
 
-	// must remove cached item
+	// cache misses must not respond with an error code
+	req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
+	req.Header.Set("x-goog-resource-state", "exists")
 	res := httptest.NewRecorder()
 	http.DefaultServeMux.ServeHTTP(res, req)
 	if res.Code != http.StatusOK {
 		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusOK)
 	}
-	if _, err := memcache.Get(ctx, cacheKey); err != memcache.ErrCacheMiss {
-		t.Fatalf("memcache.Get(%q): %v; want ErrCacheMiss", cacheKey, err)
+
+	// unrelated requests
+	tests := []struct{ state, body string }{
+		{"", body},
+		{"unknown", body},
+		{"exists", "not json"},
+		{"exists", `{"bucket": "dummy"}`},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(test.body))
+		if test.state != "" {
+			req.Header.Set("x-goog-resource-state", test.state)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("%q %q: res.Code = %d; want %d", test.state, test.body, res.Code, http.StatusBadRequest)
+		}
 	}
+}
 
-	// cache misses must not respond with an error code
-	req, _ = testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(body))
-	res = httptest.NewRecorder()
+// withConfig replaces the current config with a copy modified by edit.
+// The returned function restores the original config.
+func withConfig(edit func(c *appConfig)) (restore func()) {
+	orig := currentConfig()
+	c := *orig
+	edit(&c)
+	setConfig(&c)
+	return func() { setConfig(orig) }
+}
+
+func TestServe_NotFound(t *testing.T) {
+	const notFound = "custom not found"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/404.html" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "text/html")
+		w.Write([]byte(notFound))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		notFound string
+		body     string
+		ctype    string
+	}{
+		{"/404.html", notFound, "text/html; charset=utf-8"},
+		{"/missing.html", http.StatusText(http.StatusNotFound), ""},
+		{"", http.StatusText(http.StatusNotFound), ""},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.NotFound = test.notFound
+		})
+		req, _ := testInstance.NewRequest("GET", "/no-such-file.txt", nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != http.StatusNotFound {
+			t.Errorf("%q: res.Code = %d; want %d", test.notFound, res.Code, http.StatusNotFound)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%q: res.Body = %q; want %q", test.notFound, v, test.body)
+		}
+		if v := res.Header().Get("content-type"); test.ctype != "" && v != test.ctype {
+			t.Errorf("%q: content-type = %q; want %q", test.notFound, v, test.ctype)
+		}
+	}
+}
+
+// errBackend is a weasel.Backend failing to open objects listed in errs.
+type errBackend struct {
+	weasel.MemBackend
+	errs map[string]error
+}
+
+func (b *errBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*weasel.ObjectReader, error) {
+	if err := b.errs[name]; err != nil {
+		return nil, err
+	}
+	return b.MemBackend.Open(ctx, bucket, name, h)
+}
+
+func TestServe_ServerError(t *testing.T) {
+	const page = "<h1>oops</h1>"
+	b := &errBackend{errs: map[string]error{
+		"broken.txt":  errors.New("connection reset"),
+		"denied.txt":  &weasel.FetchError{Msg: "403 Forbidden", Code: http.StatusForbidden},
+		"down.txt":    &weasel.FetchError{Msg: "503 Service Unavailable", Code: http.StatusServiceUnavailable},
+		"broken.html": errors.New("connection reset"),
+	}}
+	b.Put("bucket", "500.html", []byte(page), map[string]string{"content-type": "text/html"})
+	defer func(orig weasel.Backend) { storage.Backend = orig }(storage.Backend)
+	storage.Backend = b
+
+	tests := []struct {
+		serverError, path string
+		code              int
+		body              string
+	}{
+		// transport errors are transient
+		{"/500.html", "/broken.txt", http.StatusServiceUnavailable, page},
+		{"/500.html", "/down.txt", http.StatusServiceUnavailable, page},
+		{"/500.html", "/denied.txt", http.StatusForbidden, http.StatusText(http.StatusForbidden)},
+		{"/500.html", "/missing.txt", http.StatusNotFound, http.StatusText(http.StatusNotFound)},
+		{"/broken.html", "/broken.txt", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)},
+		{"/missing.html", "/broken.txt", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)},
+		{"", "/broken.txt", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.ServerError = test.serverError
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != test.code {
+			t.Errorf("%q %s: res.Code = %d; want %d", test.serverError, test.path, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%q %s: res.Body = %q; want %q", test.serverError, test.path, v, test.body)
+		}
+		if v := res.Header().Get("cache-control"); test.body == page && v != "no-store" {
+			t.Errorf("%q %s: cache-control = %q; want no-store", test.serverError, test.path, v)
+		}
+	}
+
+	defer withConfig(func(c *appConfig) { c.ServerError = "/500.html" })()
+	req, _ := testInstance.NewRequest("GET", "/broken.txt", nil)
+	res := httptest.NewRecorder()
+	serveServerError(newContext(req), res, req, "bucket", http.StatusInternalServerError)
+	if res.Code != http.StatusInternalServerError || res.Body.String() != page {
+		t.Errorf("serveServerError(500): res.Code = %d, res.Body = %q; want 500, %q", res.Code, res.Body, page)
+	}
+}
+
+func TestServe_SPAFallback(t *testing.T) {
+	const index = "spa index"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/spa-bucket/index.html":
+			w.Header().Set("content-type", "text/html")
+			w.Write([]byte(index))
+		case "/other-bucket/index.html":
+			w.Write([]byte("wrong bucket"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"other-bucket"}, "spa.example.com": {"spa-bucket"}}
+		c.SPAFallback = true
+	})()
+
+	tests := []struct {
+		path, accept string
+		code         int
+		body         string
+	}{
+		{"/dashboard/settings", "text/html,application/xhtml+xml,*/*;q=0.8", http.StatusOK, index},
+		{"/api/items", "application/json", http.StatusNotFound, http.StatusText(http.StatusNotFound)},
+		{"/app.js", "*/*", http.StatusNotFound, http.StatusText(http.StatusNotFound)},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = "spa.example.com"
+		req.Header.Set("accept", test.accept)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, v, test.body)
+		}
+	}
+}
+
+func TestServe_IfNoneMatch(t *testing.T) {
+	const etag = `"v1"`
+	var gets int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets++
+		}
+		w.Header().Set("etag", etag)
+		w.Header().Set("cache-control", "public,max-age=60")
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	tests := []struct {
+		inm  string
+		code int
+		body string
+		gets int
+	}{
+		{etag, http.StatusNotModified, "", 0},
+		{`"v0", ` + etag, http.StatusNotModified, "", 0},
+		{`"v0"`, http.StatusOK, "contents", 1},
+		{"", http.StatusOK, "contents", 1},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/file.txt", nil)
+		req.Header.Set("if-none-match", test.inm)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		gets = 0
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q: res.Code = %d; want %d", test.inm, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%q: res.Body = %q; want %q", test.inm, v, test.body)
+		}
+		if gets != test.gets {
+			t.Errorf("%q: GCS GET requests = %d; want %d", test.inm, gets, test.gets)
+		}
+		if v := res.Header().Get("etag"); v != etag {
+			t.Errorf("%q: etag = %q; want %q", test.inm, v, etag)
+		}
+		if v := res.Header().Get("cache-control"); v == "" {
+			t.Errorf("%q: want cache-control header", test.inm)
+		}
+	}
+}
+
+func TestServe_IfModifiedSince(t *testing.T) {
+	const (
+		etag    = `"v1"`
+		lastMod = "Sat, 02 Jan 2016 03:04:05 GMT"
+	)
+	var gets int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets++
+		}
+		w.Header().Set("etag", etag)
+		w.Header().Set("last-modified", lastMod)
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	tests := []struct {
+		inm, ims string
+		code     int
+		gets     int
+	}{
+		{"", lastMod, http.StatusNotModified, 0},
+		{"", "Sun, 03 Jan 2016 00:00:00 GMT", http.StatusNotModified, 0},
+		{"", "Fri, 01 Jan 2016 00:00:00 GMT", http.StatusOK, 1},
+		{"", "yesterday", http.StatusOK, 1},
+		// If-None-Match takes precedence
+		{`"v0"`, lastMod, http.StatusOK, 1},
+		{etag, "Fri, 01 Jan 2016 00:00:00 GMT", http.StatusNotModified, 0},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/file.txt", nil)
+		if test.inm != "" {
+			req.Header.Set("if-none-match", test.inm)
+		}
+		req.Header.Set("if-modified-since", test.ims)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		gets = 0
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q, %q: res.Code = %d; want %d", test.inm, test.ims, res.Code, test.code)
+		}
+		if gets != test.gets {
+			t.Errorf("%q, %q: GCS GET requests = %d; want %d", test.inm, test.ims, gets, test.gets)
+		}
+		if v := res.Header().Get("last-modified"); v != lastMod {
+			t.Errorf("%q, %q: last-modified = %q; want %q", test.inm, test.ims, v, lastMod)
+		}
+		if v := res.Header().Get("etag"); v != etag {
+			t.Errorf("%q, %q: etag = %q; want %q", test.inm, test.ims, v, etag)
+		}
+	}
+}
+
+func TestServe_Range(t *testing.T) {
+	const contents = "0123456789"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/pdf")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(contents))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	tests := []struct {
+		rng          string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"bytes=-2", http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, http.StatusText(http.StatusRequestedRangeNotSatisfiable), "bytes */10"},
+		// multiple and invalid ranges fall back to full object
+		{"bytes=0-1,4-5", http.StatusOK, contents, ""},
+		{"bytes=5-2", http.StatusOK, contents, ""},
+		{"", http.StatusOK, contents, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/doc.pdf", nil)
+		req.Header.Set("range", test.rng)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%q: res.Code = %d; want %d", test.rng, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%q: res.Body = %q; want %q", test.rng, v, test.body)
+		}
+		if v := res.Header().Get("content-range"); v != test.contentRange {
+			t.Errorf("%q: content-range = %q; want %q", test.rng, v, test.contentRange)
+		}
+		if v := res.Header().Get("accept-ranges"); v != "bytes" {
+			t.Errorf("%q: accept-ranges = %q; want bytes", test.rng, v)
+		}
+		if test.code == http.StatusPartialContent {
+			if v := res.Header().Get("content-length"); v != strconv.Itoa(len(test.body)) {
+				t.Errorf("%q: content-length = %q; want %d", test.rng, v, len(test.body))
+			}
+		}
+	}
+}
+
+func TestResolveBucket(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{
+			"default":                 {"default-bucket"},
+			"example.com":             {"host-bucket"},
+			"*.preview.goa.design":    {"preview"},
+			"pr-1.preview.goa.design": {"pr-1"},
+		}
+		c.BucketPaths = map[string]bucketList{
+			"example.com/assets/":      {"assets"},
+			"example.com/assets/img/*": {"images"},
+			"other.com/assets/":        {"other-assets"},
+		}
+	})()
+	tests := []struct{ host, path, bucket string }{
+		{"example.com", "/assets/app.css", "assets"},
+		{"example.com", "/assets/img/logo.png", "images"},
+		{"example.com", "/assets", "host-bucket"},
+		{"example.com", "/index.html", "host-bucket"},
+		{"other.com", "/assets/app.css", "other-assets"},
+		{"other.com", "/index.html", "default-bucket"},
+		{"unknown.com", "/assets/app.css", "default-bucket"},
+		// wildcard hosts
+		{"pr-2.preview.goa.design", "/index.html", "preview"},
+		{"pr-1.preview.goa.design", "/index.html", "pr-1"},
+		{"a.pr-2.preview.goa.design", "/index.html", "default-bucket"},
+		{"preview.goa.design", "/index.html", "default-bucket"},
+		{".preview.goa.design", "/index.html", "default-bucket"},
+	}
+	for _, test := range tests {
+		if v := resolveBucket(test.host, test.path); v != test.bucket {
+			t.Errorf("resolveBucket(%q, %q) = %q; want %q", test.host, test.path, v, test.bucket)
+		}
+	}
+}
+
+func TestServe_BucketChain(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/new/both.txt", "/new/new.txt":
+			w.Write([]byte("new"))
+		case "/old/both.txt", "/old/old.txt":
+			w.Write([]byte("old"))
+		case "/new/broken.txt":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"new", "old"}}
+	})()
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/both.txt", http.StatusOK, "new"},
+		{"/new.txt", http.StatusOK, "new"},
+		{"/old.txt", http.StatusOK, "old"},
+		{"/missing.txt", http.StatusNotFound, http.StatusText(http.StatusNotFound)},
+		// transport and server errors don't fall through
+		{"/broken.txt", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, v, test.body)
+		}
+	}
+}
+
+func TestServe_BucketBases(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/site/page.txt" && r.URL.Path != "/site/both.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("gcs"))
+	}))
+	defer gcs.Close()
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/assets/app.css" && r.URL.Path != "/assets/both.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("cdn"))
+	}))
+	defer cdn.Close()
+	storage.Base = gcs.URL
+	defer func(m map[string]string) { storage.BucketBases = m }(storage.BucketBases)
+	storage.BucketBases = map[string]string{"assets": cdn.URL}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{
+			"default":         {"site"},
+			"cdn.example.com": {"assets"},
+			"example.com":     {"assets", "site"},
+		}
+	})()
+
+	tests := []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{"goa.design", "/page.txt", http.StatusOK, "gcs"},
+		{"cdn.example.com", "/app.css", http.StatusOK, "cdn"},
+		{"cdn.example.com", "/page.txt", http.StatusNotFound, http.StatusText(http.StatusNotFound)},
+		// bucket chain across bases
+		{"example.com", "/both.txt", http.StatusOK, "cdn"},
+		{"example.com", "/page.txt", http.StatusOK, "gcs"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s%s: res.Code = %d; want %d", test.host, test.path, res.Code, test.code)
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s%s: res.Body = %q; want %q", test.host, test.path, v, test.body)
+		}
+	}
+	// objects of the same name are cached apart
+	if k1, k2 := storage.CacheKey("assets", "a"), storage.CacheKey("site", "a"); k1 != cdn.URL+"/assets/a" || k2 != gcs.URL+"/site/a" {
+		t.Errorf("CacheKey = %q, %q; want bucket base prefixes", k1, k2)
+	}
+}
+
+func TestServe_TransientError(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+	orig := *storage
+	storage.MaxAttempts, storage.RetryBackoff = 2, time.Millisecond
+	defer func() { storage.MaxAttempts, storage.RetryBackoff = orig.MaxAttempts, orig.RetryBackoff }()
+
+	req, _ := testInstance.NewRequest("GET", "/TestServe_TransientError.txt", nil)
+	res := httptest.NewRecorder()
 	http.DefaultServeMux.ServeHTTP(res, req)
-	if res.Code != http.StatusOK {
-		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusOK)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusServiceUnavailable)
+	}
+	if v := res.Header().Get("retry-after"); v != strconv.Itoa(retryAfter) {
+		t.Errorf("retry-after = %q; want %d", v, retryAfter)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d; want 2", requests)
+	}
+}
+
+func TestServe_Stream(t *testing.T) {
+	body := strings.Repeat("<p>streamed</p>", 1000)
+	var gets int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		w.Header().Set("content-type", "text/html")
+		w.Header().Set("content-length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	storage.StreamThreshold = 1024
+	defer func() { storage.StreamThreshold = defaultStreamThreshold }()
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	for i := 0; i < 2; i++ {
+		req, _ := testInstance.NewRequest("GET", "/big.html", nil)
+		req.Header.Set("accept-encoding", "gzip")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%d: res.Code = %d; want 200", i, res.Code)
+		}
+		if v := res.Body.String(); v != body {
+			t.Errorf("%d: res.Body is %d bytes; want %d", i, len(v), len(body))
+		}
+		if v := res.Header().Get("content-encoding"); v != "" {
+			t.Errorf("%d: content-encoding = %q; want none", i, v)
+		}
+		if v := res.Header().Get("content-length"); v != strconv.Itoa(len(body)) {
+			t.Errorf("%d: content-length = %q; want %d", i, v, len(body))
+		}
+	}
+	if gets != 2 {
+		t.Errorf("gets = %d; want 2", gets)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"/", "/", true},
+		{"/a/b.html", "/a/b.html", true},
+		{"//double//slash", "/double/slash", true},
+		{"/dir//", "/dir/", true},
+		{"///", "/", true},
+		{"/./a/./b.txt", "/a/b.txt", true},
+		{"/a/.", "/a", true},
+		{"/a..b/c..", "/a..b/c..", true},
+		{"/a%2F%2Fb", "/a%2F%2Fb", true},
+		{"/%2e/a/%2E/b.txt", "/a/b.txt", true},
+		{"/hello%20world.html", "/hello%20world.html", true},
+		{"/a/%2e%2e/b", "", false},
+		{"/a%2F..%2Fb", "", false},
+		{"/bad%zz", "", false},
+		{"/../secrets/config.json", "", false},
+		{"/a/../../b", "", false},
+		{"/a/..", "", false},
+		{"/..", "", false},
+		{"relative", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		out, ok := cleanPath(test.in)
+		if out != test.out || ok != test.ok {
+			t.Errorf("cleanPath(%q) = %q, %v; want %q, %v", test.in, out, ok, test.out, test.ok)
+		}
+	}
+}
+
+func TestServeObject_CleanPath(t *testing.T) {
+	var names []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.URL.Path)
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	tests := []struct {
+		url  string
+		code int
+		name string // GCS object requested, if any
+	}{
+		{"/../secrets/config.json", http.StatusBadRequest, ""},
+		{"/a/%2e%2e/%2E%2E/secrets/config.json", http.StatusBadRequest, ""},
+		{"/a%2F..%2F..%2Fsecrets.json", http.StatusBadRequest, ""},
+		{"/double//slash///file.txt", http.StatusOK, "/bucket/double/slash/file.txt"},
+		{"/dir//", http.StatusOK, "/bucket/dir/index.html"},
+		{"/./file.txt", http.StatusOK, "/bucket/file.txt"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/", nil)
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL = u
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		names = nil
+		res := httptest.NewRecorder()
+		serveObject(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.url, res.Code, test.code)
+		}
+		if test.name == "" && len(names) > 0 {
+			t.Errorf("%s: GCS requests = %v; want none", test.url, names)
+		}
+		if test.name != "" && (len(names) == 0 || names[0] != test.name) {
+			t.Errorf("%s: GCS requests = %v; want %s", test.url, names, test.name)
+		}
+	}
+}
+
+func TestServeObject_EncodedNames(t *testing.T) {
+	var names, raw []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.URL.Path)
+		raw = append(raw, r.URL.EscapedPath())
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+	})()
+
+	tests := []struct {
+		url       string
+		name, raw string // GCS object requested and its escaped URL path
+	}{
+		{"/posts/hello%20world.html", "/bucket/posts/hello world.html", "/bucket/posts/hello%20world.html"},
+		{"/posts/hello world.html", "/bucket/posts/hello world.html", "/bucket/posts/hello%20world.html"},
+		{"/a+b.txt", "/bucket/a+b.txt", "/bucket/a%2Bb.txt"},
+		{"/a%2Bb.txt", "/bucket/a+b.txt", "/bucket/a%2Bb.txt"},
+		{"/img/caf%C3%A9.png", "/bucket/img/café.png", "/bucket/img/caf%C3%A9.png"},
+		{"/img/café.png", "/bucket/img/café.png", "/bucket/img/caf%C3%A9.png"},
+		{"/a%2F%2Fb.txt", "/bucket/a//b.txt", "/bucket/a//b.txt"},
+		{"/100%25.txt", "/bucket/100%.txt", "/bucket/100%25.txt"},
+		{"/what%3F.txt", "/bucket/what?.txt", "/bucket/what%3F.txt"},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/", nil)
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL = u
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		storage.Cache.RemovePrefix("")
+		names, raw = nil, nil
+		res := httptest.NewRecorder()
+		serveObject(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: res.Code = %d; want 200", test.url, res.Code)
+		}
+		if len(names) != 1 || names[0] != test.name || raw[0] != test.raw {
+			t.Errorf("%s: GCS requests = %q (%q); want %q (%q)", test.url, names, raw, test.name, test.raw)
+		}
+	}
+}
+
+func TestServe_LocalRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{
+		"index.html":      "<p>home</p>",
+		"docs/index.html": "<p>docs</p>",
+		"css/site.css":    "a{}",
+	} {
+		fname := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = &weasel.DirBackend{Root: dir}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.LocalRoot = dir
+		c.Redirects = map[string]redirect{"/old": {To: "/docs"}}
+		c.redirectPrefixes = c.buildRedirects()
+	})()
+
+	tests := []struct {
+		path     string
+		code     int
+		body     string
+		ctype    string
+		location string
+	}{
+		{"/", http.StatusOK, "<p>home</p>", "text/html; charset=utf-8", ""},
+		{"/docs/", http.StatusOK, "<p>docs</p>", "text/html; charset=utf-8", ""},
+		{"/css/site.css", http.StatusOK, "a{}", "text/css; charset=utf-8", ""},
+		{"/docs", http.StatusMovedPermanently, "", "", "/docs/"},
+		{"/old", http.StatusMovedPermanently, "", "", "/docs/old"},
+		{"/missing.html", http.StatusNotFound, "", "", ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		storage.Cache.RemovePrefix("")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s: res.Code = %d; want %d", test.path, res.Code, test.code)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%s: res.Body = %q; want %q", test.path, res.Body, test.body)
+		}
+		if v := res.Header().Get("content-type"); test.ctype != "" && v != test.ctype {
+			t.Errorf("%s: content-type = %q; want %q", test.path, v, test.ctype)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%s: location = %q; want %q", test.path, v, test.location)
+		}
+	}
+
+	req, _ := testInstance.NewRequest("GET", "/-/sign?object=/css/site.css", nil)
+	res := httptest.NewRecorder()
+	serveSignedURL(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("sign: res.Code = %d; want 404", res.Code)
+	}
+}
+
+func TestServe_MaxInlineBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "0123456789"
+		if r.URL.Path == "/bucket/over.txt" {
+			body += "!"
+		}
+		w.Header().Set("content-length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	storage.StreamThreshold, storage.MaxInlineBytes = 0, 10
+	defer func() { storage.StreamThreshold, storage.MaxInlineBytes = defaultStreamThreshold, 0 }()
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+
+	for path, code := range map[string]int{
+		"/under.txt": http.StatusOK,
+		"/over.txt":  http.StatusRequestEntityTooLarge,
+	} {
+		req, _ := testInstance.NewRequest("GET", path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != code {
+			t.Errorf("%s: res.Code = %d; want %d", path, res.Code, code)
+		}
+	}
+}
+
+// slowBackend is a weasel.Backend stalling until the request deadline.
+// Objects named "stream.bin" stall after the first body bytes.
+type slowBackend struct {
+	weasel.MemBackend
+}
+
+func (b *slowBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*weasel.ObjectReader, error) {
+	if name != "stream.bin" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &weasel.ObjectReader{
+		Meta: map[string]string{"content-type": "application/octet-stream", "content-length": "1048576000"},
+		Size: 1 << 30,
+		Body: ioutil.NopCloser(&stallReader{ctx: ctx}),
+	}, nil
+}
+
+// stallReader returns a few bytes, then blocks until ctx is done.
+type stallReader struct {
+	ctx  context.Context
+	read bool
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		return copy(b, "first bytes"), nil
+	}
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestServe_RequestTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = &slowBackend{}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.RequestTimeout = duration(timeout)
+	})()
+
+	req, _ := testInstance.NewRequest("GET", "/slow.txt", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	start := time.Now()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if d := time.Since(start); d < timeout || d > timeout+time.Second {
+		t.Errorf("slow.txt served in %v; want about %v", d, timeout)
+	}
+	if res.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow.txt: res.Code = %d; want %d", res.Code, http.StatusGatewayTimeout)
+	}
+
+	// streamed responses are aborted
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+	// the response headers may still be buffered when it is aborted
+	start = time.Now()
+	sres, err := http.Get(ts.URL + "/stream.bin")
+	if err == nil {
+		var b []byte
+		b, err = ioutil.ReadAll(sres.Body)
+		sres.Body.Close()
+		if err == nil {
+			t.Errorf("stream.bin: read %d bytes with no error; want the connection closed", len(b))
+		}
+	}
+	if d := time.Since(start); d > timeout+time.Second {
+		t.Errorf("stream.bin aborted in %v; want about %v", d, timeout)
 	}
 }
@@ -0,0 +1,39 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// serverTiming returns a Server-Timing header value of the cache lookup
+// and storage fetch times recorded in cs, in milliseconds, e.g.
+// "cache;dur=0.042, gcs;dur=35.125". The gcs metric is zero when all objects
+// were served from cache. An empty string is returned if cs is nil or
+// recorded no lookups, e.g. for redirects.
+func serverTiming(cs *weasel.CacheStatus) string {
+	if cs == nil || cs.Hits()+cs.Misses() == 0 {
+		return ""
+	}
+	return fmt.Sprintf("cache;dur=%s, gcs;dur=%s", timingMillis(cs.CacheTime()), timingMillis(cs.FetchTime()))
+}
+
+// timingMillis formats d in milliseconds with microsecond precision.
+func timingMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_ServerTiming(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	metric := regexp.MustCompile(`^cache;dur=([0-9.]+), gcs;dur=([0-9.]+)$`)
+	tests := []struct {
+		timing bool
+		miss   bool // response fetched from GCS
+	}{
+		{true, true},
+		{true, false},
+		{false, false},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			c.ServerTiming = test.timing
+		})
+		req, _ := testInstance.NewRequest("GET", "/timing.txt", nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		v, ok := res.Header()["Server-Timing"]
+		if !test.timing {
+			if ok {
+				t.Errorf("%d: server-timing = %q with server_timing off; want none", i, v)
+			}
+			continue
+		}
+		m := metric.FindStringSubmatch(res.Header().Get("server-timing"))
+		if m == nil {
+			t.Errorf("%d: server-timing = %q; want cache and gcs durations", i, v)
+			continue
+		}
+		gcs, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms := float64(delay) / float64(time.Millisecond)
+		if test.miss && gcs < ms {
+			t.Errorf("%d: gcs;dur=%v on cache miss; want at least %v", i, gcs, ms)
+		}
+		if !test.miss && gcs != 0 {
+			t.Errorf("%d: gcs;dur=%v on cache hit; want 0", i, gcs)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	stdlog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// stopPath is the App Engine instance shutdown request path.
+	stopPath = "/_ah/stop"
+	// defaultShutdownGrace is the default value of appConfig.ShutdownGrace.
+	defaultShutdownGrace = 10 * time.Second
+)
+
+// requestTracker counts in-flight client requests
+// and rejects new ones once shutdown has begun.
+type requestTracker struct {
+	mu       sync.Mutex
+	n        int
+	stopping bool
+	idle     chan struct{} // closed once n drops to zero while stopping
+}
+
+// inflight is the request tracker of this instance.
+var inflight = &requestTracker{}
+
+// start records a new in-flight request, unless shutdown has begun.
+// Callers must call done once the request is served if it reports true.
+func (t *requestTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopping {
+		return false
+	}
+	t.n++
+	return true
+}
+
+// done records the end of a request recorded with start.
+func (t *requestTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// isStopping reports whether shutdown has begun.
+func (t *requestTracker) isStopping() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stopping
+}
+
+// shutdown stops accepting new requests and waits up to grace
+// for in-flight ones to finish. It returns the number of requests
+// still in flight, which is zero unless grace has passed.
+func (t *requestTracker) shutdown(grace time.Duration) int {
+	t.mu.Lock()
+	t.stopping = true
+	if t.n == 0 {
+		t.mu.Unlock()
+		return 0
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+	case <-time.After(grace):
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.n
+}
+
+// drain wraps h with in-flight request tracking. Once shutdown has begun,
+// new requests are rejected with 503 status code, so that they are retried
+// on other instances.
+func drain(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !inflight.start() {
+			w.Header().Set("connection", "close")
+			w.Header().Set("retry-after", strconv.Itoa(retryAfter))
+			serveError(w, http.StatusServiceUnavailable, "")
+			return
+		}
+		defer inflight.done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdownGrace returns the current config ShutdownGrace
+// or defaultShutdownGrace if it is not set.
+func shutdownGrace() time.Duration {
+	if d := time.Duration(currentConfig().ShutdownGrace); d > 0 {
+		return d
+	}
+	return defaultShutdownGrace
+}
+
+// serveStop begins the instance shutdown and responds once in-flight
+// requests are finished or the current config ShutdownGrace passes.
+// The health handler responds with 503 status code from then on.
+func serveStop(w http.ResponseWriter, r *http.Request) {
+	// this is not a client request, so don't use newContext.
+	ctx := appengine.NewContext(r)
+	log.Infof(ctx, "shutdown: draining in-flight requests")
+	if n := inflight.shutdown(shutdownGrace()); n > 0 {
+		log.Warningf(ctx, "shutdown: %d requests still in flight", n)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// stopOnSignal begins the instance shutdown on SIGTERM, same as serveStop,
+// and exits once it is done.
+func stopOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	go func() {
+		<-c
+		stdlog.Printf("shutdown: draining in-flight requests")
+		if n := inflight.shutdown(shutdownGrace()); n > 0 {
+			stdlog.Printf("warning: shutdown: %d requests still in flight", n)
+		}
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// gateBackend is a weasel.Backend whose reads signal opened
+// and then block until release is closed.
+type gateBackend struct {
+	weasel.MemBackend
+	opened  chan struct{}
+	release chan struct{}
+}
+
+func (b *gateBackend) Open(ctx context.Context, bucket, name string, h http.Header) (*weasel.ObjectReader, error) {
+	b.opened <- struct{}{}
+	<-b.release
+	return b.MemBackend.Open(ctx, bucket, name, h)
+}
+
+func TestServe_ShutdownDrain(t *testing.T) {
+	defer func(t *requestTracker) { inflight = t }(inflight)
+	inflight = &requestTracker{}
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	backend := &gateBackend{opened: make(chan struct{}), release: make(chan struct{})}
+	backend.Put("bucket", "large.bin", []byte("contents"), nil)
+	storage.Backend = backend
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.ShutdownGrace = duration(5 * time.Second)
+	})()
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, _ := testInstance.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		return res
+	}
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- serve("/large.bin") }()
+	<-backend.opened
+
+	stopped := make(chan *httptest.ResponseRecorder)
+	go func() { stopped <- serve(stopPath) }()
+	for !inflight.isStopping() {
+		time.Sleep(time.Millisecond)
+	}
+	if res := serve("/healthz"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("health during shutdown: res.Code = %d; want 503", res.Code)
+	}
+	res := serve("/other.txt")
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("connection") != "close" {
+		t.Errorf("new request during shutdown: res.Code = %d, connection = %q; want 503, close",
+			res.Code, res.Header().Get("connection"))
+	}
+	select {
+	case <-stopped:
+		t.Fatal("stop responded with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	if res := <-slow; res.Code != http.StatusOK || res.Body.String() != "contents" {
+		t.Errorf("in-flight request: res.Code = %d, body = %q; want 200, contents", res.Code, res.Body)
+	}
+	select {
+	case res := <-stopped:
+		if res.Code != http.StatusOK {
+			t.Errorf("stop: res.Code = %d; want 200", res.Code)
+		}
+	case <-time.After(time.Second):
+		t.Error("stop did not respond once requests were drained")
+	}
+}
+
+func TestRequestTrackerShutdownGrace(t *testing.T) {
+	tr := &requestTracker{}
+	if !tr.start() {
+		t.Fatal("start() = false; want true")
+	}
+	start := time.Now()
+	if n := tr.shutdown(20 * time.Millisecond); n != 1 {
+		t.Errorf("shutdown() = %d; want 1 request in flight", n)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("shutdown returned after %v; want the grace period", d)
+	}
+	if tr.start() {
+		t.Error("start() after shutdown = true; want false")
+	}
+	tr.done()
+	if n := tr.shutdown(time.Second); n != 0 {
+		t.Errorf("shutdown() when idle = %d; want 0", n)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// defaultSignExpiry is the default value of SignExpiry.
+const defaultSignExpiry = 15 * time.Minute
+
+// signedURL is the response body of serveSignedURL.
+type signedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// serveSignedURL responds with a V4 signed URL of the object specified
+// by "object" query parameter, in JSON format. The bucket is specified by
+// "bucket" query parameter, or identified by resolveBucket if it is missing.
+//
+// Only requests of signed in users are allowed. The object must be within
+// one of the current config SignPrefixes, otherwise 403 status code is returned.
+// With LocalRoot set, there are no GCS objects to sign, so it responds with 404.
+func serveSignedURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if currentConfig().LocalRoot != "" {
+		http.Error(w, "signed URLs are not available with local_root", http.StatusNotFound)
+		return
+	}
+	ctx := newContext(r)
+	u := user.Current(ctx)
+	if u == nil {
+		http.Error(w, "sign in required", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	oname := strings.TrimPrefix(q.Get("object"), "/")
+	if oname == "" {
+		http.Error(w, "missing object", http.StatusBadRequest)
+		return
+	}
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		bucket = resolveBucket(r.Host, "/"+oname)
+	}
+	c := currentConfig()
+	if !signAllowed(c.SignPrefixes, bucket, oname) {
+		log.Warningf(ctx, "%s: signing %s/%s is not allowed", u, bucket, oname)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	expiry := time.Duration(c.SignExpiry)
+	if expiry == 0 {
+		expiry = defaultSignExpiry
+	}
+	now := time.Now()
+	s, err := storage.SignedURL(ctx, bucket, oname, now, expiry)
+	if err != nil {
+		log.Errorf(ctx, "storage.SignedURL(%q, %q): %v", bucket, oname, err)
+		serveError(w, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(signedURL{URL: s, Expires: now.Add(expiry).UTC()})
+}
+
+// signAllowed reports whether bucket/name starts with one of the prefixes.
+// Object names with ".." path elements are never allowed.
+func signAllowed(prefixes []string, bucket, name string) bool {
+	for _, el := range strings.Split(name, "/") {
+		if el == ".." {
+			return false
+		}
+	}
+	full := bucket + "/" + name
+	for _, p := range prefixes {
+		if p != "" && strings.HasPrefix(full, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/user"
+)
+
+func TestServeSignedURL(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"site"}, "dl.example.com": {"private"}}
+		c.SignPrefixes = []string{"private/downloads/", "site/gated/"}
+		c.SignExpiry = duration(time.Hour)
+	})()
+
+	tests := []struct {
+		host, query string
+		login       bool
+		code        int
+		path        string
+	}{
+		{"dl.example.com", "object=downloads/app.zip", true, http.StatusOK, "/private/downloads/app.zip"},
+		{"www.example.com", "object=/gated/doc.pdf", true, http.StatusOK, "/site/gated/doc.pdf"},
+		{"www.example.com", "bucket=private&object=downloads/app.zip", true, http.StatusOK, "/private/downloads/app.zip"},
+		{"dl.example.com", "object=downloads/app.zip", false, http.StatusUnauthorized, ""},
+		{"dl.example.com", "object=secret/app.zip", true, http.StatusForbidden, ""},
+		{"dl.example.com", "object=downloads/../secret.zip", true, http.StatusForbidden, ""},
+		{"www.example.com", "bucket=other&object=downloads/app.zip", true, http.StatusForbidden, ""},
+		{"dl.example.com", "", true, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", "/-/sign?"+test.query, nil)
+		req.Host = test.host
+		if test.login {
+			aetest.Login(&user.User{Email: "user@example.com"}, req)
+		}
+		res := httptest.NewRecorder()
+		serveSignedURL(res, req)
+		if res.Code != test.code {
+			t.Errorf("%s?%s: res.Code = %d; want %d", test.host, test.query, res.Code, test.code)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var body signedURL
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s?%s: %v", test.host, test.query, err)
+		}
+		u, err := url.Parse(body.URL)
+		if err != nil {
+			t.Fatalf("%s?%s: url.Parse(%q): %v", test.host, test.query, body.URL, err)
+		}
+		if u.Path != test.path {
+			t.Errorf("%s?%s: u.Path = %q; want %q", test.host, test.query, u.Path, test.path)
+		}
+		q := u.Query()
+		if v := q.Get("X-Goog-Expires"); v != "3600" {
+			t.Errorf("%s?%s: X-Goog-Expires = %q; want 3600", test.host, test.query, v)
+		}
+		if q.Get("X-Goog-Signature") == "" || q.Get("X-Goog-Credential") == "" {
+			t.Errorf("%s?%s: missing signature params in %s", test.host, test.query, body.URL)
+		}
+		if d := time.Until(body.Expires); d <= 0 || d > time.Hour {
+			t.Errorf("%s?%s: body.Expires = %v", test.host, test.query, body.Expires)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// sitemapPath is the request path of the generated sitemap.
+	sitemapPath = "/sitemap.xml"
+	// sitemapTTL is how long bucket listings of sitemaps are cached.
+	sitemapTTL = 10 * time.Minute
+)
+
+// sitemapCache holds bucket HTML objects listings used to generate sitemaps.
+var sitemapCache = struct {
+	sync.Mutex
+	m map[string]sitemapEntry // keyed by bucket
+}{m: make(map[string]sitemapEntry)}
+
+// sitemapEntry is a cached bucket listing.
+type sitemapEntry struct {
+	list    []*weasel.ListEntry
+	expires time.Time
+}
+
+// purgeSitemaps removes all cached sitemap listings.
+func purgeSitemaps() {
+	sitemapCache.Lock()
+	sitemapCache.m = make(map[string]sitemapEntry)
+	sitemapCache.Unlock()
+}
+
+// purgeSitemap removes the cached sitemap listing of the bucket, if any.
+func purgeSitemap(bucket string) {
+	sitemapCache.Lock()
+	delete(sitemapCache.m, bucket)
+	sitemapCache.Unlock()
+}
+
+// sitemapList returns HTML objects of the bucket from cache or GCS.
+func sitemapList(ctx context.Context, bucket string) ([]*weasel.ListEntry, error) {
+	sitemapCache.Lock()
+	e, ok := sitemapCache.m[bucket]
+	sitemapCache.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.list, nil
+	}
+	all, err := storageFrom(ctx).ListAll(ctx, bucket, "")
+	if err != nil {
+		return nil, err
+	}
+	var list []*weasel.ListEntry
+	for _, o := range all {
+		if ext := path.Ext(o.Name); ext == ".html" || ext == ".htm" {
+			list = append(list, o)
+		}
+	}
+	sitemapCache.Lock()
+	sitemapCache.m[bucket] = sitemapEntry{list: list, expires: time.Now().Add(sitemapTTL)}
+	sitemapCache.Unlock()
+	return list, nil
+}
+
+// sitemapURLSet is the sitemap XML document.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// serveSitemap responds with sitemap.xml listing HTML objects of the request
+// bucket as URLs of the request host, if the current config Sitemap is enabled.
+// Index objects map to their "directory" URLs. Objects whose paths are
+// redirected are excluded. It returns false if no response was written.
+func serveSitemap(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string) bool {
+	c := currentConfig()
+	if !c.Sitemap || r.URL.Path != sitemapPath {
+		return false
+	}
+	list, err := sitemapList(ctx, bucket)
+	if err != nil {
+		log.Errorf(ctx, "sitemapList(%q): %v", bucket, err)
+		return false
+	}
+
+	set := sitemapURLSet{}
+	for _, o := range list {
+		p := "/" + o.Name
+		if dir, base := path.Split(o.Name); base == storageFrom(ctx).IndexName(dir) {
+			p = "/" + dir
+		}
+		if _, _, ok := c.matchRedirect(r.Host, p); ok {
+			continue
+		}
+		u := sitemapURL{Loc: "https://" + r.Host + p}
+		if !o.Updated.IsZero() {
+			u.LastMod = o.Updated.UTC().Format(time.RFC3339)
+		}
+		set.URLs = append(set.URLs, u)
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	if err := enc.Encode(set); err != nil {
+		log.Errorf(ctx, "sitemap: %v", err)
+		return false
+	}
+	b.WriteByte('\n')
+
+	o := &weasel.Object{
+		Meta: map[string]string{"content-type": "application/xml; charset=utf-8"},
+		Body: b.Bytes(),
+	}
+	o = applyHeaders(r.URL.Path, applyCacheControl(r.URL.Path, o))
+	if err := weasel.ServeObject(w, o, r.Method == "GET"); err != nil {
+		log.Errorf(ctx, "%s: %v", sitemapPath, err)
+	}
+	return true
+}
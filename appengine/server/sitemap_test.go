@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServe_Sitemap(t *testing.T) {
+	var lists int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/site-bucket" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lists++
+		w.Write([]byte(`<ListBucketResult>
+  <Contents><Key>index.html</Key><LastModified>2016-01-02T03:04:05.000Z</LastModified></Contents>
+  <Contents><Key>docs/index.html</Key><LastModified>2016-02-02T03:04:05.000Z</LastModified></Contents>
+  <Contents><Key>docs/guide.html</Key><LastModified>2016-03-02T03:04:05.000Z</LastModified></Contents>
+  <Contents><Key>docs/app.js</Key><LastModified>2016-03-02T03:04:05.000Z</LastModified></Contents>
+  <Contents><Key>old/page.html</Key><LastModified>2016-04-02T03:04:05.000Z</LastModified></Contents>
+</ListBucketResult>`))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"site-bucket"}}
+		c.Sitemap = true
+		c.Redirects = map[string]redirect{"/old/": {To: "/new"}}
+		c.redirectPrefixes = c.buildRedirects()
+	})()
+	defer purgeSitemaps()
+
+	for i := 0; i < 2; i++ {
+		req, _ := testInstance.NewRequest("GET", "/sitemap.xml", nil)
+		req.Host = "www.example.com"
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%d: res.Code = %d; want %d", i, res.Code, http.StatusOK)
+		}
+		if v := res.Header().Get("content-type"); !strings.HasPrefix(v, "application/xml") {
+			t.Errorf("%d: content-type = %q; want application/xml", i, v)
+		}
+
+		var set sitemapURLSet
+		if err := xml.Unmarshal(res.Body.Bytes(), &set); err != nil {
+			t.Fatalf("%d: xml.Unmarshal: %v\n%s", i, err, res.Body)
+		}
+		if set.XMLName.Space != "http://www.sitemaps.org/schemas/sitemap/0.9" {
+			t.Errorf("%d: set.XMLName = %+v", i, set.XMLName)
+		}
+		want := []sitemapURL{
+			{"https://www.example.com/docs/guide.html", "2016-03-02T03:04:05Z"},
+			{"https://www.example.com/docs/", "2016-02-02T03:04:05Z"},
+			{"https://www.example.com/", "2016-01-02T03:04:05Z"},
+		}
+		if !reflect.DeepEqual(set.URLs, want) {
+			t.Errorf("%d: set.URLs = %+v; want %+v", i, set.URLs, want)
+		}
+	}
+	if lists != 1 {
+		t.Errorf("lists = %d; want 1", lists)
+	}
+
+	// change notifications invalidate cached listings
+	req, _ := testInstance.NewRequest("POST", "/-/hook/gcs", strings.NewReader(`{"bucket": "site-bucket", "name": "index.html"}`))
+	req.Header.Set("x-goog-resource-state", "exists")
+	http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = testInstance.NewRequest("GET", "/sitemap.xml", nil)
+	http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+	if lists != 2 {
+		t.Errorf("lists = %d; want 2", lists)
+	}
+}
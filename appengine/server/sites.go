@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// siteFields are JSON names of appConfig fields a Sites entry may set.
+// The rest apply to all sites alike.
+var siteFields = map[string]bool{
+	"buckets":       true,
+	"bucket_paths":  true,
+	"redirects":     true,
+	"root_redirect": true,
+	"index":         true,
+	"not_found":     true,
+}
+
+// site returns the config of host: the merged Sites entry of host,
+// with or without a port, or c itself if there is none.
+// The result should be used in place of c wherever the request host
+// selects fields of siteFields.
+func (c *appConfig) site(host string) *appConfig {
+	if len(c.sites) == 0 {
+		return c
+	}
+	if s, ok := c.sites[host]; ok {
+		return s
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if s, ok := c.sites[h]; ok {
+			return s
+		}
+	}
+	return c
+}
+
+// mergeSite returns a copy of c with the fields set in Sites entry sc
+// replacing those of c. The copy has no Sites of its own.
+func (c *appConfig) mergeSite(sc *appConfig) *appConfig {
+	m := *c
+	m.Sites, m.sites = nil, nil
+	if sc == nil {
+		return &m
+	}
+	if sc.Buckets != nil {
+		m.Buckets = sc.Buckets
+	}
+	if sc.BucketPaths != nil {
+		m.BucketPaths = sc.BucketPaths
+	}
+	if sc.Redirects != nil {
+		m.Redirects = sc.Redirects
+	}
+	if sc.RootRedirect != nil {
+		m.RootRedirect = sc.RootRedirect
+	}
+	if sc.Index != nil {
+		// the global "/" value applies to the rest, same as with Hosts
+		m.Index = make(indexConfig, len(sc.Index)+1)
+		for k, v := range sc.Index {
+			m.Index[k] = v
+		}
+		if v, ok := c.Index["/"]; ok && len(m.Index["/"]) == 0 {
+			m.Index["/"] = v
+		}
+	}
+	if sc.NotFound != "" {
+		m.NotFound = sc.NotFound
+	}
+	return &m
+}
+
+// buildSites returns configs of c.Sites hosts, merged with c.
+// See mergeSite.
+func (c *appConfig) buildSites() map[string]*appConfig {
+	if len(c.Sites) == 0 {
+		return nil
+	}
+	sites := make(map[string]*appConfig, len(c.Sites))
+	for host, sc := range c.Sites {
+		m := c.mergeSite(sc)
+		m.redirectPrefixes = m.buildRedirects()
+		sites[host] = m
+	}
+	return sites
+}
+
+// validateSites reports an error if a c.Sites key is not a host, is among
+// c.Hosts too, or its entry sets fields other than siteFields, or is invalid
+// once merged with c. See mergeSite.
+func (c *appConfig) validateSites() error {
+	for host, sc := range c.Sites {
+		switch {
+		case host == "" || host == "default" || strings.ContainsAny(host, "/*"):
+			return fmt.Errorf("sites[%q]: not a host", host)
+		case sc == nil:
+			return fmt.Errorf("sites[%q]: must not be empty", host)
+		}
+		if _, ok := c.Hosts[host]; ok {
+			return fmt.Errorf("sites[%q]: conflicts with hosts[%q]", host, host)
+		}
+		if err := checkSiteFields(sc); err != nil {
+			return fmt.Errorf("sites[%q].%v", host, err)
+		}
+		if err := c.mergeSite(sc).validate(); err != nil {
+			return fmt.Errorf("sites[%q].%v", host, err)
+		}
+	}
+	return nil
+}
+
+// checkSiteFields reports an error naming the first field of Sites entry sc
+// which is set but not among siteFields.
+func checkSiteFields(sc *appConfig) error {
+	v := reflect.ValueOf(sc).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "" || siteFields[name] {
+			continue
+		}
+		if !reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(f.Type).Interface()) {
+			return fmt.Errorf("%s: not supported per site", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_Sites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.json")
+	data := `{
+		"buckets": {"default": "main-bucket"},
+		"redirects": {"/old": "/new"},
+		"sites": {
+			"a.example.com": {
+				"buckets": {"default": "a-bucket"},
+				"redirects": {"/old": "/a-new"}
+			},
+			"b.example.com": {
+				"buckets": {"default": "b-bucket"},
+				"redirects": {"/old": "https://b.example.org"}
+			}
+		}
+	}`
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setConfig(currentConfig())
+	setConfig(c)
+
+	m := &weasel.MemBackend{}
+	m.Put("main-bucket", "page.html", []byte("main page"), nil)
+	m.Put("a-bucket", "page.html", []byte("a page"), nil)
+	m.Put("b-bucket", "page.html", []byte("b page"), nil)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+
+	tests := []struct {
+		host, path string
+		code       int
+		location   string
+		body       string
+	}{
+		{"example.com", "/page.html", http.StatusOK, "", "main page"},
+		{"a.example.com", "/page.html", http.StatusOK, "", "a page"},
+		{"a.example.com:8080", "/page.html", http.StatusOK, "", "a page"},
+		{"b.example.com", "/page.html", http.StatusOK, "", "b page"},
+		{"example.com", "/old", http.StatusMovedPermanently, "/new/old", ""},
+		{"a.example.com", "/old", http.StatusMovedPermanently, "/a-new/old", ""},
+		{"b.example.com", "/old", http.StatusMovedPermanently, "https://b.example.org/old", ""},
+	}
+	for i, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("%d: %s%s: res.Code = %d; want %d", i, test.host, test.path, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%d: %s%s: location = %q; want %q", i, test.host, test.path, v, test.location)
+		}
+		if test.body != "" && res.Body.String() != test.body {
+			t.Errorf("%d: %s%s: body = %q; want %q", i, test.host, test.path, res.Body.String(), test.body)
+		}
+	}
+}
+
+func TestHostsForBucket_Sites(t *testing.T) {
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"main-bucket"}, "c.example.com": {"a-bucket"}}
+		c.Sites = map[string]*appConfig{
+			"a.example.com": {Buckets: map[string]bucketList{"default": {"a-bucket"}}},
+			"b.example.com": {BucketPaths: map[string]bucketList{"b.example.com/docs/": {"a-bucket"}}},
+		}
+		c.sites = c.buildSites()
+	})()
+	hosts := hostsForBucket("a-bucket")
+	want := []string{"a.example.com", "b.example.com", "c.example.com"}
+	if len(hosts) != len(want) {
+		t.Fatalf("hostsForBucket = %q; want %q", hosts, want)
+	}
+	for i := range want {
+		if hosts[i] != want[i] {
+			t.Errorf("hostsForBucket = %q; want %q", hosts, want)
+			break
+		}
+	}
+}
+
+func TestMergeSite_Index(t *testing.T) {
+	tests := []struct {
+		global, site, want indexConfig
+	}{
+		{
+			indexConfig{"/": {"index.html"}},
+			indexConfig{"/docs/": {"README.html"}},
+			indexConfig{"/": {"index.html"}, "/docs/": {"README.html"}},
+		},
+		{
+			indexConfig{"/": {"index.html"}},
+			indexConfig{"/": {"home.html"}},
+			indexConfig{"/": {"home.html"}},
+		},
+		// no global "/" to fall back to
+		{
+			nil,
+			indexConfig{"/docs/": {"README.html"}},
+			indexConfig{"/docs/": {"README.html"}},
+		},
+		{
+			indexConfig{"/": {"index.html"}},
+			nil,
+			indexConfig{"/": {"index.html"}},
+		},
+	}
+	for i, test := range tests {
+		c := &appConfig{Index: test.global}
+		m := c.mergeSite(&appConfig{Index: test.site})
+		if !reflect.DeepEqual(m.Index, test.want) {
+			t.Errorf("%d: index = %v; want %v", i, m.Index, test.want)
+		}
+		if err := m.Index.validate(); err != nil {
+			t.Errorf("%d: merged index: %v", i, err)
+		}
+	}
+}
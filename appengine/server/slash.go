@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+// TrailingSlash policies.
+const (
+	slashIgnore = "ignore" // serve paths as requested
+	slashAdd    = "add"    // redirect /dir to /dir/
+	slashRemove = "remove" // redirect /dir/ to /dir
+)
+
+// serveTrailingSlash responds with a permanent redirect if the request path
+// does not conform to TrailingSlash policy, and reports whether it did.
+// The root path and paths with a file extension are never redirected.
+func serveTrailingSlash(w http.ResponseWriter, r *http.Request) bool {
+	p := r.URL.Path
+	if p == "/" || path.Ext(strings.TrimRight(p, "/")) != "" {
+		return false
+	}
+	var to string
+	switch currentConfig().TrailingSlash {
+	case slashAdd:
+		if !strings.HasSuffix(p, "/") {
+			to = p + "/"
+		}
+	case slashRemove:
+		if strings.HasSuffix(p, "/") {
+			to = strings.TrimRight(p, "/")
+		}
+	}
+	if to == "" {
+		return false
+	}
+	// don't let //host/ become a protocol-relative URL
+	to = "/" + strings.TrimLeft(to, "/")
+	if r.URL.RawQuery != "" {
+		to += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, to, http.StatusMovedPermanently)
+	return true
+}
+
+// serveCanonicalIndex responds with a permanent redirect of a request
+// for a directory index object, e.g. /blog/index.html, to the directory,
+// /blog/, if CanonicalizeIndex is enabled, and reports whether it did.
+// Only the first of the directory index names is redirected, since the others
+// are served from the directory only if it is missing. With slashRemove policy,
+// the redirect is to /blog instead, so that no further redirect follows.
+func serveCanonicalIndex(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	c := currentConfig()
+	if !c.CanonicalizeIndex {
+		return false
+	}
+	dir, base := path.Split(r.URL.Path)
+	if base == "" || base != storageFrom(ctx).IndexName(dir[1:]) {
+		return false
+	}
+	to := dir
+	if c.TrailingSlash == slashRemove && dir != "/" {
+		to = strings.TrimRight(dir, "/")
+	}
+	// don't let //host/ become a protocol-relative URL
+	to = "/" + strings.TrimLeft(to, "/")
+	if r.URL.RawQuery != "" {
+		to += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, to, http.StatusMovedPermanently)
+	return true
+}
+
+// readDir is similar to storage.ReadFile but, with slashRemove policy
+// or PrettyURLs, it reads a directory index in place of redirecting
+// oname to oname + "/". With PrettyURLs, oname + ".html" is tried
+// before the index, see readPretty.
+func readDir(ctx context.Context, bucket, oname string) (*weasel.Object, error) {
+	s := storageFrom(ctx)
+	return resolveDir(ctx, bucket, oname, s.ReadFile, s.ReadObject)
+}
+
+// statDir is similar to readDir except objects are stat-ed,
+// see storage.ReadFileMeta.
+func statDir(ctx context.Context, bucket, oname string) (*weasel.Object, error) {
+	s := storageFrom(ctx)
+	return resolveDir(ctx, bucket, oname, s.ReadFileMeta, s.Stat)
+}
+
+// resolveDir implements readDir and statDir with the storage methods
+// readFile, e.g. ReadFile, and read, e.g. ReadObject.
+func resolveDir(ctx context.Context, bucket, oname string, readFile, read func(context.Context, string, string) (*weasel.Object, error)) (*weasel.Object, error) {
+	o, err := readFile(ctx, bucket, oname)
+	dir := err == nil && o.Redirect() == "/"+oname+"/"
+	if (dir || isNotFound(err)) && prettyName(oname) {
+		po, perr := readPretty(ctx, bucket, oname, read)
+		if po != nil || perr != nil {
+			return po, perr
+		}
+	}
+	if dir && (currentConfig().TrailingSlash == slashRemove || prettyName(oname)) {
+		return readFile(ctx, bucket, oname+"/")
+	}
+	return o, err
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_TrailingSlash(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/docs/index.html":
+			w.Write([]byte("docs index"))
+		case "/bucket/docs/v1.2", "/bucket/style.css":
+			w.Write([]byte("file"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		policy, path string
+		code         int
+		location     string
+	}{
+		{"", "/docs", http.StatusMovedPermanently, "/docs/"}, // storage redirect
+		{"", "/docs/", http.StatusOK, ""},
+		{slashIgnore, "/docs", http.StatusMovedPermanently, "/docs/"},
+		{slashIgnore, "/docs/", http.StatusOK, ""},
+
+		{slashAdd, "/docs", http.StatusMovedPermanently, "/docs/"},
+		{slashAdd, "/docs?q=1", http.StatusMovedPermanently, "/docs/?q=1"},
+		{slashAdd, "/docs/", http.StatusOK, ""},
+		{slashAdd, "/", http.StatusNotFound, ""},
+		{slashAdd, "/style.css", http.StatusOK, ""},
+		{slashAdd, "/docs/v1.2", http.StatusOK, ""},
+
+		{slashRemove, "/docs/", http.StatusMovedPermanently, "/docs"},
+		{slashRemove, "/docs/?q=1", http.StatusMovedPermanently, "/docs?q=1"},
+		{slashRemove, "/docs", http.StatusOK, ""},
+		{slashRemove, "/style.css", http.StatusOK, ""},
+		{slashRemove, "/style.css/", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.TrailingSlash = test.policy
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+
+		if res.Code != test.code {
+			t.Errorf("%q %s: res.Code = %d; want %d", test.policy, test.path, res.Code, test.code)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%q %s: location = %q; want %q", test.policy, test.path, v, test.location)
+		}
+	}
+}
+
+func TestServeTrailingSlashHost(t *testing.T) {
+	// paths are usually cleaned by http.ServeMux, but not necessarily
+	tests := []struct{ policy, path, location string }{
+		{slashAdd, "//evil", "/evil/"},
+		{slashRemove, "//evil//", "/evil"},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) { c.TrailingSlash = test.policy })
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		req.URL.Path = test.path
+		res := httptest.NewRecorder()
+		ok := serveTrailingSlash(res, req)
+		restore()
+		if !ok {
+			t.Errorf("%q %s: serveTrailingSlash = false", test.policy, test.path)
+		}
+		if v := res.Header().Get("location"); v != test.location {
+			t.Errorf("%q %s: location = %q; want %q", test.policy, test.path, v, test.location)
+		}
+	}
+}
+
+func TestServe_CanonicalizeIndex(t *testing.T) {
+	m := &weasel.MemBackend{}
+	html := map[string]string{"content-type": "text/html"}
+	m.Put("bucket", "index.html", []byte("root index"), html)
+	m.Put("bucket", "blog/index.html", []byte("blog index"), html)
+	m.Put("bucket", "blog/post.html", []byte("post"), html)
+	m.Put("bucket", "docs/README.html", []byte("docs readme"), html)
+	defer func(b weasel.Backend) { storage.Backend = b }(storage.Backend)
+	storage.Backend = m
+	defer func(p map[string][]string) { storage.IndexPaths = p }(storage.IndexPaths)
+	storage.IndexPaths = map[string][]string{"docs/": {"README.html"}}
+
+	// get follows redirects of path, failing on a loop
+	get := func(policy, p string) (hops []string, body string) {
+		seen := map[string]bool{}
+		for len(hops) < 5 {
+			if seen[p] {
+				t.Fatalf("%q: redirect loop: %q", policy, hops)
+			}
+			seen[p] = true
+			hops = append(hops, p)
+			req, _ := testInstance.NewRequest("GET", p, nil)
+			if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+				t.Fatal(err)
+			}
+			res := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(res, req)
+			if res.Code != http.StatusMovedPermanently {
+				if res.Code != http.StatusOK {
+					t.Errorf("%q %s: res.Code = %d; want 200", policy, p, res.Code)
+				}
+				return hops, res.Body.String()
+			}
+			p = res.Header().Get("location")
+		}
+		t.Fatalf("%q: too many redirects: %q", policy, hops)
+		return nil, ""
+	}
+
+	tests := []struct {
+		policy, path string
+		hops         []string
+		body         string
+	}{
+		{"", "/blog/index.html", []string{"/blog/index.html", "/blog/"}, "blog index"},
+		{"", "/blog/index.html?page=2", []string{"/blog/index.html?page=2", "/blog/?page=2"}, "blog index"},
+		{"", "/blog/", []string{"/blog/"}, "blog index"},
+		{"", "/blog/post.html", []string{"/blog/post.html"}, "post"},
+		{"", "/index.html", []string{"/index.html", "/"}, "root index"},
+		{"", "/docs/README.html", []string{"/docs/README.html", "/docs/"}, "docs readme"},
+		{slashAdd, "/blog/index.html", []string{"/blog/index.html", "/blog/"}, "blog index"},
+		{slashAdd, "/blog", []string{"/blog", "/blog/"}, "blog index"},
+		{slashRemove, "/blog/index.html", []string{"/blog/index.html", "/blog"}, "blog index"},
+		{slashRemove, "/blog/", []string{"/blog/", "/blog"}, "blog index"},
+		{slashRemove, "/index.html", []string{"/index.html", "/"}, "root index"},
+	}
+	for _, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.CanonicalizeIndex = true
+			c.TrailingSlash = test.policy
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		})
+		hops, body := get(test.policy, test.path)
+		restore()
+		if !reflect.DeepEqual(hops, test.hops) {
+			t.Errorf("%q %s: hops = %q; want %q", test.policy, test.path, hops, test.hops)
+		}
+		if body != test.body {
+			t.Errorf("%q %s: body = %q; want %q", test.policy, test.path, body, test.body)
+		}
+	}
+}
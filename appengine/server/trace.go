@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// logTracer is a weasel.Tracer which writes finished spans
+// to the request log at debug level, along with the request trace context.
+type logTracer struct{}
+
+// StartSpan implements weasel.Tracer.
+func (logTracer) StartSpan(ctx context.Context, name string) (context.Context, weasel.Span) {
+	return ctx, &logSpan{ctx: ctx, name: name}
+}
+
+// logSpan is a span started by logTracer.
+type logSpan struct {
+	ctx   context.Context
+	name  string
+	attrs []string
+}
+
+// SetAttribute implements weasel.Span.
+func (s *logSpan) SetAttribute(key string, value interface{}) {
+	s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+}
+
+// End implements weasel.Span.
+func (s *logSpan) End() {
+	if id := requestIDFrom(s.ctx); id != "" {
+		s.attrs = append(s.attrs, "request_id="+id)
+	}
+	log.Debugf(s.ctx, "trace %s: %s %s", weasel.TraceContext(s.ctx), s.name, strings.Join(s.attrs, " "))
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// nopTracer counts started and finished spans.
+type nopTracer struct {
+	mu             sync.Mutex
+	started, ended int
+	names          []string
+}
+
+func (t *nopTracer) StartSpan(ctx context.Context, name string) (context.Context, weasel.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started++
+	t.names = append(t.names, name)
+	return ctx, nopSpan{t}
+}
+
+type nopSpan struct{ t *nopTracer }
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (s nopSpan) End() {
+	s.t.mu.Lock()
+	s.t.ended++
+	s.t.mu.Unlock()
+}
+
+func TestServe_Trace(t *testing.T) {
+	const tc = "105445aa7843bc8bf206b120001000/1;o=1"
+	var gotTC string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTC = r.Header.Get(weasel.TraceHeader)
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	config.Buckets = map[string]bucketList{"default": {"bucket"}}
+	tr := &nopTracer{}
+	storage.Tracer = tr
+	defer func() { storage.Tracer = nil }()
+
+	req, _ := testInstance.NewRequest("GET", "/traced.txt", nil)
+	req.Header.Set(weasel.TraceHeader, tc)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("res.Code = %d; want 200", res.Code)
+	}
+	if gotTC != tc {
+		t.Errorf("%s = %q; want %q", weasel.TraceHeader, gotTC, tc)
+	}
+	if tr.started != 1 || tr.ended != 1 || tr.names[0] != "gcs.fetch" {
+		t.Errorf("started = %d, ended = %d, names = %v; want 1 gcs.fetch span", tr.started, tr.ended, tr.names)
+	}
+}
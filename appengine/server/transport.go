@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Default values of transportConfig fields,
+// same as those of http.DefaultTransport.
+const (
+	defaultMaxIdleConns    = 100
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultDialTimeout     = 30 * time.Second
+)
+
+// transportConfig is the Transport section of appConfig.
+// Zero fields use their default values.
+// Its transport dials GCS with a net.Dialer, which only works on runtimes
+// allowing raw sockets, i.e. not the first-generation standard runtime.
+type transportConfig struct {
+	// MaxIdleConns is the maximum number of idle keep-alive connections
+	// to GCS, defaultMaxIdleConns if zero.
+	MaxIdleConns int `json:"max_idle_conns" yaml:"max_idle_conns"`
+	// IdleConnTimeout is how long an idle connection is kept open,
+	// defaultIdleConnTimeout if zero.
+	IdleConnTimeout duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+	// DialTimeout is how long establishing a connection may take,
+	// defaultDialTimeout if zero.
+	DialTimeout duration `json:"dial_timeout" yaml:"dial_timeout"`
+	// ResponseHeaderTimeout is how long to wait for response headers
+	// once a request is written. Zero means no limit other than the deadline
+	// of the context GCS requests are made with.
+	ResponseHeaderTimeout duration `json:"response_header_timeout" yaml:"response_header_timeout"`
+}
+
+// dialer returns the dialer of tc transport connections.
+func (tc *transportConfig) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second}
+	if tc.DialTimeout > 0 {
+		d.Timeout = time.Duration(tc.DialTimeout)
+	}
+	return d
+}
+
+// transport returns an HTTP transport configured with tc.
+// All GCS requests go to a single host, so MaxIdleConns applies per host too.
+func (tc *transportConfig) transport() *http.Transport {
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           tc.dialer().DialContext,
+		MaxIdleConns:          defaultMaxIdleConns,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		ResponseHeaderTimeout: time.Duration(tc.ResponseHeaderTimeout),
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if tc.MaxIdleConns > 0 {
+		t.MaxIdleConns = tc.MaxIdleConns
+	}
+	t.MaxIdleConnsPerHost = t.MaxIdleConns
+	if tc.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = time.Duration(tc.IdleConnTimeout)
+	}
+	return t
+}
+
+// validate reports an error if any of tc fields is negative.
+func (tc *transportConfig) validate() error {
+	switch {
+	case tc.MaxIdleConns < 0:
+		return fmt.Errorf("max_idle_conns: %d must not be negative", tc.MaxIdleConns)
+	case tc.IdleConnTimeout < 0:
+		return fmt.Errorf("idle_conn_timeout: %v must not be negative", time.Duration(tc.IdleConnTimeout))
+	case tc.DialTimeout < 0:
+		return fmt.Errorf("dial_timeout: %v must not be negative", time.Duration(tc.DialTimeout))
+	case tc.ResponseHeaderTimeout < 0:
+		return fmt.Errorf("response_header_timeout: %v must not be negative", time.Duration(tc.ResponseHeaderTimeout))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransportConfig(t *testing.T) {
+	tests := []struct {
+		tc                        transportConfig
+		maxIdle                   int
+		idle, dial, headerTimeout time.Duration
+	}{
+		{transportConfig{}, defaultMaxIdleConns, defaultIdleConnTimeout, defaultDialTimeout, 0},
+		{
+			transportConfig{
+				MaxIdleConns:          500,
+				IdleConnTimeout:       duration(time.Minute),
+				DialTimeout:           duration(5 * time.Second),
+				ResponseHeaderTimeout: duration(2 * time.Second),
+			},
+			500, time.Minute, 5 * time.Second, 2 * time.Second,
+		},
+	}
+	for i, test := range tests {
+		tr := test.tc.transport()
+		if tr.MaxIdleConns != test.maxIdle || tr.MaxIdleConnsPerHost != test.maxIdle {
+			t.Errorf("%d: MaxIdleConns, MaxIdleConnsPerHost = %d, %d; want %d", i, tr.MaxIdleConns, tr.MaxIdleConnsPerHost, test.maxIdle)
+		}
+		if tr.IdleConnTimeout != test.idle {
+			t.Errorf("%d: IdleConnTimeout = %v; want %v", i, tr.IdleConnTimeout, test.idle)
+		}
+		if tr.ResponseHeaderTimeout != test.headerTimeout {
+			t.Errorf("%d: ResponseHeaderTimeout = %v; want %v", i, tr.ResponseHeaderTimeout, test.headerTimeout)
+		}
+		if tr.DialContext == nil {
+			t.Errorf("%d: DialContext is nil", i)
+		}
+		if v := test.tc.dialer().Timeout; v != test.dial {
+			t.Errorf("%d: dial timeout = %v; want %v", i, v, test.dial)
+		}
+	}
+}
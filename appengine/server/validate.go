@@ -0,0 +1,58 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	// validateOnlyEnv enables validate-only mode when set to a true value.
+	validateOnlyEnv = "GOA_VALIDATE_ONLY"
+	// validateFlag is the command line flag enabling validate-only mode.
+	validateFlag = "-validate"
+)
+
+// validateOnly reports whether the process is started in validate-only mode,
+// with validateOnlyEnv set or validateFlag, or its "--" form, among args.
+// The flag package is not used, since the process flags belong to the app.
+func validateOnly(args []string) bool {
+	if ok, _ := strconv.ParseBool(os.Getenv(validateOnlyEnv)); ok {
+		return true
+	}
+	for _, a := range args {
+		if a == validateFlag || a == "-"+validateFlag {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfig loads and validates config file name the same way
+// readConfig does, including redirect chain and rewrite conflict checks,
+// without installing it, contacting GCS or registering handlers.
+// It writes the outcome to w and returns the process exit code:
+// 0 if the config is valid, 1 otherwise.
+func validateConfig(w io.Writer, name string) int {
+	if _, err := loadConfig(name); err != nil {
+		fmt.Fprintf(w, "invalid config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "%s: config is valid\n", name)
+	return 0
+}
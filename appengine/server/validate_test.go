@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateOnly(t *testing.T) {
+	tests := []struct {
+		env  string
+		args []string
+		ok   bool
+	}{
+		{"", nil, false},
+		{"", []string{"-validate"}, true},
+		{"", []string{"--validate"}, true},
+		{"", []string{"-v", "validate"}, false},
+		{"1", nil, true},
+		{"true", nil, true},
+		{"0", []string{"-test.v"}, false},
+	}
+	for _, test := range tests {
+		t.Setenv(validateOnlyEnv, test.env)
+		if ok := validateOnly(test.args); ok != test.ok {
+			t.Errorf("%s=%q validateOnly(%q) = %v; want %v", validateOnlyEnv, test.env, test.args, ok, test.ok)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		data string
+		code int
+		out  string
+	}{
+		{`{"buckets": {"default": "b"}}`, 0, "config is valid"},
+		{`{"buckets": {"docs.example.com": "b"}}`, 1, `invalid config: buckets: must contain "default" key`},
+		{`{"buckets": {"default": "b"}, "redirects": {"/a": ""}}`, 1, `invalid config: redirects["/a"]: loop: /a -> /a`},
+		{`{"buckets": {"default": "b"}, "redirects": {"/a": "/b"}, "rewrites": {"/a": "/c"}}`, 1, `invalid config: rewrites["/a"]: conflicts with redirects["/a"]`},
+		{`{"buckets": {"default": "b"},}`, 1, "invalid config: "},
+	}
+	orig := currentConfig()
+	for i, test := range tests {
+		name := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(name, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if code := validateConfig(&out, name); code != test.code {
+			t.Errorf("%d: validateConfig = %d; want %d", i, code, test.code)
+		}
+		if !strings.Contains(out.String(), test.out) {
+			t.Errorf("%d: output = %q; want it to contain %q", i, out.String(), test.out)
+		}
+		if currentConfig() != orig {
+			t.Errorf("%d: validateConfig installed the config", i)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// addVary adds tokens to h's Vary header, merging them with
+// the existing values into a single comma-separated list.
+// Tokens are canonicalized and deduplicated, ignoring case.
+// A "*" token replaces all others, since it already varies on everything.
+func addVary(h http.Header, tokens ...string) {
+	var (
+		list []string
+		seen = make(map[string]bool)
+	)
+	for _, v := range append(h["Vary"], tokens...) {
+		for _, t := range strings.Split(v, ",") {
+			t = http.CanonicalHeaderKey(strings.TrimSpace(t))
+			if t == "*" {
+				h.Set("vary", "*")
+				return
+			}
+			if t != "" && !seen[t] {
+				seen[t] = true
+				list = append(list, t)
+			}
+		}
+	}
+	if len(list) > 0 {
+		h.Set("vary", strings.Join(list, ", "))
+	}
+}
+
+// vary returns the Vary tokens all object responses carry under c:
+// Host, if the content depends on the request host, bucketOverrideHeader
+// if overrides are enabled, followed by c.ExtraVary.
+func (c *appConfig) vary() []string {
+	var tokens []string
+	if c.hostDependent() {
+		tokens = append(tokens, "Host")
+	}
+	if c.BucketOverrideKey != "" {
+		tokens = append(tokens, bucketOverrideHeader)
+	}
+	return append(tokens, c.ExtraVary...)
+}
+
+// hostDependent reports whether c maps distinct hosts to different
+// content, i.e. it has Hosts, Sites or BucketPaths entries, whose keys
+// start with a host, or Buckets keys other than "default".
+func (c *appConfig) hostDependent() bool {
+	if len(c.Hosts) > 0 || len(c.Sites) > 0 || len(c.BucketPaths) > 0 {
+		return true
+	}
+	for k := range c.Buckets {
+		if k != "default" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateExtraVary reports an error if any of c.ExtraVary
+// is not a header name or "*".
+func (c *appConfig) validateExtraVary() error {
+	for i, v := range c.ExtraVary {
+		if v == "*" {
+			continue
+		}
+		if !validHeaderName(v) {
+			return fmt.Errorf("extra_vary[%d]: %q is not a header name", i, v)
+		}
+	}
+	return nil
+}
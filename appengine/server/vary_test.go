@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestAddVary(t *testing.T) {
+	tests := []struct {
+		have   []string
+		tokens []string
+		want   string
+	}{
+		{nil, nil, ""},
+		{nil, []string{"accept-encoding"}, "Accept-Encoding"},
+		{[]string{"Accept-Encoding"}, []string{"Accept-Encoding", "Origin"}, "Accept-Encoding, Origin"},
+		{[]string{"Origin, accept-encoding", "Host"}, []string{"ACCEPT-ENCODING"}, "Origin, Accept-Encoding, Host"},
+		{[]string{" , Origin"}, []string{""}, "Origin"},
+		{[]string{"Origin"}, []string{"*", "Host"}, "*"},
+	}
+	for i, test := range tests {
+		h := http.Header{"Vary": test.have}
+		addVary(h, test.tokens...)
+		if v := strings.Join(h["Vary"], ", "); v != test.want {
+			t.Errorf("%d: vary = %q; want %q", i, v, test.want)
+		}
+		if len(h["Vary"]) > 1 {
+			t.Errorf("%d: %d vary headers; want 1", i, len(h["Vary"]))
+		}
+	}
+}
+
+func TestServe_Vary(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".css"):
+			w.Header().Set("content-type", "text/css")
+		default:
+			w.Header().Set("content-type", "image/png")
+		}
+		w.Write([]byte(strings.Repeat("a", 2048)))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+
+	tests := []struct {
+		edit      func(*appConfig)
+		path      string
+		origin    string
+		wantVary  string
+		wantCount int
+	}{
+		{func(c *appConfig) {}, "/logo.png", "", "", 0},
+		{func(c *appConfig) {}, "/site.css", "", "Accept-Encoding", 1},
+		{func(c *appConfig) {
+			c.CORS = &corsConfig{AllowOrigins: []string{"https://app.example.com"}}
+		}, "/site.css", "https://app.example.com", "Origin, Accept-Encoding", 1},
+		{func(c *appConfig) {
+			c.Buckets["docs.example.com"] = bucketList{"docs"}
+		}, "/site.css", "", "Host, Accept-Encoding", 1},
+		{func(c *appConfig) {
+			c.Sites = map[string]*appConfig{"docs.example.com": {Buckets: map[string]bucketList{"default": {"docs"}}}}
+			c.sites = c.buildSites()
+		}, "/site.css", "", "Host, Accept-Encoding", 1},
+		{func(c *appConfig) {
+			c.Buckets["docs.example.com"] = bucketList{"docs"}
+			c.CORS = &corsConfig{AllowOrigins: []string{"https://app.example.com"}}
+			c.ExtraVary = []string{"x-device", "origin", "Accept-Encoding"}
+		}, "/site.css", "https://app.example.com", "Host, X-Device, Origin, Accept-Encoding", 1},
+		{func(c *appConfig) {
+			c.ExtraVary = []string{"*"}
+		}, "/site.css", "", "*", 1},
+	}
+	for i, test := range tests {
+		restore := withConfig(func(c *appConfig) {
+			c.Buckets = map[string]bucketList{"default": {"bucket"}}
+			test.edit(c)
+		})
+		req, _ := testInstance.NewRequest("GET", test.path, nil)
+		req.Header.Set("accept-encoding", "gzip")
+		if test.origin != "" {
+			req.Header.Set("origin", test.origin)
+		}
+		if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		restore()
+		if res.Code != http.StatusOK {
+			t.Errorf("%d: res.Code = %d; want 200", i, res.Code)
+		}
+		if n := len(res.Header()["Vary"]); n != test.wantCount {
+			t.Errorf("%d: %d vary headers; want %d", i, n, test.wantCount)
+		}
+		if v := res.Header().Get("vary"); v != test.wantVary {
+			t.Errorf("%d: vary = %q; want %q", i, v, test.wantVary)
+		}
+	}
+}
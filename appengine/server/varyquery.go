@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// queryVariant returns the name of the object r addresses: the object name of
+// the request path followed by "?" and the request parameters listed in the
+// current config CacheVaryQuery, e.g. "config.json?env=staging", or the name
+// alone if r has none of them. Only the first non-empty value of a parameter
+// is used, and parameters are sorted, so that equivalent requests share the
+// name, thus the cache entry. It reports whether the name is a variant.
+func queryVariant(ctx context.Context, r *http.Request) (string, bool) {
+	oname := r.URL.Path[1:]
+	params := currentConfig().CacheVaryQuery
+	if len(params) == 0 || r.URL.RawQuery == "" {
+		return oname, false
+	}
+	q := r.URL.Query()
+	v := make(url.Values)
+	for _, k := range params {
+		for _, val := range q[k] {
+			if val != "" {
+				v.Set(k, val)
+				break
+			}
+		}
+	}
+	if len(v) == 0 {
+		return oname, false
+	}
+	return storageFrom(ctx).FileName(oname) + "?" + v.Encode(), true
+}
+
+// variantBase returns the object name of variant name without its query,
+// e.g. "config.json" of "config.json?env=staging", or name as is if
+// CacheVaryQuery is not configured.
+func variantBase(name string) string {
+	if len(currentConfig().CacheVaryQuery) == 0 {
+		return name
+	}
+	if i := strings.LastIndexByte(name, '?'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// validateCacheVaryQuery reports an error if c.CacheVaryQuery
+// has an empty or duplicate parameter name.
+func (c *appConfig) validateCacheVaryQuery() error {
+	seen := make(map[string]bool, len(c.CacheVaryQuery))
+	for i, k := range c.CacheVaryQuery {
+		switch {
+		case k == "":
+			return fmt.Errorf("cache_vary_query[%d]: must not be empty", i)
+		case seen[k]:
+			return fmt.Errorf("cache_vary_query[%d]: %q is listed twice", i, k)
+		}
+		seen[k] = true
+	}
+	return nil
+}
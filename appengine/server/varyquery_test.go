@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestServe_CacheVaryQuery(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = make(map[string]int)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.Path]++
+		mu.Unlock()
+		// the type is inferred from the object name extension
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/bucket/")))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	defer func(c *weasel.LRU, ttl time.Duration) { storage.Cache, storage.CacheTTL = c, ttl }(storage.Cache, storage.CacheTTL)
+	storage.Cache = weasel.NewLRU(1<<20, 16)
+	storage.CacheTTL = time.Hour
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"bucket"}}
+		c.CacheVaryQuery = []string{"env", "v"}
+	})()
+
+	tests := []struct {
+		uri, body string
+	}{
+		{"/config.json?env=staging", "config.json?env=staging"},
+		{"/config.json?env=prod", "config.json?env=prod"},
+		{"/config.json?junk=1&env=staging", "config.json?env=staging"},
+		{"/config.json?v=2&env=staging", "config.json?env=staging&v=2"},
+		{"/config.json?env=staging&v=2", "config.json?env=staging&v=2"},
+		{"/config.json?env=&env=prod", "config.json?env=prod"},
+		{"/config.json", "config.json"},
+		{"/config.json?junk=2", "config.json"},
+		{"/config.json?env=", "config.json"},
+		{"/docs/?v=1", "docs/index.html?v=1"},
+	}
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		req, _ := testInstance.NewRequest("GET", test.uri, nil)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: res.Code = %d; want 200", test.uri, res.Code)
+			continue
+		}
+		if v := res.Body.String(); v != test.body {
+			t.Errorf("%s: body = %q; want %q", test.uri, v, test.body)
+		}
+		if v := res.Header().Get("content-type"); strings.HasPrefix(test.body, "config.json") && v != "application/json" {
+			t.Errorf("%s: content-type = %q; want application/json", test.uri, v)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"config.json?env=staging", "config.json?env=prod", "config.json?env=staging&v=2", "config.json"} {
+		if n := fetches["/bucket/"+name]; n != 1 {
+			t.Errorf("%s: fetches = %d; want 1", name, n)
+		}
+	}
+}
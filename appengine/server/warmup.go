@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// warmupPath is the App Engine warmup request path.
+	warmupPath = "/_ah/warmup"
+	// defaultWarmupConcurrency is the default value of WarmupConcurrency.
+	defaultWarmupConcurrency = 4
+	// warmupTimeout limits the time spent prefetching Warmup objects.
+	warmupTimeout = 30 * time.Second
+)
+
+// serveWarmup prefetches the current config Warmup objects from the default bucket
+// into the caches, using at most WarmupConcurrency concurrent requests,
+// and loads Favicon into memory.
+// It responds with 200 status code once all objects are fetched or warmupTimeout
+// passes. Fetch errors are logged and don't fail the warmup.
+func serveWarmup(w http.ResponseWriter, r *http.Request) {
+	// this is not a client request, so don't use newContext.
+	ctx, cancel := context.WithTimeout(appengine.NewContext(r), warmupTimeout)
+	defer cancel()
+	c := currentConfig()
+	n := c.WarmupConcurrency
+	if n <= 0 {
+		n = defaultWarmupConcurrency
+	}
+	done := make(chan struct{})
+	go func() {
+		if c.Favicon != "" {
+			if _, err := favicon.get(ctx, c.Favicon); err != nil {
+				log.Warningf(ctx, "warmup favicon %s: %v", c.Favicon, err)
+			}
+		}
+		warmup(ctx, c.Buckets["default"].primary(), c.Warmup, n)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warningf(ctx, "warmup: %v", ctx.Err())
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// warmup reads the bucket objects names using n concurrent workers,
+// and returns when all reads are done or ctx is done.
+func warmup(ctx context.Context, bucket string, names []string, n int) {
+	namec := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range namec {
+				name = strings.TrimPrefix(name, "/")
+				o, err := storage.ReadFile(ctx, bucket, name)
+				if err != nil {
+					log.Warningf(ctx, "warmup %s/%s: %v", bucket, name, err)
+					continue
+				}
+				// streamed objects are not cached
+				o.Close()
+			}
+		}()
+	}
+loop:
+	for _, name := range names {
+		select {
+		case namec <- name:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(namec)
+	wg.Wait()
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goadesign/goa.design/appengine"
+)
+
+func TestServe_Warmup(t *testing.T) {
+	var (
+		mu               sync.Mutex
+		inflight, maxInf int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > maxInf {
+			maxInf = inflight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		if r.URL.Path == "/warm-bucket/missing.js" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	storage.Base = ts.URL
+	storage.Cache = weasel.NewLRU(1<<20, 0)
+	defer func() { storage.Cache = nil }()
+
+	names := []string{"/missing.js"}
+	for i := 0; i < 8; i++ {
+		names = append(names, fmt.Sprintf("/TestServe_Warmup/%d.js", i))
+	}
+	defer withConfig(func(c *appConfig) {
+		c.Buckets = map[string]bucketList{"default": {"warm-bucket"}}
+		c.Warmup = names
+		c.WarmupConcurrency = 2
+	})()
+
+	req, _ := testInstance.NewRequest("GET", "/_ah/warmup", nil)
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusOK)
+	}
+	if maxInf > 2 {
+		t.Errorf("max concurrent fetches = %d; want <= 2", maxInf)
+	}
+	for _, name := range names[1:] {
+		if _, ok := storage.Cache.Get(storage.CacheKey("warm-bucket", name[1:])); !ok {
+			t.Errorf("%s is not in local cache", name)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// MaxSignedURLExpiry is the longest validity period of V4 signed URLs.
+const MaxSignedURLExpiry = 7 * 24 * time.Hour
+
+// signAlgorithm is the V4 signing algorithm of URLs signed with App Engine
+// service account keys.
+const signAlgorithm = "GOOG4-RSA-SHA256"
+
+// SignedURL returns a V4 signed URL for a GET request of the bucket object name,
+// valid for the expiry period starting at t. The URL is signed with
+// the App Engine service account credentials,
+// see https://cloud.google.com/storage/docs/access-control/signed-urls.
+func (s *Storage) SignedURL(ctx context.Context, bucket, name string, t time.Time, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > MaxSignedURLExpiry {
+		return "", fmt.Errorf("weasel: signed URL expiry %v is out of range", expiry)
+	}
+	base, err := url.Parse(s.base(bucket))
+	if err != nil {
+		return "", err
+	}
+	email, err := appengine.ServiceAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	t = t.UTC()
+	date := t.Format("20060102")
+	stamp := t.Format("20060102T150405Z")
+	scope := date + "/auto/storage/goog4_request"
+	q := map[string]string{
+		"X-Goog-Algorithm":     signAlgorithm,
+		"X-Goog-Credential":    email + "/" + scope,
+		"X-Goog-Date":          stamp,
+		"X-Goog-Expires":       strconv.Itoa(int(expiry / time.Second)),
+		"X-Goog-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	query := make([]string, len(keys))
+	for i, k := range keys {
+		query[i] = escapeV4(k, false) + "=" + escapeV4(q[k], false)
+	}
+	canonicalQuery := strings.Join(query, "&")
+	canonicalPath := escapeV4(strings.TrimSuffix(base.Path, "/")+"/"+bucket+"/"+s.objectKey(bucket, name), true)
+
+	creq := strings.Join([]string{
+		"GET",
+		canonicalPath,
+		canonicalQuery,
+		"host:" + base.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(creq))
+	toSign := strings.Join([]string{signAlgorithm, stamp, scope, hex.EncodeToString(sum[:])}, "\n")
+	_, sig, err := appengine.SignBytes(ctx, []byte(toSign))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s%s?%s&X-Goog-Signature=%s",
+		base.Scheme, base.Host, canonicalPath, canonicalQuery, hex.EncodeToString(sig)), nil
+}
+
+// escapeV4 percent-encodes all bytes of s other than RFC 3986 unreserved
+// characters, and "/" if path is true.
+func escapeV4(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
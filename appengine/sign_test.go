@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+func TestSignedURL(t *testing.T) {
+	t.Parallel()
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	stor := &Storage{Base: "https://storage.googleapis.com"}
+	start := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	s, err := stor.SignedURL(ctx, "bucket", "dir/file name+1.zip", start, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("stor.SignedURL: %v", err)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", s, err)
+	}
+	if u.Host != "storage.googleapis.com" || u.Path != "/bucket/dir/file name+1.zip" {
+		t.Errorf("u.Host, u.Path = %q, %q", u.Host, u.Path)
+	}
+	if v := u.EscapedPath(); v != "/bucket/dir/file%20name%2B1.zip" {
+		t.Errorf("u.EscapedPath() = %q", v)
+	}
+	q := u.Query()
+	email, _ := appengine.ServiceAccount(ctx)
+	want := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    email + "/20160102/auto/storage/goog4_request",
+		"X-Goog-Date":          "20160102T030405Z",
+		"X-Goog-Expires":       "900",
+		"X-Goog-SignedHeaders": "host",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q; want %q", k, q.Get(k), v)
+		}
+	}
+	if q.Get("X-Goog-Signature") == "" {
+		t.Error("X-Goog-Signature is empty")
+	}
+
+	for _, d := range []time.Duration{0, -time.Second, MaxSignedURLExpiry + time.Second} {
+		if _, err := stor.SignedURL(ctx, "bucket", "file", start, d); err == nil {
+			t.Errorf("stor.SignedURL(%v): nil error", d)
+		}
+	}
+}
+
+func TestEscapeV4(t *testing.T) {
+	tests := []struct {
+		in   string
+		path bool
+		out  string
+	}{
+		{"a-Z_0.9~", false, "a-Z_0.9~"},
+		{"a/b c", true, "a/b%20c"},
+		{"a/b c", false, "a%2Fb%20c"},
+		{"ü+=&", false, "%C3%BC%2B%3D%26"},
+	}
+	for _, test := range tests {
+		if v := escapeV4(test.in, test.path); v != test.out {
+			t.Errorf("escapeV4(%q, %v) = %q; want %q", test.in, test.path, v, test.out)
+		}
+	}
+}
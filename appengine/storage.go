@@ -15,7 +15,9 @@
 package weasel
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
@@ -38,6 +40,9 @@ const (
 	ScopeStorageOwner = "https://www.googleapis.com/auth/devstorage.full_control"
 )
 
+// defaultRetryBackoff is the default value of Storage.RetryBackoff.
+const defaultRetryBackoff = 100 * time.Millisecond
+
 // DefaultStorage is a Storage with sensible default parameters
 // suitable for prod environments on App Engine.
 var DefaultStorage = Storage{
@@ -49,12 +54,112 @@ var DefaultStorage = Storage{
 type Storage struct {
 	Base  string // GCS service base URL, e.g. "https://storage.googleapis.com".
 	Index string // Appended to an object name in certain cases, e.g. "index.html".
+	// BucketBases maps bucket names to base URLs of buckets served
+	// from other than Base, e.g. a custom domain. Base is used for
+	// buckets not listed.
+	BucketBases map[string]string
+	// KeyTransforms maps bucket names to transforms of object names,
+	// e.g. prefixing them with "public/", into the keys objects are stored
+	// under in the bucket. Storage methods take object names; cache keys
+	// and storage requests use the transformed keys, so that names mapping
+	// to the same key share a cache entry. Notifications received by
+	// HandleChangeHook carry keys, which are mapped back to names.
+	KeyTransforms map[string]KeyTransform
+	// Mirrors maps primary bucket names to buckets holding a copy of them,
+	// which reads of objects, metadata and listings fail over to when
+	// the primary bucket fails repeatedly. Cache keys are those of
+	// the primary bucket. See Mirror.
+	Mirrors map[string]*Mirror
+	// Indexes, if not empty, are index names used in place of Index,
+	// e.g. ["index.html", "README.html"], tried in order by ReadFile.
+	Indexes []string
+	// IndexPaths maps object name prefixes, e.g. "docs/", to index names
+	// used in place of Indexes for objects under them. The longest prefix wins.
+	IndexPaths map[string][]string
+	// Cache, if not nil, is consulted before memcache
+	// and populated with objects retrieved from memcache or network.
+	Cache *LRU
+	// CacheTTL, if positive, is how long objects of Cache are fresh.
+	// Objects served from Cache carry their age in an "age" Meta entry.
+	// Zero means cached objects never expire.
+	CacheTTL time.Duration
+	// StaleWhileRevalidate is how long past CacheTTL an object of Cache
+	// is still served to requests while another one revalidates it.
+	// Objects older than that are fetched from the network again.
+	StaleWhileRevalidate time.Duration
+	// ObserveFetch, if not nil, is called with the duration
+	// of each request sent to GCS, including failed ones.
+	ObserveFetch func(bucket string, d time.Duration)
+	// ObjectChanged, if not nil, is called by HandleChangeHook with the bucket
+	// and name of each changed object once it is removed from the caches.
+	ObjectChanged func(ctx context.Context, bucket, name string)
+	// MaxAttempts is the maximum number of requests sent to GCS
+	// for a single operation failing with transient errors. Zero means 1.
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubled after each
+	// attempt. Zero means defaultRetryBackoff.
+	RetryBackoff time.Duration
+	// Tracer, if not nil, is used to trace object fetches in "gcs.fetch"
+	// spans annotated with bucket, object, status and duration.
+	Tracer Tracer
+	// StreamThreshold is the size in bytes above which object contents
+	// are returned as Object.Stream instead of being read into memory,
+	// bypassing the caches. Zero disables streaming.
+	StreamThreshold int64
+	// MaxInlineBytes, if positive, caps the size of object contents read
+	// into memory, and hence cached. Larger objects are streamed if streaming
+	// is enabled, and fail with 413 FetchError otherwise.
+	MaxInlineBytes int64
+	// Immutable, if not nil, reports whether contents of object name
+	// of the bucket never change, e.g. a fingerprinted asset. Such objects
+	// are read into memory up to ImmutableMaxBytes, regardless of
+	// StreamThreshold and MaxInlineBytes, cached regardless of the Cache
+	// entry size limit, and never expire nor get revalidated once cached.
+	Immutable func(bucket, name string) bool
+	// ImmutableMaxBytes, if greater than the inline size limit, is the size
+	// in bytes above which Immutable objects are streamed or rejected.
+	ImmutableMaxBytes int64
+	// AcceptGzip enables fetching objects stored with gzip content encoding
+	// as is, with "content-encoding" Meta entry, rather than decompressed
+	// by the storage. Range requests are still decompressed.
+	AcceptGzip bool
+	// Backend, if not nil, is the object storage used in place of GCS at Base.
+	// Base still prefixes the cache keys of its objects. See Backend.
+	Backend Backend
+	// CoalesceFetches makes concurrent reads missing the caches for the same
+	// object share a single fetch and cache population, keyed by the cache
+	// key and request headers, so a burst of them sends one GCS request.
+	// The waiters get the object of whichever generation that fetch returns.
+	// Objects streamed past StreamThreshold are not shared, as their body is
+	// read once: waiters fetch them on their own when the shared fetch turns
+	// out streamed, so only the wait for its response headers is coalesced.
+	CoalesceFetches bool
+	// Transport, if not nil, is the transport of requests sent to GCS,
+	// in place of urlfetch. Requests are still authorized with tokens
+	// of the app service account.
+	Transport http.RoundTripper
 }
 
 // ReadFile abstracts ReadObject and treats object name like a file path.
+// An empty name or one ending with "/" is read as the first of its
+// directory IndexNames found in the bucket.
 func (s *Storage) ReadFile(ctx context.Context, bucket, name string) (*Object, error) {
+	return s.readFile(ctx, bucket, name, false)
+}
+
+// ReadFileMeta is similar to ReadFile except objects are stat-ed,
+// so the returned object.Body may be nil.
+func (s *Storage) ReadFileMeta(ctx context.Context, bucket, name string) (*Object, error) {
+	return s.readFile(ctx, bucket, name, true)
+}
+
+// readFile implements ReadFile, or ReadFileMeta if stat is true.
+func (s *Storage) readFile(ctx context.Context, bucket, name string, stat bool) (*Object, error) {
 	if name == "" || strings.HasSuffix(name, "/") {
-		name += s.Index
+		if stat {
+			return s.statIndex(ctx, bucket, name)
+		}
+		return s.readIndex(ctx, bucket, name)
 	}
 
 	// stat /dir/index.html if name is /dir, concurrently
@@ -63,10 +168,9 @@ func (s *Storage) ReadFile(ctx context.Context, bucket, name string) (*Object, e
 		statdir *Object
 		staterr error
 	)
-	if !strings.HasSuffix(name, s.Index) && filepath.Ext(name) == "" {
+	if filepath.Ext(name) == "" {
 		go func() {
-			idx := path.Join(name, s.Index)
-			statdir, staterr = s.Stat(ctx, bucket, idx)
+			statdir, staterr = s.statIndex(ctx, bucket, name+"/")
 			close(statc)
 		}()
 	} else {
@@ -74,7 +178,11 @@ func (s *Storage) ReadFile(ctx context.Context, bucket, name string) (*Object, e
 	}
 
 	// get the original object meanwhile
-	o, err := s.ReadObject(ctx, bucket, name)
+	read := s.ReadObject
+	if stat {
+		read = s.Stat
+	}
+	o, err := read(ctx, bucket, name)
 	if err == nil {
 		return o, nil
 	}
@@ -102,101 +210,404 @@ func (s *Storage) ReadFile(ctx context.Context, bucket, name string) (*Object, e
 	return statdir, nil
 }
 
+// readIndex reads the first of IndexNames of directory dir found in the bucket.
+// Errors other than 404 are returned right away. If none is found,
+// the error of the first index name is returned.
+func (s *Storage) readIndex(ctx context.Context, bucket, dir string) (*Object, error) {
+	var notFound error
+	for _, idx := range s.IndexNames(dir) {
+		o, err := s.ReadObject(ctx, bucket, dir+idx)
+		if err == nil {
+			return o, nil
+		}
+		if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusNotFound {
+			return nil, err
+		}
+		if notFound == nil {
+			notFound = err
+		}
+	}
+	return nil, notFound
+}
+
+// statIndex is similar to readIndex except the index objects are stat-ed.
+func (s *Storage) statIndex(ctx context.Context, bucket, dir string) (*Object, error) {
+	var notFound error
+	for _, idx := range s.IndexNames(dir) {
+		o, err := s.Stat(ctx, bucket, path.Join(dir, idx))
+		if err == nil {
+			return o, nil
+		}
+		if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusNotFound {
+			return nil, err
+		}
+		if notFound == nil {
+			notFound = err
+		}
+	}
+	return nil, notFound
+}
+
 // ReadObject retrieves GCS object name of the bucket from cache or network.
 // Objects fetched from the network are cached before returning
-// from this function.
+// from this function. Objects returned from s.Cache are shared
+// and must not be modified.
 func (s *Storage) ReadObject(ctx context.Context, bucket, name string) (*Object, error) {
+	return s.readObject(ctx, bucket, name, nil)
+}
+
+// ReadRaw is similar to ReadObject except the object body is never
+// transparently decompressed, even if the storage serves it with
+// gzip content encoding.
+func (s *Storage) ReadRaw(ctx context.Context, bucket, name string) (*Object, error) {
+	return s.readObject(ctx, bucket, name, http.Header{"Accept-Encoding": {"gzip"}})
+}
+
+// readObject implements ReadObject, sending additional headers h
+// to the storage on cache miss.
+func (s *Storage) readObject(ctx context.Context, bucket, name string, h http.Header) (*Object, error) {
 	key := s.CacheKey(bucket, name)
-	o, err := getCache(ctx, key)
-	if err != nil {
-		o, err = s.fetch(ctx, bucket, name)
-		if err == nil {
-			putCache(ctx, key, o)
+	immutable := s.immutable(bucket, name)
+	start := time.Now()
+	o, age, ok := s.Cache.Lookup(key)
+	switch {
+	case ok && immutable:
+		recordCache(ctx, true, start)
+		return o, nil
+	case ok && (s.CacheTTL <= 0 || age < s.CacheTTL):
+		recordCache(ctx, true, start)
+		return withAge(o, age, s.CacheTTL), nil
+	case ok && age < s.CacheTTL+s.StaleWhileRevalidate:
+		recordCache(ctx, true, start)
+		if fresh, ok := s.revalidate(ctx, bucket, name, h, o); ok {
+			return fresh, nil
 		}
+		return withAge(o, age, s.CacheTTL), nil
 	}
-	return o, err
+	// objects read before a purge of the key must not be cached after it
+	f := purges.start(key)
+	defer f.done()
+	// memcache holds objects at least as old as an expired one
+	var err error = memcache.ErrCacheMiss
+	if !ok {
+		o, err = getCache(ctx, key)
+	}
+	recordCache(ctx, err == nil, start)
+	if err != nil {
+		start = time.Now()
+		o, err = s.coalesce(ctx, f, h, func() (*Object, error) {
+			o, err := s.fetch(ctx, bucket, name, h)
+			if err == nil && o.Stream == nil {
+				f.populate(func() {
+					putCache(ctx, key, o)
+					s.Cache.add(key, o, !immutable)
+				})
+			}
+			return o, err
+		})
+		recordFetch(ctx, start)
+		return o, err
+	}
+	f.populate(func() { s.Cache.add(key, o, !immutable) })
+	return o, nil
+}
+
+// immutable reports whether object name of the bucket is Immutable.
+func (s *Storage) immutable(bucket, name string) bool {
+	return s.Immutable != nil && s.Immutable(bucket, name)
 }
 
 // Stat is similar to Read except the returned object.Body may be nil.
 func (s *Storage) Stat(ctx context.Context, bucket, name string) (*Object, error) {
-	if o, err := getCache(ctx, s.CacheKey(bucket, name)); err == nil {
+	key := s.CacheKey(bucket, name)
+	start := time.Now()
+	if o, ok := s.Cache.Get(key); ok {
+		recordCache(ctx, true, start)
 		return o, nil
 	}
-	u := fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
-	req, err := http.NewRequest("HEAD", u, nil)
-	if err != nil {
-		return nil, err
+	if o, err := getCache(ctx, key); err == nil {
+		recordCache(ctx, true, start)
+		return o, nil
 	}
-	res, err := httpClient(ctx, ScopeStorageRead).Do(req)
+	recordCache(ctx, false, start)
+	defer recordFetch(ctx, time.Now())
+	return s.Head(ctx, bucket, name)
+}
+
+// Head is similar to Stat but always queries the backend,
+// bypassing the caches.
+func (s *Storage) Head(ctx context.Context, bucket, name string) (*Object, error) {
+	from, done := s.readBucket(ctx, bucket)
+	meta, err := s.backend().Stat(ctx, from, s.objectKey(bucket, name))
+	done(err)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		b, _ := ioutil.ReadAll(res.Body)
-		return nil, &FetchError{
-			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
-			Code: res.StatusCode,
-		}
+	return &Object{Meta: meta}, nil
+}
+
+// StatBucket reports an error if the bucket does not exist or is not
+// accessible with the storage credentials, bypassing the caches.
+// The error is a FetchError if the storage responds with an error code,
+// e.g. 403 or 404.
+func (s *Storage) StatBucket(ctx context.Context, bucket string) error {
+	_, err := s.backend().Stat(ctx, bucket, "")
+	return err
+}
+
+// StatFile is similar to ReadFile except the returned object.Body may be nil
+// and no attempt is made to treat a missing object as a "directory".
+func (s *Storage) StatFile(ctx context.Context, bucket, name string) (*Object, error) {
+	return s.Stat(ctx, bucket, s.FileName(name))
+}
+
+// ReadRange retrieves a byte range of object name, treated as a file path
+// similar to StatFile. The rng argument is an HTTP Range header value.
+// The returned object's Meta contain "content-range" if the storage responded
+// with partial content. Objects retrieved with ReadRange are never cached.
+func (s *Storage) ReadRange(ctx context.Context, bucket, name, rng string) (*Object, error) {
+	defer recordFetch(ctx, time.Now())
+	return s.fetch(ctx, bucket, s.FileName(name), http.Header{"Range": {rng}})
+}
+
+// FileName appends the index name of name's directory to name
+// if it is empty or ends with "/". See IndexName.
+func (s *Storage) FileName(name string) string {
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += s.IndexName(name)
 	}
-	meta := make(map[string]string)
-	for _, k := range objectHeaders {
-		if v := res.Header.Get(k); v != "" {
-			meta[k] = v
+	return name
+}
+
+// IndexName returns the first of IndexNames of name.
+func (s *Storage) IndexName(name string) string {
+	return s.IndexNames(name)[0]
+}
+
+// IndexNames returns the index object names of the "directory" containing
+// object name, in the order they are tried: the value of the longest
+// s.IndexPaths prefix of name, or s.Indexes if none matches.
+// If s.Indexes is empty, s.Index is the only index name.
+// The returned slice is never empty.
+func (s *Storage) IndexNames(name string) []string {
+	idx, n := s.Indexes, -1
+	for p, v := range s.IndexPaths {
+		if len(p) > n && len(v) > 0 && strings.HasPrefix(name, p) {
+			idx, n = v, len(p)
 		}
 	}
-	return &Object{Meta: meta}, nil
+	if len(idx) == 0 {
+		return []string{s.Index}
+	}
+	return idx
 }
 
-// PurgeCache removes cached object from memcache.
+// PurgeCache removes cached object from s.Cache and memcache.
 // It does not return an error in the case of cache miss.
+// Reads of the object in progress do not cache it again.
 func (s *Storage) PurgeCache(ctx context.Context, bucket, name string) error {
-	return purgeCache(ctx, s.CacheKey(bucket, name))
+	key := s.CacheKey(bucket, name)
+	purges.purge(key, false)
+	s.Cache.Remove(key)
+	return purgeCache(ctx, key)
+}
+
+// PurgeLocal removes objects of the bucket whose names start with prefix
+// from s.Cache, and returns the number of removed objects.
+// Unlike PurgeCache, it does not affect memcache.
+func (s *Storage) PurgeLocal(bucket, prefix string) int {
+	key := fmt.Sprintf("%s/%s/%s", s.base(bucket), bucket, s.objectKey(bucket, prefix))
+	purges.purge(key, true)
+	return s.Cache.RemovePrefix(key)
+}
+
+// PurgeAll removes all objects from s.Cache, and returns their number.
+// Like PurgeLocal, it does not affect memcache.
+func (s *Storage) PurgeAll() int {
+	purges.purge("", true)
+	return s.Cache.RemovePrefix("")
 }
 
 // CacheKey returns a key to cache an object under, computed from
-// s.Base, bucket and then name.
+// the bucket base URL, bucket and then the storage key of name.
 func (s *Storage) CacheKey(bucket, name string) string {
-	return fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
+	return fmt.Sprintf("%s/%s", s.base(bucket), objectPath(bucket, s.objectKey(bucket, name)))
 }
 
-// fetch retrieves object obj from the given GCS bucket.
+// objectURL returns the URL of object name of the bucket, with the name
+// percent-encoded as is, so that names containing e.g. " ", "+", "%", "?"
+// or non-ASCII characters address the object of that very name.
+func (s *Storage) objectURL(bucket, name string) string {
+	return s.base(bucket) + "/" + escapeV4(objectPath(bucket, name), true)
+}
+
+// objectPath returns the path of object name relative to the storage base,
+// or the bucket alone if name is empty. A leading "/" of name is ignored.
+// Unlike path.Join, it keeps the rest of the name intact,
+// since "//" and "." are valid in object names.
+func objectPath(bucket, name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		return bucket
+	}
+	return bucket + "/" + name
+}
+
+// base returns the base URL of the bucket, either its s.BucketBases
+// entry, the Base of a mirror it is the Bucket of, or s.Base.
+func (s *Storage) base(bucket string) string {
+	if b, ok := s.BucketBases[bucket]; ok {
+		return b
+	}
+	for _, m := range s.Mirrors {
+		if m.Bucket == bucket && m.Base != "" {
+			return m.Base
+		}
+	}
+	return s.Base
+}
+
+// fetch retrieves object obj of the bucket from the backend,
+// sending additional request headers h, if any, and Accept-Encoding
+// as configured by s.AcceptGzip.
+// Contents longer than s.StreamThreshold or s.MaxInlineBytes are returned
+// as the object Stream, or rejected if streaming is disabled, with at most
+// one byte more than the limit read ahead when the length is unknown.
 // The returned error will be of type FetchError if the storage responds
 // with an error code.
-func (s *Storage) fetch(ctx context.Context, bucket, obj string) (*Object, error) {
-	u := fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, obj))
-	req, err := http.NewRequest("GET", u, nil)
+func (s *Storage) fetch(ctx context.Context, bucket, obj string, h http.Header) (*Object, error) {
+	if s.AcceptGzip && h.Get("Range") == "" && h.Get("Accept-Encoding") == "" {
+		h2 := http.Header{"Accept-Encoding": {"gzip"}}
+		for k, v := range h {
+			h2[k] = v
+		}
+		h = h2
+	}
+	from, done := s.readBucket(ctx, bucket)
+	r, err := s.backend().Open(ctx, from, s.objectKey(bucket, obj), h)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
-	res, err := httpClient(ctx, ScopeStorageRead).Do(req)
+	max := s.maxInline()
+	if max > 0 && s.ImmutableMaxBytes > max && s.immutable(bucket, obj) {
+		max = s.ImmutableMaxBytes
+	}
+	if max > 0 && r.Size > max {
+		return s.oversized(ctx, bucket, obj, max, r.Meta, r.Body)
+	}
+	body := io.Reader(r.Body)
+	if max > 0 {
+		body = io.LimitReader(r.Body, max+1)
+	}
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
+		r.Body.Close()
 		return nil, err
 	}
-	defer res.Body.Close()
+	if max > 0 && int64(len(b)) > max {
+		rc := readCloser{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+		return s.oversized(ctx, bucket, obj, max, r.Meta, rc)
+	}
+	r.Body.Close()
+	return &Object{Body: b, Meta: r.Meta}, nil
+}
 
-	// error status code takes precedence over i/o errors
-	b, err := ioutil.ReadAll(res.Body)
-	if res.StatusCode > 399 {
-		return nil, &FetchError{
-			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
-			Code: res.StatusCode,
-		}
+// maxInline returns the maximum size of object contents read into memory:
+// the lesser of positive s.StreamThreshold and s.MaxInlineBytes,
+// or zero if neither is set.
+func (s *Storage) maxInline() int64 {
+	max := s.StreamThreshold
+	if max <= 0 || s.MaxInlineBytes > 0 && s.MaxInlineBytes < max {
+		max = s.MaxInlineBytes
 	}
-	if err != nil { // i/o error
-		return nil, err
+	if max < 0 {
+		max = 0
 	}
+	return max
+}
 
-	o := &Object{
-		Body: b,
-		Meta: make(map[string]string),
+// oversized returns an object streamed from body, longer than max bytes,
+// if streaming is enabled. Otherwise, body is closed and a FetchError
+// with 413 status code is returned. Objects exceeding s.MaxInlineBytes,
+// or a larger limit of Immutable objects, are logged.
+func (s *Storage) oversized(ctx context.Context, bucket, obj string, max int64, meta map[string]string, body io.ReadCloser) (*Object, error) {
+	if s.MaxInlineBytes > 0 && max >= s.MaxInlineBytes {
+		log.Warningf(ctx, "%s/%s: object exceeds %d bytes inline limit", bucket, obj, max)
+	}
+	if s.StreamThreshold > 0 {
+		return &Object{Meta: meta, Stream: body}, nil
 	}
-	for _, k := range objectHeaders {
-		if v := res.Header.Get(k); v != "" {
-			o.Meta[k] = v
+	body.Close()
+	return nil, &FetchError{
+		Msg:  fmt.Sprintf("object larger than %d bytes", max),
+		Code: http.StatusRequestEntityTooLarge,
+	}
+}
+
+// readCloser combines a Reader and a Closer, such as a response body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// send sends req to GCS, retrying on transient errors
+// up to s.MaxAttempts times in total, with exponential backoff.
+func (s *Storage) send(ctx context.Context, bucket string, req *http.Request) (*http.Response, error) {
+	backoff := s.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	if tc := TraceContext(ctx); tc != "" {
+		req.Header.Set(TraceHeader, tc)
+	}
+	client := httpClient(ctx, s.Transport, ScopeStorageRead)
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		res, err := client.Do(req)
+		s.observeFetch(bucket, start)
+		if err == nil && !transientStatus(res.StatusCode) || attempt >= s.MaxAttempts {
+			return res, err
+		}
+		if err == nil {
+			res.Body.Close()
+			log.Warningf(ctx, "%s %s: attempt %d: %s", req.Method, req.URL, attempt, res.Status)
+		} else {
+			log.Warningf(ctx, "%s %s: attempt %d: %v", req.Method, req.URL, attempt, err)
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
-	return o, nil
+}
+
+// transientStatus reports whether GCS response status code
+// indicates a temporary failure.
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// IsTransient reports whether err is a temporary storage failure,
+// such as a timeout or a 5xx GCS response, as opposed to e.g. object not found.
+// Errors other than FetchError are considered transient.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errf, ok := err.(*FetchError); ok {
+		return transientStatus(errf.Code)
+	}
+	return true
+}
+
+// observeFetch calls s.ObserveFetch, if any, with the time elapsed since start.
+func (s *Storage) observeFetch(bucket string, start time.Time) {
+	if s.ObserveFetch != nil {
+		s.ObserveFetch(bucket, time.Since(start))
+	}
 }
 
 func getCache(ctx context.Context, key string) (*Object, error) {
@@ -229,10 +640,15 @@ func purgeCache(ctx context.Context, key string) error {
 	return err
 }
 
-func httpClient(ctx context.Context, scopes ...string) *http.Client {
+// httpClient returns a client authorized with app service account tokens
+// of the scopes, sending requests with base or urlfetch if base is nil.
+func httpClient(ctx context.Context, base http.RoundTripper, scopes ...string) *http.Client {
+	if base == nil {
+		base = &urlfetch.Transport{Context: ctx}
+	}
 	t := &oauth2.Transport{
 		Source: google.AppEngineTokenSource(ctx, scopes...),
-		Base:   &urlfetch.Transport{Context: ctx},
+		Base:   base,
 	}
 	return &http.Client{Transport: t}
 }
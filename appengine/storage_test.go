@@ -18,9 +18,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/memcache"
 )
@@ -62,6 +67,69 @@ func TestReadFileIndex(t *testing.T) {
 	}
 }
 
+func TestIndexName(t *testing.T) {
+	stor := &Storage{Index: "index.html", IndexPaths: map[string][]string{
+		"docs/":     {"README.html"},
+		"docs/api/": {"api.html", "index.html"},
+	}}
+	tests := []struct{ name, index, file string }{
+		{"", "index.html", "index.html"},
+		{"blog/", "index.html", "blog/index.html"},
+		{"docs/", "README.html", "docs/README.html"},
+		{"docs/guide/", "README.html", "docs/guide/README.html"},
+		{"docs/api/", "api.html", "docs/api/api.html"},
+		{"docs/api/v1/", "api.html", "docs/api/v1/api.html"},
+		{"docs/page.html", "README.html", "docs/page.html"},
+		{"documents/", "index.html", "documents/index.html"},
+	}
+	for _, test := range tests {
+		if v := stor.IndexName(test.name); v != test.index {
+			t.Errorf("IndexName(%q) = %q; want %q", test.name, v, test.index)
+		}
+		if v := stor.FileName(test.name); v != test.file {
+			t.Errorf("FileName(%q) = %q; want %q", test.name, v, test.file)
+		}
+	}
+}
+
+func TestReadFileIndexes(t *testing.T) {
+	m := &MemBackend{}
+	m.Put("bucket", "a/index.htm", []byte("a index.htm"), nil)
+	m.Put("bucket", "a/README.html", []byte("a README.html"), nil)
+	m.Put("bucket", "b/README.html", []byte("b README.html"), nil)
+	m.Put("bucket", "c/other.html", []byte("c other.html"), nil)
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{Base: "mem://indexes", Backend: m, Indexes: []string{"index.html", "index.htm", "README.html"}}
+	tests := []struct{ name, body, redirect string }{
+		{"a/", "a index.htm", ""},
+		{"b/", "b README.html", ""},
+		{"b", "", "/b/"},
+		{"c/", "", ""},
+		{"c", "", ""},
+	}
+	for _, test := range tests {
+		o, err := stor.ReadFile(ctx, "bucket", test.name)
+		if test.body == "" && test.redirect == "" {
+			if errf, ok := err.(*FetchError); !ok || errf.Code != http.StatusNotFound {
+				t.Errorf("ReadFile(%q) = %+v, %v; want 404", test.name, o, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadFile(%q): %v", test.name, err)
+			continue
+		}
+		if string(o.Body) != test.body || o.Redirect() != test.redirect {
+			t.Errorf("ReadFile(%q) = %q, redirect %q; want %q, redirect %q", test.name, o.Body, o.Redirect(), test.body, test.redirect)
+		}
+	}
+}
+
 func TestReadFileNoTrailSlash(t *testing.T) {
 	t.Parallel()
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -97,6 +165,165 @@ func TestReadFileNoTrailSlash(t *testing.T) {
 	}
 }
 
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestStorageTransport(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// dev_appserver app identity stub
+		if v, auth := r.Header.Get("authorization"), "Bearer InvalidToken:"+ScopeStorageRead; v != auth {
+			t.Errorf("authorization = %q; want %q", v, auth)
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+
+	r, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(r)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var sent []string
+	stor := &Storage{
+		Base: ts.URL,
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			sent = append(sent, req.URL.Path)
+			mu.Unlock()
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+	o, err := stor.ReadFile(ctx, "bucket", "/file.txt")
+	if err != nil {
+		t.Fatalf("stor.ReadFile: %v", err)
+	}
+	if v := string(o.Body); v != "contents" {
+		t.Errorf("o.Body = %q; want contents", v)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"/bucket/file.txt"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent = %q; want %q", sent, want)
+	}
+}
+
+func TestFetchCancel(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	r, _ := testInstance.NewRequest("GET", "/", nil)
+	stor := &Storage{Base: ts.URL, Transport: http.DefaultTransport}
+	for _, name := range []string{"read.txt", "stat.txt"} {
+		ctx, cancel := context.WithCancel(appengine.NewContext(r))
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		var err error
+		if name == "read.txt" {
+			_, err = stor.ReadFile(ctx, "bucket", name)
+		} else {
+			_, err = stor.StatFile(ctx, "bucket", name)
+		}
+		if err == nil {
+			t.Errorf("%s: no error after the context is cancelled", name)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: took %v after the context is cancelled", name, d)
+		}
+	}
+}
+
+func TestReadFileNoDirStat(t *testing.T) {
+	t.Parallel()
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	r, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(r)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{Base: ts.URL, Index: "index.html"}
+	// names with a file extension are never looked up as directories
+	_, err := stor.ReadFile(ctx, "bucket", "docs/page.html")
+	if errf, ok := err.(*FetchError); !ok || errf.Code != http.StatusNotFound {
+		t.Errorf("stor.ReadFile err = %v; want 404 FetchError", err)
+	}
+	want := []string{"GET /bucket/docs/page.html"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %q; want %q", requests, want)
+	}
+}
+
+func TestReadFileMeta(t *testing.T) {
+	t.Parallel()
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path != "/bucket/page.html" && r.URL.Path != "/bucket/docs/index.html" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "text/html")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+
+	r, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(r)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{Base: ts.URL, Index: "index.html"}
+	o, err := stor.ReadFileMeta(ctx, "bucket", "page.html")
+	if err != nil {
+		t.Fatalf("stor.ReadFileMeta(page.html): %v", err)
+	}
+	if o.Body != nil || o.Meta["content-length"] != "8" || o.Meta["content-type"] != "text/html" {
+		t.Errorf("page.html: o = %+v; want meta only", o)
+	}
+	o, err = stor.ReadFileMeta(ctx, "bucket", "docs")
+	if err != nil {
+		t.Fatalf("stor.ReadFileMeta(docs): %v", err)
+	}
+	if v := o.Redirect(); v != "/docs/" {
+		t.Errorf("docs: o.Redirect() = %q; want /docs/", v)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, req := range requests {
+		if !strings.HasPrefix(req, "HEAD ") {
+			t.Errorf("request %q; want HEAD only", req)
+		}
+	}
+}
+
 func TestReadObjectCache(t *testing.T) {
 	t.Parallel()
 	req, _ := testInstance.NewRequest("GET", "/", nil)
@@ -148,3 +375,633 @@ func TestReadObjectErr(t *testing.T) {
 		t.Errorf("errf.Code = %d; want %d", errf.Code, http.StatusBadRequest)
 	}
 }
+
+func TestReadObjectLocalCache(t *testing.T) {
+	t.Parallel()
+	var fetches int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte("small file"))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1024, 0)}
+	for i := 0; i < 2; i++ {
+		if _, err := stor.ReadObject(ctx, "bucket", "TestReadObjectLocalCache"); err != nil {
+			t.Fatalf("%d: stor.ReadObject: %v", i, err)
+		}
+		// local cache must be consulted before memcache
+		if err := memcache.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetches = %d; want 1", fetches)
+	}
+
+	if err := stor.PurgeCache(ctx, "bucket", "TestReadObjectLocalCache"); err != nil {
+		t.Fatalf("stor.PurgeCache: %v", err)
+	}
+	if n := stor.Cache.Len(); n != 0 {
+		t.Errorf("stor.Cache.Len() = %d; want 0", n)
+	}
+}
+
+func TestReadObjectPurgeInFlight(t *testing.T) {
+	t.Parallel()
+	started, release := make(chan bool), make(chan bool)
+	var mu sync.Mutex
+	body := "old"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		b := body
+		mu.Unlock()
+		if b == "old" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte(b))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1024, 0)}
+	const name = "TestReadObjectPurgeInFlight"
+	done := make(chan *Object, 1)
+	go func() {
+		o, err := stor.ReadObject(ctx, "bucket", name)
+		if err != nil {
+			t.Errorf("stor.ReadObject: %v", err)
+		}
+		done <- o
+	}()
+
+	// the object changes and is purged while read
+	<-started
+	mu.Lock()
+	body = "new"
+	mu.Unlock()
+	if err := stor.PurgeCache(ctx, "bucket", name); err != nil {
+		t.Fatalf("stor.PurgeCache: %v", err)
+	}
+	close(release)
+	<-done
+
+	key := stor.CacheKey("bucket", name)
+	if o, ok := stor.Cache.Get(key); ok {
+		t.Errorf("stor.Cache.Get: %q; want a miss", o.Body)
+	}
+	if o, err := getCache(ctx, key); err == nil {
+		t.Errorf("getCache: %q; want a miss", o.Body)
+	}
+	o, err := stor.ReadObject(ctx, "bucket", name)
+	if err != nil {
+		t.Fatalf("stor.ReadObject: %v", err)
+	}
+	if v := string(o.Body); v != "new" {
+		t.Errorf("o.Body = %q; want new", v)
+	}
+}
+
+func TestReadObjectStaleWhileRevalidate(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches int
+		version = "v1"
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("if-none-match") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if r.Header.Get("if-none-match") == version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("etag", version)
+		w.Write([]byte(version))
+	}))
+	defer ts.Close()
+	defer close(release)
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{
+		Base:                 ts.URL,
+		Cache:                NewLRU(1024, 0),
+		CacheTTL:             time.Minute,
+		StaleWhileRevalidate: time.Minute,
+	}
+	var (
+		clockMu sync.Mutex
+		now     = time.Now()
+	)
+	stor.Cache.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		now = now.Add(d)
+		clockMu.Unlock()
+	}
+	read := func(step, body, age string, n int) {
+		o, err := stor.ReadObject(ctx, "bucket", "TestReadObjectStaleWhileRevalidate")
+		if err != nil {
+			t.Fatalf("%s: stor.ReadObject: %v", step, err)
+		}
+		if string(o.Body) != body || o.Meta["age"] != age {
+			t.Errorf("%s: body = %q, age = %q; want %q, %q", step, o.Body, o.Meta["age"], body, age)
+		}
+		if v := count(); v != n {
+			t.Errorf("%s: fetches = %d; want %d", step, v, n)
+		}
+	}
+	// revalidate reads a stale object while concurrent reads are served
+	// the stale one, and returns the revalidating read result.
+	revalidate := func(step, stale, age string, n int) *Object {
+		res := make(chan *Object, 1)
+		go func() {
+			o, err := stor.ReadObject(ctx, "bucket", "TestReadObjectStaleWhileRevalidate")
+			if err != nil {
+				t.Errorf("%s: stor.ReadObject: %v", step, err)
+			}
+			res <- o
+		}()
+		<-started
+		for i := 0; i < 3; i++ {
+			// stale objects are served while a single revalidation is in flight
+			read(step, stale, age, n)
+		}
+		release <- struct{}{}
+		return <-res
+	}
+
+	read("miss", "v1", "", 1)
+	advance(30 * time.Second)
+	read("fresh", "v1", "30", 1)
+
+	mu.Lock()
+	version = "v2"
+	mu.Unlock()
+	advance(60 * time.Second)
+	if o := revalidate("stale", "v1", "90", 1); o == nil || string(o.Body) != "v2" {
+		t.Errorf("stale: revalidated object = %+v; want v2", o)
+	}
+	read("refreshed", "v2", "0", 2)
+
+	advance(90 * time.Second)
+	if o := revalidate("stale unmodified", "v2", "90", 2); o == nil || string(o.Body) != "v2" {
+		t.Errorf("stale unmodified: revalidated object = %+v; want v2", o)
+	}
+	read("unmodified", "v2", "0", 3)
+
+	advance(3 * time.Minute)
+	read("expired", "v2", "", 4)
+}
+
+func TestCacheStatus(t *testing.T) {
+	t.Parallel()
+	const delay = 10 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("small file"))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx, cs := WithCacheStatus(appengine.NewContext(req))
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1024, 0)}
+	var fetchTime time.Duration
+	for i := 0; i < 2; i++ {
+		if _, err := stor.ReadObject(ctx, "bucket", "TestCacheStatus"); err != nil {
+			t.Fatalf("%d: stor.ReadObject: %v", i, err)
+		}
+		if i == 0 {
+			fetchTime = cs.FetchTime()
+		}
+	}
+	if fetchTime < delay {
+		t.Errorf("cs.FetchTime() = %v after a miss; want at least %v", fetchTime, delay)
+	}
+	if v := cs.FetchTime(); v != fetchTime {
+		t.Errorf("cs.FetchTime() = %v after a hit; want %v", v, fetchTime)
+	}
+	if cs.CacheTime() <= 0 {
+		t.Errorf("cs.CacheTime() = %v; want positive", cs.CacheTime())
+	}
+	if _, err := stor.Stat(ctx, "bucket", "TestCacheStatus"); err != nil {
+		t.Fatalf("stor.Stat: %v", err)
+	}
+	if cs.Hits() != 2 || cs.Misses() != 1 {
+		t.Errorf("cs.Hits(), cs.Misses() = %d, %d; want 2, 1", cs.Hits(), cs.Misses())
+	}
+}
+
+func TestObserveFetch(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("observed"))
+	}))
+	defer ts.Close()
+
+	var buckets []string
+	stor := &Storage{Base: ts.URL, ObserveFetch: func(bucket string, d time.Duration) {
+		buckets = append(buckets, bucket)
+	}}
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	if _, err := stor.ReadRange(ctx, "bucket", "TestObserveFetch", "bytes=0-1"); err != nil {
+		t.Fatalf("stor.ReadRange: %v", err)
+	}
+	if _, err := stor.Head(ctx, "bucket", "TestObserveFetch"); err != nil {
+		t.Fatalf("stor.Head: %v", err)
+	}
+	if len(buckets) != 2 || buckets[0] != "bucket" || buckets[1] != "bucket" {
+		t.Errorf("buckets = %q; want [bucket bucket]", buckets)
+	}
+}
+
+func TestFetchRetry(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	fails := map[string]int{"/bucket/flaky": 2, "/bucket/down": 100, "/bucket/throttled": 1}
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.URL.Path]++
+		n, ok := fails[r.URL.Path]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/bucket/throttled" && requests[r.URL.Path] <= n:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case requests[r.URL.Path] <= n:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	stor := &Storage{Base: ts.URL, MaxAttempts: 3, RetryBackoff: time.Millisecond}
+	tests := []struct {
+		name      string
+		requests  int
+		code      int // FetchError code or 0
+		transient bool
+	}{
+		{"flaky", 3, 0, false},
+		{"throttled", 2, 0, false},
+		{"down", 3, http.StatusServiceUnavailable, true},
+		{"missing", 1, http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		_, err := stor.ReadRange(ctx, "bucket", test.name, "bytes=0-")
+		code := 0
+		if errf, ok := err.(*FetchError); ok {
+			code = errf.Code
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if code != test.code {
+			t.Errorf("%s: code = %d; want %d", test.name, code, test.code)
+		}
+		if v := IsTransient(err); v != test.transient {
+			t.Errorf("%s: IsTransient(%v) = %v; want %v", test.name, err, v, test.transient)
+		}
+		mu.Lock()
+		n := requests["/bucket/"+test.name]
+		mu.Unlock()
+		if n != test.requests {
+			t.Errorf("%s: requests = %d; want %d", test.name, n, test.requests)
+		}
+	}
+	if !IsTransient(context.DeadlineExceeded) {
+		t.Error("IsTransient(context.DeadlineExceeded) = false")
+	}
+}
+
+// patternWriter is a ResponseWriter verifying the body is streamPattern.
+type patternWriter struct {
+	header http.Header
+	n      int64 // bytes written
+	bad    int64 // offset of the first mismatch, or -1
+}
+
+func (w *patternWriter) Header() http.Header { return w.header }
+func (w *patternWriter) WriteHeader(int)     {}
+
+func (w *patternWriter) Write(b []byte) (int, error) {
+	for i, c := range b {
+		if c != byte((w.n+int64(i))%251) && w.bad < 0 {
+			w.bad = w.n + int64(i)
+		}
+	}
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+func TestReadObjectStream(t *testing.T) {
+	chunk := make([]byte, 251*256)
+	for i := range chunk {
+		chunk[i] = byte(i % 251)
+	}
+	const chunks = 128
+	size := int64(len(chunk) * chunks)
+	var gets int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		if r.URL.Path == "/bucket/sized" {
+			w.Header().Set("content-length", strconv.FormatInt(size, 10))
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+		}
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1<<30, 1<<30), StreamThreshold: 1 << 16}
+	for _, name := range []string{"sized", "chunked"} {
+		if err := memcache.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		gets = 0
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < 2; i++ {
+			o, err := stor.ReadObject(ctx, "bucket", name)
+			if err != nil {
+				t.Fatalf("%s: ReadObject: %v", name, err)
+			}
+			if o.Stream == nil || o.Body != nil {
+				t.Fatalf("%s: o.Stream = %v, len(o.Body) = %d; want stream", name, o.Stream, len(o.Body))
+			}
+			w := &patternWriter{header: make(http.Header), bad: -1}
+			if err := ServeObject(w, o, true); err != nil {
+				t.Fatalf("%s: ServeObject: %v", name, err)
+			}
+			if w.n != size || w.bad >= 0 {
+				t.Errorf("%s: wrote %d bytes, first mismatch at %d; want %d bytes", name, w.n, w.bad, size)
+			}
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > uint64(size/4) {
+			t.Errorf("%s: allocated %d bytes serving a %d bytes object twice", name, n, size)
+		}
+		// streamed objects are never cached
+		if gets != 2 {
+			t.Errorf("%s: gets = %d; want 2", name, gets)
+		}
+	}
+
+	// small objects are buffered as before
+	stor.StreamThreshold = size
+	o, err := stor.ReadObject(ctx, "bucket", "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Stream != nil || int64(len(o.Body)) != size {
+		t.Errorf("small: o.Stream = %v, len(o.Body) = %d; want %d bytes body", o.Stream, len(o.Body), size)
+	}
+}
+
+// testTracer records spans started with StartSpan.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	s := &testSpan{name: name, attrs: make(map[string]interface{})}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return ctx, s
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) End()                                       { s.ended = true }
+
+func TestFetchTrace(t *testing.T) {
+	const tc = "105445aa7843bc8bf206b120001000/1;o=1"
+	var gotTC string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTC = r.Header.Get(TraceHeader)
+		if r.URL.Path != "/bucket/obj" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := WithTraceContext(appengine.NewContext(req), tc)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tr := &testTracer{}
+	stor := &Storage{Base: ts.URL, Tracer: tr}
+	if _, err := stor.ReadObject(ctx, "bucket", "obj"); err != nil {
+		t.Fatal(err)
+	}
+	if gotTC != tc {
+		t.Errorf("%s = %q; want %q", TraceHeader, gotTC, tc)
+	}
+	stor.ReadObject(ctx, "bucket", "missing")
+
+	if len(tr.spans) != 2 {
+		t.Fatalf("len(spans) = %d; want 2", len(tr.spans))
+	}
+	for i, want := range []struct {
+		object string
+		status int
+	}{{"obj", http.StatusOK}, {"missing", http.StatusNotFound}} {
+		s := tr.spans[i]
+		if s.name != "gcs.fetch" || !s.ended {
+			t.Errorf("%d: span %q ended = %v; want gcs.fetch ended", i, s.name, s.ended)
+		}
+		if s.attrs["bucket"] != "bucket" || s.attrs["object"] != want.object || s.attrs["status"] != want.status {
+			t.Errorf("%d: attrs = %v; want bucket, object %q and status %d", i, s.attrs, want.object, want.status)
+		}
+		if _, ok := s.attrs["duration"].(time.Duration); !ok {
+			t.Errorf("%d: duration = %v; want time.Duration", i, s.attrs["duration"])
+		}
+	}
+}
+
+func TestReadObjectMaxInline(t *testing.T) {
+	const max = 1024
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		switch r.URL.Path {
+		case "/bucket/under", "/bucket/under-chunked":
+			n = max
+		default:
+			n = max + 1
+		}
+		if !strings.HasSuffix(r.URL.Path, "-chunked") {
+			w.Header().Set("content-length", strconv.Itoa(n))
+		} else {
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(strings.Repeat("x", n)))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	tests := []struct {
+		name     string
+		stream   int64
+		code     int // FetchError code, if any
+		streamed bool
+	}{
+		{"under", 0, 0, false},
+		{"under-chunked", 0, 0, false},
+		{"over", 0, http.StatusRequestEntityTooLarge, false},
+		{"over-chunked", 0, http.StatusRequestEntityTooLarge, false},
+		{"under", 1 << 20, 0, false},
+		{"over", 1 << 20, 0, true},
+		{"over-chunked", 1 << 20, 0, true},
+	}
+	for _, test := range tests {
+		if err := memcache.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		stor := &Storage{Base: ts.URL, Cache: NewLRU(1<<20, 1<<20), MaxInlineBytes: max, StreamThreshold: test.stream}
+		o, err := stor.ReadObject(ctx, "bucket", test.name)
+		if test.code != 0 {
+			if errf, ok := err.(*FetchError); !ok || errf.Code != test.code {
+				t.Errorf("%s/%d: err = %v; want FetchError %d", test.name, test.stream, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%d: %v", test.name, test.stream, err)
+			continue
+		}
+		if v := o.Stream != nil; v != test.streamed {
+			t.Errorf("%s/%d: streamed = %v; want %v", test.name, test.stream, v, test.streamed)
+		}
+		o.Close()
+		_, cached := stor.Cache.Get(stor.CacheKey("bucket", test.name))
+		if cached == test.streamed {
+			t.Errorf("%s/%d: cached = %v; want %v", test.name, test.stream, cached, !test.streamed)
+		}
+	}
+}
+
+func TestReadObjectImmutable(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = make(map[string]int)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.Path]++
+		mu.Unlock()
+		w.Write([]byte(strings.Repeat("x", 2048)))
+	}))
+	defer ts.Close()
+
+	req, _ := testInstance.NewRequest("GET", "/", nil)
+	ctx := appengine.NewContext(req)
+	if err := memcache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stor := &Storage{
+		Base:              ts.URL,
+		Cache:             NewLRU(1<<20, 1024),
+		CacheTTL:          time.Minute,
+		StreamThreshold:   1024,
+		ImmutableMaxBytes: 4096,
+		Immutable: func(bucket, name string) bool {
+			return strings.HasPrefix(name, "static/")
+		},
+	}
+	now := time.Now()
+	stor.Cache.now = func() time.Time { return now }
+
+	for _, name := range []string{"static/app.3f9a1c.js", "app.js"} {
+		o, err := stor.ReadObject(ctx, "bucket", name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		o.Close()
+	}
+	o, err := stor.ReadObject(ctx, "bucket", "static/app.3f9a1c.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Stream != nil || len(o.Body) != 2048 {
+		t.Errorf("immutable: streamed = %v, len(body) = %d; want false, 2048", o.Stream != nil, len(o.Body))
+	}
+	if _, ok := stor.Cache.Get(stor.CacheKey("bucket", "app.js")); ok {
+		t.Error("app.js is cached; want streamed")
+	}
+
+	// immutable objects are never stale
+	now = now.Add(time.Hour)
+	o, err = stor.ReadObject(ctx, "bucket", "static/app.3f9a1c.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := o.Meta["age"]; v != "" {
+		t.Errorf("age = %q; want none", v)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := fetches["/bucket/static/app.3f9a1c.js"]; n != 1 {
+		t.Errorf("immutable fetches = %d; want 1", n)
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	stor := &Storage{Base: "https://storage.googleapis.com"}
+	tests := []struct{ name, url string }{
+		{"", "https://storage.googleapis.com/bucket"},
+		{"/docs/index.html", "https://storage.googleapis.com/bucket/docs/index.html"},
+		{"posts/hello world.html", "https://storage.googleapis.com/bucket/posts/hello%20world.html"},
+		{"a+b.txt", "https://storage.googleapis.com/bucket/a%2Bb.txt"},
+		{"img/café.png", "https://storage.googleapis.com/bucket/img/caf%C3%A9.png"},
+		{"a//b.txt", "https://storage.googleapis.com/bucket/a//b.txt"},
+		{"100%?#.txt", "https://storage.googleapis.com/bucket/100%25%3F%23.txt"},
+	}
+	for _, test := range tests {
+		if u := stor.objectURL("bucket", test.name); u != test.url {
+			t.Errorf("objectURL(bucket, %q) = %q; want %q", test.name, u, test.url)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"golang.org/x/net/context"
+)
+
+// TraceHeader is the Cloud Trace context request header.
+const TraceHeader = "X-Cloud-Trace-Context"
+
+// traceContextKey is the context key of a TraceHeader value.
+type traceContextKey struct{}
+
+// Tracer starts spans of GCS requests made by Storage.
+type Tracer interface {
+	// StartSpan starts a new span named name, as a child of the span in ctx
+	// if any, and returns a context carrying the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation started by a Tracer.
+type Span interface {
+	// SetAttribute annotates the span with a key/value pair.
+	SetAttribute(key string, value interface{})
+	// End finishes the span. No methods should be called after End.
+	End()
+}
+
+// WithTraceContext returns a copy of ctx which makes Storage propagate
+// TraceHeader value tc to GCS requests.
+func WithTraceContext(ctx context.Context, tc string) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContext returns TraceHeader value of ctx set with WithTraceContext.
+func TraceContext(ctx context.Context) string {
+	tc, _ := ctx.Value(traceContextKey{}).(string)
+	return tc
+}